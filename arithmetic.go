@@ -675,6 +675,62 @@ func numDiv(z1, z2 Value) (Value, error) {
 	}
 }
 
+// numBinary applies the binary numeric operand op to its arguments.
+// The type-specialized operands are applied with their generic
+// operations. The VM uses this when the arguments of a specialized
+// instruction are not of its specialized type.
+func numBinary(op Operand, z1, z2 Value) (Value, error) {
+	var v Value
+	var err error
+
+	switch op {
+	case OpAdd, OpAddI64, OpAddF64:
+		op = OpAdd
+		v, err = numAdd(z1, z2)
+
+	case OpSub, OpSubI64, OpSubF64:
+		op = OpSub
+		v, err = numSub(z1, z2)
+
+	case OpMul, OpMulI64, OpMulF64:
+		op = OpMul
+		v, err = numMul(z1, z2)
+
+	case OpDiv, OpDivF64:
+		op = OpDiv
+		v, err = numDiv(z1, z2)
+
+	case OpEq, OpEqI64, OpEqF64:
+		op = OpEq
+		v, err = numEq(z1, z2)
+
+	case OpLt, OpLtI64, OpLtF64:
+		op = OpLt
+		v, err = numLt(z1, z2)
+
+	case OpGt, OpGtI64, OpGtF64:
+		op = OpGt
+		v, err = numGt(z1, z2)
+
+	case OpLe, OpLeI64, OpLeF64:
+		op = OpLe
+		v, err = numGt(z1, z2)
+		v = Boolean(!IsTrue(v))
+
+	case OpGe, OpGeI64, OpGeF64:
+		op = OpGe
+		v, err = numLt(z1, z2)
+		v = Boolean(!IsTrue(v))
+
+	default:
+		return nil, fmt.Errorf("%s: invalid numeric operand", op)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err.Error())
+	}
+	return v, nil
+}
+
 func numEq(z1, z2 Value) (Value, error) {
 	switch v1 := z1.(type) {
 	case Int, Float, *BigInt, *BigFloat:
@@ -18,6 +18,7 @@ type AST interface {
 	Equal(o AST) bool
 	Type(ctx types.Ctx) *types.Type
 	Typecheck(lib *Library, round int) error
+	Optimize(lib *Library) AST
 	Bytecode(lib *Library) error
 }
 
@@ -29,8 +30,11 @@ var (
 	_ AST = &ASTIf{}
 	_ AST = &ASTApply{}
 	_ AST = &ASTCall{}
+	_ AST = &ASTInlineCall{}
 	_ AST = &ASTCallUnary{}
 	_ AST = &ASTLambda{}
+	_ AST = &ASTCaseLambda{}
+	_ AST = &ASTRecordType{}
 	_ AST = &ASTConstant{}
 	_ AST = &ASTIdentifier{}
 	_ AST = &ASTCond{}
@@ -92,6 +96,12 @@ func (ast *ASTSequence) Typecheck(lib *Library, round int) error {
 	return nil
 }
 
+// Optimize implements AST.Optimize.
+func (ast *ASTSequence) Optimize(lib *Library) AST {
+	ast.Items = lib.optimizeBody(ast.Items)
+	return ast
+}
+
 // Bytecode implements AST.Bytecode.
 func (ast *ASTSequence) Bytecode(lib *Library) error {
 	for _, item := range ast.Items {
@@ -139,7 +149,7 @@ func (ast *ASTDefine) Typecheck(lib *Library, round int) error {
 		return err
 	}
 
-	sym := lib.scm.Intern(ast.Name.Name)
+	sym := lib.intern(ast.Name.Name)
 	ctx := make(types.Ctx)
 	nt := ast.Value.Type(ctx)
 
@@ -159,6 +169,13 @@ func (ast *ASTDefine) Typecheck(lib *Library, round int) error {
 	return nil
 }
 
+// Optimize implements AST.Optimize.
+func (ast *ASTDefine) Optimize(lib *Library) AST {
+	ast.Value = ast.Value.Optimize(lib)
+	lib.defineConstant(ast.Name, ast.Flags, ast.Value)
+	return ast
+}
+
 // Bytecode implements AST.Bytecode.
 func (ast *ASTDefine) Bytecode(lib *Library) error {
 	err := ast.Value.Bytecode(lib)
@@ -168,6 +185,100 @@ func (ast *ASTDefine) Bytecode(lib *Library) error {
 	return lib.define(ast.From, ast.Name, ast.Flags)
 }
 
+// ASTDefineValues implements (define-values formals value).
+type ASTDefineValues struct {
+	From       Locator
+	Formals    Args
+	ValueFrame *EnvFrame
+	Value      AST
+}
+
+// Locator implements AST.Locator.
+func (ast *ASTDefineValues) Locator() Locator {
+	return ast.From
+}
+
+// Equal implements AST.Equal.
+func (ast *ASTDefineValues) Equal(o AST) bool {
+	oast, ok := o.(*ASTDefineValues)
+	if !ok {
+		return false
+	}
+	return ast.Formals.Equal(oast.Formals) &&
+		ast.Value.Equal(oast.Value)
+}
+
+// Type implements AST.Type.
+func (ast *ASTDefineValues) Type(ctx types.Ctx) *types.Type {
+	return ast.Value.Type(ctx)
+}
+
+// Typecheck implements AST.Typecheck.
+func (ast *ASTDefineValues) Typecheck(lib *Library, round int) error {
+	err := ast.Value.Typecheck(lib, round)
+	if err != nil {
+		return err
+	}
+
+	ctx := make(types.Ctx)
+	vt, err := valuesTypes(ast.Value.Type(ctx), ast.Formals)
+	if err != nil {
+		return ast.From.Errorf("define-values: %v", err)
+	}
+
+	for idx, name := range ast.Formals.Names() {
+		sym := lib.intern(name)
+		nt := vt[idx]
+
+		if round == 0 {
+			if !sym.GlobalType.IsA(types.Unspecified) {
+				return ast.From.Errorf("redefining symbol '%s'", name)
+			}
+			sym.GlobalType = nt
+			lib.recheck = true
+		} else {
+			if !nt.IsA(sym.GlobalType) {
+				sym.GlobalType = nt
+				lib.recheck = true
+			}
+		}
+	}
+
+	return nil
+}
+
+// Optimize implements AST.Optimize.
+func (ast *ASTDefineValues) Optimize(lib *Library) AST {
+	ast.Value = ast.Value.Optimize(lib)
+	return ast
+}
+
+// Bytecode implements AST.Bytecode.
+func (ast *ASTDefineValues) Bytecode(lib *Library) error {
+	// Push value scope.
+	lib.addInstr(ast.From, OpPushS, nil, 1)
+
+	err := ast.Value.Bytecode(lib)
+	if err != nil {
+		return err
+	}
+	lib.addInstr(ast.From, OpLocalSet, nil, ast.ValueFrame.Index)
+	lib.addValuesCheck(ast.From, ast.Formals)
+
+	for idx, name := range ast.Formals.Names() {
+		lib.addValueRef(ast.From, ast.ValueFrame, ast.Formals, idx)
+		err = lib.define(ast.From, &Identifier{Name: name}, 0)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Pop value scope.
+	lib.addInstr(nil, OpPopS, nil, 1)
+
+	return nil
+}
+
 // ASTSet implements (set name value).
 type ASTSet struct {
 	From    Locator
@@ -210,7 +321,7 @@ func (ast *ASTSet) Typecheck(lib *Library, round int) error {
 		// let-variables can be assigned with different value types.
 		return nil
 	}
-	sym := lib.scm.Intern(ast.Name)
+	sym := lib.intern(ast.Name)
 	if sym.GlobalType.IsA(types.Unspecified) {
 		return ast.From.Errorf("setting undefined symbol '%s'", ast.Name)
 	}
@@ -221,6 +332,12 @@ func (ast *ASTSet) Typecheck(lib *Library, round int) error {
 	return nil
 }
 
+// Optimize implements AST.Optimize.
+func (ast *ASTSet) Optimize(lib *Library) AST {
+	ast.Value = ast.Value.Optimize(lib)
+	return ast
+}
+
 // Bytecode implements AST.Bytecode.
 func (ast *ASTSet) Bytecode(lib *Library) error {
 	err := ast.Value.Bytecode(lib)
@@ -232,7 +349,7 @@ func (ast *ASTSet) Bytecode(lib *Library) error {
 		lib.setBinding(ast.From, ast.Binding)
 	} else {
 		instr := lib.addInstr(ast.From, OpGlobalSet, nil, 0)
-		instr.Sym = lib.scm.Intern(ast.Name)
+		instr.Sym = lib.intern(ast.Name)
 	}
 
 	return nil
@@ -242,7 +359,6 @@ func (ast *ASTSet) Bytecode(lib *Library) error {
 type ASTLet struct {
 	From     Locator
 	Kind     Keyword
-	Captures bool
 	Tail     bool
 	Bindings []*ASTLetBinding
 	Body     []AST
@@ -266,7 +382,7 @@ func (ast *ASTLet) Equal(o AST) bool {
 	if !ok {
 		return false
 	}
-	if ast.Kind != oast.Kind || ast.Captures != oast.Captures ||
+	if ast.Kind != oast.Kind ||
 		ast.Tail != oast.Tail || len(ast.Bindings) != len(oast.Bindings) ||
 		len(ast.Body) != len(oast.Body) {
 		return false
@@ -302,7 +418,7 @@ func (ast *ASTLet) Typecheck(lib *Library, round int) error {
 		nt := b.Init.Type(ctx)
 		if round == 0 {
 			b.Binding.Type = nt
-			if ast.Kind == KwLetrec {
+			if ast.Kind == KwLetrec || ast.Kind == KwLetrecStar {
 				lib.recheck = true
 			}
 		} else {
@@ -321,9 +437,54 @@ func (ast *ASTLet) Typecheck(lib *Library, round int) error {
 	return nil
 }
 
+// Optimize implements AST.Optimize.
+func (ast *ASTLet) Optimize(lib *Library) AST {
+	for _, b := range ast.Bindings {
+		b.Init = b.Init.Optimize(lib)
+		if ast.Kind == KwLet || ast.Kind == KwLetStar {
+			lib.bindConstant(b.Binding, b.Init)
+		}
+	}
+	if ast.patchable() {
+		for _, b := range ast.Bindings {
+			b.Binding.Patched = !b.Binding.Assigned
+		}
+	}
+	ast.Body = lib.optimizeBody(ast.Body)
+	return ast
+}
+
+// patchable tests if the captures of the letrec bindings can be
+// patched into the lambdas of the letrec instead of boxing the
+// bindings. This is possible if the bindings are bound to constants
+// or to lambdas that are never assigned. Then no code is run before
+// all bindings are set and the letrec's lambdas are the only
+// closures capturing the unset bindings. The assigned bindings are
+// still boxed.
+func (ast *ASTLet) patchable() bool {
+	if ast.Kind != KwLetrec && ast.Kind != KwLetrecStar {
+		return false
+	}
+	for _, b := range ast.Bindings {
+		switch b.Init.(type) {
+		case *ASTConstant:
+		case *ASTLambda:
+			if b.Binding.Assigned {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
 // Bytecode implements AST.Bytecode.
 func (ast *ASTLet) Bytecode(lib *Library) error {
-	lib.addPushS(ast.From, len(ast.Bindings), ast.Captures)
+	lib.addInstr(ast.From, OpPushS, nil, len(ast.Bindings))
+	for _, binding := range ast.Bindings {
+		lib.addBox(binding.From, binding.Binding)
+	}
 
 	for _, binding := range ast.Bindings {
 		err := binding.Init.Bytecode(lib)
@@ -332,6 +493,11 @@ func (ast *ASTLet) Bytecode(lib *Library) error {
 		}
 		lib.setBinding(binding.From, binding.Binding)
 	}
+	if ast.patched() {
+		frame := ast.Bindings[0].Binding.Frame
+		instr := lib.addInstr(ast.From, OpPatch, nil, frame.Index)
+		instr.J = frame.Size
+	}
 
 	for _, item := range ast.Body {
 		err := item.Bytecode(lib)
@@ -340,7 +506,156 @@ func (ast *ASTLet) Bytecode(lib *Library) error {
 		}
 	}
 	if !ast.Tail {
-		lib.addPopS(nil, len(ast.Bindings), ast.Captures)
+		lib.addInstr(nil, OpPopS, nil, len(ast.Bindings))
+	}
+
+	return nil
+}
+
+// patched tests if the letrec's lambdas capture patched bindings.
+func (ast *ASTLet) patched() bool {
+	for _, b := range ast.Bindings {
+		if b.Binding.Patched && b.Binding.Captured {
+			return true
+		}
+	}
+	return false
+}
+
+// ASTLetValues implements let-values syntaxes.
+type ASTLetValues struct {
+	From        Locator
+	Kind        Keyword
+	Tail        bool
+	NumBindings int
+	ValueFrame  *EnvFrame
+	Bindings    []*ASTLetValuesBinding
+	Body        []AST
+}
+
+// ASTLetValuesBinding implements a let-values binding.
+type ASTLetValuesBinding struct {
+	From     Locator
+	Formals  Args
+	Bindings []*EnvBinding
+	Init     AST
+}
+
+// Locator implements AST.Locator.
+func (ast *ASTLetValues) Locator() Locator {
+	return ast.From
+}
+
+// Equal implements AST.Equal.
+func (ast *ASTLetValues) Equal(o AST) bool {
+	oast, ok := o.(*ASTLetValues)
+	if !ok {
+		return false
+	}
+	if ast.Kind != oast.Kind ||
+		ast.Tail != oast.Tail || len(ast.Bindings) != len(oast.Bindings) ||
+		len(ast.Body) != len(oast.Body) {
+		return false
+	}
+	for idx, b := range ast.Bindings {
+		if !b.Formals.Equal(oast.Bindings[idx].Formals) ||
+			!b.Init.Equal(oast.Bindings[idx].Init) {
+			return false
+		}
+	}
+	for idx, item := range ast.Body {
+		if !item.Equal(oast.Body[idx]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Type implements AST.Type.
+func (ast *ASTLetValues) Type(ctx types.Ctx) *types.Type {
+	return ast.Body[len(ast.Body)-1].Type(ctx)
+}
+
+// Typecheck implements AST.Typecheck.
+func (ast *ASTLetValues) Typecheck(lib *Library, round int) error {
+	ctx := make(types.Ctx)
+
+	for _, b := range ast.Bindings {
+		err := b.Init.Typecheck(lib, round)
+		if err != nil {
+			return err
+		}
+		vt, err := valuesTypes(b.Init.Type(ctx), b.Formals)
+		if err != nil {
+			return b.From.Errorf("%s: %v", ast.Kind, err)
+		}
+		for idx, binding := range b.Bindings {
+			nt := vt[idx]
+			if round == 0 {
+				binding.Type = nt
+			} else {
+				if !nt.IsKindOf(binding.Type) {
+					binding.Type = nt
+					lib.recheck = true
+				}
+			}
+		}
+	}
+	for _, body := range ast.Body {
+		err := body.Typecheck(lib, round)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Optimize implements AST.Optimize.
+func (ast *ASTLetValues) Optimize(lib *Library) AST {
+	for _, b := range ast.Bindings {
+		b.Init = b.Init.Optimize(lib)
+	}
+	ast.Body = lib.optimizeBody(ast.Body)
+	return ast
+}
+
+// Bytecode implements AST.Bytecode.
+func (ast *ASTLetValues) Bytecode(lib *Library) error {
+	lib.addInstr(ast.From, OpPushS, nil, ast.NumBindings)
+	for _, binding := range ast.Bindings {
+		for _, b := range binding.Bindings {
+			lib.addBox(binding.From, b)
+		}
+	}
+
+	// Push value scope.
+	lib.addInstr(ast.From, OpPushS, nil, 1)
+
+	for _, binding := range ast.Bindings {
+		err := binding.Init.Bytecode(lib)
+		if err != nil {
+			return err
+		}
+		lib.addInstr(binding.From, OpLocalSet, nil, ast.ValueFrame.Index)
+		lib.addValuesCheck(binding.From, binding.Formals)
+
+		for idx, b := range binding.Bindings {
+			lib.addValueRef(binding.From, ast.ValueFrame, binding.Formals, idx)
+			lib.setBinding(binding.From, b)
+		}
+	}
+
+	// Pop value scope.
+	lib.addInstr(nil, OpPopS, nil, 1)
+
+	for _, item := range ast.Body {
+		err := item.Bytecode(lib)
+		if err != nil {
+			return err
+		}
+	}
+	if !ast.Tail {
+		lib.addInstr(nil, OpPopS, nil, ast.NumBindings)
 	}
 
 	return nil
@@ -411,6 +726,35 @@ func (ast *ASTIf) Typecheck(lib *Library, round int) error {
 	return nil
 }
 
+// Optimize implements AST.Optimize.
+func (ast *ASTIf) Optimize(lib *Library) AST {
+	ast.Cond = ast.Cond.Optimize(lib)
+	ast.True = ast.True.Optimize(lib)
+	if ast.False != nil {
+		ast.False = ast.False.Optimize(lib)
+	}
+
+	// Drop the dead branch of constant conditions.
+	c, ok := ast.Cond.(*ASTConstant)
+	if ok {
+		if IsTrue(c.Value) {
+			return ast.True
+		}
+		if ast.False != nil {
+			return ast.False
+		}
+		return c
+	}
+
+	// (if (not cond) t f) => (if cond f t)
+	not, ok := ast.Cond.(*ASTCallUnary)
+	if ok && not.Op == OpNot && ast.False != nil {
+		ast.Cond = not.Arg
+		ast.True, ast.False = ast.False, ast.True
+	}
+	return ast
+}
+
 // Bytecode implements AST.Bytecode.
 func (ast *ASTIf) Bytecode(lib *Library) error {
 	labelFalse := lib.newLabel()
@@ -495,6 +839,13 @@ func (ast *ASTApply) Typecheck(lib *Library, round int) error {
 	return ast.Args.Typecheck(lib, round)
 }
 
+// Optimize implements AST.Optimize.
+func (ast *ASTApply) Optimize(lib *Library) AST {
+	ast.Lambda = ast.Lambda.Optimize(lib)
+	ast.Args = ast.Args.Optimize(lib)
+	return ast
+}
+
 // Bytecode implements AST.Bytecode.
 func (ast *ASTApply) Bytecode(lib *Library) error {
 	err := ast.Lambda.Bytecode(lib)
@@ -519,11 +870,15 @@ func (ast *ASTApply) Bytecode(lib *Library) error {
 	return nil
 }
 
-// ASTCall implements function call syntax.
+// ASTCall implements function call syntax. The Inline calls are
+// compiled into their InlineOp instructions. The Builtin calls are
+// compiled into their InlineOp instructions if the type checker
+// proves the types of their arguments.
 type ASTCall struct {
 	From     Locator
 	Inline   bool
 	InlineOp Operand
+	Builtin  bool
 	Func     AST
 	ArgFrame *EnvFrame
 	Args     []AST
@@ -663,6 +1018,14 @@ func (ast *ASTCall) Typecheck(lib *Library, round int) error {
 	if ft.Enum != types.EnumLambda {
 		return ast.Func.Locator().Errorf("invalid procedure: %s", ft)
 	}
+	if len(ft.Clauses) > 0 {
+		clause := ft.Clause(len(ast.Args))
+		if clause == nil {
+			return ast.From.Errorf("no clause for %v arguments: %v",
+				len(ast.Args), ft)
+		}
+		ft = clause
+	}
 	if len(ast.Args) < ft.MinArgs() {
 		return ast.From.Errorf("too few arguments: got %v, need %v",
 			len(ast.Args), ft.MinArgs())
@@ -671,7 +1034,7 @@ func (ast *ASTCall) Typecheck(lib *Library, round int) error {
 		return ast.From.Errorf("too many arguments: got %v, max %v",
 			len(ast.Args), ft.MaxArgs())
 	}
-	if lib.scm.pragmaVerboseTypecheck {
+	if lib.scm.image.pragmaVerboseTypecheck {
 		var argOfs []int
 		sig := fmt.Sprintf("(%v", ast.Func)
 		for _, arg := range ft.Args {
@@ -724,31 +1087,126 @@ func (ast *ASTCall) Typecheck(lib *Library, round int) error {
 	return nil
 }
 
+// Optimize implements AST.Optimize.
+func (ast *ASTCall) Optimize(lib *Library) AST {
+	if !ast.Inline {
+		ast.Func = ast.Func.Optimize(lib)
+	}
+	for idx, arg := range ast.Args {
+		ast.Args[idx] = arg.Optimize(lib)
+	}
+	if !ast.Inline {
+		inlined := lib.inlineCall(ast)
+		if inlined != nil {
+			return inlined
+		}
+	}
+	if ast.Inline && len(ast.Args) == 2 {
+		v, ok := foldBinary(ast.InlineOp, ast.Args[0], ast.Args[1])
+		if ok {
+			return &ASTConstant{
+				From:  ast.From,
+				Value: v,
+			}
+		}
+	}
+	return ast
+}
+
+// int64Ops define the instructions of the inline operands whose
+// arguments are proven to be integers.
+var int64Ops = map[Operand]Operand{
+	OpAdd: OpAddI64,
+	OpSub: OpSubI64,
+	OpMul: OpMulI64,
+	OpEq:  OpEqI64,
+	OpLt:  OpLtI64,
+	OpGt:  OpGtI64,
+	OpLe:  OpLeI64,
+	OpGe:  OpGeI64,
+}
+
+// float64Ops define the instructions of the inline operands whose
+// arguments are proven to be floating point numbers.
+var float64Ops = map[Operand]Operand{
+	OpAdd: OpAddF64,
+	OpSub: OpSubF64,
+	OpMul: OpMulF64,
+	OpDiv: OpDivF64,
+	OpEq:  OpEqF64,
+	OpLt:  OpLtF64,
+	OpGt:  OpGtF64,
+	OpLe:  OpLeF64,
+	OpGe:  OpGeF64,
+}
+
+// specialize returns the instruction for the inline or builtin call
+// based on the types of its arguments. The function returns false if
+// the builtin call must be compiled into a procedure call.
+func (ast *ASTCall) specialize() (Operand, bool) {
+	if !ast.Inline && !ast.Builtin {
+		return 0, false
+	}
+	if len(ast.Args) != 2 {
+		return ast.InlineOp, ast.Inline
+	}
+	ctx := make(types.Ctx)
+	t1 := ast.Args[0].Type(ctx).Enum
+	t2 := ast.Args[1].Type(ctx).Enum
+
+	switch ast.InlineOp {
+	case OpVectorRef:
+		return ast.InlineOp,
+			t1 == types.EnumVector && t2 == types.EnumInexactInteger
+	case OpStringRef:
+		return ast.InlineOp,
+			t1 == types.EnumString && t2 == types.EnumInexactInteger
+	}
+
+	var ops map[Operand]Operand
+	if t1 == types.EnumInexactInteger && t2 == types.EnumInexactInteger {
+		ops = int64Ops
+	} else if t1 == types.EnumInexactFloat && t2 == types.EnumInexactFloat {
+		ops = float64Ops
+	}
+	op, ok := ops[ast.InlineOp]
+	if ok {
+		return op, true
+	}
+	return ast.InlineOp, true
+}
+
 // Bytecode implements AST.Bytecode.
 func (ast *ASTCall) Bytecode(lib *Library) error {
 	var self *lambdaCompilation
-	const calltAsJump bool = false
+	if !ast.Inline && ast.Tail {
+		self = lib.selfCall(ast.Func, len(ast.Args))
+	}
+	if self != nil {
+		return ast.selfBytecode(lib, self)
+	}
 
-	if !ast.Inline {
-		id, ok := ast.Func.(*ASTIdentifier)
-		if ok && id.Binding != nil && lib.current != nil &&
-			lib.current.Self == id.Init {
-			self = lib.current
-		}
+	op, inline := ast.specialize()
+
+	// The builtin calls keep the call frame slot so the argument
+	// indices match the argument scope.
+	scope := len(ast.Args)
+	if inline && ast.Builtin {
+		scope++
+	}
 
+	if !inline {
 		err := ast.Func.Bytecode(lib)
 		if err != nil {
 			return nil
 		}
 		// Create call frame.
-		if !(calltAsJump && self != nil && ast.Tail) {
-			lib.addInstr(ast.From, OpPushF, nil, 0)
-		}
+		lib.addInstr(ast.From, OpPushF, nil, 0)
 	}
 
 	// Push argument scope.
-	if len(ast.Args) > 0 {
-		lib.addInstr(ast.From, OpPushS, nil, len(ast.Args))
+	if scope > 0 {
+		lib.addInstr(ast.From, OpPushS, nil, scope)
 	}
 
 	// Evaluate arguments.
@@ -760,20 +1218,9 @@ func (ast *ASTCall) Bytecode(lib *Library) error {
 		lib.addInstr(ast.ArgLocs[idx], OpLocalSet, nil, ast.ArgFrame.Index+idx)
 	}
 
-	if ast.Inline {
-		lib.addInstr(ast.From, ast.InlineOp, nil, 0)
-		lib.addInstr(ast.From, OpPopS, nil, len(ast.Args))
-	} else if calltAsJump && self != nil && ast.Tail {
-		if false {
-			fmt.Printf(" - jmp %v\n", self.Label)
-			for idx, b := range self.ArgBindings {
-				fmt.Printf("   - %v: %d.%d(%v) %v\n",
-					idx, b.Frame.Index, b.Index, b.Disabled, b.Type)
-			}
-			self.Env.Print()
-		}
-		instr := lib.addInstr(nil, OpJmp, nil, 0)
-		instr.J = self.Label.I
+	if inline {
+		lib.addInstr(ast.From, op, nil, 0)
+		lib.addInstr(ast.From, OpPopS, nil, scope)
 	} else {
 		lib.addCall(nil, len(ast.Args), ast.Tail)
 	}
@@ -781,6 +1228,156 @@ func (ast *ASTCall) Bytecode(lib *Library) error {
 	return nil
 }
 
+// selfBytecode compiles a tail-call to the enclosing lambda self into
+// a jump to the beginning of the lambda. The arguments are evaluated
+// into the argument scope like in normal calls, then copied over the
+// lambda's arguments. Finally, the stack is popped to the lambda's
+// arguments and the execution jumps to the lambda start.
+func (ast *ASTCall) selfBytecode(lib *Library,
+	self *lambdaCompilation) error {
+
+	// Push the argument scope. The call frame slot is kept so the
+	// argument indices match the argument scope.
+	lib.addInstr(ast.From, OpPushS, nil, len(ast.Args)+1)
+
+	// Evaluate arguments.
+	for idx, arg := range ast.Args {
+		err := arg.Bytecode(lib)
+		if err != nil {
+			return err
+		}
+		lib.addInstr(ast.ArgLocs[idx], OpLocalSet, nil, ast.ArgFrame.Index+idx)
+	}
+
+	// Rebind arguments.
+	for idx, b := range self.ArgBindings {
+		lib.addInstr(ast.From, OpLocal, nil, ast.ArgFrame.Index+idx)
+		lib.addInstr(ast.From, OpLocalSet, nil, b.Frame.Index+b.Index)
+	}
+
+	// Pop everything above the lambda's arguments.
+	lib.addInstr(ast.From, OpPopS, nil,
+		ast.ArgFrame.Index+len(ast.Args)-len(self.ArgBindings))
+
+	instr := lib.addInstr(ast.From, OpJmp, nil, 0)
+	instr.J = self.Label.I
+
+	return nil
+}
+
+// ASTInlineCall implements calls of known procedures whose bodies are
+// inlined into the call site. The arguments are evaluated into the
+// argument scope of the call and the Body is a copy of the procedure
+// body with its arguments bound to the argument scope.
+type ASTInlineCall struct {
+	From     Locator
+	Lambda   *ASTLambda
+	ArgFrame *EnvFrame
+	Args     []AST
+	ArgLocs  []Locator
+	Body     AST
+	Tail     bool
+}
+
+// Locator implements AST.Locator.
+func (ast *ASTInlineCall) Locator() Locator {
+	return ast.From
+}
+
+// Equal implements AST.Equal.
+func (ast *ASTInlineCall) Equal(o AST) bool {
+	oast, ok := o.(*ASTInlineCall)
+	if !ok {
+		return false
+	}
+	if len(ast.Args) != len(oast.Args) {
+		return false
+	}
+	for idx, arg := range ast.Args {
+		if !arg.Equal(oast.Args[idx]) {
+			return false
+		}
+	}
+	return ast.Body.Equal(oast.Body) && ast.Tail == oast.Tail
+}
+
+// Type implements AST.Type.
+func (ast *ASTInlineCall) Type(ctx types.Ctx) *types.Type {
+	return ast.Body.Type(ctx)
+}
+
+// Typecheck implements AST.Typecheck.
+func (ast *ASTInlineCall) Typecheck(lib *Library, round int) error {
+	for _, arg := range ast.Args {
+		err := arg.Typecheck(lib, round)
+		if err != nil {
+			return err
+		}
+	}
+	return ast.Body.Typecheck(lib, round)
+}
+
+// Optimize implements AST.Optimize.
+func (ast *ASTInlineCall) Optimize(lib *Library) AST {
+	for idx, arg := range ast.Args {
+		ast.Args[idx] = arg.Optimize(lib)
+	}
+	ast.Body = ast.Body.Optimize(lib)
+
+	// The call is constant if its body is constant and its
+	// arguments do not have side effects.
+	c, ok := ast.Body.(*ASTConstant)
+	if !ok {
+		return ast
+	}
+	for _, arg := range ast.Args {
+		switch arg.(type) {
+		case *ASTConstant, *ASTIdentifier:
+		default:
+			return ast
+		}
+	}
+	return &ASTConstant{
+		From:  ast.From,
+		Value: c.Value,
+	}
+}
+
+// Bytecode implements AST.Bytecode.
+func (ast *ASTInlineCall) Bytecode(lib *Library) error {
+	// Push the argument scope. The call frame slot is kept so the
+	// argument indices match the argument scope.
+	lib.addInstr(ast.From, OpPushS, nil, len(ast.Args)+1)
+
+	// Evaluate arguments.
+	for idx, arg := range ast.Args {
+		err := arg.Bytecode(lib)
+		if err != nil {
+			return err
+		}
+		lib.addInstr(ast.ArgLocs[idx], OpLocalSet, nil, ast.ArgFrame.Index+idx)
+	}
+
+	// The body is mapped to the inlined call so the stack traces show
+	// the inlined procedure.
+	outer := lib.inlined
+	lib.inlined = &PCInline{
+		Signature: ast.Lambda.inlinedSignature(),
+		Line:      ast.From.From().Line,
+		Outer:     outer,
+	}
+	err := ast.Body.Bytecode(lib)
+	lib.inlined = outer
+	if err != nil {
+		return err
+	}
+	if !ast.Tail {
+		lib.addInstr(nil, OpPopS, nil, len(ast.Args)+1)
+	}
+
+	return nil
+}
+
 // ASTCallUnary implements inlined unary function calls.
 type ASTCallUnary struct {
 	From Locator
@@ -863,13 +1460,40 @@ func (ast *ASTCallUnary) Typecheck(lib *Library, round int) error {
 	return nil
 }
 
+// Optimize implements AST.Optimize.
+func (ast *ASTCallUnary) Optimize(lib *Library) AST {
+	ast.Arg = ast.Arg.Optimize(lib)
+	v, ok := foldUnary(ast.Op, ast.I, ast.Arg)
+	if ok {
+		return &ASTConstant{
+			From:  ast.From,
+			Value: v,
+		}
+	}
+	if redundantCast(ast.Op, ast.Arg) {
+		return ast.Arg
+	}
+	return ast
+}
+
 // Bytecode implements AST.Bytecode.
 func (ast *ASTCallUnary) Bytecode(lib *Library) error {
 	err := ast.Arg.Bytecode(lib)
 	if err != nil {
 		return err
 	}
-	lib.addInstr(ast.From, ast.Op, nil, ast.I)
+	op := ast.Op
+	if op == OpCar || op == OpCdr {
+		ctx := make(types.Ctx)
+		if ast.Arg.Type(ctx).Enum == types.EnumPair {
+			if op == OpCar {
+				op = OpCarPair
+			} else {
+				op = OpCdrPair
+			}
+		}
+	}
+	lib.addInstr(ast.From, op, nil, ast.I)
 
 	return nil
 }
@@ -882,7 +1506,6 @@ type ASTLambda struct {
 	ArgBindings []*EnvBinding
 	Body        []AST
 	Env         *Env
-	Captures    bool
 	Define      bool
 	Flags       Flags
 }
@@ -909,7 +1532,7 @@ func (ast *ASTLambda) Equal(o AST) bool {
 			return false
 		}
 	}
-	return ast.Captures == oast.Captures && ast.Flags == oast.Flags
+	return ast.Flags == oast.Flags
 }
 
 // Type implements AST.Type.
@@ -981,7 +1604,7 @@ func (ast *ASTLambda) Typecheck(lib *Library, round int) error {
 	}
 
 	ctx := make(types.Ctx)
-	sym := lib.scm.Intern(ast.Name.Name)
+	sym := lib.intern(ast.Name.Name)
 	nt := ast.Type(ctx)
 
 	if round == 0 {
@@ -1000,25 +1623,210 @@ func (ast *ASTLambda) Typecheck(lib *Library, round int) error {
 	return nil
 }
 
+// Optimize implements AST.Optimize.
+func (ast *ASTLambda) Optimize(lib *Library) AST {
+	// The lambda is not inlined into its own body.
+	stats := lib.stats
+	inlining := lib.inlining[ast]
+	lib.stats = ast.Env.Stats
+	lib.inlining[ast] = true
+
+	ast.Body = lib.optimizeBody(ast.Body)
+
+	lib.stats = stats
+	lib.inlining[ast] = inlining
+	lib.optimized[ast] = true
+
+	return ast
+}
+
 // Bytecode implements AST.Bytecode.
 func (ast *ASTLambda) Bytecode(lib *Library) error {
 	lib.addInstr(ast.From, OpLambda, nil, len(lib.lambdas))
-	lib.lambdas = append(lib.lambdas, &lambdaCompilation{
+	c := ast.compilation()
+	c.Captures = lib.captures(ast.Env.Closure)
+	lib.lambdas = append(lib.lambdas, c)
+	if ast.Define {
+		err := lib.define(ast.From, ast.Name, ast.Flags)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// inlinedSignature returns the signature of the lambda for the stack
+// traces of its inlined calls.
+func (ast *ASTLambda) inlinedSignature() string {
+	name := "lambda"
+	if ast.Name != nil {
+		name = ast.Name.Name
+	}
+	return fmt.Sprintf("(%s %s {inlined})%s", name, ast.Args.String(),
+		ast.Body[len(ast.Body)-1].Type(make(types.Ctx)))
+}
+
+func (ast *ASTLambda) compilation() *lambdaCompilation {
+	return &lambdaCompilation{
 		Self:        ast,
 		Name:        ast.Name,
 		Args:        ast.Args,
 		ArgBindings: ast.ArgBindings,
 		Body:        ast.Body,
 		Env:         ast.Env,
-		Captures:    ast.Captures,
-	})
-	if ast.Define {
-		err := lib.define(ast.From, ast.Name, ast.Flags)
+	}
+}
+
+// ASTRecordType implements the record-type descriptor values of
+// define-record-type. The descriptor value has the static record
+// type Record. The record type's parent is resolved from the static
+// type of the Parent descriptor.
+type ASTRecordType struct {
+	From   Locator
+	Record *types.Type
+	Parent AST
+	Value  AST
+}
+
+// Locator implements AST.Locator.
+func (ast *ASTRecordType) Locator() Locator {
+	return ast.From
+}
+
+// Equal implements AST.Equal.
+func (ast *ASTRecordType) Equal(o AST) bool {
+	oast, ok := o.(*ASTRecordType)
+	if !ok {
+		return false
+	}
+	return ast.Record == oast.Record && ast.Value.Equal(oast.Value)
+}
+
+// Type implements AST.Type.
+func (ast *ASTRecordType) Type(ctx types.Ctx) *types.Type {
+	return types.NewRecordType(ast.Record)
+}
+
+// Typecheck implements AST.Typecheck.
+func (ast *ASTRecordType) Typecheck(lib *Library, round int) error {
+	err := ast.Value.Typecheck(lib, round)
+	if err != nil {
+		return err
+	}
+	if ast.Parent != nil {
+		pt := ast.Parent.Type(make(types.Ctx))
+		if pt.Enum == types.EnumRecordType {
+			ast.Record.Parent = pt.Record
+		}
+	}
+	return nil
+}
+
+// Optimize implements AST.Optimize.
+func (ast *ASTRecordType) Optimize(lib *Library) AST {
+	ast.Value = ast.Value.Optimize(lib)
+	return ast
+}
+
+// Bytecode implements AST.Bytecode.
+func (ast *ASTRecordType) Bytecode(lib *Library) error {
+	return ast.Value.Bytecode(lib)
+}
+
+// ASTCaseLambda implements case-lambda syntax. The Env is the
+// environment of the closure that the clauses share.
+type ASTCaseLambda struct {
+	From    Locator
+	Env     *Env
+	Clauses []*ASTLambda
+}
+
+// Locator implements AST.Locator.
+func (ast *ASTCaseLambda) Locator() Locator {
+	return ast.From
+}
+
+// Equal implements AST.Equal.
+func (ast *ASTCaseLambda) Equal(o AST) bool {
+	oast, ok := o.(*ASTCaseLambda)
+	if !ok {
+		return false
+	}
+	if len(ast.Clauses) != len(oast.Clauses) {
+		return false
+	}
+	for idx, clause := range ast.Clauses {
+		if !clause.Equal(oast.Clauses[idx]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Type implements AST.Type. The type is the union of the clause
+// types.
+func (ast *ASTCaseLambda) Type(ctx types.Ctx) *types.Type {
+	t := &types.Type{
+		Enum:         types.EnumLambda,
+		Parametrizer: ast,
+	}
+	for _, clause := range ast.Clauses {
+		ct := clause.Type(ctx)
+		t.Clauses = append(t.Clauses, ct)
+		t.Return = types.Unify(t.Return, ct.Return)
+	}
+	if t.Return == nil {
+		t.Return = types.Unspecified
+	}
+	return t
+}
+
+// Parametrize implements types.Parametrizer.
+func (ast *ASTCaseLambda) Parametrize(ctx types.Ctx,
+	params []*types.Type) *types.Type {
+
+	for _, clause := range ast.Clauses {
+		if len(params) >= clause.Args.Min && len(params) <= clause.Args.Max {
+			return clause.Parametrize(ctx, params)
+		}
+	}
+	return types.Unspecified
+}
+
+// Typecheck implements AST.Typecheck.
+func (ast *ASTCaseLambda) Typecheck(lib *Library, round int) error {
+	for _, clause := range ast.Clauses {
+		err := clause.Typecheck(lib, round)
 		if err != nil {
 			return err
 		}
 	}
+	return nil
+}
+
+// Optimize implements AST.Optimize.
+func (ast *ASTCaseLambda) Optimize(lib *Library) AST {
+	for _, clause := range ast.Clauses {
+		clause.Optimize(lib)
+	}
+	return ast
+}
 
+// Bytecode implements AST.Bytecode. The clauses are compiled into
+// lambdas which the case-lambda compilation references. The clauses
+// share the captures of the case-lambda.
+func (ast *ASTCaseLambda) Bytecode(lib *Library) error {
+	lib.addInstr(ast.From, OpLambda, nil, len(lib.lambdas))
+	c := &lambdaCompilation{
+		Self:     ast,
+		Captures: lib.captures(ast.Env.Closure),
+	}
+	lib.lambdas = append(lib.lambdas, c)
+	for _, clause := range ast.Clauses {
+		c.Clauses = append(c.Clauses, len(lib.lambdas))
+		lib.lambdas = append(lib.lambdas, clause.compilation())
+	}
 	return nil
 }
 
@@ -1059,19 +1867,27 @@ func (ast *ASTConstant) Typecheck(lib *Library, round int) error {
 	return nil
 }
 
+// Optimize implements AST.Optimize.
+func (ast *ASTConstant) Optimize(lib *Library) AST {
+	return ast
+}
+
 // Bytecode implements AST.Bytecode.
 func (ast *ASTConstant) Bytecode(lib *Library) error {
-	lib.addInstr(nil, OpConst, ast.Value, 0)
+	lib.addInstr(ast.From, OpConst, ast.Value, 0)
 	return nil
 }
 
-// ASTIdentifier implements identifer references.
+// ASTIdentifier implements identifer references. The global
+// references are resolved in the Library scope after the library
+// body is parsed so that they can refer to the library's private
+// definitions that follow the reference.
 type ASTIdentifier struct {
 	From    Locator
 	Name    string
 	Binding *EnvBinding
+	Library *Library
 	Global  *Identifier
-	Init    AST
 }
 
 func (ast *ASTIdentifier) String() string {
@@ -1106,7 +1922,15 @@ func (ast *ASTIdentifier) Type(ctx types.Ctx) *types.Type {
 	if ast.Binding != nil {
 		return ast.Binding.Type
 	}
-	return ast.Global.GlobalType
+	return ast.global().GlobalType
+}
+
+// global returns the symbol of the global reference.
+func (ast *ASTIdentifier) global() *Identifier {
+	if ast.Global == nil {
+		ast.Global = ast.Library.intern(ast.Name)
+	}
+	return ast.Global
 }
 
 // Typecheck implements AST.Typecheck.
@@ -1114,29 +1938,40 @@ func (ast *ASTIdentifier) Typecheck(lib *Library, round int) error {
 	return nil
 }
 
+// Optimize implements AST.Optimize.
+func (ast *ASTIdentifier) Optimize(lib *Library) AST {
+	var v Value
+	var ok bool
+	if ast.Binding != nil {
+		v, ok = lib.bindingConstants[ast.Binding]
+	} else {
+		v, ok = lib.constant(ast.global())
+	}
+	if ok {
+		return &ASTConstant{
+			From:  ast.From,
+			Value: v,
+		}
+	}
+	return ast
+}
+
 // Bytecode implements AST.Bytecode.
 func (ast *ASTIdentifier) Bytecode(lib *Library) error {
 	if ast.Binding != nil {
-		if ast.Binding.Frame.Type == TypeStack {
-			lib.addInstr(ast.From, OpLocal, nil,
-				ast.Binding.Frame.Index+ast.Binding.Index)
-		} else {
-			instr := lib.addInstr(ast.From, OpEnv, nil, ast.Binding.Frame.Index)
-			instr.J = ast.Binding.Index
-		}
+		lib.getBinding(ast.From, ast.Binding)
 	} else {
 		instr := lib.addInstr(ast.From, OpGlobal, nil, 0)
-		instr.Sym = lib.scm.Intern(ast.Name)
+		instr.Sym = ast.global()
 	}
 	return nil
 }
 
 // ASTCond implements cond syntax.
 type ASTCond struct {
-	From     Locator
-	Choices  []*ASTCondChoice
-	Tail     bool
-	Captures bool
+	From    Locator
+	Choices []*ASTCondChoice
+	Tail    bool
 }
 
 // ASTCondChoice implements a cond choice.
@@ -1182,7 +2017,7 @@ func (ast *ASTCond) Equal(o AST) bool {
 			return false
 		}
 	}
-	return ast.Tail == oast.Tail && ast.Captures == oast.Captures
+	return ast.Tail == oast.Tail
 }
 
 // Type implements AST.Type.
@@ -1235,6 +2070,50 @@ func (ast *ASTCond) Typecheck(lib *Library, round int) error {
 	return nil
 }
 
+// Optimize implements AST.Optimize.
+func (ast *ASTCond) Optimize(lib *Library) AST {
+	var choices []*ASTCondChoice
+	for _, choice := range ast.Choices {
+		if choice.Cond != nil {
+			choice.Cond = choice.Cond.Optimize(lib)
+		}
+		if choice.Func != nil {
+			choice.Func = choice.Func.Optimize(lib)
+		}
+		choice.Exprs = lib.optimizeBody(choice.Exprs)
+
+		// Drop the choices with constant false conditions, and the
+		// choices that follow a constant true condition.
+		c, ok := choice.Cond.(*ASTConstant)
+		if ok {
+			if !IsTrue(c.Value) {
+				continue
+			}
+			if choice.Func == nil && len(choice.Exprs) > 0 {
+				choice.Cond = nil
+			}
+		}
+		choices = append(choices, choice)
+		if ok || choice.Cond == nil {
+			break
+		}
+	}
+	if len(choices) == 0 {
+		return &ASTConstant{
+			From:  ast.From,
+			Value: Boolean(false),
+		}
+	}
+	if choices[0].Cond == nil {
+		return &ASTSequence{
+			From:  ast.From,
+			Items: choices[0].Exprs,
+		}
+	}
+	ast.Choices = choices
+	return ast
+}
+
 // Bytecode implements AST.Bytecode.
 func (ast *ASTCond) Bytecode(lib *Library) error {
 	labelEnd := lib.newLabel()
@@ -1293,7 +2172,7 @@ func (ast *ASTCond) Bytecode(lib *Library) error {
 			lib.addCall(nil, 1, ast.Tail)
 			if !ast.Tail {
 				// Pop value scope.
-				lib.addPopS(choice.From, 1, ast.Captures)
+				lib.addInstr(choice.From, OpPopS, nil, 1)
 			}
 		} else {
 			// Compile expressions.
@@ -1322,7 +2201,6 @@ type ASTCase struct {
 	EqvArgFrame *EnvFrame
 	Expr        AST
 	Tail        bool
-	Captures    bool
 }
 
 // ASTCaseChoice implements a case choice.
@@ -1373,8 +2251,7 @@ func (ast *ASTCase) Equal(o AST) bool {
 			return false
 		}
 	}
-	return ast.Expr.Equal(oast.Expr) && ast.Tail == oast.Tail &&
-		ast.Captures == oast.Captures
+	return ast.Expr.Equal(oast.Expr) && ast.Tail == oast.Tail
 }
 
 // Type implements AST.Type.
@@ -1414,6 +2291,15 @@ func (ast *ASTCase) Typecheck(lib *Library, round int) error {
 	return nil
 }
 
+// Optimize implements AST.Optimize.
+func (ast *ASTCase) Optimize(lib *Library) AST {
+	ast.Expr = ast.Expr.Optimize(lib)
+	for _, choice := range ast.Choices {
+		choice.Exprs = lib.optimizeBody(choice.Exprs)
+	}
+	return ast
+}
+
 // Bytecode implements AST.Bytecode.
 func (ast *ASTCase) Bytecode(lib *Library) error {
 	labelEnd := lib.newLabel()
@@ -1503,7 +2389,7 @@ func (ast *ASTCase) Bytecode(lib *Library) error {
 
 	if !ast.Tail {
 		// Pop value scope.
-		lib.addPopS(nil, 1, ast.Captures)
+		lib.addInstr(nil, OpPopS, nil, 1)
 	}
 
 	return nil
@@ -1557,6 +2443,27 @@ func (ast *ASTAnd) Typecheck(lib *Library, round int) error {
 	return nil
 }
 
+// Optimize implements AST.Optimize.
+func (ast *ASTAnd) Optimize(lib *Library) AST {
+	var exprs []AST
+	for idx, expr := range ast.Exprs {
+		expr = expr.Optimize(lib)
+		c, ok := expr.(*ASTConstant)
+		if ok && IsTrue(c.Value) && idx+1 < len(ast.Exprs) {
+			continue
+		}
+		exprs = append(exprs, expr)
+		if ok && !IsTrue(c.Value) {
+			break
+		}
+	}
+	if len(exprs) == 1 {
+		return exprs[0]
+	}
+	ast.Exprs = exprs
+	return ast
+}
+
 // Bytecode implements AST.Bytecode.
 func (ast *ASTAnd) Bytecode(lib *Library) error {
 	if len(ast.Exprs) == 0 {
@@ -1637,6 +2544,27 @@ func (ast *ASTOr) Typecheck(lib *Library, round int) error {
 	return nil
 }
 
+// Optimize implements AST.Optimize.
+func (ast *ASTOr) Optimize(lib *Library) AST {
+	var exprs []AST
+	for idx, expr := range ast.Exprs {
+		expr = expr.Optimize(lib)
+		c, ok := expr.(*ASTConstant)
+		if ok && !IsTrue(c.Value) && idx+1 < len(ast.Exprs) {
+			continue
+		}
+		exprs = append(exprs, expr)
+		if ok && IsTrue(c.Value) {
+			break
+		}
+	}
+	if len(exprs) == 1 {
+		return exprs[0]
+	}
+	ast.Exprs = exprs
+	return ast
+}
+
 // Bytecode implements AST.Bytecode.
 func (ast *ASTOr) Bytecode(lib *Library) error {
 	if len(ast.Exprs) == 0 {
@@ -1707,7 +2635,7 @@ func (ast *ASTPragma) Typecheck(lib *Library, round int) error {
 				return ast.From.Errorf("pragma %s: invalid argument: %v",
 					id, d[1])
 			}
-			lib.scm.pragmaVerboseTypecheck = bool(v)
+			lib.scm.image.pragmaVerboseTypecheck = bool(v)
 
 		default:
 			return ast.From.Errorf("unknown pragma '%s'", id.Name)
@@ -1716,19 +2644,48 @@ func (ast *ASTPragma) Typecheck(lib *Library, round int) error {
 	return nil
 }
 
+// Optimize implements AST.Optimize.
+func (ast *ASTPragma) Optimize(lib *Library) AST {
+	return ast
+}
+
 // Bytecode implements AST.Bytecode.
 func (ast *ASTPragma) Bytecode(lib *Library) error {
 	return nil
 }
 
+// addValuesCheck adds an instruction that checks that the number of
+// values in the accumulator matches the formals.
+func (lib *Library) addValuesCheck(loc Locator, formals Args) {
+	instr := lib.addInstr(loc, OpValues, nil, len(formals.Fixed))
+	if formals.Rest != nil {
+		instr.J = 1
+	}
+}
+
+// addValueRef adds instructions that load the idx:th formal's value
+// from the values, saved in the value frame, into the accumulator.
+func (lib *Library) addValueRef(loc Locator, frame *EnvFrame, formals Args,
+	idx int) {
+
+	lib.addInstr(loc, OpLocal, nil, frame.Index)
+	if idx < len(formals.Fixed) {
+		lib.addInstr(loc, OpValueRef, nil, idx)
+	} else {
+		lib.addInstr(loc, OpValueRest, nil, idx)
+	}
+}
+
 func (lib *Library) define(loc Locator, name *Identifier, flags Flags) error {
+	instr := lib.addInstr(loc, OpDefine, nil, int(flags))
+	instr.Sym = lib.intern(name.Name)
+
+	// The importing libraries bind the exports with their external
+	// names to the library's symbol.
 	export, ok := lib.exported[name.Name]
 	if ok {
 		export.id = name
 	}
 
-	instr := lib.addInstr(loc, OpDefine, nil, int(flags))
-	instr.Sym = lib.scm.Intern(name.Name)
-
 	return nil
 }
@@ -0,0 +1,243 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package scheme
+
+import (
+	"fmt"
+	"io"
+	"math"
+)
+
+// Word implements an encoded bytecode instruction. The low 8 bits
+// hold the operand, the bits 8-31 hold the unsigned J argument, and
+// the high 32 bits hold the signed I argument.
+type Word uint64
+
+const (
+	wordOpMask = 0xff
+	wordJShift = 8
+	wordJMax   = 1<<24 - 1
+	wordIShift = 32
+)
+
+// Op returns the instruction operand.
+func (w Word) Op() Operand {
+	return Operand(w & wordOpMask)
+}
+
+// I returns the instruction's I argument.
+func (w Word) I() int {
+	return int(int32(w >> wordIShift))
+}
+
+// J returns the instruction's J argument.
+func (w Word) J() int {
+	return int(w >> wordJShift & wordJMax)
+}
+
+func makeWord(op Operand, i, j int) Word {
+	return Word(op) | Word(j)<<wordJShift | Word(uint32(int32(i)))<<wordIShift
+}
+
+// Code implements compiled bytecode. The Words hold the encoded
+// instructions. The instructions refer to their constant values with
+// indices to the Consts pool and to their global symbols with
+// indices to the Syms table.
+type Code struct {
+	Words  []Word
+	Consts []Value
+	Syms   []*Identifier
+}
+
+// encoder holds the constant pool and the symbol table indices of the
+// code being encoded.
+type encoder struct {
+	code   *Code
+	consts map[Value]int
+	syms   map[*Identifier]int
+}
+
+// encode encodes the instructions into bytecode. The labels are
+// removed and the jump offsets and the program counter values of the
+// pcmap are mapped to the encoded instructions. The calls with
+// constant number of arguments are encoded into single OpCallConst
+// instructions.
+func encode(instrs Instrs, pcmap PCMap) (*Code, error) {
+	// Map instruction indices to the indices of the encoded
+	// instructions.
+	index := make([]int, len(instrs)+1)
+	var count int
+	for idx, instr := range instrs {
+		if instr.Op == OpLabel {
+			index[idx] = count
+		} else if constCall(instrs, idx-1) {
+			index[idx] = count - 1
+		} else {
+			index[idx] = count
+			count++
+		}
+	}
+	index[len(instrs)] = count
+
+	code := &Code{
+		Words: make([]Word, 0, count),
+	}
+	enc := &encoder{
+		code: code,
+	}
+	for idx := 0; idx < len(instrs); idx++ {
+		instr := instrs[idx]
+		op := instr.Op
+		i := instr.I
+		j := instr.J
+
+		switch op {
+		case OpLabel:
+			continue
+
+		case OpConst:
+			if constCall(instrs, idx) {
+				op = OpCallConst
+				i = instrs[idx+1].I
+				j = int(instr.V.(Int))
+				idx++
+			} else {
+				i = enc.addConst(instr.V)
+			}
+
+		case OpLambda, OpResume:
+			i = enc.addConst(instr.V)
+			j = 0
+
+		case OpGlobal, OpGlobalSet, OpDefine:
+			j = enc.addSym(instr.Sym)
+
+		case OpIf, OpIfNot, OpJmp:
+			target := idx + 1 + i
+			if target < 0 || target > len(instrs) {
+				return nil, fmt.Errorf("%s: invalid target %v", op, target)
+			}
+			i = index[target] - len(code.Words) - 1
+		}
+		if i < math.MinInt32 || i > math.MaxInt32 || j < 0 || j > wordJMax {
+			return nil, fmt.Errorf("%s: argument out of range: %v, %v",
+				op, i, j)
+		}
+		code.Words = append(code.Words, makeWord(op, i, j))
+	}
+
+	for idx := range pcmap {
+		pcmap[idx].PC = index[pcmap[idx].PC]
+	}
+
+	return code, nil
+}
+
+// mustEncode encodes the instructions into bytecode and panics if the
+// instructions can't be encoded.
+func mustEncode(instrs Instrs) *Code {
+	code, err := encode(instrs, nil)
+	if err != nil {
+		panic(err)
+	}
+	return code
+}
+
+// constCall tests if the instruction at idx loads the constant number
+// of arguments for the call that follows it.
+func constCall(instrs Instrs, idx int) bool {
+	if idx < 0 || idx+1 >= len(instrs) ||
+		instrs[idx].Op != OpConst || instrs[idx+1].Op != OpCall {
+		return false
+	}
+	n, ok := instrs[idx].V.(Int)
+	return ok && n >= 0 && n <= wordJMax
+}
+
+// addConst adds the value v to the constant pool and returns its
+// index. The atomic values are shared by all instructions using them.
+func (enc *encoder) addConst(v Value) int {
+	code := enc.code
+	switch v.(type) {
+	case nil, Boolean, Character, Int, Float, Keyword, String, *Identifier:
+		idx, ok := enc.consts[v]
+		if ok {
+			return idx
+		}
+		if enc.consts == nil {
+			enc.consts = make(map[Value]int)
+		}
+		enc.consts[v] = len(code.Consts)
+	}
+	code.Consts = append(code.Consts, v)
+	return len(code.Consts) - 1
+}
+
+// addSym adds the symbol to the symbol table and returns its index.
+func (enc *encoder) addSym(sym *Identifier) int {
+	code := enc.code
+	idx, ok := enc.syms[sym]
+	if ok {
+		return idx
+	}
+	if enc.syms == nil {
+		enc.syms = make(map[*Identifier]int)
+	}
+	enc.syms[sym] = len(code.Syms)
+	code.Syms = append(code.Syms, sym)
+	return len(code.Syms) - 1
+}
+
+// Decode decodes the bytecode into instructions.
+func (code *Code) Decode() Instrs {
+	if code == nil {
+		return nil
+	}
+	result := make(Instrs, len(code.Words))
+	for idx, w := range code.Words {
+		instr := &Instr{
+			Op: w.Op(),
+			I:  w.I(),
+			J:  w.J(),
+		}
+		switch instr.Op {
+		case OpConst, OpLambda, OpResume:
+			instr.V = code.Consts[instr.I]
+			instr.I = 0
+
+		case OpGlobal, OpGlobalSet, OpDefine:
+			instr.Sym = code.Syms[instr.J]
+			instr.J = 0
+		}
+		result[idx] = instr
+	}
+	return result
+}
+
+// Print prints the code and the code of the lambdas it creates.
+func (code *Code) Print(w io.Writer) {
+	code.Decode().Print(w)
+	if code == nil {
+		return
+	}
+	for _, c := range code.Consts {
+		impl, ok := c.(*LambdaImpl)
+		if ok {
+			printLambda(w, impl)
+		}
+	}
+}
+
+func printLambda(w io.Writer, impl *LambdaImpl) {
+	if impl.Code != nil {
+		fmt.Fprintf(w, "\n%s:\n", impl.Signature(false))
+		impl.Code.Print(w)
+	}
+	for _, clause := range impl.Clauses {
+		printLambda(w, clause)
+	}
+}
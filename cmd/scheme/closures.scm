@@ -0,0 +1,24 @@
+(define (lookup key alist)
+  (let loop ((l alist))
+    (cond
+     ((null? l) #f)
+     ((eq? (car (car l)) key) (cdr (car l)))
+     (else (loop (cdr l))))))
+
+(define (make-counter)
+  (let ((count 0))
+    (lambda ()
+      (set! count (+ count 1))
+      count)))
+
+(define (run rounds alist counter)
+  (let loop ((i 0) (sum 0))
+    (if (< i rounds)
+        (begin
+          (counter)
+          (loop (+ i 1) (+ sum (lookup 'e alist))))
+        (+ sum (counter)))))
+
+(display (run 3000000 '((a . 1) (b . 2) (c . 3) (d . 4) (e . 5))
+              (make-counter)))
+(newline)
@@ -0,0 +1,13 @@
+(import (go format))
+
+(define (run rounds)
+  (let loop ((i 0) (len 0))
+    (if (< i rounds)
+        (loop (+ i 1)
+              (+ len (string-length
+                      (format "%d: %5d|%-5d|%x %v %v\n" i i i i "foo"
+                              '(1 2 3)))))
+        len)))
+
+(display (run 100000))
+(newline)
@@ -0,0 +1,37 @@
+(define (fill-data v n)
+  (let loop ((i 0))
+    (if (< i n)
+        (begin
+          (vector-set! v i i)
+          (loop (+ i 1))))))
+
+(define (sum-vector v n)
+  (let loop ((i 0) (sum 0))
+    (if (< i n)
+        (loop (+ i 1) (+ sum (vector-ref v i)))
+        sum)))
+
+(define (count-chars s n c)
+  (let loop ((i 0) (count 0))
+    (if (< i n)
+        (loop (+ i 1) (if (char=? (string-ref s i) c) (+ count 1) count))
+        count)))
+
+(define (scale x rounds)
+  (let loop ((i 0) (x x))
+    (if (< i rounds)
+        (loop (+ i 1) (* (+ x 0.5) 0.999))
+        x)))
+
+(define data (make-vector 1000 0))
+(fill-data data 1000)
+(define text "the quick brown fox jumps over the lazy dog")
+
+(let loop ((round 0) (sum 0) (count 0))
+  (if (< round 20000)
+      (loop (+ round 1)
+            (+ sum (sum-vector data 1000))
+            (+ count (count-chars text 43 #\o)))
+      (begin
+        (display (list sum count (scale 1.0 1000000)))
+        (newline))))
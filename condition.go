@@ -0,0 +1,282 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package scheme
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/markkurossi/scheme/types"
+)
+
+// ConditionType defines a condition type.
+type ConditionType struct {
+	Name   string
+	Parent *ConditionType
+	Fields []string
+}
+
+// IsA tests if the condition type is the argument type or its
+// subtype.
+func (t *ConditionType) IsA(o *ConditionType) bool {
+	for ; t != nil; t = t.Parent {
+		if t == o {
+			return true
+		}
+	}
+	return false
+}
+
+// NumFields returns the number of fields in the condition type,
+// including the fields of its parent types.
+func (t *ConditionType) NumFields() int {
+	var count int
+	for ; t != nil; t = t.Parent {
+		count += len(t.Fields)
+	}
+	return count
+}
+
+// FieldIndex returns the index of the named field in the condition
+// type's field values. The parent type fields come first so the index
+// is valid also for the subtypes of the condition type.
+func (t *ConditionType) FieldIndex(name string) (int, bool) {
+	for idx, field := range t.Fields {
+		if field == name {
+			return t.Parent.NumFields() + idx, true
+		}
+	}
+	return 0, false
+}
+
+// Scheme returns the value as a Scheme string.
+func (t *ConditionType) Scheme() string {
+	return t.String()
+}
+
+// Eq tests if the argument value is eq? to this value.
+func (t *ConditionType) Eq(o Value) bool {
+	return t == o
+}
+
+// Equal tests if the argument value is equal to this value.
+func (t *ConditionType) Equal(o Value) bool {
+	return t == o
+}
+
+// Type implements Value.Type.
+func (t *ConditionType) Type() *types.Type {
+	return types.Unspecified
+}
+
+func (t *ConditionType) String() string {
+	return fmt.Sprintf("#<condition-type %s>", t.Name)
+}
+
+// New creates a simple condition of the condition type.
+func (t *ConditionType) New(fields ...Value) *Condition {
+	return &Condition{
+		Kind:   t,
+		Fields: fields,
+	}
+}
+
+// Condition implements condition objects. Simple conditions have a
+// condition type, Kind, and values for the type's fields. Compound
+// conditions hold their simple condition components.
+type Condition struct {
+	Kind       *ConditionType
+	Fields     []Value
+	Components []*Condition
+}
+
+// NewCondition creates a compound condition from the argument
+// conditions. If the argument is a single simple condition, it is
+// returned as is.
+func NewCondition(conditions ...*Condition) *Condition {
+	if len(conditions) == 1 && conditions[0].Kind != nil {
+		return conditions[0]
+	}
+	result := new(Condition)
+	for _, c := range conditions {
+		result.Components = append(result.Components, c.Simple()...)
+	}
+	return result
+}
+
+// Simple returns the simple conditions of the condition.
+func (c *Condition) Simple() []*Condition {
+	if c.Kind != nil {
+		return []*Condition{c}
+	}
+	return c.Components
+}
+
+// Find returns the first simple condition component whose type is
+// the argument type or its subtype.
+func (c *Condition) Find(t *ConditionType) (*Condition, bool) {
+	for _, s := range c.Simple() {
+		if s.Kind.IsA(t) {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+// Field returns the value of the named field of the first simple
+// condition component of the condition type t.
+func (c *Condition) Field(t *ConditionType, name string) (Value, bool) {
+	s, ok := c.Find(t)
+	if !ok {
+		return nil, false
+	}
+	idx, ok := t.FieldIndex(name)
+	if !ok || idx >= len(s.Fields) {
+		return nil, false
+	}
+	return s.Fields[idx], true
+}
+
+// Error implements the error interface.
+func (c *Condition) Error() string {
+	var str strings.Builder
+
+	who, ok := c.Field(condWho, "who")
+	if ok && who != nil && who != Boolean(false) {
+		str.WriteString(fmt.Sprintf("%v: ", who))
+	}
+	msg, ok := c.Field(condMessage, "message")
+	if ok {
+		str.WriteString(fmt.Sprintf("%v", msg))
+	} else {
+		str.WriteString(c.Scheme())
+	}
+	irritants, ok := c.Field(condIrritants, "irritants")
+	if ok {
+		Map(func(idx int, v Value) error {
+			str.WriteRune(' ')
+			str.WriteString(ToScheme(v))
+			return nil
+		}, irritants)
+	}
+	return str.String()
+}
+
+// Scheme returns the value as a Scheme string.
+func (c *Condition) Scheme() string {
+	return c.String()
+}
+
+// Eq tests if the argument value is eq? to this value.
+func (c *Condition) Eq(o Value) bool {
+	return c == o
+}
+
+// Equal tests if the argument value is equal to this value.
+func (c *Condition) Equal(o Value) bool {
+	return c == o
+}
+
+// Type implements Value.Type.
+func (c *Condition) Type() *types.Type {
+	return types.Unspecified
+}
+
+func (c *Condition) String() string {
+	var str strings.Builder
+
+	str.WriteString("#<condition")
+	for _, s := range c.Simple() {
+		str.WriteRune(' ')
+		str.WriteString(s.Kind.Name)
+	}
+	str.WriteRune('>')
+
+	return str.String()
+}
+
+// errorCondition creates an error condition from the error err. If
+// the error is a condition, it is returned as is. The who argument
+// specifies the procedure that failed.
+func (scm *Scheme) errorCondition(who string, err error) *Condition {
+	var c *Condition
+	if errors.As(err, &c) {
+		return c
+	}
+	var conditions []*Condition
+	conditions = append(conditions, condError.New())
+	if len(who) > 0 {
+		conditions = append(conditions, condWho.New(scm.Intern(who)))
+	}
+	conditions = append(conditions, condMessage.New(String(err.Error())))
+
+	return NewCondition(conditions...)
+}
+
+// undefinedCondition creates an undefined violation for the symbol.
+func undefinedCondition(sym *Identifier) *Condition {
+	return NewCondition(
+		condUndefined.New(),
+		condMessage.New(String(fmt.Sprintf("undefined symbol '%s'",
+			sym.Name))),
+		condIrritants.New(NewPair(sym, nil)))
+}
+
+// stackOverflowCondition creates an implementation restriction
+// violation for exceeding the maximum stack depth.
+func stackOverflowCondition(depth int) *Condition {
+	return NewCondition(
+		condImplementationRestriction.New(),
+		condMessage.New(String(fmt.Sprintf("stack overflow: max depth %d",
+			depth))))
+}
+
+var conditionBuiltins = []Builtin{
+	{
+		Name:   "scheme::handlers",
+		Return: types.Pair,
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			return scm.handlers, nil
+		},
+	},
+	{
+		Name:   "scheme::set-handlers!",
+		Args:   []string{"list"},
+		Return: types.Any,
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			scm.handlers = args[0]
+			return nil, nil
+		},
+	},
+	{
+		Name:   "scheme::raise",
+		Args:   []string{"obj"},
+		Return: types.Any,
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			c, ok := args[0].(*Condition)
+			if ok {
+				return nil, c
+			}
+			return nil, condMessage.New(
+				String(fmt.Sprintf("uncaught exception: %v",
+					ToScheme(args[0]))))
+		},
+	},
+	{
+		Name:   "scheme::non-continuable",
+		Args:   []string{"obj"},
+		Return: types.Any,
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			return NewCondition(
+				condNonContinuable.New(),
+				condWho.New(scm.Intern("raise")),
+				condMessage.New(String("handler returned")),
+				condIrritants.New(NewPair(args[0], nil))), nil
+		},
+	},
+}
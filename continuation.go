@@ -0,0 +1,256 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package scheme
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/markkurossi/scheme/types"
+)
+
+// Continuation implements a captured virtual machine
+// continuation. The continuation holds a copy of the virtual machine
+// stack up to, and including, the frame whose return it
+// represents. Resuming the continuation reinstates the stack and
+// returns from the frame. The stack frames hold the caller's pc,
+// code, and environment so they define the rest of the
+// computation. The stack slots are restored to their values at the
+// capture time but the assigned variables are shared through their
+// boxes. The continuation
+// can be resumed only in the execution run where it was captured,
+// or from the nested calls of the run.
+type Continuation struct {
+	Stack []Value
+	FP    int
+	run   *vmRun
+}
+
+// callCCCode implements the scheme::call/cc procedure. The code captures the
+// continuation of the call/cc frame and tail-calls the procedure
+// argument with the continuation. The call/cc frame is replaced with
+// the procedure's frame so the continuation is the return from
+// call/cc.
+//
+//	fp+0: call/cc frame
+//	fp+1: proc
+//	fp+2: proc frame
+//	fp+3: continuation
+var callCCCode = mustEncode(Instrs{
+	{
+		Op: OpLocal,
+		I:  0,
+	},
+	{
+		Op: OpPushF,
+	},
+	{
+		Op: OpPushS,
+		I:  1,
+	},
+	{
+		Op: OpContinuation,
+	},
+	{
+		Op: OpLocalSet,
+		I:  2,
+	},
+	{
+		Op: OpConst,
+		V:  Int(1),
+	},
+	{
+		Op: OpCall,
+		I:  1,
+	},
+	{
+		Op: OpReturn,
+	},
+})
+
+// defineCallCC defines the scheme::call/cc procedure which implements
+// the primitive call-with-current-continuation. The runtime wraps it
+// to maintain the dynamic-wind extents.
+func (scm *Scheme) defineCallCC() {
+	args := Args{
+		Fixed: []*TypedName{
+			{
+				Name: "proc",
+				Type: types.Any,
+			},
+		},
+	}
+	args.Init()
+
+	lambda := &Lambda{
+		Impl: &LambdaImpl{
+			Name:     "scheme::call/cc",
+			Args:     args,
+			Return:   types.Unspecified,
+			Code:     callCCCode,
+			MaxStack: 2,
+		},
+	}
+	sym := scm.Intern(lambda.Impl.Name)
+	sym.GlobalType = lambda.Type()
+	sym.bind(lambda, FlagConst)
+}
+
+// captureContinuation captures the continuation of the current frame
+// and returns it as an escape procedure.
+func (scm *Scheme) captureContinuation() *Lambda {
+	cont := &Continuation{
+		Stack: make([]Value, scm.fp+1),
+		FP:    scm.fp,
+		run:   scm.run,
+	}
+	copyStack(cont.Stack, scm.stack)
+	return &Lambda{
+		Impl: &LambdaImpl{
+			Name: "continuation",
+			Args: Args{
+				Max: math.MaxInt,
+				Rest: &TypedName{
+					Name: "values",
+					Type: types.Any,
+				},
+			},
+			Return: types.Unspecified,
+			Code: mustEncode(Instrs{
+				{
+					Op: OpLocal,
+					I:  0,
+				},
+				{
+					Op: OpResume,
+					V:  cont,
+				},
+			}),
+		},
+	}
+}
+
+// restoreContinuation reinstates the continuation's stack.
+func (scm *Scheme) restoreContinuation(cont *Continuation) {
+	copyStack(scm.stack, cont.Stack)
+	scm.fp = cont.FP
+	scm.sp = len(cont.Stack)
+	scm.limitStack()
+}
+
+// copyStack copies the stack values from src to dst. The stack frames
+// are copied since they are modified and recycled when the stack is
+// unwound.
+func copyStack(dst, src []Value) {
+	for idx := 0; idx < len(dst) && idx < len(src); idx++ {
+		frame, ok := src[idx].(*Frame)
+		if ok {
+			f := *frame
+			f.flNext = nil
+			dst[idx] = &f
+		} else {
+			dst[idx] = src[idx]
+		}
+	}
+}
+
+// unwind runs the after thunks of the dynamic-wind extents until the
+// winders list is unwound to the argument list. All after thunks are
+// run even if some of them fail. The function returns the error of
+// the first failing thunk.
+func (scm *Scheme) unwind(to Value) error {
+	var result error
+	for scm.winders != nil && scm.winders != to {
+		pair, ok := scm.winders.(Pair)
+		if !ok {
+			break
+		}
+		scm.winders = pair.Cdr()
+
+		winder, ok := pair.Car().(Pair)
+		if ok {
+			_, err := scm.execute(winder.Cdr(), nil)
+			if err != nil && result == nil {
+				result = err
+			}
+		}
+	}
+	scm.winders = to
+	return result
+}
+
+var continuationBuiltins = []Builtin{
+	{
+		Name:   "scheme::winders",
+		Return: types.Pair,
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			return scm.winders, nil
+		},
+	},
+	{
+		Name:   "scheme::set-winders!",
+		Args:   []string{"list"},
+		Return: types.Any,
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			scm.winders = args[0]
+			return nil, nil
+		},
+	},
+	{
+		Name:   "scheme::continuation-valid?",
+		Args:   []string{"k"},
+		Return: types.Boolean,
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			cont, ok := continuationOf(args[0])
+			if !ok {
+				return nil, fmt.Errorf("invalid continuation: %v",
+					ToScheme(args[0]))
+			}
+			return Boolean(scm.active(cont.run)), nil
+		},
+	},
+}
+
+// continuationOf returns the continuation that the escape procedure k
+// resumes.
+func continuationOf(k Value) (*Continuation, bool) {
+	lambda, ok := k.(*Lambda)
+	if !ok || lambda.Impl.Code == nil {
+		return nil, false
+	}
+	for _, c := range lambda.Impl.Code.Consts {
+		cont, ok := c.(*Continuation)
+		if ok {
+			return cont, true
+		}
+	}
+	return nil, false
+}
+
+// Scheme returns the value as a Scheme string.
+func (c *Continuation) Scheme() string {
+	return c.String()
+}
+
+// Eq tests if the argument value is eq? to this value.
+func (c *Continuation) Eq(o Value) bool {
+	return c == o
+}
+
+// Equal tests if the argument value is equal to this value.
+func (c *Continuation) Equal(o Value) bool {
+	return c == o
+}
+
+// Type implements Value.Type.
+func (c *Continuation) Type() *types.Type {
+	return types.Unspecified
+}
+
+func (c *Continuation) String() string {
+	return "#<continuation>"
+}
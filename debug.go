@@ -58,25 +58,34 @@ var debugBuiltins = []Builtin{
 				}
 			}
 			var names []string
-			for k, v := range scm.symbols {
-				if v.Global != nil {
-					switch val := v.Global.(type) {
-					case *Lambda:
-						if flags&fLambda != 0 {
-							if (flags&(fNative|fScheme)) == 0 ||
-								((val.Impl.Native != nil) &&
-									(flags&fNative != 0)) ||
-								((val.Impl.Native == nil) &&
-									(flags&fScheme != 0)) {
-								names = append(names, k)
-							}
-						}
+			values := make(map[string]Value)
 
-					default:
-						if flags&fLambda == 0 {
+			scm.image.m.RLock()
+			for k, v := range scm.image.symbols {
+				value := v.Global()
+				if value != nil {
+					values[k] = value
+				}
+			}
+			scm.image.m.RUnlock()
+
+			for k, v := range values {
+				switch val := v.(type) {
+				case *Lambda:
+					if flags&fLambda != 0 {
+						if (flags&(fNative|fScheme)) == 0 ||
+							((val.Impl.Native != nil) &&
+								(flags&fNative != 0)) ||
+							((val.Impl.Native == nil) &&
+								(flags&fScheme != 0)) {
 							names = append(names, k)
 						}
 					}
+
+				default:
+					if flags&fLambda == 0 {
+						names = append(names, k)
+					}
 				}
 			}
 			sort.Strings(names)
@@ -94,7 +103,7 @@ var debugBuiltins = []Builtin{
 				for i := 0; i+len(name) < max; i++ {
 					fmt.Print(" ")
 				}
-				fmt.Printf("%s : %s\n", name, scm.symbols[name].Global)
+				fmt.Printf("%s : %s\n", name, values[name])
 			}
 			fmt.Printf("%d symbols matched\n", len(names))
 			return nil, nil
@@ -109,7 +118,7 @@ var debugBuiltins = []Builtin{
 			case *Lambda:
 				scm.Stdout.Printf("lambda: %v\n", arg)
 				if arg.Impl.Native == nil {
-					for _, c := range arg.Impl.Code {
+					for _, c := range arg.Impl.Code.Decode() {
 						scm.Stdout.Printf("%s\n", c)
 					}
 				}
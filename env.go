@@ -1,5 +1,5 @@
 //
-// Copyright (c) 2022-2023 Markku Rossi
+// Copyright (c) 2022-2024 Markku Rossi
 //
 // All rights reserved.
 //
@@ -12,10 +12,14 @@ import (
 	"github.com/markkurossi/scheme/types"
 )
 
-// Env implements environment bindings.
+// Env implements environment bindings. The Frames hold all frames
+// that are visible in the environment, including the frames of the
+// enclosing lambdas. The Closure identifies the lambda whose stack
+// frames the environment defines.
 type Env struct {
-	Stats  *EnvStats
-	Frames []*EnvFrame
+	Stats   *EnvStats
+	Frames  []*EnvFrame
+	Closure *EnvClosure
 }
 
 // EnvStats define environment statistics.
@@ -23,20 +27,51 @@ type EnvStats struct {
 	MaxStack int
 }
 
+// EnvClosure defines the closure of a lambda. The Free holds the
+// bindings of the enclosing lambdas that the lambda references. The
+// bindings are copied into the lambda's captures when the lambda is
+// created.
+type EnvClosure struct {
+	Outer *EnvClosure
+	Free  []*EnvBinding
+	free  map[*EnvBinding]int
+}
+
+// Index returns the index of the free binding b in the closure's
+// captures.
+func (c *EnvClosure) Index(b *EnvBinding) (int, bool) {
+	idx, ok := c.free[b]
+	return idx, ok
+}
+
+func (c *EnvClosure) add(b *EnvBinding) {
+	_, ok := c.free[b]
+	if ok {
+		return
+	}
+	if c.free == nil {
+		c.free = make(map[*EnvBinding]int)
+	}
+	c.free[b] = len(c.Free)
+	c.Free = append(c.Free, b)
+}
+
 // FrameType defines the frame type.
 type FrameType int
 
 // Frame types.
 const (
 	TypeStack FrameType = iota
-	TypeEnv
+	TypeMacro
 )
 
 func (ft FrameType) String() string {
-	if ft == TypeStack {
+	switch ft {
+	case TypeMacro:
+		return "m"
+	default:
 		return "s"
 	}
-	return "e"
 }
 
 // FrameUsage defines how frame is used.
@@ -65,27 +100,52 @@ func (fu FrameUsage) String() string {
 	return fmt.Sprintf("{FrameUsage %d}", fu)
 }
 
-// EnvFrame implements an environment frame.
+// EnvFrame implements an environment frame. The Macros hold the
+// macros that are defined in the frame's scope. The Closure is the
+// closure of the lambda whose stack holds the frame.
 type EnvFrame struct {
 	Type     FrameType
 	Usage    FrameUsage
 	Index    int
 	Size     int
 	Bindings map[string]*EnvBinding
+	Macros   map[string]*Macro
+	Closure  *EnvClosure
 }
 
-// EnvBinding defines symbol's location in the environment.
+// EnvBinding defines symbol's location in the environment. The Init
+// holds the lambda bound to a letrec symbol and Assigned tells if the
+// symbol is assigned with set!. The Captured tells if inner lambdas
+// reference the symbol and Letrec if the symbol is visible in its
+// own init. The Patched tells if the captures of the letrec symbol
+// are patched into the lambdas of its letrec after the symbols are
+// bound.
 type EnvBinding struct {
 	Frame    *EnvFrame
 	Disabled bool
 	Index    int
 	Type     *types.Type
+	Init     AST
+	Assigned bool
+	Captured bool
+	Letrec   bool
+	Patched  bool
+}
+
+// Boxed tests if the binding's value is stored in a box. The assigned
+// bindings are boxed so that the lambdas capturing them and the
+// continuations resuming their scope share the binding. The captured
+// letrec bindings are boxed since their values are set after they
+// are captured, unless their captures are patched.
+func (b *EnvBinding) Boxed() bool {
+	return b.Assigned || (b.Captured && b.Letrec && !b.Patched)
 }
 
 // NewEnv creates a new empty environment.
 func NewEnv() *Env {
 	return &Env{
-		Stats: new(EnvStats),
+		Stats:   new(EnvStats),
+		Closure: new(EnvClosure),
 	}
 }
 
@@ -96,24 +156,36 @@ func (e *Env) Copy() *Env {
 	copy(frames, e.Frames)
 
 	return &Env{
-		Stats:  e.Stats,
-		Frames: frames,
+		Stats:   e.Stats,
+		Frames:  frames,
+		Closure: e.Closure,
 	}
 }
 
-// CopyEnvFrames creates a new copy of the environment sharing TypeEnv
-// frames and statistics.
-func (e *Env) CopyEnvFrames() *Env {
-	var frames []*EnvFrame
-	for _, frame := range e.Frames {
-		if frame.Type == TypeEnv {
-			frames = append(frames, frame)
-		}
+// Enclose creates a new environment for a lambda that is defined in
+// this environment. The lambda sees all frames of the environment
+// but its stack frames are allocated from its own stack.
+func (e *Env) Enclose() *Env {
+	env := e.Copy()
+	env.Stats = new(EnvStats)
+	env.Closure = &EnvClosure{
+		Outer: e.Closure,
 	}
-	return &Env{
-		Stats:  e.Stats,
-		Frames: frames,
+	return env
+}
+
+// Capture records the reference of the binding b in this
+// environment. If the binding is defined in an enclosing lambda, it
+// is captured by all lambdas from this environment up to the lambda
+// defining the binding.
+func (e *Env) Capture(b *EnvBinding) {
+	if b.Frame.Closure == e.Closure {
+		return
+	}
+	for c := e.Closure; c != nil && c != b.Frame.Closure; c = c.Outer {
+		c.add(b)
 	}
+	b.Captured = true
 }
 
 // Print prints the environment to standard output.
@@ -137,24 +209,14 @@ func (e *Env) Depth() int {
 	return len(e.Frames)
 }
 
-// PushCaptureFrame pushes a new stack frame. The capture argument
-// specifies if the frame is an env or a stack frame.
-func (e *Env) PushCaptureFrame(captures bool, usage FrameUsage,
-	size int) *EnvFrame {
-
-	if captures {
-		return e.PushFrame(TypeEnv, usage, size)
-	}
-	return e.PushFrame(TypeStack, usage, size)
-}
-
 // PushFrame pushes a new environment or stack frame based on frame
-// type argument.
+// type argument. The stack frames are indexed from the stack frames
+// of the environment's lambda.
 func (e *Env) PushFrame(t FrameType, usage FrameUsage, size int) *EnvFrame {
 	var index int
 
 	for _, f := range e.Frames {
-		if f.Type == t {
+		if f.Type == t && f.Closure == e.Closure {
 			if t == TypeStack {
 				index += f.Size
 			} else {
@@ -173,11 +235,24 @@ func (e *Env) PushFrame(t FrameType, usage FrameUsage, size int) *EnvFrame {
 		Index:    index,
 		Size:     size,
 		Bindings: make(map[string]*EnvBinding),
+		Closure:  e.Closure,
 	}
 	e.Frames = append(e.Frames, frame)
 	return frame
 }
 
+// ResizeFrame sets the size of the topmost frame. It is used for
+// frames whose bindings are known only after the frame is pushed,
+// like the frames of the internal definitions of bodies.
+func (e *Env) ResizeFrame(size int) {
+	frame := e.Frames[len(e.Frames)-1]
+	frame.Size = size
+
+	if frame.Type == TypeStack && frame.Index+size > e.Stats.MaxStack {
+		e.Stats.MaxStack = frame.Index + size
+	}
+}
+
 // PopFrame pops the topmost environment frame.
 func (e *Env) PopFrame() {
 	e.Frames = e.Frames[:len(e.Frames)-1]
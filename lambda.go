@@ -1,5 +1,5 @@
 //
-// Copyright (c) 2022-2023 Markku Rossi
+// Copyright (c) 2022-2024 Markku Rossi
 //
 // All rights reserved.
 //
@@ -15,9 +15,10 @@ import (
 	"github.com/markkurossi/scheme/types"
 )
 
-// Lambda implements lambda values.
+// Lambda implements lambda values. The Capture holds the values of
+// the lambda's free variables.
 type Lambda struct {
-	Capture *VMEnvFrame
+	Capture []Value
 	Impl    *LambdaImpl
 }
 
@@ -42,19 +43,29 @@ func (v *Lambda) Equal(o Value) bool {
 
 // Type implements the Value.Type().
 func (v *Lambda) Type() *types.Type {
+	return v.Impl.lambdaType()
+}
+
+func (v *LambdaImpl) lambdaType() *types.Type {
 	t := &types.Type{
 		Enum:   types.EnumLambda,
-		Return: v.Impl.Return,
+		Return: v.Return,
+	}
+	if len(v.Clauses) > 0 {
+		for _, clause := range v.Clauses {
+			t.Clauses = append(t.Clauses, clause.lambdaType())
+		}
+		return t
 	}
-	for _, arg := range v.Impl.Args.Fixed {
+	for _, arg := range v.Args.Fixed {
 		if arg.Type == nil {
 			t.Args = append(t.Args, types.Any)
 		} else {
 			t.Args = append(t.Args, arg.Type)
 		}
 	}
-	if v.Impl.Args.Rest != nil {
-		if v.Impl.Args.Rest.Type == nil {
+	if v.Args.Rest != nil {
+		if v.Args.Rest.Type == nil {
 			t.Rest = &types.Type{
 				Enum: types.EnumPair,
 				Car:  types.Unspecified,
@@ -63,7 +74,7 @@ func (v *Lambda) Type() *types.Type {
 		} else {
 			t.Rest = &types.Type{
 				Enum: types.EnumPair,
-				Car:  v.Impl.Args.Rest.Type,
+				Car:  v.Args.Rest.Type,
 				Cdr:  types.Any,
 			}
 		}
@@ -91,16 +102,19 @@ func (v *Lambda) MapPC(pc int) (source string, line int) {
 	return
 }
 
-// LambdaImpl implements lambda functions.
+// LambdaImpl implements lambda functions. The case-lambda functions
+// hold their clauses in Clauses and the call selects the clause by
+// the number of arguments. The Captures define how the lambda's
+// free variables are captured when the lambda is created.
 type LambdaImpl struct {
 	Name     string
+	Clauses  []*LambdaImpl
 	Args     Args
 	Return   *types.Type
-	Captures bool
-	Capture  *VMEnvFrame
+	Captures []Capture
 	Native   Native
 	Source   string
-	Code     Code
+	Code     *Code
 	MaxStack int
 	PCMap    PCMap
 	Body     []AST
@@ -121,9 +135,15 @@ func (v *LambdaImpl) Signature(body bool) string {
 	} else {
 		str.WriteString("lambda")
 	}
-	str.WriteString(" ")
-
-	str.WriteString(v.Args.String())
+	if len(v.Clauses) > 0 {
+		for _, clause := range v.Clauses {
+			str.WriteRune(' ')
+			str.WriteString(clause.Args.String())
+		}
+	} else {
+		str.WriteRune(' ')
+		str.WriteString(v.Args.String())
+	}
 
 	if v.Native != nil {
 		str.WriteString(" {native}")
@@ -157,9 +177,22 @@ func (v *LambdaImpl) Equal(o Value) bool {
 	if !v.Args.Equal(ov.Args) {
 		return false
 	}
-	if v.Captures != ov.Captures {
+	if len(v.Clauses) != len(ov.Clauses) {
+		return false
+	}
+	for idx, clause := range v.Clauses {
+		if !clause.Equal(ov.Clauses[idx]) {
+			return false
+		}
+	}
+	if len(v.Captures) != len(ov.Captures) {
 		return false
 	}
+	for idx, c := range v.Captures {
+		if c != ov.Captures[idx] {
+			return false
+		}
+	}
 	if v.Native == nil && ov.Native != nil {
 		return false
 	}
@@ -182,6 +215,26 @@ func (v *LambdaImpl) Type() *types.Type {
 	return types.Unspecified
 }
 
+// Clause returns the case-lambda clause that accepts numArgs
+// arguments or nil if no clause accepts them.
+func (v *LambdaImpl) Clause(numArgs int) *LambdaImpl {
+	for _, clause := range v.Clauses {
+		if numArgs >= clause.Args.Min && numArgs <= clause.Args.Max {
+			return clause
+		}
+	}
+	return nil
+}
+
+// Capture defines the location of a captured free variable in the
+// environment that creates the lambda. The variable is in the
+// creator's captures if Env is true and in its stack frames
+// otherwise.
+type Capture struct {
+	Env   bool
+	Index int
+}
+
 // Args specify lambda arguments.
 type Args struct {
 	Min   int
@@ -239,6 +292,18 @@ func (args Args) String() string {
 	return str.String()
 }
 
+// Names returns the names of the fixed and rest arguments.
+func (args Args) Names() []string {
+	var result []string
+	for _, arg := range args.Fixed {
+		result = append(result, arg.Name)
+	}
+	if args.Rest != nil {
+		result = append(result, args.Rest.Name)
+	}
+	return result
+}
+
 // Init initializes argument limits and checks that all argument names
 // are unique.
 func (args *Args) Init() {
@@ -279,10 +344,11 @@ type Native func(scm *Scheme, args []Value) (Value, error)
 
 // Builtin defines a built-in native function.
 type Builtin struct {
-	Name    string
-	Aliases []string
-	Args    []string
-	Return  *types.Type
-	Flags   Flags
-	Native  Native
+	Name         string
+	Aliases      []string
+	Args         []string
+	Return       *types.Type
+	Parametrizer types.Parametrizer
+	Flags        Flags
+	Native       Native
 }
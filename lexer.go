@@ -31,18 +31,26 @@ const (
 	THashLPar
 	TVU8LPar
 	TCommaAt
+	THashQuote
+	THashBackquote
+	THashComma
+	THashCommaAt
 )
 
 var tokenTypes = map[TokenType]string{
-	TIdentifier: "identifier",
-	TBoolean:    "boolean",
-	TNumber:     "number",
-	TCharacter:  "character",
-	TString:     "string",
-	TKeyword:    "keyword",
-	THashLPar:   "#(",
-	TVU8LPar:    "#vu8(",
-	TCommaAt:    ",@",
+	TIdentifier:    "identifier",
+	TBoolean:       "boolean",
+	TNumber:        "number",
+	TCharacter:     "character",
+	TString:        "string",
+	TKeyword:       "keyword",
+	THashLPar:      "#(",
+	TVU8LPar:       "#vu8(",
+	TCommaAt:       ",@",
+	THashQuote:     "#'",
+	THashBackquote: "#`",
+	THashComma:     "#,",
+	THashCommaAt:   "#,@",
 }
 
 func (t TokenType) String() string {
@@ -94,6 +102,19 @@ const (
 	KwImplies
 	KwDefine
 	KwDefineConstant
+	KwDefineValues
+	KwDefineConditionType
+	KwDefineRecordType
+	KwDefineSyntax
+	KwLetSyntax
+	KwLetrecSyntax
+	KwSyntaxRules
+	KwSyntaxCase
+	KwSyntax
+	KwQuasisyntax
+	KwUnsyntax
+	KwUnsyntaxSplicing
+	KwWithSyntax
 	KwUnquote
 	KwUnquoteSplicing
 	KwQuote
@@ -108,37 +129,60 @@ const (
 	KwLet
 	KwLetStar
 	KwLetrec
+	KwLetrecStar
+	KwLetValues
+	KwLetStarValues
 	KwDo
+	KwCaseLambda
 	KwDelay
+	KwGuard
 	KwQuasiquote
 	KwSchemeApply
 	KwPragma
 )
 
 var keywords = map[Keyword]string{
-	KwElse:            "else",
-	KwImplies:         "=>",
-	KwDefine:          "define",
-	KwDefineConstant:  "define-constant",
-	KwUnquote:         "unquote",
-	KwUnquoteSplicing: "unquote-splicing",
-	KwQuote:           "quote",
-	KwLambda:          "lambda",
-	KwIf:              "if",
-	KwSet:             "set!",
-	KwBegin:           "begin",
-	KwCond:            "cond",
-	KwAnd:             "and",
-	KwOr:              "or",
-	KwCase:            "case",
-	KwLet:             "let",
-	KwLetStar:         "let*",
-	KwLetrec:          "letrec",
-	KwDo:              "do",
-	KwDelay:           "delay",
-	KwQuasiquote:      "quasiquote",
-	KwSchemeApply:     "scheme::apply",
-	KwPragma:          "pragma",
+	KwElse:                "else",
+	KwImplies:             "=>",
+	KwDefine:              "define",
+	KwDefineConstant:      "define-constant",
+	KwDefineValues:        "define-values",
+	KwDefineConditionType: "define-condition-type",
+	KwDefineRecordType:    "define-record-type",
+	KwDefineSyntax:        "define-syntax",
+	KwLetSyntax:           "let-syntax",
+	KwLetrecSyntax:        "letrec-syntax",
+	KwSyntaxRules:         "syntax-rules",
+	KwSyntaxCase:          "syntax-case",
+	KwSyntax:              "syntax",
+	KwQuasisyntax:         "quasisyntax",
+	KwUnsyntax:            "unsyntax",
+	KwUnsyntaxSplicing:    "unsyntax-splicing",
+	KwWithSyntax:          "with-syntax",
+	KwUnquote:             "unquote",
+	KwUnquoteSplicing:     "unquote-splicing",
+	KwQuote:               "quote",
+	KwLambda:              "lambda",
+	KwIf:                  "if",
+	KwSet:                 "set!",
+	KwBegin:               "begin",
+	KwCond:                "cond",
+	KwAnd:                 "and",
+	KwOr:                  "or",
+	KwCase:                "case",
+	KwLet:                 "let",
+	KwLetStar:             "let*",
+	KwLetrec:              "letrec",
+	KwLetrecStar:          "letrec*",
+	KwLetValues:           "let-values",
+	KwLetStarValues:       "let*-values",
+	KwDo:                  "do",
+	KwCaseLambda:          "case-lambda",
+	KwDelay:               "delay",
+	KwGuard:               "guard",
+	KwQuasiquote:          "quasiquote",
+	KwSchemeApply:         "scheme::apply",
+	KwPragma:              "pragma",
 }
 
 var keywordNames map[string]Keyword
@@ -391,9 +435,23 @@ func (l *Lexer) Get() (*Token, error) {
 				return nil, err
 			}
 
-		case '(', ')', '\'', '`', ',':
+		case '(', ')', '\'', '`':
 			return l.Token(TokenType(r)), nil
 
+		case ',':
+			r, _, err = l.ReadRune()
+			if err != nil {
+				if err != io.EOF {
+					return nil, err
+				}
+				return l.Token(','), nil
+			}
+			if r == '@' {
+				return l.Token(TCommaAt), nil
+			}
+			l.UnreadRune()
+			return l.Token(','), nil
+
 		case '.':
 			r, _, err := l.ReadRune()
 			if err != nil {
@@ -448,6 +506,26 @@ func (l *Lexer) Get() (*Token, error) {
 					return nil, l.errf("unknown vector type: '%s'", name)
 				}
 
+			case '\'':
+				return l.Token(THashQuote), nil
+
+			case '`':
+				return l.Token(THashBackquote), nil
+
+			case ',':
+				r, _, err = l.ReadRune()
+				if err != nil {
+					if err != io.EOF {
+						return nil, err
+					}
+					return l.Token(THashComma), nil
+				}
+				if r == '@' {
+					return l.Token(THashCommaAt), nil
+				}
+				l.UnreadRune()
+				return l.Token(THashComma), nil
+
 			case 't', 'f':
 				token := l.Token(TBoolean)
 				token.Bool = r == 't'
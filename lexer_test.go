@@ -1,5 +1,5 @@
 //
-// Copyright (c) 2022-2023 Markku Rossi
+// Copyright (c) 2022-2024 Markku Rossi
 //
 // All rights reserved.
 //
@@ -46,6 +46,12 @@ var lexerTests = []struct {
 			Type: ',',
 		},
 	},
+	{
+		i: ",@",
+		o: &Token{
+			Type: TCommaAt,
+		},
+	},
 	{
 		i: ".",
 		o: &Token{
@@ -0,0 +1,10 @@
+;;;
+;;; Copyright (c) 2024 Markku Rossi
+;;;
+;;; All rights reserved.
+;;;
+
+(library (rnrs conditions (6))
+  (export)
+  (import (rnrs base))
+  )
@@ -1,11 +1,11 @@
 ;;;
-;;; Copyright (c) 2023 Markku Rossi
+;;; Copyright (c) 2023-2024 Markku Rossi
 ;;;
 ;;; All rights reserved.
 ;;;
 
 (library (rnrs sorting (6))
-  (export list-sort)
+  (export list-sort vector-sort vector-sort!)
   (import (rnrs base))
 
   (define (list-sort proc lst)
@@ -38,4 +38,7 @@
     (if (<= (vector-length vect) 1)
         vect
         (list->vector (list-sort proc (vector->list vect)))))
+
+  (define (vector-sort! proc vect)
+    (scheme::vector-sort! proc vect))
   )
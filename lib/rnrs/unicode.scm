@@ -1,11 +1,12 @@
 ;;;
-;;; Copyright (c) 2023 Markku Rossi
+;;; Copyright (c) 2023-2024 Markku Rossi
 ;;;
 ;;; All rights reserved.
 ;;;
 
 (library (rnrs unicode (6))
-  (export char-ci=? char-ci<? char-ci>? char-ci<=? char-ci>=?)
+  (export char-ci=? char-ci<? char-ci>? char-ci<=? char-ci>=?
+          string-ci=? string-ci<? string-ci>? string-ci<=? string-ci>=?)
   (import (rnrs base))
 
   (define (char-ci=? char1 char2 . rest)
@@ -1,11 +1,13 @@
 ;;;
-;;; Copyright (c) 2023 Markku Rossi
+;;; Copyright (c) 2023-2024 Markku Rossi
 ;;;
 ;;; All rights reserved.
 ;;;
 
 (library (vt100 cursor (1 0))
-  (export cursor-move)
+  (export cursor-move
+          erase-line-head erase-line-tail erase-line
+          erase-screen-head erase-screen-tail erase-screen)
   (import (vt100 base) (rnrs base))
 
   (define (cursor-move row col)
@@ -1,11 +1,14 @@
 ;;;
-;;; Copyright (c) 2023 Markku Rossi
+;;; Copyright (c) 2023-2024 Markku Rossi
 ;;;
 ;;; All rights reserved.
 ;;;
 
 (library (vt100 text (1 0))
-  (export text-reset text-bold text-dim text-italic text-underscore)
+  (export (rename (text-default text-reset))
+          text-bold text-dim text-italic text-underscore
+          text-fg-black text-fg-red text-fg-green text-fg-yellow
+          text-fg-blue text-fg-magenta text-fg-cyan text-fg-white)
   (import (vt100 base) (rnrs base))
 
   (define (text spec)
@@ -1,5 +1,5 @@
 //
-// Copyright (c) 2022-2023 Markku Rossi
+// Copyright (c) 2022-2024 Markku Rossi
 //
 // All rights reserved.
 //
@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strings"
 
 	"github.com/markkurossi/scheme/types"
 )
@@ -23,14 +24,36 @@ type Library struct {
 	Exports   Value
 	ExportAll bool
 	Imports   Value
-	Init      Code
+	Init      Instrs
 	PCMap     PCMap
 
+	imports   []*importSet
 	lambdas   []*lambdaCompilation
 	nextLabel int
 	exported  map[string]*export
+	defined   map[string]Locator
+	symbols   map[string]*Identifier
+	imported  map[string]*Identifier
+	assigned  map[string]bool
 	recheck   bool
+	inlined   *PCInline
 	current   *lambdaCompilation
+	parser    *Parser
+	forms     []libraryForm
+
+	constants        map[*Identifier]Value
+	bindingConstants map[*EnvBinding]Value
+	procedures       map[*Identifier]*ASTLambda
+	inlining         map[*ASTLambda]bool
+	optimized        map[*ASTLambda]bool
+	stats            *EnvStats
+	bodyStats        *EnvStats
+}
+
+// libraryForm holds an unparsed library body form.
+type libraryForm struct {
+	from  Locator
+	value Value
 }
 
 // Scheme implements Value.Scheme.
@@ -67,7 +90,11 @@ func (lib *Library) parseLibraryHeader(list []Pair) error {
 	if !ok || len(l) == 0 {
 		return list[1].Errorf("invalid library name: %v", pair)
 	}
-	lib.Name = pair
+	lib.Name = libraryName(pair)
+	_, _, err := libraryVersion(lib.Name)
+	if err != nil {
+		return list[1].Errorf("%v", err)
+	}
 
 	// Export.
 	l, ok = ListPairs(list[2].Car())
@@ -75,9 +102,9 @@ func (lib *Library) parseLibraryHeader(list []Pair) error {
 		return list[2].Errorf("expected (export ...)")
 	}
 	for i := 1; i < len(l); i++ {
-		_, ok := isIdentifier(l[i].Car())
-		if !ok {
-			return l[i].Errorf("invalid export name: %v", l[i])
+		err := lib.parseExportSpec(l[i])
+		if err != nil {
+			return err
 		}
 	}
 	lib.Exports = l[0].Cdr()
@@ -87,15 +114,675 @@ func (lib *Library) parseLibraryHeader(list []Pair) error {
 	if !ok {
 		return list[3].Errorf("invalid library import: %v", list[3].Car())
 	}
-	_, ok = ListPairs(list[3].Car())
+	return lib.parseImports(list[3], pair)
+}
+
+// parseExportSpec parses the export spec. The spec is an identifier
+// or a rename spec:
+//
+//	(rename (internal external)...)
+func (lib *Library) parseExportSpec(spec Pair) error {
+	id, ok := isIdentifier(spec.Car())
+	if ok {
+		return lib.addExport(spec, id.Name, id.Name)
+	}
+	l, ok := ListPairs(spec.Car())
+	if !ok || len(l) == 0 || !isNamedIdentifier(l[0].Car(), "rename") {
+		return spec.Errorf("invalid export spec: %v", spec.Car())
+	}
+	for _, r := range l[1:] {
+		names, ok := ListValues(r.Car())
+		if ok && len(names) == 2 {
+			internal, ok1 := isIdentifier(names[0])
+			external, ok2 := isIdentifier(names[1])
+			if ok1 && ok2 {
+				err := lib.addExport(r, internal.Name, external.Name)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		return r.Errorf("invalid export rename: %v", r.Car())
+	}
+	return nil
+}
+
+// addExport exports the internal binding with the external name.
+func (lib *Library) addExport(from Locator, internal, external string) error {
+	for _, e := range lib.exported {
+		for _, name := range e.names {
+			if name == external {
+				return from.Errorf("duplicate export: %v", external)
+			}
+		}
+	}
+	e, ok := lib.exported[internal]
+	if !ok {
+		e = &export{
+			from: from,
+		}
+		lib.exported[internal] = e
+	}
+	e.names = append(e.names, external)
+	return nil
+}
+
+// exportedBindings returns the library's exported bindings by their
+// external names. The exported macros have nil bindings since the
+// macros are bound globally.
+func (lib *Library) exportedBindings() map[string]*Identifier {
+	result := make(map[string]*Identifier)
+	for internal, e := range lib.exported {
+		for _, name := range e.names {
+			result[name] = lib.symbols[internal]
+		}
+	}
+	return result
+}
+
+// parseImports parses the import specs of the import form. The
+// library references of the import specs are collected into Imports
+// for loading the imported libraries.
+func (lib *Library) parseImports(from Locator, form Pair) error {
+	specs, ok := ListPairs(libraryName(form))
+	if !ok {
+		return from.Errorf("expected (import ...)")
+	}
+	var refs []Value
+	for _, spec := range specs[1:] {
+		set, err := parseImportSet(spec)
+		if err != nil {
+			return err
+		}
+		lib.imports = append(lib.imports, set)
+		refs = append(refs, set.library().ref)
+	}
+	lib.Imports = newList(from, refs...)
+	return nil
+}
+
+// importKind defines the import set kinds.
+type importKind int
+
+// Import set kinds.
+const (
+	importLibrary importKind = iota
+	importOnly
+	importExcept
+	importPrefix
+	importRename
+)
+
+// importSet implements the import sets of library imports. The
+// import sets are nested and the innermost import set references the
+// imported library:
+//
+//	(only (prefix (go format) go:) go:format)
+type importSet struct {
+	from    Locator
+	kind    importKind
+	set     *importSet
+	ref     Value
+	name    string
+	version Value
+	ids     map[string]bool
+	prefix  string
+	renames map[string]string
+}
+
+// parseImportSet parses the import set. The for import sets are
+// parsed as their import sets since all bindings are imported for
+// all phases.
+func parseImportSet(spec Pair) (*importSet, error) {
+	l, ok := ListPairs(spec.Car())
+	if !ok || len(l) == 0 {
+		return nil, spec.Errorf("invalid import set: %v", spec.Car())
+	}
+	id, ok := isIdentifier(l[0].Car())
 	if !ok {
-		return list[3].Errorf("expected (import ...)")
+		return nil, spec.Errorf("invalid import set: %v", spec.Car())
+	}
+	set := &importSet{
+		from: spec,
+	}
+	switch id.Name {
+	case "library":
+		if len(l) != 2 {
+			return nil, spec.Errorf("invalid import set: %v", spec.Car())
+		}
+		return parseLibraryReference(l[1])
+
+	case "for":
+		if len(l) < 2 {
+			return nil, spec.Errorf("invalid import set: %v", spec.Car())
+		}
+		return parseImportSet(l[1])
+
+	case "only", "except":
+		if len(l) < 2 {
+			return nil, spec.Errorf("invalid import set: %v", spec.Car())
+		}
+		set.kind = importOnly
+		if id.Name == "except" {
+			set.kind = importExcept
+		}
+		set.ids = make(map[string]bool)
+		for _, pair := range l[2:] {
+			name, ok := isIdentifier(pair.Car())
+			if !ok {
+				return nil, pair.Errorf("%s: invalid identifier: %v",
+					id.Name, pair.Car())
+			}
+			set.ids[name.Name] = true
+		}
+
+	case "prefix":
+		if len(l) != 3 {
+			return nil, spec.Errorf("invalid import set: %v", spec.Car())
+		}
+		prefix, ok := isIdentifier(l[2].Car())
+		if !ok {
+			return nil, l[2].Errorf("prefix: invalid identifier: %v",
+				l[2].Car())
+		}
+		set.kind = importPrefix
+		set.prefix = prefix.Name
+
+	case "rename":
+		if len(l) < 2 {
+			return nil, spec.Errorf("invalid import set: %v", spec.Car())
+		}
+		set.kind = importRename
+		set.renames = make(map[string]string)
+		set.ids = make(map[string]bool)
+		for _, pair := range l[2:] {
+			names, ok := ListValues(pair.Car())
+			if ok && len(names) == 2 {
+				from, ok1 := isIdentifier(names[0])
+				to, ok2 := isIdentifier(names[1])
+				if ok1 && ok2 {
+					set.ids[from.Name] = true
+					set.renames[to.Name] = from.Name
+					continue
+				}
+			}
+			return nil, pair.Errorf("rename: invalid rename: %v", pair.Car())
+		}
+
+	default:
+		return parseLibraryReference(spec)
+	}
+
+	var err error
+	set.set, err = parseImportSet(l[1])
+	if err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+// parseLibraryReference parses the library reference. The reference
+// is the library name, optionally followed by a version reference.
+func parseLibraryReference(spec Pair) (*importSet, error) {
+	l, ok := ListPairs(spec.Car())
+	if !ok || len(l) == 0 {
+		return nil, spec.Errorf("invalid library reference: %v", spec.Car())
+	}
+	set := &importSet{
+		from: spec,
+		kind: importLibrary,
+		ref:  spec.Car(),
+	}
+	var names []string
+	for idx, pair := range l {
+		id, ok := isIdentifier(pair.Car())
+		if ok {
+			names = append(names, id.Name)
+			continue
+		}
+		if idx == 0 || idx+1 < len(l) {
+			return nil, pair.Errorf("invalid library reference: %v",
+				spec.Car())
+		}
+		set.version = pair.Car()
+		_, err := matchVersion(set.version, nil)
+		if err != nil {
+			return nil, pair.Errorf("%v", err)
+		}
+	}
+	set.name = libraryKey(names)
+	return set, nil
+}
+
+// library returns the library reference of the import set.
+func (set *importSet) library() *importSet {
+	for set.kind != importLibrary {
+		set = set.set
+	}
+	return set
+}
+
+// bindings returns the bindings that the import set imports, keyed
+// by their names in the importing library. The function returns nil
+// if the imported library does not declare its exports. The built-in
+// libraries, like (rnrs base), and the libraries of built-in
+// procedures do not declare their exports.
+func (set *importSet) bindings(libraries map[string]*Library) (
+	map[string]*Identifier, error) {
+
+	if set.kind == importLibrary {
+		lib, ok := libraries[set.name]
+		if !ok || len(lib.exported) == 0 {
+			return nil, nil
+		}
+		return lib.exportedBindings(), nil
+	}
+	bindings, err := set.set.bindings(libraries)
+	if err != nil {
+		return nil, err
+	}
+	if set.kind == importOnly {
+		result := make(map[string]*Identifier)
+		for id := range set.ids {
+			b, ok := bindings[id]
+			if bindings != nil && !ok {
+				return nil, set.from.Errorf("only: %v not exported by %v",
+					id, set.library().name)
+			}
+			result[id] = b
+		}
+		return result, nil
+	}
+	if bindings == nil {
+		return nil, nil
+	}
+	result := make(map[string]*Identifier)
+	for id := range set.ids {
+		_, ok := bindings[id]
+		if !ok {
+			return nil, set.from.Errorf("%v not exported by %v",
+				id, set.library().name)
+		}
+	}
+	for name, b := range bindings {
+		switch set.kind {
+		case importExcept, importRename:
+			if !set.ids[name] {
+				result[name] = b
+			}
+
+		case importPrefix:
+			result[set.prefix+name] = b
+		}
+	}
+	for to, from := range set.renames {
+		result[to] = bindings[from]
+	}
+	return result, nil
+}
+
+// resolve resolves the name that the import set imports. The
+// function returns the name of the binding in the imported library,
+// and a flag telling if the imported library declares the binding.
+// The function returns an empty name if the import set does not
+// import the name.
+func (set *importSet) resolve(libraries map[string]*Library,
+	name string) (string, bool) {
+
+	switch set.kind {
+	case importLibrary:
+		lib, ok := libraries[set.name]
+		if !ok || len(lib.exported) == 0 {
+			return name, false
+		}
+		_, ok = lib.exportedBindings()[name]
+		if !ok {
+			return "", false
+		}
+		return name, true
+
+	case importOnly:
+		if !set.ids[name] {
+			return "", false
+		}
+
+	case importExcept:
+		if set.ids[name] {
+			return "", false
+		}
+
+	case importPrefix:
+		if !strings.HasPrefix(name, set.prefix) {
+			return "", false
+		}
+		name = name[len(set.prefix):]
+
+	case importRename:
+		from, ok := set.renames[name]
+		if ok {
+			name = from
+		} else if set.ids[name] {
+			return "", false
+		}
 	}
-	lib.Imports, _ = Cdr(pair, true)
+	return set.set.resolve(libraries, name)
+}
 
+// checkImports checks that the import sets import names that the
+// imported libraries export, and creates the library's import table.
+// The import table binds the imported names to the symbols of the
+// libraries that export them. A name can't be imported with
+// different bindings. The top-level programs share the machine's
+// import table so their imports remain visible to the programs that
+// the machine evaluates after them, and a later top-level import
+// replaces the earlier binding of the name.
+func (lib *Library) checkImports() error {
+	lib.imported = make(map[string]*Identifier)
+	if lib.ExportAll {
+		for name, b := range lib.scm.imported {
+			lib.imported[name] = b
+		}
+	}
+	from := make(map[string]*importSet)
+
+	for _, set := range lib.imports {
+		bindings, err := set.bindings(lib.scm.image.libraries)
+		if err != nil {
+			return err
+		}
+		for name, b := range bindings {
+			if b == nil {
+				continue
+			}
+			prev, ok := lib.imported[name]
+			if ok && prev != b && from[name] != nil {
+				return set.from.Errorf("%v imported from %v and %v",
+					name, from[name].library().name, set.library().name)
+			}
+			lib.imported[name] = b
+			from[name] = set
+		}
+	}
+	if lib.ExportAll {
+		lib.scm.imported = lib.imported
+	}
 	return nil
 }
 
+// resolveImport resolves the global name of the imported identifier
+// name. The names that the import table binds are resolved by the
+// table and they are returned as-is. The names that the import sets
+// import from the built-in libraries are resolved to their global
+// names. If no import set imports the name, the name is returned
+// as-is.
+func (lib *Library) resolveImport(loc Locator, name string) (string, error) {
+	_, ok := lib.imported[name]
+	if ok {
+		return name, nil
+	}
+	for _, set := range lib.imports {
+		n, declared := set.resolve(lib.scm.image.libraries, name)
+		if len(n) > 0 && !declared {
+			return n, nil
+		}
+	}
+	return name, nil
+}
+
+// addDefinition records the library's global definition of the
+// name.
+func (lib *Library) addDefinition(loc Locator, name string) {
+	if lib.defined == nil {
+		lib.defined = make(map[string]Locator)
+	}
+	_, ok := lib.defined[name]
+	if !ok {
+		lib.defined[name] = loc
+	}
+}
+
+// defineSymbols creates the symbols of the library's definitions.
+// The definitions of the libraries that declare their exports are
+// bound to library-owned symbols which are not interned. The
+// importing libraries bind the exported symbols with their import
+// tables so the libraries can use the same names for their
+// definitions, and the definitions are visible only in the libraries
+// that import them.
+func (lib *Library) defineSymbols() error {
+	if lib.ExportAll {
+		return nil
+	}
+	for name, loc := range lib.defined {
+		if isInlined(name) {
+			return loc.Errorf("redefining symbol '%s'", name)
+		}
+		if lib.symbols == nil {
+			lib.symbols = make(map[string]*Identifier)
+		}
+		lib.symbols[name] = &Identifier{
+			Name:       name,
+			GlobalType: types.Unspecified,
+		}
+	}
+	return nil
+}
+
+// binding returns the library's binding of the global name: the
+// symbol of the library's own definition or the imported symbol. The
+// function returns nil if the name is bound in the global symbol
+// table.
+func (lib *Library) binding(name string) *Identifier {
+	sym, ok := lib.symbols[name]
+	if ok {
+		return sym
+	}
+	return lib.imported[name]
+}
+
+// intern returns the symbol of the global name. The library's own
+// symbols and the imported symbols shadow the interned symbols.
+func (lib *Library) intern(name string) *Identifier {
+	sym := lib.binding(name)
+	if sym != nil {
+		return sym
+	}
+	return lib.scm.Intern(name)
+}
+
+// libraryKey returns the registry key of the library name.
+func libraryKey(names []string) string {
+	return "(" + strings.Join(names, " ") + ")"
+}
+
+// libraryVersion splits the library name into its name identifiers
+// and version.
+func libraryVersion(name Value) ([]string, []int, error) {
+	var names []string
+	var version []int
+
+	l, ok := ListValues(name)
+	if !ok {
+		return nil, nil, fmt.Errorf("invalid library name: %v", name)
+	}
+	for idx, item := range l {
+		id, ok := isIdentifier(item)
+		if ok {
+			names = append(names, id.Name)
+			continue
+		}
+		if idx == 0 || idx+1 < len(l) {
+			return nil, nil, fmt.Errorf("invalid library name: %v", name)
+		}
+		var err error
+		version, err = parseVersion(item)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return names, version, nil
+}
+
+// parseVersion parses the library version.
+func parseVersion(v Value) ([]int, error) {
+	var version []int
+
+	l, ok := ListValues(v)
+	if !ok {
+		return nil, fmt.Errorf("invalid version: %v", v)
+	}
+	for _, item := range l {
+		i, ok := item.(Int)
+		if !ok || i < 0 {
+			return nil, fmt.Errorf("invalid version: %v", v)
+		}
+		version = append(version, int(i))
+	}
+	return version, nil
+}
+
+// matchVersion tests if the version matches the version reference.
+// The function checks the syntax of the whole version reference, so
+// it can be called with an empty version to check the syntax. The
+// comparison references, like (>= 1), are accepted as version
+// references for the first sub-version.
+func matchVersion(ref Value, version []int) (bool, error) {
+	l, ok := ListValues(ref)
+	if !ok {
+		return false, fmt.Errorf("invalid version reference: %v", ref)
+	}
+	if len(l) > 0 {
+		op, ok := versionOp(l[0])
+		if ok && (op == ">=" || op == "<=") {
+			l = []Value{ref}
+		} else if ok {
+			if op == "not" && len(l) != 2 {
+				return false, fmt.Errorf("invalid version reference: %v",
+					ref)
+			}
+			return matchVersionLogic(op, ref, l[1:],
+				func(v Value) (bool, error) {
+					return matchVersion(v, version)
+				})
+		}
+	}
+	result := len(version) >= len(l)
+	for idx, item := range l {
+		var sub int
+		if idx < len(version) {
+			sub = version[idx]
+		}
+		match, err := matchSubVersion(item, sub)
+		if err != nil {
+			return false, err
+		}
+		result = result && match
+	}
+	return result, nil
+}
+
+// matchSubVersion tests if the sub-version matches the sub-version
+// reference.
+func matchSubVersion(ref Value, sub int) (bool, error) {
+	i, ok := ref.(Int)
+	if ok && i >= 0 {
+		return int(i) == sub, nil
+	}
+	l, ok := ListValues(ref)
+	if !ok || len(l) == 0 {
+		return false, fmt.Errorf("invalid sub-version reference: %v", ref)
+	}
+	op, ok := versionOp(l[0])
+	if !ok {
+		return false, fmt.Errorf("invalid sub-version reference: %v", ref)
+	}
+	switch op {
+	case ">=", "<=":
+		if len(l) != 2 {
+			return false, fmt.Errorf("invalid sub-version reference: %v",
+				ref)
+		}
+		i, ok := l[1].(Int)
+		if !ok || i < 0 {
+			return false, fmt.Errorf("invalid sub-version reference: %v",
+				ref)
+		}
+		if op == ">=" {
+			return sub >= int(i), nil
+		}
+		return sub <= int(i), nil
+
+	case "not":
+		if len(l) != 2 {
+			return false, fmt.Errorf("invalid sub-version reference: %v",
+				ref)
+		}
+	}
+	return matchVersionLogic(op, ref, l[1:],
+		func(v Value) (bool, error) {
+			return matchSubVersion(v, sub)
+		})
+}
+
+// versionOp returns the operator name of the version reference. The
+// and and or operators are keywords in quoted version references.
+func versionOp(v Value) (string, bool) {
+	switch op := v.(type) {
+	case *Identifier:
+		return op.Name, true
+	case Keyword:
+		return op.String(), true
+	default:
+		return "", false
+	}
+}
+
+// matchVersionLogic matches the and, or, and not version references
+// with the match function.
+func matchVersionLogic(op string, ref Value, refs []Value,
+	match func(v Value) (bool, error)) (bool, error) {
+
+	var result bool
+	switch op {
+	case "and", "not":
+		result = true
+	case "or":
+	default:
+		return false, fmt.Errorf("invalid version reference: %v", ref)
+	}
+	for _, r := range refs {
+		m, err := match(r)
+		if err != nil {
+			return false, err
+		}
+		switch op {
+		case "and":
+			result = result && m
+		case "or":
+			result = result || m
+		case "not":
+			result = !m
+		}
+	}
+	return result, nil
+}
+
+// libraryName converts the syntactic keywords of the library name or
+// import spec into identifiers. This allows library names like
+// (rnrs syntax-case).
+func libraryName(name Value) Value {
+	name, _ = mapSyntax(name, func(v Value) (Value, bool) {
+		kw, ok := v.(Keyword)
+		if !ok {
+			return v, false
+		}
+		return &Identifier{
+			Name: kw.String(),
+		}, true
+	})
+	return name
+}
+
 // MapPC maps the program counter value to the source location.
 func (lib *Library) MapPC(pc int) (source string, line int) {
 	source = lib.Source
@@ -118,9 +805,20 @@ type PCMap []PCLine
 
 // MapPC maps the program counter value to the source line number.
 func (pcmap PCMap) MapPC(pc int) (line int) {
+	return pcmap.lookup(pc).Line
+}
+
+// Inlined returns the inlined procedure call whose body the program
+// counter value is executing. The function returns nil if the
+// program counter is not in an inlined procedure body.
+func (pcmap PCMap) Inlined(pc int) *PCInline {
+	return pcmap.lookup(pc).Inlined
+}
+
+func (pcmap PCMap) lookup(pc int) (result PCLine) {
 	for _, pm := range pcmap {
 		if pc > pm.PC {
-			line = pm.Line
+			result = pm
 		}
 		if pc <= pm.PC {
 			break
@@ -129,24 +827,49 @@ func (pcmap PCMap) MapPC(pc int) (line int) {
 	return
 }
 
-// PCLine maps program counter values to line numbers.
+// PCLine maps program counter values to line numbers. The Inlined
+// holds the inlined procedure call if the instructions belong to an
+// inlined procedure body.
 type PCLine struct {
-	PC   int
-	Line int
+	PC      int
+	Line    int
+	Inlined *PCInline
 }
 
-// Code implements scheme bytecode.
-type Code []*Instr
+// PCInline describes an inlined procedure call. The Signature is the
+// signature of the inlined procedure, the Line is the line number of
+// the call site, and the Outer is the inlined call containing the
+// call site.
+type PCInline struct {
+	Signature string
+	Line      int
+	Outer     *PCInline
+}
+
+// Instrs implements scheme bytecode instructions before they are
+// encoded into Code.
+type Instrs []*Instr
 
-// Print prints the code to standard output.
-func (code Code) Print(w io.Writer) {
-	for idx, c := range code {
+// Print prints the instructions to the writer.
+func (instrs Instrs) Print(w io.Writer) {
+	for idx, c := range instrs {
 		fmt.Fprintf(w, "%v\t%s\n", idx, c)
 	}
 }
 
 // Compile compiles the library into bytecode.
 func (lib *Library) Compile() (Value, error) {
+	lib.scm.image.lockCompile(lib.scm)
+	defer lib.scm.image.unlockCompile()
+
+	if lib.parser != nil {
+		err := lib.parser.parseBody(lib)
+		if err != nil {
+			return nil, err
+		}
+		lib.parser = nil
+	}
+
 	lib.recheck = true
 	for round := 0; lib.recheck; round++ {
 		lib.recheck = false
@@ -155,6 +878,7 @@ func (lib *Library) Compile() (Value, error) {
 			return nil, err
 		}
 	}
+	lib.optimize()
 
 	err := lib.Body.Bytecode(lib)
 	if err != nil {
@@ -162,6 +886,8 @@ func (lib *Library) Compile() (Value, error) {
 	}
 
 	lib.addInstr(nil, OpReturn, nil, 0)
+	toplevelEnd := len(lib.Init)
+	pcmapToplevel := len(lib.PCMap)
 
 	// Compile lambdas.
 
@@ -169,13 +895,25 @@ func (lib *Library) Compile() (Value, error) {
 
 	for i := 0; i < len(lib.lambdas); i++ {
 		lambda := lib.lambdas[i]
+		if len(lambda.Clauses) > 0 {
+			// The case-lambda clauses are compiled as lambdas.
+			pcmaps = append(pcmaps, nil)
+			continue
+		}
 		pcmapStart := len(lib.PCMap)
 		lib.current = lambda
 
 		// Lambda body starts after the label.
 		ofs := len(lib.Init)
 		lambda.Start = ofs + 1
-		lambda.Label = lib.addInstr(nil, OpLabel, nil, lambda.Start)
+		lambda.Label = lib.newLabel()
+		lib.addLabel(lambda.Label)
+
+		// The arguments are boxed after the label so that the self
+		// tail-calls box their new arguments.
+		for _, b := range lambda.ArgBindings {
+			lib.addBox(lambda.Self.Locator(), b)
+		}
 
 		for _, ast := range lambda.Body {
 			err := ast.Bytecode(lib)
@@ -202,34 +940,55 @@ func (lib *Library) Compile() (Value, error) {
 		}
 	}
 
+	var impls []*LambdaImpl
+	var defs []*lambdaCompilation
+
+	lambdaImpl := func(idx int) *LambdaImpl {
+		def := lib.lambdas[idx]
+
+		var name string
+		if def.Name != nil {
+			name = def.Name.Name
+		}
+
+		ctx := make(types.Ctx)
+
+		impl := &LambdaImpl{
+			Name:     name,
+			Args:     def.Args,
+			Return:   def.Body[len(def.Body)-1].Type(ctx),
+			Captures: def.Captures,
+			Source:   lib.Source,
+			MaxStack: def.Env.Stats.MaxStack,
+			PCMap:    pcmaps[idx],
+			Body:     def.Body,
+		}
+		impls = append(impls, impl)
+		defs = append(defs, def)
+
+		return impl
+	}
+
 	// Patch code offsets.
 	for i := 0; i < len(lib.Init); i++ {
 		instr := lib.Init[i]
 		switch instr.Op {
 		case OpLambda:
-			pcmap := pcmaps[instr.I]
 			def := lib.lambdas[instr.I]
-
-			var name string
-			if def.Name != nil {
-				name = def.Name.Name
-			}
-
-			ctx := make(types.Ctx)
-
-			instr.I = def.Start
-			instr.J = def.End
-			instr.V = &LambdaImpl{
-				Name:     name,
-				Args:     def.Args,
-				Return:   def.Body[len(def.Body)-1].Type(ctx),
-				Captures: def.Captures,
-				Source:   lib.Source,
-				Code:     lib.Init[def.Start:def.End],
-				MaxStack: def.Env.Stats.MaxStack,
-				PCMap:    pcmap,
-				Body:     def.Body,
+			if len(def.Clauses) > 0 {
+				impl := &LambdaImpl{
+					Source:   lib.Source,
+					Captures: def.Captures,
+				}
+				for _, clause := range def.Clauses {
+					ci := lambdaImpl(clause)
+					impl.Clauses = append(impl.Clauses, ci)
+					impl.Return = types.Unify(impl.Return, ci.Return)
+				}
+				instr.V = impl
+				break
 			}
+			instr.V = lambdaImpl(instr.I)
 
 		case OpIf, OpIfNot, OpJmp:
 			ofs, ok := labels[instr.J]
@@ -240,20 +999,43 @@ func (lib *Library) Compile() (Value, error) {
 		}
 	}
 
+	// Encode lambdas.
+	for idx, impl := range impls {
+		def := defs[idx]
+		impl.Code, err = encode(lib.Init[def.Start:def.End], impl.PCMap)
+		if err != nil {
+			return nil, err
+		}
+	}
+	pcmap := lib.PCMap[:pcmapToplevel]
+	code, err := encode(lib.Init[:toplevelEnd], pcmap)
+	if err != nil {
+		return nil, err
+	}
+	// The instructions are not needed after they are encoded.
+	lib.Init = nil
+
 	// Check that all exported names were defined.
 	for k, v := range lib.exported {
 		if v.id == nil {
 			return nil, v.from.Errorf("exported symbol '%s' not defined", k)
 		}
 	}
+	if !lib.ExportAll {
+		names, _, err := libraryVersion(lib.Name)
+		if err != nil {
+			return nil, err
+		}
+		lib.scm.image.libraries[libraryKey(names)] = lib
+	}
 
 	return &Lambda{
 		Impl: &LambdaImpl{
 			Return:   types.Any,
 			Source:   lib.Source,
-			Code:     lib.Init,
-			PCMap:    lib.PCMap,
-			Captures: true,
+			Code:     code,
+			MaxStack: lib.bodyStats.MaxStack,
+			PCMap:    pcmap,
 		},
 	}, nil
 }
@@ -269,29 +1051,6 @@ func (lib *Library) addCall(from Locator, numArgs int, tail bool) {
 	lib.addInstr(from, OpCall, nil, i)
 }
 
-func (lib *Library) addPushS(from Locator, size int, capture bool) {
-	var op Operand
-	if capture {
-		op = OpPushE
-	} else {
-		op = OpPushS
-	}
-	lib.addInstr(from, op, nil, size)
-}
-
-func (lib *Library) addPopS(from Locator, size int, capture bool) {
-	var op Operand
-	if capture {
-		op = OpPopE
-	} else {
-		op = OpPopS
-	}
-	instr := lib.addInstr(from, op, nil, size)
-	if !capture {
-		instr.J = 1
-	}
-}
-
 func (lib *Library) addInstr(from Locator, op Operand, v Value, i int) *Instr {
 	instr := &Instr{
 		Op: op,
@@ -301,10 +1060,12 @@ func (lib *Library) addInstr(from Locator, op Operand, v Value, i int) *Instr {
 	if from != nil {
 		p := from.From()
 		if len(lib.PCMap) == 0 ||
-			lib.PCMap[len(lib.PCMap)-1].Line != p.Line {
+			lib.PCMap[len(lib.PCMap)-1].Line != p.Line ||
+			lib.PCMap[len(lib.PCMap)-1].Inlined != lib.inlined {
 			lib.PCMap = append(lib.PCMap, PCLine{
-				PC:   len(lib.Init),
-				Line: p.Line,
+				PC:      len(lib.Init),
+				Line:    p.Line,
+				Inlined: lib.inlined,
 			})
 		}
 	}
@@ -324,13 +1085,100 @@ func (lib *Library) newLabel() *Instr {
 	}
 }
 
+// selfCall tests if the function f, called with numArgs arguments,
+// is the lambda being compiled. The function returns the lambda
+// compilation if the call can be compiled into a jump to the
+// beginning of the lambda. This is possible when the lambda does not
+// take rest arguments. The function f must be the lambda's letrec
+// binding that is never assigned, or its global definition that
+// defineProcedure recorded as a known procedure. The other global
+// procedures can be assigned or redefined by later evaluations so
+// their self-calls must call the current value of the global.
+func (lib *Library) selfCall(f AST, numArgs int) *lambdaCompilation {
+	current := lib.current
+	if current == nil || current.Args.Rest != nil ||
+		numArgs != len(current.Args.Fixed) {
+		return nil
+	}
+	id, ok := f.(*ASTIdentifier)
+	if !ok {
+		return nil
+	}
+	if id.Binding != nil {
+		if id.Binding.Assigned || id.Binding.Init != current.Self {
+			return nil
+		}
+		return current
+	}
+	if current.Name == nil || current.Name.Name != id.Name ||
+		lib.procedures[lib.intern(id.Name)] != current.Self {
+		return nil
+	}
+	return current
+}
+
+// local tests if the binding b is in the stack frames of the lambda
+// being compiled. The other bindings are the captures of the lambda.
+func (lib *Library) local(b *EnvBinding) bool {
+	return lib.current == nil || b.Frame.Closure == lib.current.Env.Closure
+}
+
+func (lib *Library) getBinding(from Locator, b *EnvBinding) {
+	if lib.local(b) {
+		if b.Boxed() {
+			lib.addInstr(from, OpLocalBox, nil, b.Frame.Index+b.Index)
+		} else {
+			lib.addInstr(from, OpLocal, nil, b.Frame.Index+b.Index)
+		}
+	} else {
+		idx, _ := lib.current.Env.Closure.Index(b)
+		if b.Boxed() {
+			lib.addInstr(from, OpEnvBox, nil, idx)
+		} else {
+			lib.addInstr(from, OpEnv, nil, idx)
+		}
+	}
+}
+
 func (lib *Library) setBinding(from Locator, b *EnvBinding) {
-	if b.Frame.Type == TypeStack {
-		lib.addInstr(from, OpLocalSet, nil, b.Frame.Index+b.Index)
+	if lib.local(b) {
+		if b.Boxed() {
+			lib.addInstr(from, OpLocalBoxSet, nil, b.Frame.Index+b.Index)
+		} else {
+			lib.addInstr(from, OpLocalSet, nil, b.Frame.Index+b.Index)
+		}
 	} else {
-		instr := lib.addInstr(from, OpEnvSet, nil, b.Frame.Index)
-		instr.J = b.Index
+		idx, _ := lib.current.Env.Closure.Index(b)
+		lib.addInstr(from, OpEnvSet, nil, idx)
+	}
+}
+
+// addBox boxes the value of the binding b if the binding is boxed.
+func (lib *Library) addBox(from Locator, b *EnvBinding) {
+	if b.Boxed() {
+		lib.addInstr(from, OpBox, nil, b.Frame.Index+b.Index)
+	}
+}
+
+// captures returns the captures of the closure. The captures tell
+// where the lambda creator finds the values of the closure's free
+// variables.
+func (lib *Library) captures(closure *EnvClosure) []Capture {
+	var result []Capture
+	for _, b := range closure.Free {
+		if lib.local(b) {
+			result = append(result, Capture{
+				Index: b.Frame.Index + b.Index,
+			})
+		} else {
+			idx, _ := lib.current.Env.Closure.Index(b)
+			result = append(result, Capture{
+				Env:   true,
+				Index: idx,
+			})
+		}
 	}
+	return result
 }
 
 type lambdaCompilation struct {
@@ -344,5 +1192,6 @@ type lambdaCompilation struct {
 	Body        []AST
 	Env         *Env
 	MaxStack    int
-	Captures    bool
+	Captures    []Capture
+	Clauses     []int
 }
@@ -1,5 +1,5 @@
 //
-// Copyright (c) 2023 Markku Rossi
+// Copyright (c) 2023-2024 Markku Rossi
 //
 // All rights reserved.
 //
@@ -71,6 +71,32 @@ var loadBuiltins = []Builtin{
 			return result, nil
 		},
 	},
+	{
+		Name:   "scheme::version-match?",
+		Args:   []string{"ref<any>", "version<any>"},
+		Return: types.Boolean,
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			version, err := parseVersion(args[1])
+			if err != nil {
+				return nil, err
+			}
+			match, err := matchVersion(args[0], version)
+			if err != nil {
+				return nil, err
+			}
+			return Boolean(match), nil
+		},
+	},
+	{
+		Name:   "scheme::with-library-lock",
+		Args:   []string{"thunk<any>"},
+		Return: types.Any,
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			scm.image.initLibraries.lock(scm)
+			defer scm.image.initLibraries.unlock()
+			return scm.Apply(args[0], nil)
+		},
+	},
 	{
 		Name: "scheme::compile",
 		Args: []string{"ast<any>"},
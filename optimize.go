@@ -0,0 +1,590 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package scheme
+
+import (
+	"github.com/markkurossi/scheme/types"
+)
+
+// optimize optimizes the library body after it is type checked. The
+// procedure definitions are collected before the body is optimized.
+// The define-constant values are recorded when their definitions are
+// optimized so they are propagated only to the references that
+// follow the definitions.
+func (lib *Library) optimize() {
+	lib.constants = make(map[*Identifier]Value)
+	lib.bindingConstants = make(map[*EnvBinding]Value)
+	lib.procedures = make(map[*Identifier]*ASTLambda)
+	lib.inlining = make(map[*ASTLambda]bool)
+	lib.optimized = make(map[*ASTLambda]bool)
+	lib.stats = lib.bodyStats
+
+	lib.collectProcedures(lib.Body)
+	lib.Body.Optimize(lib)
+}
+
+// collectProcedures records the top-level procedures that can be
+// inlined.
+func (lib *Library) collectProcedures(ast AST) {
+	switch a := ast.(type) {
+	case *ASTSequence:
+		for _, item := range a.Items {
+			lib.collectProcedures(item)
+		}
+
+	case *ASTDefine:
+		lambda, ok := a.Value.(*ASTLambda)
+		if ok {
+			lib.defineProcedure(a.Name, a.Flags, lambda)
+		}
+
+	case *ASTLambda:
+		if a.Define {
+			lib.defineProcedure(a.Name, a.Flags, a)
+		}
+	}
+}
+
+// defineProcedure records the procedure definition if the procedure
+// is defined with define-constant or if it is a library-owned
+// definition that is never assigned in the library. The importing
+// libraries can't assign the library's definitions. The other global
+// procedures can be assigned or redefined by later evaluations so
+// they are not inlined.
+func (lib *Library) defineProcedure(name *Identifier, flags Flags,
+	lambda *ASTLambda) {
+
+	if flags&FlagConst == 0 {
+		_, owned := lib.symbols[name.Name]
+		if !owned || lib.assigned[name.Name] {
+			return
+		}
+	}
+	lib.procedures[lib.intern(name.Name)] = lambda
+}
+
+// defineConstant records the value of the define-constant definition
+// if the value is an atom constant.
+func (lib *Library) defineConstant(name *Identifier, flags Flags, value AST) {
+	if flags&FlagConst == 0 {
+		return
+	}
+	c, ok := value.(*ASTConstant)
+	if ok && isAtom(c.Value) {
+		lib.constants[lib.intern(name.Name)] = c.Value
+	}
+}
+
+// bindConstant records the value of the let binding if the binding
+// is never assigned and its init is an atom constant.
+func (lib *Library) bindConstant(b *EnvBinding, init AST) {
+	if b.Assigned {
+		return
+	}
+	c, ok := init.(*ASTConstant)
+	if ok && isAtom(c.Value) {
+		lib.bindingConstants[b] = c.Value
+	}
+}
+
+// constant returns the constant value of the global symbol. The
+// symbols are constant if they are defined with define-constant in
+// this library, or if they are already bound to constant atoms.
+func (lib *Library) constant(sym *Identifier) (Value, bool) {
+	v, ok := lib.constants[sym]
+	if ok {
+		return v, true
+	}
+	v, flags := sym.global()
+	if flags&FlagConst != 0 && isAtom(v) {
+		return v, true
+	}
+	return nil, false
+}
+
+// optimizeBody optimizes the body expressions. The constants are
+// dropped from the body, except the last expression which is the
+// value of the body.
+func (lib *Library) optimizeBody(body []AST) []AST {
+	var result []AST
+	for idx, item := range body {
+		item = item.Optimize(lib)
+		_, ok := item.(*ASTConstant)
+		if ok && idx+1 < len(body) {
+			continue
+		}
+		result = append(result, item)
+	}
+	return result
+}
+
+// isAtom tests if the value is an immutable atom that can be
+// propagated to the references of its binding.
+func isAtom(v Value) bool {
+	switch v.(type) {
+	case Boolean, Character, String, Int, Float, *BigInt, *BigFloat:
+		return true
+	default:
+		return false
+	}
+}
+
+// foldUnary evaluates the inlined unary operand with a constant
+// argument. The function returns false if the argument is not
+// constant or if the evaluation would fail at runtime.
+func foldUnary(op Operand, i int, arg AST) (Value, bool) {
+	c, ok := arg.(*ASTConstant)
+	if !ok {
+		return nil, false
+	}
+	v := c.Value
+
+	var result Value
+	var err error
+
+	switch op {
+	case OpPairp:
+		_, ok := v.(Pair)
+		return Boolean(ok), true
+
+	case OpNullp:
+		return Boolean(v == nil), true
+
+	case OpNot:
+		return Boolean(!IsTrue(v)), true
+
+	case OpZerop:
+		result, err = zero(v)
+
+	case OpAddConst:
+		result, err = numAdd(v, Int(i))
+
+	case OpSubConst:
+		result, err = numSub(v, Int(i))
+
+	case OpMulConst:
+		result, err = numMul(v, Int(i))
+
+	case OpCastNumber:
+		return v, v != nil && v.Type().IsKindOf(types.Number)
+
+	case OpCastSymbol:
+		return v, v != nil && v.Type().IsA(types.Symbol)
+
+	default:
+		return nil, false
+	}
+	return result, err == nil
+}
+
+// redundantCast tests if the inlined cast operand op can be removed
+// because the type of its argument is proven.
+func redundantCast(op Operand, arg AST) bool {
+	t := provenType(arg)
+	if t == nil {
+		return false
+	}
+	switch op {
+	case OpCastNumber:
+		return t.IsKindOf(types.Number) && t.Enum != types.EnumUnspecified
+	case OpCastSymbol:
+		return t.IsA(types.Symbol)
+	default:
+		return false
+	}
+}
+
+// provenType returns the type of the values of the expression. The
+// inferred types of the lambda arguments and the let variables can
+// differ from their runtime values and the function returns nil for
+// expressions whose types depend on them.
+func provenType(ast AST) *types.Type {
+	switch a := ast.(type) {
+	case *ASTConstant:
+		if a.Value == nil {
+			return types.Nil
+		}
+		return a.Value.Type()
+
+	case *ASTCallUnary:
+		switch a.Op {
+		case OpPairp, OpNullp, OpZerop, OpNot:
+			return types.Boolean
+		case OpAddConst, OpSubConst, OpMulConst, OpCastNumber:
+			return types.Number
+		case OpCastSymbol:
+			return types.Symbol
+		}
+
+	case *ASTCall:
+		if !a.Inline {
+			return nil
+		}
+		switch a.InlineOp {
+		case OpAdd, OpSub, OpMul, OpDiv:
+			return types.Number
+		case OpEq, OpLt, OpGt, OpLe, OpGe:
+			return types.Boolean
+		}
+	}
+	return nil
+}
+
+// foldBinary evaluates the inlined binary operand with constant
+// arguments. The function returns false if the arguments are not
+// constant or if the evaluation would fail at runtime.
+func foldBinary(op Operand, arg1, arg2 AST) (Value, bool) {
+	c1, ok := arg1.(*ASTConstant)
+	if !ok {
+		return nil, false
+	}
+	c2, ok := arg2.(*ASTConstant)
+	if !ok {
+		return nil, false
+	}
+	z1 := c1.Value
+	z2 := c2.Value
+
+	var result Value
+	var err error
+
+	switch op {
+	case OpAdd:
+		result, err = numAdd(z1, z2)
+
+	case OpSub:
+		result, err = numSub(z1, z2)
+
+	case OpMul:
+		result, err = numMul(z1, z2)
+
+	case OpDiv:
+		// Division by zero is left for the runtime to report.
+		result, err = zero(z2)
+		if err != nil || IsTrue(result) {
+			return nil, false
+		}
+		result, err = numDiv(z1, z2)
+
+	case OpEq:
+		result, err = numEq(z1, z2)
+
+	case OpLt:
+		result, err = numLt(z1, z2)
+
+	case OpGt:
+		result, err = numGt(z1, z2)
+
+	case OpLe:
+		result, err = numGt(z1, z2)
+		result = Boolean(!IsTrue(result))
+
+	case OpGe:
+		result, err = numLt(z1, z2)
+		result = Boolean(!IsTrue(result))
+
+	default:
+		return nil, false
+	}
+	return result, err == nil
+}
+
+// inlineMaxSize defines the maximum number of AST nodes in the
+// procedure bodies that are inlined into their call sites.
+const inlineMaxSize = 16
+
+// inlineCall inlines the call of a known procedure into the call
+// site. The procedure must be defined before the call site, it must
+// not capture its environment, it must have only fixed arguments,
+// and its body must be a small expression. The function returns nil
+// if the call can't be inlined.
+func (lib *Library) inlineCall(call *ASTCall) AST {
+	lambda := lib.knownProcedure(call.Func)
+	if lambda == nil || lib.inlining[lambda] ||
+		len(lambda.Env.Closure.Free) > 0 ||
+		lambda.Args.Rest != nil || len(lambda.Body) != 1 ||
+		len(call.Args) != len(lambda.Args.Fixed) {
+		return nil
+	}
+	// The procedures are inlined only after their definitions so
+	// that the calls preceding them still fail at runtime.
+	if !lib.optimized[lambda] {
+		return nil
+	}
+
+	// Bind the argument types of the call site to the procedure
+	// arguments so that the inlined body is specialized for them.
+	ctx := make(types.Ctx)
+	var params, saved []*types.Type
+	for idx, arg := range call.Args {
+		params = append(params, arg.Type(ctx))
+		saved = append(saved, lambda.ArgBindings[idx].Type)
+	}
+	lambda.Parametrize(ctx, params)
+
+	inliner := &inliner{
+		base:     call.ArgFrame.Index,
+		tail:     call.Tail,
+		callee:   lambda.Env.Closure,
+		caller:   call.ArgFrame.Closure,
+		frames:   make(map[*EnvFrame]*EnvFrame),
+		bindings: make(map[*EnvBinding]*EnvBinding),
+	}
+	if len(lambda.ArgBindings) > 0 {
+		inliner.frames[lambda.ArgBindings[0].Frame] = call.ArgFrame
+	}
+	body, ok := inliner.clone(lambda.Body[0])
+
+	for idx, t := range saved {
+		lambda.ArgBindings[idx].Type = t
+	}
+	if !ok || inliner.size > inlineMaxSize {
+		return nil
+	}
+
+	// The procedure's stack is on top of the call's arguments.
+	if lib.stats != nil &&
+		inliner.base+lambda.Env.Stats.MaxStack > lib.stats.MaxStack {
+		lib.stats.MaxStack = inliner.base + lambda.Env.Stats.MaxStack
+	}
+
+	for idx, b := range lambda.ArgBindings {
+		nb, ok := inliner.bindings[b]
+		if ok {
+			lib.bindConstant(nb, call.Args[idx])
+		}
+	}
+
+	ast := &ASTInlineCall{
+		From:     call.From,
+		Lambda:   lambda,
+		ArgFrame: call.ArgFrame,
+		Args:     call.Args,
+		ArgLocs:  call.ArgLocs,
+		Body:     body,
+		Tail:     call.Tail,
+	}
+
+	lib.inlining[lambda] = true
+	defer func() {
+		lib.inlining[lambda] = false
+	}()
+
+	return ast.Optimize(lib)
+}
+
+// knownProcedure returns the lambda of the procedure call target if
+// the target is a never-assigned local procedure or a constant or
+// private global procedure of the library.
+func (lib *Library) knownProcedure(f AST) *ASTLambda {
+	id, ok := f.(*ASTIdentifier)
+	if !ok {
+		return nil
+	}
+	if id.Binding != nil {
+		if id.Binding.Assigned {
+			return nil
+		}
+		lambda, _ := id.Binding.Init.(*ASTLambda)
+		return lambda
+	}
+	return lib.procedures[id.global()]
+}
+
+// inliner copies procedure bodies into their call sites. The stack
+// frames of the procedure are relocated on top of the call site's
+// stack frames.
+type inliner struct {
+	base     int
+	tail     bool
+	callee   *EnvClosure
+	caller   *EnvClosure
+	size     int
+	frames   map[*EnvFrame]*EnvFrame
+	bindings map[*EnvBinding]*EnvBinding
+}
+
+// frame returns the relocated stack frame.
+func (in *inliner) frame(f *EnvFrame) *EnvFrame {
+	nf, ok := in.frames[f]
+	if !ok {
+		nf = &EnvFrame{
+			Type:     TypeStack,
+			Usage:    f.Usage,
+			Index:    in.base + f.Index,
+			Size:     f.Size,
+			Bindings: make(map[string]*EnvBinding),
+			Closure:  in.caller,
+		}
+		in.frames[f] = nf
+	}
+	return nf
+}
+
+// binding returns the relocated binding. The function returns false
+// if the binding is not in the procedure's stack frames.
+func (in *inliner) binding(b *EnvBinding) (*EnvBinding, bool) {
+	if b.Frame.Closure != in.callee {
+		return nil, false
+	}
+	nb, ok := in.bindings[b]
+	if !ok {
+		nb = &EnvBinding{
+			Frame: in.frame(b.Frame),
+			Index: b.Index,
+			Type:  b.Type,
+		}
+		in.bindings[b] = nb
+	}
+	return nb, true
+}
+
+// clone copies the AST for the call site. The function returns false
+// if the AST can't be inlined.
+func (in *inliner) clone(ast AST) (AST, bool) {
+	in.size++
+	if in.size > inlineMaxSize {
+		return nil, false
+	}
+
+	switch a := ast.(type) {
+	case *ASTConstant:
+		return &ASTConstant{
+			From:  a.From,
+			Value: a.Value,
+		}, true
+
+	case *ASTIdentifier:
+		result := &ASTIdentifier{
+			From:    a.From,
+			Name:    a.Name,
+			Library: a.Library,
+			Global:  a.Global,
+		}
+		if a.Binding != nil {
+			b, ok := in.binding(a.Binding)
+			if !ok || a.Binding.Assigned {
+				return nil, false
+			}
+			result.Binding = b
+		}
+		return result, true
+
+	case *ASTCallUnary:
+		arg, ok := in.clone(a.Arg)
+		if !ok {
+			return nil, false
+		}
+		return &ASTCallUnary{
+			From: a.From,
+			Op:   a.Op,
+			I:    a.I,
+			Arg:  arg,
+		}, true
+
+	case *ASTCall:
+		result := &ASTCall{
+			From:     a.From,
+			Inline:   a.Inline,
+			InlineOp: a.InlineOp,
+			Builtin:  a.Builtin,
+			ArgFrame: in.frame(a.ArgFrame),
+			ArgLocs:  a.ArgLocs,
+			Tail:     a.Tail && in.tail,
+		}
+		if !a.Inline {
+			f, ok := in.clone(a.Func)
+			if !ok {
+				return nil, false
+			}
+			result.Func = f
+		}
+		args, ok := in.cloneList(a.Args)
+		if !ok {
+			return nil, false
+		}
+		result.Args = args
+		return result, true
+
+	case *ASTInlineCall:
+		args, ok := in.cloneList(a.Args)
+		if !ok {
+			return nil, false
+		}
+		body, ok := in.clone(a.Body)
+		if !ok {
+			return nil, false
+		}
+		return &ASTInlineCall{
+			From:     a.From,
+			Lambda:   a.Lambda,
+			ArgFrame: in.frame(a.ArgFrame),
+			Args:     args,
+			ArgLocs:  a.ArgLocs,
+			Body:     body,
+			Tail:     a.Tail && in.tail,
+		}, true
+
+	case *ASTIf:
+		c, ok := in.clone(a.Cond)
+		if !ok {
+			return nil, false
+		}
+		t, ok := in.clone(a.True)
+		if !ok {
+			return nil, false
+		}
+		result := &ASTIf{
+			From: a.From,
+			Cond: c,
+			True: t,
+		}
+		if a.False != nil {
+			result.False, ok = in.clone(a.False)
+			if !ok {
+				return nil, false
+			}
+		}
+		return result, true
+
+	case *ASTAnd:
+		exprs, ok := in.cloneList(a.Exprs)
+		if !ok {
+			return nil, false
+		}
+		return &ASTAnd{
+			From:  a.From,
+			Exprs: exprs,
+		}, true
+
+	case *ASTOr:
+		exprs, ok := in.cloneList(a.Exprs)
+		if !ok {
+			return nil, false
+		}
+		return &ASTOr{
+			From:  a.From,
+			Exprs: exprs,
+		}, true
+
+	default:
+		return nil, false
+	}
+}
+
+// cloneList copies the ASTs for the call site.
+func (in *inliner) cloneList(list []AST) ([]AST, bool) {
+	var result []AST
+	for _, ast := range list {
+		c, ok := in.clone(ast)
+		if !ok {
+			return nil, false
+		}
+		result = append(result, c)
+	}
+	return result, true
+}
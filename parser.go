@@ -7,22 +7,28 @@
 package scheme
 
 import (
-	"errors"
 	"fmt"
 	"io"
+	"math"
 
 	"github.com/markkurossi/scheme/types"
 )
 
 // Parser implements the byte-code compiler.
 type Parser struct {
-	scm    *Scheme
-	source string
+	scm        *Scheme
+	source     string
+	library    *Library
+	assigned   map[string]bool
+	expansions int
 }
 
+// export defines an exported binding. The id is the definition of
+// the binding and the names are its external names.
 type export struct {
-	from Locator
-	id   *Identifier
+	from  Locator
+	id    *Identifier
+	names []string
 }
 
 // NewParser creates a new bytecode compiler.
@@ -37,14 +43,9 @@ func (p *Parser) Parse(source string, in io.Reader) (*Library, error) {
 	sexpr := NewSexprParser(source, in)
 
 	p.source = source
+	p.assigned = make(map[string]bool)
 	p.scm.Parsing = true
 
-	env := NewEnv()
-
-	// Top-level definitions are executed inside an empty lambda so
-	// push the empty argument frame.
-	env.PushFrame(TypeEnv, FUArgs, 0)
-
 	first := true
 
 	library := &Library{
@@ -52,6 +53,7 @@ func (p *Parser) Parse(source string, in io.Reader) (*Library, error) {
 		Source:   source,
 		Body:     &ASTSequence{},
 		exported: make(map[string]*export),
+		parser:   p,
 	}
 
 	for {
@@ -79,14 +81,13 @@ func (p *Parser) Parse(source string, in io.Reader) (*Library, error) {
 					return nil, err
 				}
 
-				// Compile library body.
+				// The library body is parsed when it is compiled,
+				// after its imports have been loaded.
 				for i := 4; i < len(list); i++ {
-					ast, err := p.parseValue(env, list[i], list[i].Car(), false,
-						true)
-					if err != nil {
-						return nil, err
-					}
-					library.Body.Add(ast)
+					library.forms = append(library.forms, libraryForm{
+						from:  list[i],
+						value: list[i].Car(),
+					})
 				}
 
 				// Check that the file does not have any trailing garbage
@@ -109,30 +110,63 @@ func (p *Parser) Parse(source string, in io.Reader) (*Library, error) {
 
 			// Check for top-level imports.
 			if ok && isNamedIdentifier(pair.Car(), "import") {
-				_, ok := ListPairs(v)
-				if !ok {
-					return nil, pair.Errorf("expected (import ...)")
+				err = library.parseImports(pair, pair)
+				if err != nil {
+					return nil, err
 				}
-				library.Imports, _ = Cdr(pair, true)
 				continue
 			}
 		}
 
-		ast, err := p.parseValue(env, Point{}, v, false, true)
+		library.forms = append(library.forms, libraryForm{
+			from:  Point{},
+			value: v,
+		})
+	}
+
+	return library, nil
+}
+
+// parseBody parses the library body forms into the library's AST.
+func (p *Parser) parseBody(library *Library) error {
+	p.library = library
+	err := library.checkImports()
+	if err != nil {
+		return err
+	}
+
+	env := NewEnv()
+
+	// Top-level definitions are executed inside an empty lambda so
+	// push the empty argument frame.
+	env.PushFrame(TypeStack, FUArgs, 0)
+
+	for _, form := range library.forms {
+		ast, err := p.parseValue(env, form.from, form.value, false)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		library.Body.Add(ast)
 	}
+	library.forms = nil
+	library.assigned = p.assigned
+	library.bodyStats = env.Stats
 
-	return library, nil
+	return library.defineSymbols()
 }
 
 func (p *Parser) parseValue(env *Env, loc Locator, value Value,
-	tail, captures bool) (AST, error) {
+	tail bool) (AST, error) {
 
 	switch v := value.(type) {
 	case Pair:
+		id, ok := v.Car().(*Identifier)
+		if ok {
+			m := p.lookupMacro(env, id)
+			if m != nil {
+				return p.parseMacro(env, m, v, tail)
+			}
+		}
 		list, ok := ListPairs(v)
 		if !ok {
 			return nil, v.Errorf("unexpected value: %v", v)
@@ -143,25 +177,64 @@ func (p *Parser) parseValue(env *Env, loc Locator, value Value,
 			return p.parsePragma(env, list)
 		}
 		if isKeyword(v.Car(), KwDefine) {
-			return p.parseDefine(env, list, 0, captures)
+			return p.parseDefine(env, list, 0)
 		}
 		if isKeyword(v.Car(), KwDefineConstant) {
-			return p.parseDefine(env, list, FlagConst, captures)
+			return p.parseDefine(env, list, FlagConst)
+		}
+		if isKeyword(v.Car(), KwDefineValues) {
+			return p.parseDefineValues(env, list)
+		}
+		if isKeyword(v.Car(), KwDefineConditionType) {
+			return p.parseDefineConditionType(env, list)
+		}
+		if isKeyword(v.Car(), KwDefineRecordType) {
+			return p.parseDefineRecordType(env, list)
+		}
+		if isKeyword(v.Car(), KwDefineSyntax) {
+			return p.parseDefineSyntax(env, list)
+		}
+		if isKeyword(v.Car(), KwLetSyntax) {
+			return p.parseLetSyntax(KwLetSyntax, env, list, tail)
+		}
+		if isKeyword(v.Car(), KwLetrecSyntax) {
+			return p.parseLetSyntax(KwLetrecSyntax, env, list, tail)
 		}
 		if isKeyword(v.Car(), KwLambda) {
 			return p.parseLambda(env, false, 0, list)
 		}
+		if isKeyword(v.Car(), KwCaseLambda) {
+			return p.parseCaseLambda(env, list)
+		}
 		if isKeyword(v.Car(), KwSet) {
-			return p.parseSet(env, list, captures)
+			return p.parseSet(env, list)
 		}
 		if isKeyword(v.Car(), KwLet) {
-			return p.parseLet(KwLet, env, list, tail, captures)
+			if length > 1 {
+				_, ok := isIdentifier(list[1].Car())
+				if ok {
+					return p.parseNamedLet(env, list, tail)
+				}
+			}
+			return p.parseLet(KwLet, env, list, tail)
+		}
+		if isKeyword(v.Car(), KwDo) {
+			return p.parseDo(env, list, tail)
 		}
 		if isKeyword(v.Car(), KwLetStar) {
-			return p.parseLet(KwLetStar, env, list, tail, captures)
+			return p.parseLet(KwLetStar, env, list, tail)
 		}
 		if isKeyword(v.Car(), KwLetrec) {
-			return p.parseLet(KwLetrec, env, list, tail, captures)
+			return p.parseLet(KwLetrec, env, list, tail)
+		}
+		if isKeyword(v.Car(), KwLetrecStar) {
+			return p.parseLet(KwLetrecStar, env, list, tail)
+		}
+		if isKeyword(v.Car(), KwLetValues) {
+			return p.parseLetValues(KwLetValues, env, list, tail)
+		}
+		if isKeyword(v.Car(), KwLetStarValues) {
+			return p.parseLetValues(KwLetStarValues, env, list, tail)
 		}
 		if isKeyword(v.Car(), KwBegin) {
 			seq := &ASTSequence{
@@ -169,7 +242,7 @@ func (p *Parser) parseValue(env *Env, loc Locator, value Value,
 			}
 			err := MapPairs(func(idx int, pair Pair) error {
 				ast, err := p.parseValue(env, pair, pair.Car(),
-					tail && idx+1 >= length-1, captures)
+					tail && idx+1 >= length-1)
 				if err != nil {
 					return err
 				}
@@ -182,7 +255,7 @@ func (p *Parser) parseValue(env *Env, loc Locator, value Value,
 			return seq, nil
 		}
 		if isKeyword(v.Car(), KwIf) {
-			return p.parseIf(env, list, tail, captures)
+			return p.parseIf(env, list, tail)
 		}
 		if isKeyword(v.Car(), KwQuote) {
 			if length != 2 {
@@ -192,28 +265,47 @@ func (p *Parser) parseValue(env *Env, loc Locator, value Value,
 			if !ok {
 				return nil, v.Errorf("invalid quote: %v", v)
 			}
+			quoted, _ = unalias(quoted)
 			return &ASTConstant{
 				From:  loc,
 				Value: quoted,
 			}, nil
 		}
+		if isKeyword(v.Car(), KwQuasiquote) {
+			return p.parseQuasiquote(env, list, tail)
+		}
 		if isKeyword(v.Car(), KwSchemeApply) {
 			if length != 3 {
 				return nil, v.Errorf("invalid scheme::apply: %v", v)
 			}
-			return p.parseApply(env, v, tail, captures)
+			return p.parseApply(env, v, tail)
 		}
 		if isKeyword(v.Car(), KwCond) {
-			return p.parseCond(env, list, tail, captures)
+			return p.parseCond(env, list, tail)
 		}
 		if isKeyword(v.Car(), KwCase) {
-			return p.parseCase(env, list, tail, captures)
+			return p.parseCase(env, list, tail)
 		}
 		if isKeyword(v.Car(), KwAnd) {
-			return p.parseAnd(env, list, tail, captures)
+			return p.parseAnd(env, list, tail)
 		}
 		if isKeyword(v.Car(), KwOr) {
-			return p.parseOr(env, list, tail, captures)
+			return p.parseOr(env, list, tail)
+		}
+		if isKeyword(v.Car(), KwGuard) {
+			return p.parseGuard(env, list, tail)
+		}
+		if isKeyword(v.Car(), KwSyntaxCase) {
+			return p.parseSyntaxCase(env, list, tail)
+		}
+		if isKeyword(v.Car(), KwSyntax) {
+			return p.parseSyntax(env, list, tail)
+		}
+		if isKeyword(v.Car(), KwQuasisyntax) {
+			return p.parseQuasisyntax(env, list, tail)
+		}
+		if isKeyword(v.Car(), KwWithSyntax) {
+			return p.parseWithSyntax(env, list, tail)
 		}
 
 		// Function call.
@@ -226,8 +318,7 @@ func (p *Parser) parseValue(env *Env, loc Locator, value Value,
 				Op:   inlineOp,
 				I:    inlineI,
 			}
-			arg, err := p.parseValue(env, list[1], list[1].Car(), false,
-				captures)
+			arg, err := p.parseValue(env, list[1], list[1].Car(), false)
 			if err != nil {
 				return nil, err
 			}
@@ -245,6 +336,8 @@ func (p *Parser) parseValue(env *Env, loc Locator, value Value,
 		if ok {
 			ast.Inline = true
 			ast.InlineOp = inlineOp
+		} else {
+			ast.Builtin, ast.InlineOp = p.builtin(env, list)
 		}
 		if tail && length == 1 && false {
 			fmt.Printf("parseValue: call, tail=%v\n", tail)
@@ -257,7 +350,7 @@ func (p *Parser) parseValue(env *Env, loc Locator, value Value,
 
 		if !ast.Inline {
 			// Compile function.
-			a, err := p.parseValue(env, list[0], list[0].Car(), false, captures)
+			a, err := p.parseValue(env, list[0], list[0].Car(), false)
 			if err != nil {
 				return nil, err
 			}
@@ -272,8 +365,7 @@ func (p *Parser) parseValue(env *Env, loc Locator, value Value,
 
 		// Evaluate arguments.
 		for i := 1; i < len(list); i++ {
-			a, err := p.parseValue(lambdaEnv, list[i], list[i].Car(), false,
-				captures)
+			a, err := p.parseValue(lambdaEnv, list[i], list[i].Car(), false)
 			if err != nil {
 				return nil, err
 			}
@@ -284,16 +376,22 @@ func (p *Parser) parseValue(env *Env, loc Locator, value Value,
 		return ast, nil
 
 	case *Identifier:
-		var sym *Identifier
-		binding, ok := env.Lookup(v.Name)
-		if !ok {
-			sym = p.scm.Intern(v.Name)
+		var lib *Library
+		binding, name := lookupBinding(env.Frames, v)
+		if binding != nil {
+			env.Capture(binding)
+		} else {
+			var err error
+			name, lib, err = p.globalName(loc, v, name)
+			if err != nil {
+				return nil, err
+			}
 		}
 		return &ASTIdentifier{
 			From:    loc,
-			Name:    v.Name,
+			Name:    name,
 			Binding: binding,
-			Global:  sym,
+			Library: lib,
 		}, nil
 
 	case Keyword:
@@ -303,7 +401,8 @@ func (p *Parser) parseValue(env *Env, loc Locator, value Value,
 		// Vector literals must be quoted like list constants.
 		return nil, loc.Errorf("invalid syntax: %v", v)
 
-	case Bytevector, Boolean, String, Character, Int, Float, *BigInt, *BigFloat:
+	case Bytevector, Boolean, String, Character, Int, Float, *BigInt, *BigFloat,
+		*Syntax:
 		return &ASTConstant{
 			From:  loc,
 			Value: v,
@@ -332,26 +431,28 @@ var inlineUnaryBinary = map[string]Operand{
 }
 
 func (p *Parser) inlineUnary(env *Env, list []Pair) (bool, Operand, int) {
-	id, ok := list[0].Car().(*Identifier)
+	name, ok := p.inlineName(env, list[0])
 	if !ok {
 		return false, 0, 0
 	}
 
 	switch len(list) {
 	case 2:
-		op, ok := inlineUnary[id.Name]
+		op, ok := inlineUnary[name]
 		if !ok {
 			return false, 0, 0
 		}
 		return true, op, 0
 
 	case 3:
-		op, ok := inlineUnaryBinary[id.Name]
+		op, ok := inlineUnaryBinary[name]
 		if !ok {
 			return false, 0, 0
 		}
+		// The instruction encoding holds 32-bit immediate operands;
+		// other values use the constant pool and the binary operand.
 		iv, ok := list[2].Car().(Int)
-		if !ok {
+		if !ok || iv < math.MinInt32 || iv > math.MaxInt32 {
 			return false, 0, 0
 		}
 		return true, op, int(iv)
@@ -379,11 +480,11 @@ func (p *Parser) inlineBinary(env *Env, list []Pair) (bool, Operand) {
 	if len(list) != 3 {
 		return false, 0
 	}
-	id, ok := list[0].Car().(*Identifier)
+	name, ok := p.inlineName(env, list[0])
 	if !ok {
 		return false, 0
 	}
-	op, ok := inlineBinary[id.Name]
+	op, ok := inlineBinary[name]
 	if !ok {
 		return false, 0
 	}
@@ -391,6 +492,92 @@ func (p *Parser) inlineBinary(env *Env, list []Pair) (bool, Operand) {
 	return true, op
 }
 
+// builtinOps define the built-in procedures whose calls are compiled
+// into instructions when the type checker proves the types of their
+// arguments.
+var builtinOps = map[string]Operand{
+	"vector-ref": OpVectorRef,
+	"string-ref": OpStringRef,
+}
+
+func (p *Parser) builtin(env *Env, list []Pair) (bool, Operand) {
+	if len(list) != 3 {
+		return false, 0
+	}
+	name, ok := p.inlineName(env, list[0])
+	if !ok {
+		return false, 0
+	}
+	op, ok := builtinOps[name]
+	if !ok {
+		return false, 0
+	}
+	return true, op
+}
+
+// isInlined tests if the calls of the global name are inlined.
+func isInlined(name string) bool {
+	_, ok := inlineUnary[name]
+	if !ok {
+		_, ok = inlineBinary[name]
+	}
+	if !ok {
+		_, ok = builtinOps[name]
+	}
+	return ok
+}
+
+// inlineName returns the global name of the called function value in
+// the call's car. Macro expansion aliases are resolved to their
+// original names unless the expansion binds them, and the imported
+// names are resolved to their names in the imported libraries.
+func (p *Parser) inlineName(env *Env, pair Pair) (string, bool) {
+	id, ok := pair.Car().(*Identifier)
+	if !ok {
+		return "", false
+	}
+	name := id.Name
+	if id.alias != nil {
+		var binding *EnvBinding
+		binding, name = lookupBinding(env.Frames, id)
+		if binding != nil {
+			return "", false
+		}
+	}
+	name, lib, err := p.globalName(pair, id, name)
+	if err != nil || (lib != nil && lib.binding(name) != nil) {
+		return "", false
+	}
+	return name, true
+}
+
+// globalName resolves the global symbol name of the identifier id
+// that is not bound in the environment. The name is resolved in the
+// library that defines the identifier's scope: the identifiers that
+// macro expansions introduce are resolved in the library of the
+// macro definition, and all other identifiers in the library being
+// compiled. The imported names are resolved with the import sets of
+// the library. The function returns the resolved name and the scope
+// library.
+func (p *Parser) globalName(loc Locator, id *Identifier, name string) (
+	string, *Library, error) {
+
+	lib := p.library
+	for ; id.alias != nil; id = id.alias.orig {
+		if id.alias.library != nil {
+			lib = id.alias.library
+		}
+	}
+	if lib == nil {
+		return name, nil, nil
+	}
+	name, err := lib.resolveImport(loc, name)
+	if err != nil {
+		return "", nil, err
+	}
+	return name, lib, nil
+}
+
 func (p *Parser) parsePragma(env *Env, list []Pair) (AST, error) {
 	ast := &ASTPragma{
 		From: list[0],
@@ -406,8 +593,7 @@ func (p *Parser) parsePragma(env *Env, list []Pair) (AST, error) {
 	return ast, nil
 }
 
-func (p *Parser) parseDefine(env *Env, list []Pair, flags Flags,
-	captures bool) (AST, error) {
+func (p *Parser) parseDefine(env *Env, list []Pair, flags Flags) (AST, error) {
 
 	if len(list) < 3 {
 		return nil, list[0].Errorf("syntax error: %v", list[0])
@@ -415,7 +601,9 @@ func (p *Parser) parseDefine(env *Env, list []Pair, flags Flags,
 	// (define name value)
 	name, ok := isIdentifier(list[1].Car())
 	if ok {
-		ast, err := p.parseValue(env, list[2], list[2].Car(), false, captures)
+		name = unaliasIdentifier(name)
+		p.addDefinition(list[1], name.Name)
+		ast, err := p.parseValue(env, list[2], list[2].Car(), false)
 		if err != nil {
 			return nil, err
 		}
@@ -431,6 +619,45 @@ func (p *Parser) parseDefine(env *Env, list []Pair, flags Flags,
 	return p.parseLambda(env, true, flags, list)
 }
 
+// addDefinition records the global definition of the name.
+func (p *Parser) addDefinition(loc Locator, name string) {
+	if p.library != nil {
+		p.library.addDefinition(loc, name)
+	}
+}
+
+func (p *Parser) parseDefineValues(env *Env, list []Pair) (AST, error) {
+
+	// (define-values formals value)
+	if len(list) != 3 {
+		return nil, list[0].Errorf("syntax error: %v", list[0])
+	}
+	formals, err := p.parseFormals(list[1], list[1].Car())
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range formals.Names() {
+		p.addDefinition(list[1], name)
+	}
+
+	ast := &ASTDefineValues{
+		From:    list[1],
+		Formals: formals,
+	}
+
+	// Push value scope.
+	ast.ValueFrame = env.PushFrame(TypeStack, FUValue, 1)
+
+	ast.Value, err = p.parseValue(env, list[2], list[2].Car(), false)
+	if err != nil {
+		return nil, err
+	}
+
+	env.PopFrame()
+
+	return ast, nil
+}
+
 type seen map[string]bool
 
 func newSeen() seen {
@@ -448,6 +675,14 @@ func (seen seen) add(name string) error {
 
 func (p *Parser) parseLambda(env *Env, define bool, flags Flags,
 	list []Pair) (AST, error) {
+	return p.parseClosure(env.Enclose(), define, flags, list)
+}
+
+// parseClosure parses the lambda expression in the lambda's
+// environment env. The env is created with Env.Enclose and it
+// collects the free variables that the lambda references.
+func (p *Parser) parseClosure(env *Env, define bool, flags Flags,
+	list []Pair) (AST, error) {
 
 	// (define (name args?) body)
 	// (lambda (args?) body)
@@ -457,140 +692,44 @@ func (p *Parser) parseLambda(env *Env, define bool, flags Flags,
 	}
 
 	var name *Identifier
-	var args Args
-
-	seen := newSeen()
-
-	arg, ok := isIdentifier(list[1].Car())
-	if ok {
-		if define {
-			return nil, list[1].Errorf("invalid define: %v", list[0])
-		}
-		err := seen.add(arg.Name)
-		if err != nil {
-			return nil, list[1].Errorf("%v", err)
-		}
-		args.Rest = &TypedName{
-			Name: arg.Name,
-			Type: types.Unspecified,
-		}
-	} else {
-		var pair Pair
-		if list[1].Car() != nil {
-			pair, ok = list[1].Car().(Pair)
-			if !ok {
-				return nil, list[0].Errorf("invalid arguments: %v",
-					list[1].Car())
-			}
-		}
-		for pair != nil {
-			arg, ok = isIdentifier(pair.Car())
-			if !ok {
-				return nil, pair.Errorf("invalid argument: %v", pair.Car())
-			}
-			if define && name == nil {
-				name = arg
-			} else {
-				err := seen.add(arg.Name)
-				if err != nil {
-					return nil, pair.Errorf("%v", err)
-				}
-				args.Fixed = append(args.Fixed, &TypedName{
-					Name: arg.Name,
-					Type: types.Unspecified,
-				})
-			}
-
-			arg, ok = isIdentifier(pair.Cdr())
-			if ok {
-				// Rest arguments.
-				err := seen.add(arg.Name)
-				if err != nil {
-					return nil, fmt.Errorf("%s: %v", pair.To(), err)
-				}
-				args.Rest = &TypedName{
-					Name: arg.Name,
-					Type: types.Unspecified,
-				}
-				break
-			}
-			if pair.Cdr() == nil {
-				pair = nil
-			} else {
-				next, ok := pair.Cdr().(Pair)
-				if !ok {
-					return nil, pair.Errorf("invalid argument: %v", pair)
-				}
-				pair = next
-			}
-		}
-	}
-	args.Init()
-
-	if define && name == nil {
-		return nil, list[0].Errorf("define: name not defined: %v", list[0])
-	}
-
-	// Check if the lambda captures the environment.
-	var lambdas int
-	var checkLambda func(idx int, p Pair) error
 
-	var ErrNext = errors.New("next")
-
-	checkLambda = func(idx int, p Pair) error {
-		if idx == 0 && (isKeyword(p.Car(), KwLambda) ||
-			isKeyword(p.Car(), KwDefine)) {
-			lambdas++
-			return ErrNext
+	formals := list[1].Car()
+	if define {
+		pair, ok := formals.(Pair)
+		if !ok {
+			return nil, list[0].Errorf("invalid arguments: %v", formals)
 		}
-		car, ok := p.Car().(Pair)
+		name, ok = isIdentifier(pair.Car())
 		if !ok {
-			return nil
+			return nil, pair.Errorf("invalid argument: %v", pair.Car())
 		}
-		return MapPairs(checkLambda, car)
+		name = unaliasIdentifier(name)
+		formals = pair.Cdr()
+		p.addDefinition(pair, name.Name)
 	}
-
-	body := list[2:]
-	for _, pair := range body {
-		MapPairs(checkLambda, pair)
+	args, err := p.parseFormals(list[0], formals)
+	if err != nil {
+		return nil, err
 	}
-	captures := lambdas > 0
-
-	// The environment (below) is converted to lambda capture:
-	//
-	//     0: let-frame-m
-	//        ...
-	//   n-1: let-frame-0
-	//     n: ctx-function-args
-	//
-	// The final lambda environment (scope) is as follows. The lambda
-	// argument frame is at the top of the capture environment:
-	//
-	//     0: lambda-args
-	//     1: let-frame-m
-	//        ...
-	//   n-1: let-frame-0
-	//     n: ctx-function-args
 
 	numArgs := len(args.Fixed)
 	if args.Rest != nil {
 		numArgs++
 	}
 
-	capture := env.CopyEnvFrames()
-	capture.PushCaptureFrame(captures, FUArgs, numArgs)
+	env.PushFrame(TypeStack, FUArgs, numArgs)
 
 	var argBindings []*EnvBinding
 
 	for _, arg := range args.Fixed {
-		b, err := capture.Define(arg.Name, types.Unspecified)
+		b, err := env.Define(arg.Name, types.Unspecified)
 		if err != nil {
 			return nil, err
 		}
 		argBindings = append(argBindings, b)
 	}
 	if args.Rest != nil {
-		b, err := capture.Define(args.Rest.Name, &types.Type{
+		b, err := env.Define(args.Rest.Name, &types.Type{
 			Enum: types.EnumPair,
 			Car:  types.Unspecified,
 			Cdr:  types.Any,
@@ -606,25 +745,114 @@ func (p *Parser) parseLambda(env *Env, define bool, flags Flags,
 		Name:        name,
 		Args:        args,
 		ArgBindings: argBindings,
-		Env:         capture,
-		Captures:    captures,
+		Env:         env,
 		Define:      define,
 		Flags:       flags,
 	}
 
-	for i := 2; i < len(list); i++ {
-		a, err := p.parseValue(capture, list[i], list[i].Car(),
-			i+1 >= len(list), captures)
+	ast.Body, err = p.parseInternalBody(env, list[2:], true)
+	if err != nil {
+		return nil, err
+	}
+
+	return ast, nil
+}
+
+func (p *Parser) parseCaseLambda(env *Env, list []Pair) (AST, error) {
+	// (case-lambda (formals body...)...)
+	// The clauses share the closure of the case-lambda.
+	if len(list) < 2 {
+		return nil, list[0].Errorf("case-lambda: no clauses")
+	}
+	closure := env.Enclose()
+
+	ast := &ASTCaseLambda{
+		From: list[0],
+		Env:  closure,
+	}
+	for _, clause := range list[1:] {
+		l, ok := ListPairs(clause.Car())
+		if !ok || len(l) < 2 {
+			return nil, clause.Errorf("case-lambda: invalid clause: %v",
+				clause.Car())
+		}
+		lambda, err := p.parseClosure(closure.Copy(), false, 0,
+			append([]Pair{clause}, l...))
 		if err != nil {
 			return nil, err
 		}
-		ast.Body = append(ast.Body, a)
+		ast.Clauses = append(ast.Clauses, lambda.(*ASTLambda))
 	}
-
 	return ast, nil
 }
 
-func (p *Parser) parseSet(env *Env, list []Pair, captures bool) (AST, error) {
+// parseFormals parses the formal arguments of a lambda expression:
+// (arg...), (arg... . rest), or rest.
+func (p *Parser) parseFormals(loc Locator, formals Value) (Args, error) {
+	var args Args
+
+	seen := newSeen()
+
+	arg, ok := isIdentifier(formals)
+	if ok {
+		args.Rest = &TypedName{
+			Name: arg.Name,
+			Type: types.Unspecified,
+		}
+		args.Init()
+		return args, nil
+	}
+
+	var pair Pair
+	if formals != nil {
+		pair, ok = formals.(Pair)
+		if !ok {
+			return args, loc.Errorf("invalid arguments: %v", formals)
+		}
+	}
+	for pair != nil {
+		arg, ok = isIdentifier(pair.Car())
+		if !ok {
+			return args, pair.Errorf("invalid argument: %v", pair.Car())
+		}
+		err := seen.add(arg.Name)
+		if err != nil {
+			return args, pair.Errorf("%v", err)
+		}
+		args.Fixed = append(args.Fixed, &TypedName{
+			Name: arg.Name,
+			Type: types.Unspecified,
+		})
+
+		arg, ok = isIdentifier(pair.Cdr())
+		if ok {
+			// Rest arguments.
+			err := seen.add(arg.Name)
+			if err != nil {
+				return args, fmt.Errorf("%s: %v", pair.To(), err)
+			}
+			args.Rest = &TypedName{
+				Name: arg.Name,
+				Type: types.Unspecified,
+			}
+			break
+		}
+		if pair.Cdr() == nil {
+			pair = nil
+		} else {
+			next, ok := pair.Cdr().(Pair)
+			if !ok {
+				return args, pair.Errorf("invalid argument: %v", pair)
+			}
+			pair = next
+		}
+	}
+	args.Init()
+
+	return args, nil
+}
+
+func (p *Parser) parseSet(env *Env, list []Pair) (AST, error) {
 	// (set! name value)
 	if len(list) != 3 {
 		return nil, list[0].Errorf("syntax error: %v", list[0])
@@ -634,23 +862,39 @@ func (p *Parser) parseSet(env *Env, list []Pair, captures bool) (AST, error) {
 		return nil, list[1].Errorf("set!: expected variable name: %v",
 			list[1].Car())
 	}
-	ast, err := p.parseValue(env, list[2], list[2].Car(), false, captures)
+	ast, err := p.parseValue(env, list[2], list[2].Car(), false)
 	if err != nil {
 		return nil, err
 	}
 
-	binding, _ := env.Lookup(name.Name)
+	binding, global := lookupBinding(env.Frames, name)
+	if binding != nil {
+		binding.Assigned = true
+		env.Capture(binding)
+	} else {
+		var lib *Library
+		global, lib, err = p.globalName(list[1], name, global)
+		if err != nil {
+			return nil, err
+		}
+		if lib != nil && lib.symbols[global] == nil &&
+			lib.imported[global] != nil {
+			return nil, list[1].Errorf(
+				"set!: can't assign imported variable '%s'", global)
+		}
+		p.assigned[global] = true
+	}
 
 	return &ASTSet{
 		From:    list[1],
-		Name:    name.Name,
+		Name:    global,
 		Binding: binding,
 		Value:   ast,
 	}, nil
 }
 
 func (p *Parser) parseLet(kind Keyword, env *Env, list []Pair,
-	tail, captures bool) (AST, error) {
+	tail bool) (AST, error) {
 
 	if len(list) < 3 {
 		return nil, list[0].Errorf("%s: missing bindings or body", kind)
@@ -661,11 +905,8 @@ func (p *Parser) parseLet(kind Keyword, env *Env, list []Pair,
 			kind, list[1].Car())
 	}
 
-	// XXX check if the let inits or body captures and use that as the
-	// capture flag.
-
 	letEnv := env.Copy()
-	letEnv.PushCaptureFrame(captures, FULet, len(bindings))
+	letEnv.PushFrame(TypeStack, FULet, len(bindings))
 
 	var letBindings []*EnvBinding
 
@@ -682,17 +923,18 @@ func (p *Parser) parseLet(kind Keyword, env *Env, list []Pair,
 		if err != nil {
 			return nil, err
 		}
-		if kind != KwLetrec {
+		if kind == KwLetrec || kind == KwLetrecStar {
+			b.Letrec = true
+		} else {
 			b.Disabled = true
 		}
 		letBindings = append(letBindings, b)
 	}
 
 	ast := &ASTLet{
-		From:     list[0],
-		Kind:     kind,
-		Captures: captures,
-		Tail:     tail,
+		From: list[0],
+		Kind: kind,
+		Tail: tail,
 	}
 
 	for idx, binding := range bindings {
@@ -701,8 +943,7 @@ func (p *Parser) parseLet(kind Keyword, env *Env, list []Pair,
 			return nil, list[1].Errorf("%s: invalid init: %v", kind, binding)
 		}
 
-		initAst, err := p.parseValue(letEnv, def[1], def[1].Car(), false,
-			captures)
+		initAst, err := p.parseValue(letEnv, def[1], def[1].Car(), false)
 		if err != nil {
 			return nil, err
 		}
@@ -716,6 +957,12 @@ func (p *Parser) parseLet(kind Keyword, env *Env, list []Pair,
 		switch kind {
 		case KwLetStar:
 			letBindings[idx].Disabled = false
+
+		case KwLetrec, KwLetrecStar:
+			lambda, ok := initAst.(*ASTLambda)
+			if ok {
+				letBindings[idx].Init = lambda
+			}
 		}
 	}
 
@@ -726,42 +973,439 @@ func (p *Parser) parseLet(kind Keyword, env *Env, list []Pair,
 	}
 
 	// Compile body.
-	for i := 2; i < len(list); i++ {
-		bodyAst, err := p.parseValue(letEnv, list[i], list[i].Car(),
-			tail && i+1 >= len(list), captures)
-		if err != nil {
-			return nil, err
-		}
-		ast.Body = append(ast.Body, bodyAst)
+	body, err := p.parseInternalBody(letEnv, list[2:], tail)
+	if err != nil {
+		return nil, err
 	}
+	ast.Body = body
 
 	return ast, nil
 }
 
-func (p *Parser) parseIf(env *Env, list []Pair,
-	tail, captures bool) (AST, error) {
+// bodyForm is a form of a body. The depth is the number of macro
+// expansions that produced the form.
+type bodyForm struct {
+	loc   Locator
+	value Value
+	depth int
+}
 
-	if len(list) < 3 || len(list) > 4 {
-		return nil, list[0].Errorf("if: syntax error")
-	}
+// bodyDefinition is an internal definition of a body. The record is
+// the record name of record-type descriptor definitions.
+type bodyDefinition struct {
+	loc     Locator
+	binding *EnvBinding
+	value   Value
+	record  *Identifier
+	parent  bool
+}
 
-	ast := &ASTIf{
-		From: list[0],
-	}
-	a, err := p.parseValue(env, list[1], list[1].Car(), false, captures)
-	if err != nil {
-		return nil, err
-	}
-	ast.Cond = a
+// parseInternalBody parses the body of lambda and let expressions.
+// The internal definitions at the beginning of the body are compiled
+// into letrec* bindings:
+//
+//	(letrec* ((name value)...) expr...)
+//
+// The body is scanned before it is parsed: the begin forms are
+// spliced into the body and the macro uses are expanded to find the
+// definitions they produce. The internal syntax definitions define
+// their macros in the frame of the letrec* bindings.
+func (p *Parser) parseInternalBody(env *Env, body []Pair,
+	tail bool) ([]AST, error) {
 
-	a, err = p.parseValue(env, list[2], list[2].Car(), tail, captures)
-	if err != nil {
-		return nil, err
-	}
+	// The size of the frame is known after the body is scanned.
+	bodyEnv := env.Copy()
+	frame := bodyEnv.PushFrame(TypeStack, FULet, 0)
+
+	var defs []*bodyDefinition
+	var exprs []bodyForm
+
+	define := func(loc Locator, name *Identifier, value Value) (
+		*bodyDefinition, error) {
+
+		if len(exprs) > 0 {
+			return nil, loc.Errorf("definition after expression: %v", name)
+		}
+		b, err := bodyEnv.Define(name.Name, types.Unspecified)
+		if err != nil {
+			return nil, loc.Errorf("%v", err)
+		}
+		b.Letrec = true
+		def := &bodyDefinition{
+			loc:     loc,
+			binding: b,
+			value:   value,
+		}
+		defs = append(defs, def)
+		return def, nil
+	}
+
+	var forms []bodyForm
+	for _, pair := range body {
+		forms = append(forms, bodyForm{
+			loc:   pair,
+			value: pair.Car(),
+		})
+	}
+	for len(forms) > 0 {
+		form := forms[0]
+		forms = forms[1:]
+
+		pair, ok := form.value.(Pair)
+		if !ok {
+			exprs = append(exprs, form)
+			continue
+		}
+		id, ok := pair.Car().(*Identifier)
+		if ok {
+			m := p.lookupMacro(bodyEnv, id)
+			if m != nil {
+				if form.depth >= maxExpansionDepth {
+					return nil, pair.Errorf("%s: macro expansion too deep",
+						m.Name)
+				}
+				expanded, loc, err := p.expandMacro(bodyEnv, m, pair)
+				if err != nil {
+					return nil, err
+				}
+				forms = append([]bodyForm{{
+					loc:   loc,
+					value: expanded,
+					depth: form.depth + 1,
+				}}, forms...)
+				continue
+			}
+		}
+		list, ok := ListPairs(pair)
+		if !ok {
+			exprs = append(exprs, form)
+			continue
+		}
+
+		switch {
+		case isKeyword(pair.Car(), KwBegin):
+			var spliced []bodyForm
+			for _, item := range list[1:] {
+				spliced = append(spliced, bodyForm{
+					loc:   item,
+					value: item.Car(),
+					depth: form.depth,
+				})
+			}
+			forms = append(spliced, forms...)
+
+		case isKeyword(pair.Car(), KwDefine):
+			// (define name value)
+			// (define (name args?) body)
+			if len(list) < 3 {
+				return nil, list[0].Errorf("syntax error: %v", list[0])
+			}
+			name, ok := isIdentifier(list[1].Car())
+			if ok {
+				_, err := define(list[1], name, list[2].Car())
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			spec, ok := list[1].Car().(Pair)
+			if ok {
+				name, ok = isIdentifier(spec.Car())
+			}
+			if !ok {
+				return nil, list[1].Errorf("invalid arguments: %v",
+					list[1].Car())
+			}
+			lambda := []Value{KwLambda, spec.Cdr()}
+			for _, b := range list[2:] {
+				lambda = append(lambda, b.Car())
+			}
+			_, err := define(list[1], name, newList(list[0], lambda...))
+			if err != nil {
+				return nil, err
+			}
+
+		case isKeyword(pair.Car(), KwDefineValues):
+			// (define-values formals value) is compiled into
+			// definitions that take their values from the list of
+			// the values:
+			//
+			//   (define tmp
+			//     (call-with-values (lambda () value)
+			//       (lambda formals (list arg...))))
+			//   (define arg (list-ref tmp idx))...
+			if len(list) != 3 {
+				return nil, list[0].Errorf("syntax error: %v", list[0])
+			}
+			formals, err := p.parseFormals(list[1], list[1].Car())
+			if err != nil {
+				return nil, err
+			}
+			loc := list[1]
+			var args []Value
+			for _, arg := range formals.Fixed {
+				args = append(args, &Identifier{
+					Name:  arg.Name,
+					Point: loc.From(),
+				})
+			}
+			var rest Value
+			all := args
+			if formals.Rest != nil {
+				rest = &Identifier{
+					Name:  formals.Rest.Name,
+					Point: loc.From(),
+				}
+				all = append(all, rest)
+			}
+			tmp := p.temporary(loc, "values")
+			_, err = define(loc, tmp, newList(loc,
+				p.globalIdentifier(loc, "call-with-values"),
+				newList(loc, KwLambda, nil, list[2].Car()),
+				newList(loc, KwLambda, newListTail(loc, rest, args...),
+					newList(loc, append([]Value{
+						p.globalIdentifier(loc, "list"),
+					}, all...)...))))
+			if err != nil {
+				return nil, err
+			}
+			for idx, arg := range all {
+				_, err = define(loc, arg.(*Identifier), newList(loc,
+					p.globalIdentifier(loc, "list-ref"), tmp, Int(idx)))
+				if err != nil {
+					return nil, err
+				}
+			}
+
+		case isKeyword(pair.Car(), KwDefineRecordType):
+			name, rtd, parent, procs, err := p.recordTypeDefinitions(list)
+			if err != nil {
+				return nil, err
+			}
+			def, err := define(list[1], name, rtd)
+			if err != nil {
+				return nil, err
+			}
+			def.record = name
+			def.parent = parent
+
+			var spliced []bodyForm
+			for _, proc := range procs {
+				spliced = append(spliced, bodyForm{
+					loc:   list[0],
+					value: proc,
+					depth: form.depth,
+				})
+			}
+			forms = append(spliced, forms...)
+
+		case isKeyword(pair.Car(), KwDefineSyntax):
+			if len(exprs) > 0 {
+				return nil, list[0].Errorf(
+					"definition after expression: %v", pair)
+			}
+			_, err := p.parseDefineSyntax(bodyEnv, list)
+			if err != nil {
+				return nil, err
+			}
+
+		default:
+			exprs = append(exprs, form)
+		}
+	}
+	if len(exprs) == 0 {
+		return nil, body[len(body)-1].Errorf("no expressions in body")
+	}
+
+	if len(defs) == 0 {
+		// The body without definitions does not need the frame for
+		// the bindings. The frame holds only the internal syntax
+		// definitions.
+		frame.Type = TypeMacro
+		return p.parseBodyExprs(bodyEnv, exprs, tail)
+	}
+	bodyEnv.ResizeFrame(len(defs))
+
+	ast := &ASTLet{
+		From: body[0],
+		Kind: KwLetrecStar,
+		Tail: tail,
+	}
+	for _, def := range defs {
+		init, err := p.parseValue(bodyEnv, def.loc, def.value, false)
+		if err != nil {
+			return nil, err
+		}
+		if def.record != nil {
+			init = p.recordTypeValue(def.loc, def.record, init, def.parent)
+		}
+		lambda, ok := init.(*ASTLambda)
+		if ok {
+			def.binding.Init = lambda
+		}
+		ast.Bindings = append(ast.Bindings, &ASTLetBinding{
+			From:    def.loc,
+			Binding: def.binding,
+			Init:    init,
+		})
+	}
+	result, err := p.parseBodyExprs(bodyEnv, exprs, tail)
+	if err != nil {
+		return nil, err
+	}
+	ast.Body = result
+
+	return []AST{ast}, nil
+}
+
+// parseBodyExprs parses the expressions of a body. The last
+// expression is in the tail position if the body is.
+func (p *Parser) parseBodyExprs(env *Env, exprs []bodyForm,
+	tail bool) ([]AST, error) {
+
+	var result []AST
+	for idx, expr := range exprs {
+		ast, err := p.parseValue(env, expr.loc, expr.value,
+			tail && idx+1 >= len(exprs))
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, ast)
+	}
+	return result, nil
+}
+
+func (p *Parser) parseNamedLet(env *Env, list []Pair,
+	tail bool) (AST, error) {
+
+	// (let name ((var init)...) body...)
+	if len(list) < 4 {
+		return nil, list[0].Errorf("let: missing bindings or body")
+	}
+	name, ok := isIdentifier(list[1].Car())
+	if !ok {
+		return nil, list[1].Errorf("let: invalid name: %v", list[1].Car())
+	}
+	bindings, ok := ListPairs(list[2].Car())
+	if !ok {
+		return nil, list[2].Errorf("let: invalid bindings: %v",
+			list[2].Car())
+	}
+
+	// The named let is compiled into a letrec-bound lambda which is
+	// called with the inits:
+	//
+	//   ((letrec ((name (lambda (var...) body...))) name) init...)
+	//
+	// The tail-calls of name are compiled into jumps to the beginning
+	// of the lambda.
+	loc := list[0]
+	var vars []Value
+	call := []Value{nil}
+	for _, binding := range bindings {
+		def, ok := ListValues(binding.Car())
+		if !ok || len(def) != 2 {
+			return nil, binding.Errorf("let: invalid init: %v",
+				binding.Car())
+		}
+		vars = append(vars, def[0])
+		call = append(call, def[1])
+	}
+	lambda := []Value{KwLambda, newList(loc, vars...)}
+	for _, b := range list[3:] {
+		lambda = append(lambda, b.Car())
+	}
+	call[0] = newList(loc, KwLetrec,
+		newList(loc, newList(loc, name, newList(loc, lambda...))),
+		name)
+
+	return p.parseValue(env, loc, newList(loc, call...), tail)
+}
+
+func (p *Parser) parseDo(env *Env, list []Pair,
+	tail bool) (AST, error) {
+
+	// (do ((var init step)...) (test expr...) command...)
+	if len(list) < 3 {
+		return nil, list[0].Errorf("do: missing bindings or test")
+	}
+	bindings, ok := ListPairs(list[1].Car())
+	if !ok {
+		return nil, list[1].Errorf("do: invalid bindings: %v",
+			list[1].Car())
+	}
+	exit, ok := ListValues(list[2].Car())
+	if !ok || len(exit) == 0 {
+		return nil, list[2].Errorf("do: invalid test: %v", list[2].Car())
+	}
+
+	// The do loop is compiled into a named let:
+	//
+	//   (let loop ((var init)...)
+	//     (if test
+	//         (begin expr...)
+	//         (begin command... (loop step...))))
+	loc := list[0]
+	loop := p.temporary(loc, "do")
+
+	var inits []Value
+	steps := []Value{loop}
+	for _, binding := range bindings {
+		def, ok := ListValues(binding.Car())
+		if !ok || len(def) < 2 || len(def) > 3 {
+			return nil, binding.Errorf("do: invalid binding: %v",
+				binding.Car())
+		}
+		inits = append(inits, newList(binding, def[0], def[1]))
+		if len(def) == 3 {
+			steps = append(steps, def[2])
+		} else {
+			steps = append(steps, def[0])
+		}
+	}
+
+	var result Value
+	if len(exit) > 1 {
+		result = newList(list[2], append([]Value{KwBegin}, exit[1:]...)...)
+	} else {
+		result = newList(list[2], KwIf, Boolean(false), Boolean(false))
+	}
+	body := []Value{KwBegin}
+	for _, command := range list[3:] {
+		body = append(body, command.Car())
+	}
+	body = append(body, newList(loc, steps...))
+
+	expr := newList(loc, KwLet, loop, newList(loc, inits...),
+		newList(loc, KwIf, exit[0], result, newList(loc, body...)))
+
+	return p.parseValue(env, loc, expr, tail)
+}
+
+func (p *Parser) parseIf(env *Env, list []Pair,
+	tail bool) (AST, error) {
+
+	if len(list) < 3 || len(list) > 4 {
+		return nil, list[0].Errorf("if: syntax error")
+	}
+
+	ast := &ASTIf{
+		From: list[0],
+	}
+	a, err := p.parseValue(env, list[1], list[1].Car(), false)
+	if err != nil {
+		return nil, err
+	}
+	ast.Cond = a
+
+	a, err = p.parseValue(env, list[2], list[2].Car(), tail)
+	if err != nil {
+		return nil, err
+	}
 	ast.True = a
 
 	if len(list) == 4 {
-		a, err = p.parseValue(env, list[3], list[3].Car(), tail, captures)
+		a, err = p.parseValue(env, list[3], list[3].Car(), tail)
 		if err != nil {
 			return nil, err
 		}
@@ -771,8 +1415,95 @@ func (p *Parser) parseIf(env *Env, list []Pair,
 	return ast, nil
 }
 
+func (p *Parser) parseLetValues(kind Keyword, env *Env, list []Pair,
+	tail bool) (AST, error) {
+
+	if len(list) < 3 {
+		return nil, list[0].Errorf("%s: missing bindings or body", kind)
+	}
+	bindings, ok := ListPairs(list[1].Car())
+	if !ok {
+		return nil, list[1].Errorf("%s: invalid bindings: %v",
+			kind, list[1].Car())
+	}
+
+	ast := &ASTLetValues{
+		From: list[0],
+		Kind: kind,
+		Tail: tail,
+	}
+
+	// Parse formals.
+	var inits []Pair
+	for _, binding := range bindings {
+		def, ok := ListPairs(binding.Car())
+		if !ok || len(def) != 2 {
+			return nil, list[1].Errorf("%s: invalid init: %v", kind, binding)
+		}
+		formals, err := p.parseFormals(def[0], def[0].Car())
+		if err != nil {
+			return nil, err
+		}
+		ast.Bindings = append(ast.Bindings, &ASTLetValuesBinding{
+			From:    def[1],
+			Formals: formals,
+		})
+		ast.NumBindings += len(formals.Names())
+		inits = append(inits, def[1])
+	}
+
+	letEnv := env.Copy()
+	letEnv.PushFrame(TypeStack, FULet, ast.NumBindings)
+
+	for _, binding := range ast.Bindings {
+		for _, name := range binding.Formals.Names() {
+			b, err := letEnv.Define(name, types.Unspecified)
+			if err != nil {
+				return nil, err
+			}
+			b.Disabled = true
+			binding.Bindings = append(binding.Bindings, b)
+		}
+	}
+
+	// Push value scope.
+	ast.ValueFrame = letEnv.PushFrame(TypeStack, FUValue, 1)
+
+	for idx, binding := range ast.Bindings {
+		init := inits[idx]
+		initAst, err := p.parseValue(letEnv, init, init.Car(), false)
+		if err != nil {
+			return nil, err
+		}
+		binding.Init = initAst
+
+		if kind == KwLetStarValues {
+			for _, b := range binding.Bindings {
+				b.Disabled = false
+			}
+		}
+	}
+
+	letEnv.PopFrame()
+
+	for _, binding := range ast.Bindings {
+		for _, b := range binding.Bindings {
+			b.Disabled = false
+		}
+	}
+
+	// Compile body.
+	body, err := p.parseInternalBody(letEnv, list[2:], tail)
+	if err != nil {
+		return nil, err
+	}
+	ast.Body = body
+
+	return ast, nil
+}
+
 func (p *Parser) parseApply(env *Env, pair Pair,
-	tail, captures bool) (AST, error) {
+	tail bool) (AST, error) {
 
 	f, ok := Car(pair.Cdr(), true)
 	if !ok {
@@ -784,7 +1515,7 @@ func (p *Parser) parseApply(env *Env, pair Pair,
 	}
 
 	// Lambda.
-	lambdaAST, err := p.parseValue(env, pair, f, false, captures)
+	lambdaAST, err := p.parseValue(env, pair, f, false)
 	if err != nil {
 		return nil, err
 	}
@@ -793,7 +1524,7 @@ func (p *Parser) parseApply(env *Env, pair Pair,
 	env.PushFrame(TypeStack, FUFrame, 1)
 
 	// Compile arguments.
-	argsAST, err := p.parseValue(env, pair, args, false, captures)
+	argsAST, err := p.parseValue(env, pair, args, false)
 	if err != nil {
 		return nil, err
 	}
@@ -810,16 +1541,15 @@ func (p *Parser) parseApply(env *Env, pair Pair,
 }
 
 func (p *Parser) parseCond(env *Env, list []Pair,
-	tail, captures bool) (AST, error) {
+	tail bool) (AST, error) {
 
 	if len(list) < 2 {
 		return nil, list[0].Errorf("cond: no clauses")
 	}
 
 	ast := &ASTCond{
-		From:     list[0],
-		Tail:     tail,
-		Captures: captures,
+		From: list[0],
+		Tail: tail,
 	}
 
 	for i := 1; i < len(list); i++ {
@@ -844,8 +1574,7 @@ func (p *Parser) parseCond(env *Env, list []Pair,
 
 		if !isElse {
 			// Compile condition.
-			condAST, err := p.parseValue(env, clause[0], clause[0].Car(), false,
-				captures)
+			condAST, err := p.parseValue(env, clause[0], clause[0].Car(), false)
 			if err != nil {
 				return nil, err
 			}
@@ -858,21 +1587,20 @@ func (p *Parser) parseCond(env *Env, list []Pair,
 			}
 
 			// Push value scope.
-			choice.FuncValueFrame = env.PushCaptureFrame(false, FUValue, 1)
+			choice.FuncValueFrame = env.PushFrame(TypeStack, FUValue, 1)
 
 			// Compile function.
-			funcAST, err := p.parseValue(env, clause[2], clause[2].Car(), false,
-				captures)
+			funcAST, err := p.parseValue(env, clause[2], clause[2].Car(), false)
 			if err != nil {
 				return nil, err
 			}
 			choice.Func = funcAST
 
 			// Create call frame.
-			env.PushCaptureFrame(captures, FUFrame, 1)
+			env.PushFrame(TypeStack, FUFrame, 1)
 
 			// Push argument scope.
-			choice.FuncArgsFrame = env.PushCaptureFrame(false, FUArgs, 1)
+			choice.FuncArgsFrame = env.PushFrame(TypeStack, FUArgs, 1)
 
 			env.PopFrame() // Argument
 			env.PopFrame() // Call
@@ -882,7 +1610,7 @@ func (p *Parser) parseCond(env *Env, list []Pair,
 			for j := 1; j < len(clause); j++ {
 				last := j+1 >= len(clause)
 				expr, err := p.parseValue(env, clause[j], clause[j].Car(),
-					tail && last, captures)
+					tail && last)
 				if err != nil {
 					return nil, err
 				}
@@ -895,23 +1623,22 @@ func (p *Parser) parseCond(env *Env, list []Pair,
 }
 
 func (p *Parser) parseCase(env *Env, list []Pair,
-	tail, captures bool) (AST, error) {
+	tail bool) (AST, error) {
 
 	if len(list) < 3 {
 		return nil, list[0].Errorf("case: key or clauses")
 	}
 
 	ast := &ASTCase{
-		From:     list[0],
-		Tail:     tail,
-		Captures: captures,
+		From: list[0],
+		Tail: tail,
 	}
 
 	// Push value scope.
-	ast.ValueFrame = env.PushCaptureFrame(false, FUValue, 1)
+	ast.ValueFrame = env.PushFrame(TypeStack, FUValue, 1)
 
 	// Compile key.
-	expr, err := p.parseValue(env, list[1], list[1].Car(), false, captures)
+	expr, err := p.parseValue(env, list[1], list[1].Car(), false)
 	if err != nil {
 		return nil, err
 	}
@@ -949,8 +1676,8 @@ func (p *Parser) parseCase(env *Env, list []Pair,
 			}
 
 			eqvEnv := env.Copy()
-			eqvEnv.PushCaptureFrame(false, FUFrame, 1)
-			ast.EqvArgFrame = eqvEnv.PushCaptureFrame(false, FUArgs, 2)
+			eqvEnv.PushFrame(TypeStack, FUFrame, 1)
+			ast.EqvArgFrame = eqvEnv.PushFrame(TypeStack, FUArgs, 2)
 
 			for _, datum := range datums {
 				// (eqv? value datum)
@@ -964,7 +1691,7 @@ func (p *Parser) parseCase(env *Env, list []Pair,
 			last := j+1 >= len(clause)
 
 			expr, err := p.parseValue(env, clause[j], clause[j].Car(),
-				tail && last, captures)
+				tail && last)
 			if err != nil {
 				return nil, err
 			}
@@ -978,14 +1705,14 @@ func (p *Parser) parseCase(env *Env, list []Pair,
 }
 
 func (p *Parser) parseAnd(env *Env, list []Pair,
-	tail, captures bool) (AST, error) {
+	tail bool) (AST, error) {
 
 	ast := &ASTAnd{
 		From: list[0],
 	}
 
 	for i := 1; i < len(list); i++ {
-		expr, err := p.parseValue(env, list[i], list[i].Car(), false, captures)
+		expr, err := p.parseValue(env, list[i], list[i].Car(), false)
 		if err != nil {
 			return nil, err
 		}
@@ -996,14 +1723,14 @@ func (p *Parser) parseAnd(env *Env, list []Pair,
 }
 
 func (p *Parser) parseOr(env *Env, list []Pair,
-	tail, captures bool) (AST, error) {
+	tail bool) (AST, error) {
 
 	ast := &ASTOr{
 		From: list[0],
 	}
 
 	for i := 1; i < len(list); i++ {
-		expr, err := p.parseValue(env, list[i], list[i].Car(), false, captures)
+		expr, err := p.parseValue(env, list[i], list[i].Car(), false)
 		if err != nil {
 			return nil, err
 		}
@@ -1013,6 +1740,661 @@ func (p *Parser) parseOr(env *Env, list []Pair,
 	return ast, nil
 }
 
+func (p *Parser) parseGuard(env *Env, list []Pair,
+	tail bool) (AST, error) {
+
+	// (guard (var clause...) body...)
+	if len(list) < 3 {
+		return nil, list[0].Errorf("guard: missing clauses or body")
+	}
+	spec, ok := ListPairs(list[1].Car())
+	if !ok || len(spec) < 2 {
+		return nil, list[1].Errorf("guard: invalid clauses: %v",
+			list[1].Car())
+	}
+	name, ok := isIdentifier(spec[0].Car())
+	if !ok {
+		return nil, spec[0].Errorf("guard: invalid variable: %v",
+			spec[0].Car())
+	}
+
+	// The guard is compiled into a call of the scheme::guard runtime
+	// function:
+	//
+	//   (scheme::guard (lambda () body...)
+	//                  (lambda (var scheme::reraise)
+	//                    (cond clause...
+	//                          (else (scheme::reraise)))))
+	loc := list[0]
+	reraise := &Identifier{
+		Name:  "scheme::reraise",
+		Point: loc.From(),
+	}
+
+	cond := []Value{KwCond}
+	var hasElse bool
+	for _, clause := range spec[1:] {
+		cond = append(cond, clause.Car())
+		c, ok := clause.Car().(Pair)
+		hasElse = ok && isKeyword(c.Car(), KwElse)
+	}
+	if !hasElse {
+		cond = append(cond, newList(loc, KwElse, newList(loc, reraise)))
+	}
+
+	body := []Value{KwLambda, nil}
+	for _, b := range list[2:] {
+		body = append(body, b.Car())
+	}
+
+	expr := newList(loc,
+		&Identifier{
+			Name:  "scheme::guard",
+			Point: loc.From(),
+		},
+		newList(loc, body...),
+		newList(loc, KwLambda, newList(loc, name, reraise),
+			newList(loc, cond...)))
+
+	return p.parseValue(env, loc, expr, tail)
+}
+
+func (p *Parser) parseDefineConditionType(env *Env, list []Pair) (AST, error) {
+
+	// (define-condition-type type parent constructor predicate
+	//   (field accessor)...)
+	if len(list) < 5 {
+		return nil, list[0].Errorf("define-condition-type: syntax error")
+	}
+	var names []*Identifier
+	for _, pair := range list[1:5] {
+		name, ok := isIdentifier(pair.Car())
+		if !ok {
+			return nil, pair.Errorf("define-condition-type: invalid name: %v",
+				pair.Car())
+		}
+		names = append(names, name)
+	}
+
+	// The definition is compiled into a sequence of definitions:
+	//
+	//   (begin
+	//     (define type
+	//       (scheme::make-condition-type 'type parent '(field...)))
+	//     (define constructor
+	//       (scheme::condition-constructor 'constructor type))
+	//     (define predicate (condition-predicate type))
+	//     (define accessor
+	//       (scheme::condition-accessor 'accessor type 'field))...)
+	loc := list[0]
+	typeName := names[0]
+
+	var fields []Value
+	var accessors []Value
+	for _, pair := range list[5:] {
+		spec, ok := ListPairs(pair.Car())
+		if !ok || len(spec) != 2 {
+			return nil, pair.Errorf("define-condition-type: invalid field: %v",
+				pair.Car())
+		}
+		field, ok := isIdentifier(spec[0].Car())
+		if !ok {
+			return nil, spec[0].Errorf(
+				"define-condition-type: invalid field: %v", spec[0].Car())
+		}
+		accessor, ok := isIdentifier(spec[1].Car())
+		if !ok {
+			return nil, spec[1].Errorf(
+				"define-condition-type: invalid accessor: %v", spec[1].Car())
+		}
+		fields = append(fields, field)
+		accessors = append(accessors, newList(pair, KwDefine, accessor,
+			newList(pair,
+				&Identifier{
+					Name:  "scheme::condition-accessor",
+					Point: pair.From(),
+				},
+				newList(pair, KwQuote, accessor),
+				typeName,
+				newList(pair, KwQuote, field))))
+	}
+
+	defs := []Value{
+		KwBegin,
+		newList(loc, KwDefine, typeName,
+			newList(loc,
+				&Identifier{
+					Name:  "scheme::make-condition-type",
+					Point: loc.From(),
+				},
+				newList(loc, KwQuote, typeName),
+				names[1],
+				newList(loc, KwQuote, newList(loc, fields...)))),
+		newList(loc, KwDefine, names[2],
+			newList(loc,
+				&Identifier{
+					Name:  "scheme::condition-constructor",
+					Point: loc.From(),
+				},
+				newList(loc, KwQuote, names[2]),
+				typeName)),
+		newList(loc, KwDefine, names[3],
+			newList(loc,
+				&Identifier{
+					Name:  "condition-predicate",
+					Point: loc.From(),
+				},
+				typeName)),
+	}
+	defs = append(defs, accessors...)
+
+	return p.parseValue(env, loc, newList(loc, defs...), false)
+}
+
+func (p *Parser) parseDefineRecordType(env *Env, list []Pair) (AST, error) {
+
+	name, rtd, parent, defs, err := p.recordTypeDefinitions(list)
+	if err != nil {
+		return nil, err
+	}
+	loc := list[0]
+
+	seq := &ASTSequence{
+		From: loc,
+	}
+	value, err := p.parseValue(env, loc, rtd, false)
+	if err != nil {
+		return nil, err
+	}
+	p.addDefinition(list[1], unaliasIdentifier(name).Name)
+	seq.Add(&ASTDefine{
+		From:  list[1],
+		Name:  unaliasIdentifier(name),
+		Value: p.recordTypeValue(loc, name, value, parent),
+	})
+	for _, def := range defs {
+		ast, err := p.parseValue(env, loc, def, false)
+		if err != nil {
+			return nil, err
+		}
+		seq.Add(ast)
+	}
+	return seq, nil
+}
+
+// recordTypeDefinitions expands the define-record-type form. The
+// function returns the record name, the record-type descriptor
+// expression, a flag telling if the record type has a parent, and the
+// definitions of the record procedures.
+func (p *Parser) recordTypeDefinitions(list []Pair) (
+	*Identifier, Value, bool, []Value, error) {
+
+	// (define-record-type name-spec clause...)
+	if len(list) < 2 {
+		return nil, nil, false, nil,
+			list[0].Errorf("define-record-type: syntax error")
+	}
+	loc := list[0]
+
+	// The name-spec is either the record name or a list of the record
+	// name, constructor name, and predicate name.
+	var name, constructor, predicate *Identifier
+	name, ok := isIdentifier(list[1].Car())
+	if ok {
+		constructor = &Identifier{
+			Name:  "make-" + unaliasIdentifier(name).Name,
+			Point: list[1].From(),
+		}
+		predicate = &Identifier{
+			Name:  unaliasIdentifier(name).Name + "?",
+			Point: list[1].From(),
+		}
+	} else {
+		spec, ok := ListPairs(list[1].Car())
+		if !ok || len(spec) != 3 {
+			return nil, nil, false, nil, list[1].Errorf(
+				"define-record-type: invalid name: %v", list[1].Car())
+		}
+		var names []*Identifier
+		for _, pair := range spec {
+			id, ok := isIdentifier(pair.Car())
+			if !ok {
+				return nil, nil, false, nil, pair.Errorf(
+					"define-record-type: invalid name: %v", pair.Car())
+			}
+			names = append(names, id)
+		}
+		name, constructor, predicate = names[0], names[1], names[2]
+	}
+
+	// The definition is compiled into a sequence of definitions:
+	//
+	//   (begin
+	//     (define name
+	//       (scheme::make-record-type 'name parent uid sealed opaque
+	//         '#((mutable field)...) parent-cd protocol))
+	//     (define constructor
+	//       (scheme::record-constructor 'constructor name))
+	//     (define predicate (scheme::record-predicate 'predicate name))
+	//     (define accessor
+	//       (scheme::record-accessor 'accessor name k))...
+	//     (define mutator
+	//       (scheme::record-mutator 'mutator name k))...)
+	var parent Value = Boolean(false)
+	var parentCD Value = Boolean(false)
+	var uid Value = Boolean(false)
+	var sealed Value = Boolean(false)
+	var opaque Value = Boolean(false)
+	var protocol Value = Boolean(false)
+	var fields []Value
+	var procs []Value
+
+	seen := newSeen()
+	for _, pair := range list[2:] {
+		clause, ok := ListPairs(pair.Car())
+		if !ok || len(clause) == 0 {
+			return nil, nil, false, nil, pair.Errorf(
+				"define-record-type: invalid clause: %v", pair.Car())
+		}
+		kind, ok := isIdentifier(clause[0].Car())
+		if !ok {
+			return nil, nil, false, nil, pair.Errorf(
+				"define-record-type: invalid clause: %v", pair.Car())
+		}
+		if seen.add(kind.Name) != nil {
+			return nil, nil, false, nil, pair.Errorf(
+				"define-record-type: duplicate clause: %v", kind)
+		}
+		switch kind.Name {
+		case "fields":
+			for idx, f := range clause[1:] {
+				field, accessor, mutator, err := p.parseRecordField(name, f)
+				if err != nil {
+					return nil, nil, false, nil, err
+				}
+				mutability := "immutable"
+				if mutator != nil {
+					mutability = "mutable"
+				}
+				fields = append(fields, newList(f,
+					&Identifier{
+						Name:  mutability,
+						Point: f.From(),
+					},
+					field))
+				procs = append(procs, newList(f, KwDefine, accessor,
+					newList(f,
+						&Identifier{
+							Name:  "scheme::record-accessor",
+							Point: f.From(),
+						},
+						newList(f, KwQuote, accessor),
+						name,
+						Int(idx))))
+				if mutator != nil {
+					procs = append(procs, newList(f, KwDefine, mutator,
+						newList(f,
+							&Identifier{
+								Name:  "scheme::record-mutator",
+								Point: f.From(),
+							},
+							newList(f, KwQuote, mutator),
+							name,
+							Int(idx))))
+				}
+			}
+
+		case "parent":
+			if len(clause) != 2 {
+				return nil, nil, false, nil, pair.Errorf(
+					"define-record-type: invalid parent: %v", pair.Car())
+			}
+			parent = clause[1].Car()
+			parentCD = newList(pair,
+				p.globalIdentifier(pair, "record-constructor-descriptor"),
+				parent)
+
+		case "parent-rtd":
+			if len(clause) != 3 {
+				return nil, nil, false, nil, pair.Errorf(
+					"define-record-type: invalid parent-rtd: %v", pair.Car())
+			}
+			parent = clause[1].Car()
+			parentCD = clause[2].Car()
+
+		case "protocol":
+			if len(clause) != 2 {
+				return nil, nil, false, nil, pair.Errorf(
+					"define-record-type: invalid protocol: %v", pair.Car())
+			}
+			protocol = clause[1].Car()
+
+		case "sealed", "opaque":
+			if len(clause) != 2 {
+				return nil, nil, false, nil, pair.Errorf(
+					"define-record-type: invalid %v: %v", kind, pair.Car())
+			}
+			b, ok := clause[1].Car().(Boolean)
+			if !ok {
+				return nil, nil, false, nil, clause[1].Errorf(
+					"define-record-type: invalid %v: %v", kind, pair.Car())
+			}
+			if kind.Name == "sealed" {
+				sealed = b
+			} else {
+				opaque = b
+			}
+
+		case "nongenerative":
+			switch len(clause) {
+			case 1:
+				uid = newList(pair, KwQuote, p.temporary(pair, name.Name))
+			case 2:
+				id, ok := isIdentifier(clause[1].Car())
+				if !ok {
+					return nil, nil, false, nil, clause[1].Errorf(
+						"define-record-type: invalid uid: %v",
+						clause[1].Car())
+				}
+				uid = newList(pair, KwQuote, id)
+			default:
+				return nil, nil, false, nil, pair.Errorf(
+					"define-record-type: invalid nongenerative: %v",
+					pair.Car())
+			}
+
+		default:
+			return nil, nil, false, nil, pair.Errorf(
+				"define-record-type: invalid clause: %v", pair.Car())
+		}
+	}
+	if seen["parent"] && seen["parent-rtd"] {
+		return nil, nil, false, nil, loc.Errorf(
+			"define-record-type: both parent and parent-rtd specified")
+	}
+
+	rtd := newList(loc,
+		&Identifier{
+			Name:  "scheme::make-record-type",
+			Point: loc.From(),
+		},
+		newList(loc, KwQuote, name),
+		parent, uid, sealed, opaque,
+		newList(loc, KwQuote, Vector(fields)),
+		parentCD, protocol)
+
+	defs := []Value{
+		newList(loc, KwDefine, constructor,
+			newList(loc,
+				&Identifier{
+					Name:  "scheme::record-constructor",
+					Point: loc.From(),
+				},
+				newList(loc, KwQuote, constructor),
+				name)),
+		newList(loc, KwDefine, predicate,
+			newList(loc,
+				&Identifier{
+					Name:  "scheme::record-predicate",
+					Point: loc.From(),
+				},
+				newList(loc, KwQuote, predicate),
+				name)),
+	}
+	defs = append(defs, procs...)
+
+	return name, rtd, parent != Boolean(false), defs, nil
+}
+
+// recordTypeValue wraps the record-type descriptor value of the
+// record name into a value that has the static record type.
+func (p *Parser) recordTypeValue(loc Locator, name *Identifier, value AST,
+	parent bool) AST {
+
+	ast := &ASTRecordType{
+		From:   loc,
+		Record: types.NewRecord(unaliasIdentifier(name).Name, nil),
+		Value:  value,
+	}
+	call, ok := value.(*ASTCall)
+	if ok && parent {
+		ast.Parent = call.Args[1]
+	}
+	return ast
+}
+
+// parseRecordField parses the define-record-type field spec. The
+// function returns the field name, its accessor, and its mutator. The
+// mutator is nil for immutable fields.
+func (p *Parser) parseRecordField(record *Identifier, spec Pair) (
+	field, accessor, mutator *Identifier, err error) {
+
+	// field
+	// (immutable field [accessor])
+	// (mutable field [accessor mutator])
+	field, ok := isIdentifier(spec.Car())
+	if ok {
+		accessor = recordFieldProcName(spec, record, field, "")
+		return
+	}
+	l, ok := ListPairs(spec.Car())
+	if !ok || len(l) < 2 {
+		err = spec.Errorf("define-record-type: invalid field: %v", spec.Car())
+		return
+	}
+	var names []*Identifier
+	for _, pair := range l {
+		id, ok := isIdentifier(pair.Car())
+		if !ok {
+			err = pair.Errorf("define-record-type: invalid field: %v",
+				spec.Car())
+			return
+		}
+		names = append(names, id)
+	}
+	field = names[1]
+
+	switch names[0].Name {
+	case "immutable":
+		switch len(names) {
+		case 2:
+			accessor = recordFieldProcName(spec, record, field, "")
+			return
+		case 3:
+			accessor = names[2]
+			return
+		}
+
+	case "mutable":
+		switch len(names) {
+		case 2:
+			accessor = recordFieldProcName(spec, record, field, "")
+			mutator = recordFieldProcName(spec, record, field, "-set!")
+			return
+		case 4:
+			accessor = names[2]
+			mutator = names[3]
+			return
+		}
+	}
+	err = spec.Errorf("define-record-type: invalid field: %v", spec.Car())
+	return
+}
+
+// recordProcName creates the default name for the field procedure of
+// the record.
+func recordFieldProcName(loc Locator, record, field *Identifier,
+	suffix string) *Identifier {
+
+	return &Identifier{
+		Name:  record.Name + "-" + field.Name + suffix,
+		Point: loc.From(),
+	}
+}
+
+func (p *Parser) parseQuasiquote(env *Env, list []Pair,
+	tail bool) (AST, error) {
+
+	// (quasiquote template)
+	if len(list) != 2 {
+		return nil, list[0].Errorf("quasiquote: syntax error")
+	}
+
+	// The template is compiled into list and vector constructors.
+	// The constant parts of the template are quoted so they are
+	// shared and not copied.
+	loc := list[0]
+	expr, constant, err := p.quasiquote(loc, list[1].Car(), 0)
+	if err != nil {
+		return nil, err
+	}
+	if constant {
+		expr = newList(loc, KwQuote, expr)
+	}
+	return p.parseValue(env, loc, expr, tail)
+}
+
+// quasiquote compiles the quasiquote template at the nesting level
+// depth. The function returns the template as-is and true if it does
+// not contain unquoted expressions at level 0.
+func (p *Parser) quasiquote(loc Locator, template Value, depth int) (
+	Value, bool, error) {
+
+	switch t := template.(type) {
+	case Pair:
+		var l Locator = t
+		kw, ok := t.Car().(Keyword)
+		if ok {
+			switch kw {
+			case KwUnquote, KwUnquoteSplicing:
+				if depth > 0 {
+					return p.quasiquoteForm(l, t, depth-1)
+				}
+				if kw == KwUnquoteSplicing {
+					return nil, false, t.Errorf("%s: not in list context",
+						kw)
+				}
+				args, ok := ListValues(t.Cdr())
+				if !ok || len(args) != 1 {
+					return nil, false, t.Errorf("%s: syntax error", kw)
+				}
+				return args[0], false, nil
+
+			case KwQuasiquote:
+				return p.quasiquoteForm(l, t, depth+1)
+			}
+		}
+
+		// Unquoted items at level 0 are spliced into the list.
+		item, ok := t.Car().(Pair)
+		if ok && depth == 0 && (isKeyword(item.Car(), KwUnquote) ||
+			isKeyword(item.Car(), KwUnquoteSplicing)) {
+
+			args, ok := ListValues(item.Cdr())
+			if !ok {
+				return nil, false, item.Errorf("%s: syntax error",
+					item.Car())
+			}
+			rest, constant, err := p.quasiquote(l, t.Cdr(), depth)
+			if err != nil {
+				return nil, false, err
+			}
+			if constant {
+				rest = newList(l, KwQuote, rest)
+			}
+			if isKeyword(item.Car(), KwUnquote) {
+				for i := len(args) - 1; i >= 0; i-- {
+					rest = newList(l, p.globalIdentifier(l, "cons"), args[i],
+						rest)
+				}
+				return rest, false, nil
+			}
+			if constant && t.Cdr() == nil && len(args) == 1 {
+				// The last spliced list is not copied.
+				return args[0], false, nil
+			}
+			if len(args) == 0 {
+				return rest, false, nil
+			}
+			call := []Value{p.globalIdentifier(l, "append")}
+			call = append(call, args...)
+			call = append(call, rest)
+			return newList(l, call...), false, nil
+		}
+
+		car, carConstant, err := p.quasiquote(l, t.Car(), depth)
+		if err != nil {
+			return nil, false, err
+		}
+		cdr, cdrConstant, err := p.quasiquote(l, t.Cdr(), depth)
+		if err != nil {
+			return nil, false, err
+		}
+		if carConstant && cdrConstant {
+			return t, true, nil
+		}
+		if carConstant {
+			car = newList(l, KwQuote, car)
+		}
+		if cdrConstant {
+			cdr = newList(l, KwQuote, cdr)
+		}
+		return newList(l, p.globalIdentifier(l, "cons"), car, cdr), false,
+			nil
+
+	case Vector:
+		var items Value
+		for i := len(t) - 1; i >= 0; i-- {
+			items = NewLocationPair(loc.From(), loc.To(), t[i], items)
+		}
+		expr, constant, err := p.quasiquote(loc, items, depth)
+		if err != nil {
+			return nil, false, err
+		}
+		if constant {
+			return t, true, nil
+		}
+		return newList(loc, p.globalIdentifier(loc, "list->vector"), expr),
+			false, nil
+
+	default:
+		return template, true, nil
+	}
+}
+
+// quasiquoteForm compiles the nested quasiquote, unquote, or
+// unquote-splicing form whose arguments are at the nesting level
+// depth.
+func (p *Parser) quasiquoteForm(loc Locator, form Pair, depth int) (
+	Value, bool, error) {
+
+	args, constant, err := p.quasiquote(loc, form.Cdr(), depth)
+	if err != nil {
+		return nil, false, err
+	}
+	if constant {
+		return form, true, nil
+	}
+	return newList(loc, p.globalIdentifier(loc, "cons"),
+		newList(loc, KwQuote, form.Car()), args), false, nil
+}
+
+// newList creates a list of the argument values. The list pairs get
+// their location from loc.
+func newList(loc Locator, values ...Value) Value {
+	return newListTail(loc, nil, values...)
+}
+
+// newListTail creates a list of the argument values ending with the
+// tail value. The list pairs get their location from loc.
+func newListTail(loc Locator, tail Value, values ...Value) Value {
+	result := tail
+	for i := len(values) - 1; i >= 0; i-- {
+		result = NewLocationPair(loc.From(), loc.To(), values[i], result)
+	}
+	return result
+}
+
 func isKeyword(value Value, keyword Keyword) bool {
 	kw, ok := value.(Keyword)
 	if !ok {
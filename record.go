@@ -0,0 +1,233 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package scheme
+
+import (
+	"fmt"
+
+	"github.com/markkurossi/scheme/types"
+)
+
+// RecordType implements record-type descriptors. The record type's
+// fields follow the fields of its parent types in the record values.
+type RecordType struct {
+	Name   string
+	Parent *RecordType
+	UID    string
+	Sealed bool
+	Opaque bool
+	Fields []RecordField
+
+	// Constructor is the constructor descriptor of the record type
+	// definition. It is used as the parent constructor descriptor of
+	// the record types that name this record type as their parent.
+	Constructor *RecordConstructor
+}
+
+// RecordField defines a record field.
+type RecordField struct {
+	Name    string
+	Mutable bool
+}
+
+// IsA tests if the record type is the argument type or its subtype.
+func (t *RecordType) IsA(o *RecordType) bool {
+	for ; t != nil; t = t.Parent {
+		if t == o {
+			return true
+		}
+	}
+	return false
+}
+
+// NumFields returns the number of fields in the record type,
+// including the fields of its parent types.
+func (t *RecordType) NumFields() int {
+	var count int
+	for ; t != nil; t = t.Parent {
+		count += len(t.Fields)
+	}
+	return count
+}
+
+// AllFields returns the fields of the record type and its parent
+// types in the order they are in the record values.
+func (t *RecordType) AllFields() []RecordField {
+	if t == nil {
+		return nil
+	}
+	return append(t.Parent.AllFields(), t.Fields...)
+}
+
+// FieldIndex returns the index of the record type's kth field in the
+// record values.
+func (t *RecordType) FieldIndex(k int) (int, error) {
+	if k < 0 || k >= len(t.Fields) {
+		return 0, fmt.Errorf("invalid field index %v for record type %v",
+			k, t.Name)
+	}
+	return t.Parent.NumFields() + k, nil
+}
+
+// equivalent tests if the record type has the same definition as the
+// argument nongenerative record type.
+func (t *RecordType) equivalent(o *RecordType) bool {
+	if t.Name != o.Name || t.Parent != o.Parent || t.Sealed != o.Sealed ||
+		t.Opaque != o.Opaque || len(t.Fields) != len(o.Fields) {
+		return false
+	}
+	for idx, field := range t.Fields {
+		if field != o.Fields[idx] {
+			return false
+		}
+	}
+	return true
+}
+
+// Scheme returns the value as a Scheme string.
+func (t *RecordType) Scheme() string {
+	return t.String()
+}
+
+// Eq tests if the argument value is eq? to this value.
+func (t *RecordType) Eq(o Value) bool {
+	return t == o
+}
+
+// Equal tests if the argument value is equal to this value.
+func (t *RecordType) Equal(o Value) bool {
+	return t == o
+}
+
+// Type implements Value.Type.
+func (t *RecordType) Type() *types.Type {
+	return types.RecordType
+}
+
+func (t *RecordType) String() string {
+	return fmt.Sprintf("#<record-type %s>", t.Name)
+}
+
+// RecordConstructor implements record constructor descriptors. The
+// Protocol is nil for the default protocol.
+type RecordConstructor struct {
+	Kind     *RecordType
+	Parent   *RecordConstructor
+	Protocol Value
+}
+
+// NewRecordConstructor creates a constructor descriptor for the
+// record type t. If the parent descriptor is nil and the record type
+// has a parent type, the parent's default constructor descriptor is
+// used.
+func NewRecordConstructor(t *RecordType, parent *RecordConstructor,
+	protocol Value) (*RecordConstructor, error) {
+
+	if parent == nil && t.Parent != nil {
+		var err error
+		parent, err = NewRecordConstructor(t.Parent, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if parent != nil && parent.Kind != t.Parent {
+		return nil, fmt.Errorf("constructor descriptor %v is not for %v",
+			parent, t.Parent)
+	}
+	if protocol == Boolean(false) {
+		protocol = nil
+	}
+	if protocol == nil && parent != nil && !parent.isDefault() {
+		return nil, fmt.Errorf("%v: protocol required with parent %v",
+			t.Name, parent)
+	}
+	return &RecordConstructor{
+		Kind:     t,
+		Parent:   parent,
+		Protocol: protocol,
+	}, nil
+}
+
+// isDefault tests if the constructor descriptor and its parent
+// descriptors use the default protocol.
+func (c *RecordConstructor) isDefault() bool {
+	for ; c != nil; c = c.Parent {
+		if c.Protocol != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Scheme returns the value as a Scheme string.
+func (c *RecordConstructor) Scheme() string {
+	return c.String()
+}
+
+// Eq tests if the argument value is eq? to this value.
+func (c *RecordConstructor) Eq(o Value) bool {
+	return c == o
+}
+
+// Equal tests if the argument value is equal to this value.
+func (c *RecordConstructor) Equal(o Value) bool {
+	return c == o
+}
+
+// Type implements Value.Type.
+func (c *RecordConstructor) Type() *types.Type {
+	return types.Unspecified
+}
+
+func (c *RecordConstructor) String() string {
+	return fmt.Sprintf("#<record-constructor-descriptor %s>", c.Kind.Name)
+}
+
+// Record implements record values.
+type Record struct {
+	Kind   *RecordType
+	Fields []Value
+}
+
+// Scheme returns the value as a Scheme string.
+func (r *Record) Scheme() string {
+	return r.String()
+}
+
+// Eq tests if the argument value is eq? to this value.
+func (r *Record) Eq(o Value) bool {
+	return r == o
+}
+
+// Equal tests if the argument value is equal to this value. Records
+// are equal only if they are the same record.
+func (r *Record) Equal(o Value) bool {
+	return r == o
+}
+
+// Type implements Value.Type.
+func (r *Record) Type() *types.Type {
+	return types.Record
+}
+
+// Field returns the value of the named field. The field is searched
+// starting from the record type's own fields so the subtype fields
+// shadow the parent type fields with the same name.
+func (r *Record) Field(name string) (Value, bool) {
+	for t := r.Kind; t != nil; t = t.Parent {
+		for idx, field := range t.Fields {
+			if field.Name == name {
+				return r.Fields[t.Parent.NumFields()+idx], true
+			}
+		}
+	}
+	return nil, false
+}
+
+func (r *Record) String() string {
+	return fmt.Sprintf("#<record %s>", r.Kind.Name)
+}
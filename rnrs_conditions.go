@@ -0,0 +1,573 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+// The (rnrs conditions (6)) library.
+//
+
+package scheme
+
+import (
+	"fmt"
+
+	"github.com/markkurossi/scheme/types"
+)
+
+// Standard condition types.
+var (
+	condCondition = &ConditionType{
+		Name: "&condition",
+	}
+	condMessage = &ConditionType{
+		Name:   "&message",
+		Parent: condCondition,
+		Fields: []string{"message"},
+	}
+	condWarning = &ConditionType{
+		Name:   "&warning",
+		Parent: condCondition,
+	}
+	condSerious = &ConditionType{
+		Name:   "&serious",
+		Parent: condCondition,
+	}
+	condError = &ConditionType{
+		Name:   "&error",
+		Parent: condSerious,
+	}
+	condViolation = &ConditionType{
+		Name:   "&violation",
+		Parent: condSerious,
+	}
+	condAssertion = &ConditionType{
+		Name:   "&assertion",
+		Parent: condViolation,
+	}
+	condIrritants = &ConditionType{
+		Name:   "&irritants",
+		Parent: condCondition,
+		Fields: []string{"irritants"},
+	}
+	condWho = &ConditionType{
+		Name:   "&who",
+		Parent: condCondition,
+		Fields: []string{"who"},
+	}
+	condNonContinuable = &ConditionType{
+		Name:   "&non-continuable",
+		Parent: condViolation,
+	}
+	condImplementationRestriction = &ConditionType{
+		Name:   "&implementation-restriction",
+		Parent: condViolation,
+	}
+	condLexical = &ConditionType{
+		Name:   "&lexical",
+		Parent: condViolation,
+	}
+	condSyntax = &ConditionType{
+		Name:   "&syntax",
+		Parent: condViolation,
+		Fields: []string{"form", "subform"},
+	}
+	condUndefined = &ConditionType{
+		Name:   "&undefined",
+		Parent: condViolation,
+	}
+
+	// I/O condition types.
+	condIO = &ConditionType{
+		Name:   "&i/o",
+		Parent: condError,
+	}
+	condIORead = &ConditionType{
+		Name:   "&i/o-read",
+		Parent: condIO,
+	}
+	condIOWrite = &ConditionType{
+		Name:   "&i/o-write",
+		Parent: condIO,
+	}
+	condIOInvalidPosition = &ConditionType{
+		Name:   "&i/o-invalid-position",
+		Parent: condIO,
+		Fields: []string{"position"},
+	}
+	condIOFilename = &ConditionType{
+		Name:   "&i/o-filename",
+		Parent: condIO,
+		Fields: []string{"filename"},
+	}
+	condIOFileProtection = &ConditionType{
+		Name:   "&i/o-file-protection",
+		Parent: condIOFilename,
+	}
+	condIOFileIsReadOnly = &ConditionType{
+		Name:   "&i/o-file-is-read-only",
+		Parent: condIOFileProtection,
+	}
+	condIOFileAlreadyExists = &ConditionType{
+		Name:   "&i/o-file-already-exists",
+		Parent: condIOFilename,
+	}
+	condIOFileDoesNotExist = &ConditionType{
+		Name:   "&i/o-file-does-not-exist",
+		Parent: condIOFilename,
+	}
+	condIOPort = &ConditionType{
+		Name:   "&i/o-port",
+		Parent: condIO,
+		Fields: []string{"port"},
+	}
+	condIODecoding = &ConditionType{
+		Name:   "&i/o-decoding",
+		Parent: condIOPort,
+	}
+	condIOEncoding = &ConditionType{
+		Name:   "&i/o-encoding",
+		Parent: condIOPort,
+		Fields: []string{"char"},
+	}
+)
+
+// conditionTypes define the standard condition types and the names
+// of their constructor, predicate, and field accessor procedures. The
+// accessors are listed in the order of the type's fields.
+var conditionTypes = []struct {
+	Type        *ConditionType
+	Constructor string
+	Predicate   string
+	Accessors   []string
+}{
+	{
+		Type: condCondition,
+	},
+	{
+		Type:        condMessage,
+		Constructor: "make-message-condition",
+		Predicate:   "message-condition?",
+		Accessors:   []string{"condition-message"},
+	},
+	{
+		Type:        condWarning,
+		Constructor: "make-warning",
+		Predicate:   "warning?",
+	},
+	{
+		Type:        condSerious,
+		Constructor: "make-serious-condition",
+		Predicate:   "serious-condition?",
+	},
+	{
+		Type:        condError,
+		Constructor: "make-error",
+		Predicate:   "error?",
+	},
+	{
+		Type:        condViolation,
+		Constructor: "make-violation",
+		Predicate:   "violation?",
+	},
+	{
+		Type:        condAssertion,
+		Constructor: "make-assertion-violation",
+		Predicate:   "assertion-violation?",
+	},
+	{
+		Type:        condIrritants,
+		Constructor: "make-irritants-condition",
+		Predicate:   "irritants-condition?",
+		Accessors:   []string{"condition-irritants"},
+	},
+	{
+		Type:        condWho,
+		Constructor: "make-who-condition",
+		Predicate:   "who-condition?",
+		Accessors:   []string{"condition-who"},
+	},
+	{
+		Type:        condNonContinuable,
+		Constructor: "make-non-continuable-violation",
+		Predicate:   "non-continuable-violation?",
+	},
+	{
+		Type:        condImplementationRestriction,
+		Constructor: "make-implementation-restriction-violation",
+		Predicate:   "implementation-restriction-violation?",
+	},
+	{
+		Type:        condLexical,
+		Constructor: "make-lexical-violation",
+		Predicate:   "lexical-violation?",
+	},
+	{
+		Type:        condSyntax,
+		Constructor: "make-syntax-violation",
+		Predicate:   "syntax-violation?",
+		Accessors: []string{
+			"syntax-violation-form",
+			"syntax-violation-subform",
+		},
+	},
+	{
+		Type:        condUndefined,
+		Constructor: "make-undefined-violation",
+		Predicate:   "undefined-violation?",
+	},
+	{
+		Type:        condIO,
+		Constructor: "make-i/o-error",
+		Predicate:   "i/o-error?",
+	},
+	{
+		Type:        condIORead,
+		Constructor: "make-i/o-read-error",
+		Predicate:   "i/o-read-error?",
+	},
+	{
+		Type:        condIOWrite,
+		Constructor: "make-i/o-write-error",
+		Predicate:   "i/o-write-error?",
+	},
+	{
+		Type:        condIOInvalidPosition,
+		Constructor: "make-i/o-invalid-position-error",
+		Predicate:   "i/o-invalid-position-error?",
+		Accessors:   []string{"i/o-error-position"},
+	},
+	{
+		Type:        condIOFilename,
+		Constructor: "make-i/o-filename-error",
+		Predicate:   "i/o-filename-error?",
+		Accessors:   []string{"i/o-error-filename"},
+	},
+	{
+		Type:        condIOFileProtection,
+		Constructor: "make-i/o-file-protection-error",
+		Predicate:   "i/o-file-protection-error?",
+	},
+	{
+		Type:        condIOFileIsReadOnly,
+		Constructor: "make-i/o-file-is-read-only-error",
+		Predicate:   "i/o-file-is-read-only-error?",
+	},
+	{
+		Type:        condIOFileAlreadyExists,
+		Constructor: "make-i/o-file-already-exists-error",
+		Predicate:   "i/o-file-already-exists-error?",
+	},
+	{
+		Type:        condIOFileDoesNotExist,
+		Constructor: "make-i/o-file-does-not-exist-error",
+		Predicate:   "i/o-file-does-not-exist-error?",
+	},
+	{
+		Type:        condIOPort,
+		Constructor: "make-i/o-port-error",
+		Predicate:   "i/o-port-error?",
+		Accessors:   []string{"i/o-error-port"},
+	},
+	{
+		Type:        condIODecoding,
+		Constructor: "make-i/o-decoding-error",
+		Predicate:   "i/o-decoding-error?",
+	},
+	{
+		Type:        condIOEncoding,
+		Constructor: "make-i/o-encoding-error",
+		Predicate:   "i/o-encoding-error?",
+		Accessors:   []string{"i/o-encoding-error-char"},
+	},
+}
+
+// defineConditionTypes defines the standard condition types and
+// their procedures.
+func (scm *Scheme) defineConditionTypes() {
+	for _, ct := range conditionTypes {
+		sym := scm.Intern(ct.Type.Name)
+		sym.GlobalType = ct.Type.Type()
+		sym.bind(ct.Type, FlagConst)
+
+		if len(ct.Constructor) > 0 {
+			scm.defineLambda(conditionConstructor(ct.Constructor, ct.Type))
+		}
+		if len(ct.Predicate) > 0 {
+			scm.defineLambda(conditionPredicate(ct.Predicate, ct.Type))
+		}
+		for idx, accessor := range ct.Accessors {
+			scm.defineLambda(conditionAccessor(accessor, ct.Type,
+				ct.Type.Fields[idx]))
+		}
+	}
+}
+
+// defineLambda defines the lambda as a constant global symbol.
+func (scm *Scheme) defineLambda(lambda *Lambda) {
+	sym := scm.Intern(lambda.Impl.Name)
+	sym.GlobalType = lambda.Type()
+	sym.bind(lambda, FlagConst)
+}
+
+// nativeLambda creates a native lambda with the argument names.
+func nativeLambda(name string, ret *types.Type, native Native,
+	names ...string) *Lambda {
+
+	var args Args
+	for _, n := range names {
+		args.Fixed = append(args.Fixed, &TypedName{
+			Name: n,
+			Type: types.Any,
+		})
+	}
+	args.Init()
+
+	return &Lambda{
+		Impl: &LambdaImpl{
+			Name:   name,
+			Args:   args,
+			Return: ret,
+			Native: native,
+		},
+	}
+}
+
+// conditionConstructor creates a constructor for the condition type
+// t. The constructor takes the values of the type's fields, starting
+// from the fields of its parent types.
+func conditionConstructor(name string, t *ConditionType) *Lambda {
+	var names []string
+	for p := t; p != nil; p = p.Parent {
+		names = append(append([]string(nil), p.Fields...), names...)
+	}
+	return nativeLambda(name, types.Unspecified,
+		func(scm *Scheme, args []Value) (Value, error) {
+			fields := make([]Value, len(args))
+			copy(fields, args)
+			return t.New(fields...), nil
+		}, names...)
+}
+
+// conditionPredicate creates a predicate that tests if its argument
+// is a condition with a component of the condition type t.
+func conditionPredicate(name string, t *ConditionType) *Lambda {
+	return nativeLambda(name, types.Boolean,
+		func(scm *Scheme, args []Value) (Value, error) {
+			c, ok := args[0].(*Condition)
+			if !ok {
+				return Boolean(false), nil
+			}
+			_, ok = c.Find(t)
+			return Boolean(ok), nil
+		}, "obj")
+}
+
+// conditionAccessor creates an accessor for the field of the
+// condition type t.
+func conditionAccessor(name string, t *ConditionType,
+	field string) *Lambda {
+
+	return nativeLambda(name, types.Unspecified,
+		func(scm *Scheme, args []Value) (Value, error) {
+			c, ok := args[0].(*Condition)
+			if !ok {
+				return nil, fmt.Errorf("not a condition: %v",
+					ToScheme(args[0]))
+			}
+			v, ok := c.Field(t, field)
+			if !ok {
+				return nil, fmt.Errorf("condition %v is not of type %v",
+					c, t.Name)
+			}
+			return v, nil
+		}, "condition")
+}
+
+var rnrsConditionsBuiltins = []Builtin{
+	{
+		Name:   "condition",
+		Args:   []string{"condition<any>..."},
+		Return: types.Unspecified,
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			var conditions []*Condition
+			for _, arg := range args {
+				c, ok := arg.(*Condition)
+				if !ok {
+					return nil, fmt.Errorf("not a condition: %v",
+						ToScheme(arg))
+				}
+				conditions = append(conditions, c)
+			}
+			return NewCondition(conditions...), nil
+		},
+	},
+	{
+		Name:   "simple-conditions",
+		Args:   []string{"condition<any>"},
+		Return: types.Any,
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			c, ok := args[0].(*Condition)
+			if !ok {
+				return nil, fmt.Errorf("not a condition: %v",
+					ToScheme(args[0]))
+			}
+			simple := c.Simple()
+			var result Value
+			for i := len(simple) - 1; i >= 0; i-- {
+				result = NewPair(simple[i], result)
+			}
+			return result, nil
+		},
+	},
+	{
+		Name:   "condition?",
+		Args:   []string{"obj"},
+		Return: types.Boolean,
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			_, ok := args[0].(*Condition)
+			return Boolean(ok), nil
+		},
+	},
+	{
+		Name:   "condition-predicate",
+		Args:   []string{"rtd<any>"},
+		Return: types.Unspecified,
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			t, ok := args[0].(*ConditionType)
+			if !ok {
+				return nil, fmt.Errorf("not a condition type: %v",
+					ToScheme(args[0]))
+			}
+			return conditionPredicate("", t), nil
+		},
+	},
+	{
+		Name:   "scheme::condition-component",
+		Args:   []string{"rtd<any>", "condition<any>"},
+		Return: types.Unspecified,
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			t, ok := args[0].(*ConditionType)
+			if !ok {
+				return nil, fmt.Errorf("not a condition type: %v",
+					ToScheme(args[0]))
+			}
+			c, ok := args[1].(*Condition)
+			if !ok {
+				return nil, fmt.Errorf("not a condition: %v",
+					ToScheme(args[1]))
+			}
+			s, ok := c.Find(t)
+			if !ok {
+				return nil, fmt.Errorf("condition %v is not of type %v",
+					c, t.Name)
+			}
+			return s, nil
+		},
+	},
+	{
+		Name:   "scheme::make-condition-type",
+		Args:   []string{"name<symbol>", "parent<any>", "fields<any>"},
+		Return: types.Unspecified,
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			name, ok := args[0].(*Identifier)
+			if !ok {
+				return nil, fmt.Errorf("invalid name: %v", ToScheme(args[0]))
+			}
+			parent, ok := args[1].(*ConditionType)
+			if !ok {
+				return nil, fmt.Errorf("not a condition type: %v",
+					ToScheme(args[1]))
+			}
+			t := &ConditionType{
+				Name:   name.Name,
+				Parent: parent,
+			}
+			err := Map(func(idx int, v Value) error {
+				field, ok := v.(*Identifier)
+				if !ok {
+					return fmt.Errorf("invalid field: %v", ToScheme(v))
+				}
+				t.Fields = append(t.Fields, field.Name)
+				return nil
+			}, args[2])
+			if err != nil {
+				return nil, err
+			}
+			return t, nil
+		},
+	},
+	{
+		Name:   "scheme::condition-constructor",
+		Args:   []string{"name<symbol>", "rtd<any>"},
+		Return: types.Unspecified,
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			name, ok := args[0].(*Identifier)
+			if !ok {
+				return nil, fmt.Errorf("invalid name: %v", ToScheme(args[0]))
+			}
+			t, ok := args[1].(*ConditionType)
+			if !ok {
+				return nil, fmt.Errorf("not a condition type: %v",
+					ToScheme(args[1]))
+			}
+			return conditionConstructor(name.Name, t), nil
+		},
+	},
+	{
+		Name:   "scheme::condition-accessor",
+		Args:   []string{"name<symbol>", "rtd<any>", "field<symbol>"},
+		Return: types.Unspecified,
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			name, ok := args[0].(*Identifier)
+			if !ok {
+				return nil, fmt.Errorf("invalid name: %v", ToScheme(args[0]))
+			}
+			t, ok := args[1].(*ConditionType)
+			if !ok {
+				return nil, fmt.Errorf("not a condition type: %v",
+					ToScheme(args[1]))
+			}
+			field, ok := args[2].(*Identifier)
+			if !ok {
+				return nil, fmt.Errorf("invalid field: %v",
+					ToScheme(args[2]))
+			}
+			if _, ok := t.FieldIndex(field.Name); !ok {
+				return nil, fmt.Errorf("condition type %v has no field %v",
+					t.Name, field.Name)
+			}
+			return conditionAccessor(name.Name, t, field.Name), nil
+		},
+	},
+	{
+		Name:   "assertion-violation",
+		Args:   []string{"who", "message<string>", "irritant..."},
+		Return: types.Any,
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			return nil, newErrorCondition(condAssertion, args)
+		},
+	},
+}
+
+// newErrorCondition creates a condition of type t from the who, message,
+// and irritant arguments of the error and assertion-violation
+// procedures.
+func newErrorCondition(t *ConditionType, args []Value) error {
+	message, ok := args[1].(String)
+	if !ok {
+		return fmt.Errorf("invalid message: %v", args[1])
+	}
+	conditions := []*Condition{t.New()}
+	if args[0] != Boolean(false) {
+		conditions = append(conditions, condWho.New(args[0]))
+	}
+	conditions = append(conditions, condMessage.New(message))
+
+	var irritants Value
+	for i := len(args) - 1; i >= 2; i-- {
+		irritants = NewPair(args[i], irritants)
+	}
+	conditions = append(conditions, condIrritants.New(irritants))
+
+	return NewCondition(conditions...)
+}
@@ -0,0 +1,729 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+// The (rnrs records syntactic (6)), (rnrs records procedural (6)),
+// and (rnrs records inspection (6)) libraries.
+//
+
+package scheme
+
+import (
+	"fmt"
+
+	"github.com/markkurossi/scheme/types"
+)
+
+// recordParametrizer resolves the type of a record procedure from
+// the static record type of its record-type descriptor argument Arg.
+// If the record type is not known, the procedure type is resolved for
+// the generic record type.
+type recordParametrizer struct {
+	Arg     int
+	Resolve func(record *types.Type) *types.Type
+}
+
+// Parametrize implements types.Parametrizer.
+func (p recordParametrizer) Parametrize(ctx types.Ctx,
+	params []*types.Type) *types.Type {
+
+	record := types.Record
+	if p.Arg < len(params) && params[p.Arg].Enum == types.EnumRecordType {
+		record = params[p.Arg].Record
+	}
+	return p.Resolve(record)
+}
+
+// recordConstructorType returns the type of the constructor of the
+// record type.
+func recordConstructorType(record *types.Type) *types.Type {
+	return &types.Type{
+		Enum:   types.EnumLambda,
+		Rest:   types.Unspecified,
+		Return: record,
+	}
+}
+
+// recordPredicateType returns the type of the predicate of the record
+// type.
+func recordPredicateType(record *types.Type) *types.Type {
+	return &types.Type{
+		Enum:   types.EnumLambda,
+		Args:   []*types.Type{types.Any},
+		Return: types.Boolean,
+	}
+}
+
+// recordAccessorType returns the type of the field accessors of the
+// record type.
+func recordAccessorType(record *types.Type) *types.Type {
+	return &types.Type{
+		Enum:   types.EnumLambda,
+		Args:   []*types.Type{record},
+		Return: types.Unspecified,
+	}
+}
+
+// recordMutatorType returns the type of the field mutators of the
+// record type.
+func recordMutatorType(record *types.Type) *types.Type {
+	return &types.Type{
+		Enum:   types.EnumLambda,
+		Args:   []*types.Type{record, types.Unspecified},
+		Return: types.Unspecified,
+	}
+}
+
+// makeRecordType creates a record type from the arguments of
+// make-record-type-descriptor. Nongenerative record types are
+// registered in the image and an existing record type is returned
+// if it has the same definition.
+func (scm *Scheme) makeRecordType(args []Value) (*RecordType, error) {
+	name, ok := args[0].(*Identifier)
+	if !ok {
+		return nil, fmt.Errorf("invalid name: %v", ToScheme(args[0]))
+	}
+	t := &RecordType{
+		Name:   name.Name,
+		Sealed: args[3] != Boolean(false),
+		Opaque: args[4] != Boolean(false),
+	}
+	if args[1] != Boolean(false) {
+		t.Parent, ok = args[1].(*RecordType)
+		if !ok {
+			return nil, fmt.Errorf("not a record type: %v", ToScheme(args[1]))
+		}
+		if t.Parent.Sealed {
+			return nil, fmt.Errorf("parent record type %v is sealed",
+				t.Parent.Name)
+		}
+		if t.Parent.Opaque {
+			t.Opaque = true
+		}
+	}
+	fields, ok := args[5].(Vector)
+	if !ok {
+		return nil, fmt.Errorf("invalid fields: %v", ToScheme(args[5]))
+	}
+	for _, f := range fields {
+		spec, ok := ListValues(f)
+		if !ok || len(spec) != 2 {
+			return nil, fmt.Errorf("invalid field: %v", ToScheme(f))
+		}
+		kind, ok := spec[0].(*Identifier)
+		if !ok || (kind.Name != "mutable" && kind.Name != "immutable") {
+			return nil, fmt.Errorf("invalid field: %v", ToScheme(f))
+		}
+		fname, ok := spec[1].(*Identifier)
+		if !ok {
+			return nil, fmt.Errorf("invalid field: %v", ToScheme(f))
+		}
+		t.Fields = append(t.Fields, RecordField{
+			Name:    fname.Name,
+			Mutable: kind.Name == "mutable",
+		})
+	}
+
+	if args[2] == Boolean(false) {
+		return t, nil
+	}
+	uid, ok := args[2].(*Identifier)
+	if !ok {
+		return nil, fmt.Errorf("invalid uid: %v", ToScheme(args[2]))
+	}
+	t.UID = uid.Name
+
+	img := scm.image
+	img.recordsM.Lock()
+	defer img.recordsM.Unlock()
+
+	old, ok := img.records[t.UID]
+	if ok {
+		if !old.equivalent(t) {
+			return nil, fmt.Errorf("record type %v redefined with uid %v",
+				t.Name, t.UID)
+		}
+		return old, nil
+	}
+	img.records[t.UID] = t
+	return t, nil
+}
+
+// recordConstructor creates a constructor procedure for the
+// constructor descriptor c. The constructors with the default
+// protocols are implemented natively. The protocols are applied by
+// the Scheme runtime.
+func (scm *Scheme) recordConstructor(name string, c *RecordConstructor) (
+	Value, error) {
+
+	if !c.isDefault() {
+		sym := scm.Intern("scheme::record-protocol-constructor")
+		proc := sym.Global()
+		if proc == nil {
+			return nil, fmt.Errorf("record protocols not supported")
+		}
+		return scm.Apply(proc, []Value{c})
+	}
+
+	t := c.Kind
+	var names []string
+	for _, field := range t.AllFields() {
+		names = append(names, field.Name)
+	}
+	return nativeLambda(name, types.Record,
+		func(scm *Scheme, args []Value) (Value, error) {
+			fields := make([]Value, len(args))
+			copy(fields, args)
+			return &Record{
+				Kind:   t,
+				Fields: fields,
+			}, nil
+		}, names...), nil
+}
+
+// recordPredicate creates a predicate that tests if its argument is a
+// record of the record type t.
+func recordPredicate(name string, t *RecordType) *Lambda {
+	return nativeLambda(name, types.Boolean,
+		func(scm *Scheme, args []Value) (Value, error) {
+			r, ok := args[0].(*Record)
+			return Boolean(ok && r.Kind.IsA(t)), nil
+		}, "obj")
+}
+
+// recordArg checks that the argument value is a record of the record
+// type t.
+func recordArg(t *RecordType, v Value) (*Record, error) {
+	r, ok := v.(*Record)
+	if !ok || !r.Kind.IsA(t) {
+		return nil, fmt.Errorf("not a %v record: %v", t.Name, ToScheme(v))
+	}
+	return r, nil
+}
+
+// recordAccessor creates an accessor for the kth field of the record
+// type t.
+func recordAccessor(name string, t *RecordType, k int) (*Lambda, error) {
+	idx, err := t.FieldIndex(k)
+	if err != nil {
+		return nil, err
+	}
+	return nativeLambda(name, types.Unspecified,
+		func(scm *Scheme, args []Value) (Value, error) {
+			r, err := recordArg(t, args[0])
+			if err != nil {
+				return nil, err
+			}
+			return r.Fields[idx], nil
+		}, "record"), nil
+}
+
+// recordMutator creates a mutator for the kth field of the record
+// type t.
+func recordMutator(name string, t *RecordType, k int) (*Lambda, error) {
+	idx, err := t.FieldIndex(k)
+	if err != nil {
+		return nil, err
+	}
+	if !t.Fields[k].Mutable {
+		return nil, fmt.Errorf("field %v of record type %v is immutable",
+			t.Fields[k].Name, t.Name)
+	}
+	return nativeLambda(name, types.Unspecified,
+		func(scm *Scheme, args []Value) (Value, error) {
+			r, err := recordArg(t, args[0])
+			if err != nil {
+				return nil, err
+			}
+			r.Fields[idx] = args[1]
+			return nil, nil
+		}, "record", "obj"), nil
+}
+
+// recordTypeArg checks that the argument value is a record-type
+// descriptor.
+func recordTypeArg(v Value) (*RecordType, error) {
+	t, ok := v.(*RecordType)
+	if !ok {
+		return nil, fmt.Errorf("not a record type: %v", ToScheme(v))
+	}
+	return t, nil
+}
+
+// recordConstructorArg checks that the argument value is a record
+// constructor descriptor.
+func recordConstructorArg(v Value) (*RecordConstructor, error) {
+	c, ok := v.(*RecordConstructor)
+	if !ok {
+		return nil, fmt.Errorf("not a record constructor descriptor: %v",
+			ToScheme(v))
+	}
+	return c, nil
+}
+
+// recordProcName returns the procedure name from the name argument
+// of the record procedure builtins.
+func recordProcName(v Value) (string, error) {
+	name, ok := v.(*Identifier)
+	if !ok {
+		return "", fmt.Errorf("invalid name: %v", ToScheme(v))
+	}
+	return name.Name, nil
+}
+
+var rnrsRecordsSyntacticBuiltins = []Builtin{
+	{
+		Name: "scheme::make-record-type",
+		Args: []string{
+			"name<symbol>", "parent<any>", "uid<any>", "sealed<bool>",
+			"opaque<bool>", "fields<vector>", "parent-cd<any>",
+			"protocol<any>",
+		},
+		Return: types.RecordType,
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			t, err := scm.makeRecordType(args)
+			if err != nil {
+				return nil, err
+			}
+			if t.Constructor != nil {
+				// Nongenerative record type defined earlier.
+				return t, nil
+			}
+			var parent *RecordConstructor
+			if args[6] != Boolean(false) {
+				parent, err = recordConstructorArg(args[6])
+				if err != nil {
+					return nil, err
+				}
+			}
+			t.Constructor, err = NewRecordConstructor(t, parent, args[7])
+			if err != nil {
+				return nil, err
+			}
+			return t, nil
+		},
+	},
+	{
+		Name:         "scheme::record-constructor",
+		Args:         []string{"name<symbol>", "rtd"},
+		Return:       types.Unspecified,
+		Parametrizer: recordParametrizer{1, recordConstructorType},
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			name, err := recordProcName(args[0])
+			if err != nil {
+				return nil, err
+			}
+			t, err := recordTypeArg(args[1])
+			if err != nil {
+				return nil, err
+			}
+			if t.Constructor == nil {
+				return nil, fmt.Errorf("record type %v has no constructor",
+					t.Name)
+			}
+			return scm.recordConstructor(name, t.Constructor)
+		},
+	},
+	{
+		Name:         "scheme::record-predicate",
+		Args:         []string{"name<symbol>", "rtd"},
+		Return:       types.Unspecified,
+		Parametrizer: recordParametrizer{1, recordPredicateType},
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			name, err := recordProcName(args[0])
+			if err != nil {
+				return nil, err
+			}
+			t, err := recordTypeArg(args[1])
+			if err != nil {
+				return nil, err
+			}
+			return recordPredicate(name, t), nil
+		},
+	},
+	{
+		Name:         "scheme::record-accessor",
+		Args:         []string{"name<symbol>", "rtd", "k"},
+		Return:       types.Unspecified,
+		Parametrizer: recordParametrizer{1, recordAccessorType},
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			name, err := recordProcName(args[0])
+			if err != nil {
+				return nil, err
+			}
+			t, err := recordTypeArg(args[1])
+			if err != nil {
+				return nil, err
+			}
+			k, err := Int64(args[2])
+			if err != nil {
+				return nil, err
+			}
+			return recordAccessor(name, t, int(k))
+		},
+	},
+	{
+		Name:         "scheme::record-mutator",
+		Args:         []string{"name<symbol>", "rtd", "k"},
+		Return:       types.Unspecified,
+		Parametrizer: recordParametrizer{1, recordMutatorType},
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			name, err := recordProcName(args[0])
+			if err != nil {
+				return nil, err
+			}
+			t, err := recordTypeArg(args[1])
+			if err != nil {
+				return nil, err
+			}
+			k, err := Int64(args[2])
+			if err != nil {
+				return nil, err
+			}
+			return recordMutator(name, t, int(k))
+		},
+	},
+	{
+		Name:         "record-type-descriptor",
+		Args:         []string{"rtd"},
+		Return:       types.RecordType,
+		Parametrizer: recordParametrizer{0, types.NewRecordType},
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			return recordTypeArg(args[0])
+		},
+	},
+	{
+		Name:   "record-constructor-descriptor",
+		Args:   []string{"rtd"},
+		Return: types.Unspecified,
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			t, err := recordTypeArg(args[0])
+			if err != nil {
+				return nil, err
+			}
+			if t.Constructor == nil {
+				return nil, fmt.Errorf("record type %v has no constructor",
+					t.Name)
+			}
+			return t.Constructor, nil
+		},
+	},
+	{
+		Name:   "scheme::make-record",
+		Args:   []string{"rtd", "fields<list>"},
+		Return: types.Record,
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			t, err := recordTypeArg(args[0])
+			if err != nil {
+				return nil, err
+			}
+			fields, ok := ListValues(args[1])
+			if !ok {
+				return nil, fmt.Errorf("invalid fields: %v",
+					ToScheme(args[1]))
+			}
+			if len(fields) != t.NumFields() {
+				return nil, fmt.Errorf("%v: expected %v fields, got %v",
+					t.Name, t.NumFields(), len(fields))
+			}
+			return &Record{
+				Kind:   t,
+				Fields: fields,
+			}, nil
+		},
+	},
+	{
+		Name:   "scheme::rcd-rtd",
+		Args:   []string{"rcd<any>"},
+		Return: types.RecordType,
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			c, err := recordConstructorArg(args[0])
+			if err != nil {
+				return nil, err
+			}
+			return c.Kind, nil
+		},
+	},
+	{
+		Name:   "scheme::rcd-parent",
+		Args:   []string{"rcd<any>"},
+		Return: types.Any,
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			c, err := recordConstructorArg(args[0])
+			if err != nil {
+				return nil, err
+			}
+			if c.Parent == nil {
+				return Boolean(false), nil
+			}
+			return c.Parent, nil
+		},
+	},
+	{
+		Name:   "scheme::rcd-protocol",
+		Args:   []string{"rcd<any>"},
+		Return: types.Any,
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			c, err := recordConstructorArg(args[0])
+			if err != nil {
+				return nil, err
+			}
+			if c.Protocol == nil {
+				return Boolean(false), nil
+			}
+			return c.Protocol, nil
+		},
+	},
+	{
+		Name:   "scheme::record-type-num-fields",
+		Args:   []string{"rtd"},
+		Return: types.InexactInteger,
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			t, err := recordTypeArg(args[0])
+			if err != nil {
+				return nil, err
+			}
+			return Int(t.NumFields()), nil
+		},
+	},
+}
+
+var rnrsRecordsProceduralBuiltins = []Builtin{
+	{
+		Name: "make-record-type-descriptor",
+		Args: []string{
+			"name<symbol>", "parent<any>", "uid<any>", "sealed<bool>",
+			"opaque<bool>", "fields<vector>",
+		},
+		Return: types.RecordType,
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			return scm.makeRecordType(args)
+		},
+	},
+	{
+		Name:   "record-type-descriptor?",
+		Args:   []string{"obj"},
+		Return: types.Boolean,
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			_, ok := args[0].(*RecordType)
+			return Boolean(ok), nil
+		},
+	},
+	{
+		Name:   "make-record-constructor-descriptor",
+		Args:   []string{"rtd", "parent-cd<any>", "protocol<any>"},
+		Return: types.Unspecified,
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			t, err := recordTypeArg(args[0])
+			if err != nil {
+				return nil, err
+			}
+			var parent *RecordConstructor
+			if args[1] != Boolean(false) {
+				parent, err = recordConstructorArg(args[1])
+				if err != nil {
+					return nil, err
+				}
+			}
+			return NewRecordConstructor(t, parent, args[2])
+		},
+	},
+	{
+		Name:   "record-constructor",
+		Args:   []string{"rcd<any>"},
+		Return: recordConstructorType(types.Record),
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			c, err := recordConstructorArg(args[0])
+			if err != nil {
+				return nil, err
+			}
+			return scm.recordConstructor("", c)
+		},
+	},
+	{
+		Name:         "record-predicate",
+		Args:         []string{"rtd"},
+		Return:       recordPredicateType(types.Record),
+		Parametrizer: recordParametrizer{0, recordPredicateType},
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			t, err := recordTypeArg(args[0])
+			if err != nil {
+				return nil, err
+			}
+			return recordPredicate("", t), nil
+		},
+	},
+	{
+		Name:         "record-accessor",
+		Args:         []string{"rtd", "k"},
+		Return:       recordAccessorType(types.Record),
+		Parametrizer: recordParametrizer{0, recordAccessorType},
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			t, err := recordTypeArg(args[0])
+			if err != nil {
+				return nil, err
+			}
+			k, err := Int64(args[1])
+			if err != nil {
+				return nil, err
+			}
+			return recordAccessor("", t, int(k))
+		},
+	},
+	{
+		Name:         "record-mutator",
+		Args:         []string{"rtd", "k"},
+		Return:       recordMutatorType(types.Record),
+		Parametrizer: recordParametrizer{0, recordMutatorType},
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			t, err := recordTypeArg(args[0])
+			if err != nil {
+				return nil, err
+			}
+			k, err := Int64(args[1])
+			if err != nil {
+				return nil, err
+			}
+			return recordMutator("", t, int(k))
+		},
+	},
+}
+
+var rnrsRecordsInspectionBuiltins = []Builtin{
+	{
+		Name:   "record?",
+		Args:   []string{"obj"},
+		Return: types.Boolean,
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			r, ok := args[0].(*Record)
+			return Boolean(ok && !r.Kind.Opaque), nil
+		},
+	},
+	{
+		Name:   "record-rtd",
+		Args:   []string{"record"},
+		Return: types.RecordType,
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			r, ok := args[0].(*Record)
+			if !ok || r.Kind.Opaque {
+				return nil, fmt.Errorf("not a non-opaque record: %v",
+					ToScheme(args[0]))
+			}
+			return r.Kind, nil
+		},
+	},
+	{
+		Name:   "record-type-name",
+		Args:   []string{"rtd"},
+		Return: types.Symbol,
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			t, err := recordTypeArg(args[0])
+			if err != nil {
+				return nil, err
+			}
+			return scm.Intern(t.Name), nil
+		},
+	},
+	{
+		Name:   "record-type-parent",
+		Args:   []string{"rtd"},
+		Return: types.Any,
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			t, err := recordTypeArg(args[0])
+			if err != nil {
+				return nil, err
+			}
+			if t.Parent == nil {
+				return Boolean(false), nil
+			}
+			return t.Parent, nil
+		},
+	},
+	{
+		Name:   "record-type-uid",
+		Args:   []string{"rtd"},
+		Return: types.Any,
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			t, err := recordTypeArg(args[0])
+			if err != nil {
+				return nil, err
+			}
+			if len(t.UID) == 0 {
+				return Boolean(false), nil
+			}
+			return scm.Intern(t.UID), nil
+		},
+	},
+	{
+		Name:   "record-type-generative?",
+		Args:   []string{"rtd"},
+		Return: types.Boolean,
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			t, err := recordTypeArg(args[0])
+			if err != nil {
+				return nil, err
+			}
+			return Boolean(len(t.UID) == 0), nil
+		},
+	},
+	{
+		Name:   "record-type-sealed?",
+		Args:   []string{"rtd"},
+		Return: types.Boolean,
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			t, err := recordTypeArg(args[0])
+			if err != nil {
+				return nil, err
+			}
+			return Boolean(t.Sealed), nil
+		},
+	},
+	{
+		Name:   "record-type-opaque?",
+		Args:   []string{"rtd"},
+		Return: types.Boolean,
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			t, err := recordTypeArg(args[0])
+			if err != nil {
+				return nil, err
+			}
+			return Boolean(t.Opaque), nil
+		},
+	},
+	{
+		Name:   "record-type-field-names",
+		Args:   []string{"rtd"},
+		Return: types.Unspecified,
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			t, err := recordTypeArg(args[0])
+			if err != nil {
+				return nil, err
+			}
+			names := make(Vector, len(t.Fields))
+			for idx, field := range t.Fields {
+				names[idx] = scm.Intern(field.Name)
+			}
+			return names, nil
+		},
+	},
+	{
+		Name:   "record-field-mutable?",
+		Args:   []string{"rtd", "k"},
+		Return: types.Boolean,
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			t, err := recordTypeArg(args[0])
+			if err != nil {
+				return nil, err
+			}
+			k, err := Int64(args[1])
+			if err != nil {
+				return nil, err
+			}
+			if _, err := t.FieldIndex(int(k)); err != nil {
+				return nil, err
+			}
+			return Boolean(t.Fields[k].Mutable), nil
+		},
+	},
+}
@@ -0,0 +1,43 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+// The (rnrs sorting (6)) library.
+//
+
+package scheme
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/markkurossi/scheme/types"
+)
+
+var rnrsSortingBuiltins = []Builtin{
+	{
+		Name:   "scheme::vector-sort!",
+		Args:   []string{"proc<any>", "vector"},
+		Return: types.Any,
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			vector, ok := args[1].(Vector)
+			if !ok {
+				return nil, fmt.Errorf("invalid vector: %v", args[1])
+			}
+			var err error
+			sort.SliceStable(vector, func(i, j int) bool {
+				if err != nil {
+					return false
+				}
+				var v Value
+				v, err = scm.Apply(args[0], []Value{vector[i], vector[j]})
+				return err == nil && IsTrue(v)
+			})
+			if err != nil {
+				return nil, err
+			}
+			return nil, nil
+		},
+	},
+}
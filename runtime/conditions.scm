@@ -0,0 +1,14 @@
+;;;
+;;; Copyright (c) 2024 Markku Rossi
+;;;
+;;; All rights reserved.
+;;;
+
+;; The condition types, their constructors, predicates, and field
+;; accessors are implemented natively. The condition-accessor is
+;; defined here since its accessor procedure can be any Scheme
+;; procedure.
+
+(define (condition-accessor rtd proc)
+  (lambda (condition)
+    (proc (scheme::condition-component rtd condition))))
@@ -78,3 +78,67 @@
                 (apply f (scheme::list-heads lists))
                 (iter (not even) (scheme::list-tails lists)))))))
     (iter #t lists)))
+
+;; The dynamic-wind extents are kept in the scheme::winders list as
+;; (before . after) pairs, innermost extent first.
+
+(define-constant (dynamic-wind before thunk after)
+  (before)
+  (let ((winders (scheme::winders)))
+    (scheme::set-winders! (cons (cons before after) winders))
+    (let ((result (thunk)))
+      (scheme::set-winders! winders)
+      (after)
+      result)))
+
+;; The scheme::rewind moves from the current dynamic-wind extent to
+;; the extent of the argument winders list. It calls the after thunks
+;; of the extents being exited, innermost first, and the before thunks
+;; of the extents being entered, outermost first.
+(define (scheme::rewind to)
+  (letrec ((drop
+            (lambda (lst n)
+              (if (> n 0)
+                  (drop (cdr lst) (- n 1))
+                  lst)))
+           (common
+            (lambda (a b)
+              (if (eq? a b)
+                  a
+                  (common (cdr a) (cdr b)))))
+           (unwind
+            (lambda (common)
+              (let ((winders (scheme::winders)))
+                (if (not (eq? winders common))
+                    (begin
+                      (scheme::set-winders! (cdr winders))
+                      ((cdar winders))
+                      (unwind common))))))
+           (rewind
+            (lambda (winders common)
+              (if (not (eq? winders common))
+                  (begin
+                    (rewind (cdr winders) common)
+                    ((caar winders))
+                    (scheme::set-winders! winders))))))
+    (let* ((from (scheme::winders))
+           (from-length (length from))
+           (to-length (length to))
+           (base (common (drop from (- from-length (min from-length to-length)))
+                         (drop to (- to-length (min from-length to-length))))))
+      (unwind base)
+      (rewind to base))))
+
+(define-constant (call-with-current-continuation proc)
+  (let ((winders (scheme::winders))
+        (handlers (scheme::handlers)))
+    (scheme::call/cc
+     (lambda (k)
+       (proc (lambda values
+               (if (not (scheme::continuation-valid? k))
+                   (error 'continuation "continuation of returned call"))
+               (scheme::rewind winders)
+               (scheme::set-handlers! handlers)
+               (scheme::apply k values)))))))
+
+(define-constant call/cc call-with-current-continuation)
@@ -0,0 +1,64 @@
+;;;
+;;; Copyright (c) 2024 Markku Rossi
+;;;
+;;; All rights reserved.
+;;;
+
+;; The current exception handlers are kept in a list, innermost
+;; first. Continuations restore the handlers of their capture time so
+;; the handlers follow the dynamic extents like the dynamic-wind
+;; winders.
+
+(define-constant (with-exception-handler handler thunk)
+  (let ((handlers (scheme::handlers)))
+    (scheme::set-handlers! (cons handler handlers))
+    (let ((result (thunk)))
+      (scheme::set-handlers! handlers)
+      result)))
+
+;; The handler is called with the handlers that were current when it
+;; was installed. If the handler returns, a non-continuable violation
+;; is raised in the handler's dynamic environment.
+(define-constant (raise obj)
+  (let ((handlers (scheme::handlers)))
+    (if (null? handlers)
+        (scheme::raise obj)
+        (begin
+          (scheme::set-handlers! (cdr handlers))
+          ((car handlers) obj)
+          (raise (scheme::non-continuable obj))))))
+
+(define-constant (raise-continuable obj)
+  (let ((handlers (scheme::handlers)))
+    (if (null? handlers)
+        (scheme::raise obj)
+        (begin
+          (scheme::set-handlers! (cdr handlers))
+          (let ((result ((car handlers) obj)))
+            (scheme::set-handlers! handlers)
+            result)))))
+
+;; scheme::guard implements the guard syntax. The body thunk is called
+;; with an exception handler that returns to the guard's continuation
+;; and calls the clauses procedure with the raised object. If none of
+;; the clauses match, the clauses procedure calls its reraise thunk
+;; which re-raises the object with raise-continuable in the dynamic
+;; environment of the original raise.
+(define (scheme::guard body clauses)
+  ((call/cc
+    (lambda (guard-k)
+      (with-exception-handler
+       (lambda (condition)
+         ((call/cc
+           (lambda (handler-k)
+             (guard-k
+              (lambda ()
+                (clauses condition
+                         (lambda ()
+                           (handler-k
+                            (lambda ()
+                              (raise-continuable condition)))))))))))
+       (lambda ()
+         (call-with-values body
+           (lambda args
+             (guard-k (lambda () (apply values args)))))))))))
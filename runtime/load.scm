@@ -1,5 +1,5 @@
 ;;;
-;;; Copyright (c) 2023 Markku Rossi
+;;; Copyright (c) 2023-2024 Markku Rossi
 ;;;
 ;;; All rights reserved.
 ;;;
@@ -107,39 +107,66 @@
                ((equal? obj (caar alist)) (car alist))
                (else (assoc obj (cdr alist))))))
 
-           ;; The importer imports all library imports and returns a
-           ;; boolean success status.
+           ;; The check-version checks that the version of the
+           ;; imported library matches the version reference of the
+           ;; import.
+           (check-version
+            (lambda (import lib version-ref)
+              (if (not (scheme::version-match? version-ref (lib-version lib)))
+                  (error 'import "library version mismatch"
+                         import (lib-version lib)))))
+
+           ;; The importer imports all library imports. The imports
+           ;; are the library references of the import sets. The
+           ;; importer raises an error if an imported library can't
+           ;; be initialized.
            (importer
             (lambda (imports)
-              (if (null? imports)
-                  #t
+              (if (not (null? imports))
                   (let* ((lib-name (parse-lib-name (car imports)))
-                         (lib-version (parse-lib-version (car imports)))
+                         (version-ref (parse-lib-version (car imports)))
                          (lib (assoc lib-name scheme::libraries)))
+                    (if (not lib)
+                        (begin
+                          ;; Load library.
+                          (load-library lib-name)
+                          (set! lib (assoc lib-name scheme::libraries))))
                     (cond
                      ((not lib)
-                      ;; Load library.
-                      (load-library lib-name)
-
-                      ;; Check that the library was initialized.
-                      (set! lib (assoc lib-name scheme::libraries))
-                      (if (and lib (eq? (lib-status lib) 'initialized))
-                          (importer (cdr imports))
-                          #f))
+                      (error 'import "library not defined" lib-name))
                      ((eq? (lib-status lib) 'initialized)
                       ;; Import initialized.
+                      (check-version (car imports) lib version-ref)
                       (importer (cdr imports)))
+                     ((eq? (lib-status lib) 'initializing)
+                      (error 'import "circular library import" lib-name))
                      (else
-                      ;; Dependency error.
-                      #f)))))))
-
-    (let* ((lib-name (parse-lib-name (cadr library)))
-           (lib-version (parse-lib-version (cadr library)))
-           (lib-exports (caddr library))
-           (lib-imports (cadddr library))
-           (lib-library (cadddr (cdr library)))
-           (this (assoc lib-name scheme::libraries))
-           (result #f))
+                      (error 'import "library initialization failed"
+                             lib-name)))))))
+
+           ;; The init initializes the library. The library is
+           ;; registered before its imports are loaded so the circular
+           ;; imports are detected. The library status is set to
+           ;; error if the initialization fails.
+           (init
+            (lambda (lib-name lib-version lib-imports lib-library)
+              (let ((this (list lib-name lib-version 'initializing)))
+                (set! scheme::libraries (cons this scheme::libraries))
+                (dynamic-wind
+                  (lambda () #f)
+                  (lambda ()
+                    (importer lib-imports)
+                    (let ((result ((scheme::compile lib-library))))
+                      (set-lib-status! this 'initialized)
+                      result))
+                  (lambda ()
+                    (if (eq? (lib-status this) 'initializing)
+                        (set-lib-status! this 'error))))))))
+
+    (let ((lib-name (parse-lib-name (cadr library)))
+          (lib-version (parse-lib-version (cadr library)))
+          (lib-imports (cadddr library))
+          (lib-library (cadddr (cdr library))))
       (if #f
           (begin
             (display "scheme::init-library: ") (display lib-name)
@@ -149,24 +176,22 @@
                   (display lib-imports)))
             (newline)))
 
-      (if this
-          ;; Library seen, check that is has been initialized
-          ;; successfully.
-          (eq? (lib-status this) 'initialized)
-
-          ;; Library not seen before. Initialize it now.
+      ;; The library registry is shared by the machines of the image
+      ;; so the libraries are initialized with the library lock
+      ;; held. The top-level programs are run without the lock after
+      ;; their imports have been initialized.
+      (if (main? lib-name)
           (begin
-            (set! this (list lib-name lib-version 'initializing))
-            (if (not (main? lib-name))
-                (set! scheme::libraries (cons this scheme::libraries)))
-
-            ;; Imports.
-            (if (importer lib-imports)
-                (begin
-                  ;; Imports loaded, now init this module.
-                  (set! result ((scheme::compile lib-library)))
-                  (set-lib-status! this 'initialized))
-                (set-lib-status! this 'error))
-
-            ;; XXX return an error if init fails
-            result)))))
+            (scheme::with-library-lock
+             (lambda ()
+               (importer lib-imports)))
+            ((scheme::compile lib-library)))
+          (scheme::with-library-lock
+           (lambda ()
+             (let ((this (assoc lib-name scheme::libraries)))
+               (if this
+                   ;; Library seen, check that is has been
+                   ;; initialized successfully.
+                   (eq? (lib-status this) 'initialized)
+                   (init lib-name lib-version lib-imports
+                         lib-library)))))))))
@@ -0,0 +1,56 @@
+;;;
+;;; Copyright (c) 2024 Markku Rossi
+;;;
+;;; All rights reserved.
+;;;
+
+;; The record types, predicates, field accessors, and the record
+;; constructors with the default protocols are implemented natively.
+;; The constructors with protocols are defined here since the
+;; protocols are Scheme procedures.
+
+;; The record-protocol-constructor creates the constructor of the
+;; constructor descriptor rcd by calling its protocol.
+(define (scheme::record-protocol-constructor rcd)
+  (scheme::record-maker rcd (scheme::rcd-rtd rcd) '()))
+
+;; The record-maker calls the protocol of the constructor descriptor
+;; rcd to create a constructor for the records of type rtd. The rtd is
+;; the rcd's record type or its subtype. The child-values are the
+;; field values of the subtypes, and they follow the field values of
+;; the rcd's record type in the record.
+(define (scheme::record-maker rcd rtd child-values)
+  (let ((parent (scheme::rcd-parent rcd))
+        (protocol (scheme::record-protocol rcd)))
+    (if parent
+        (protocol
+         (lambda parent-args
+           (lambda field-values
+             (apply (scheme::record-maker parent rtd
+                                          (append field-values child-values))
+                    parent-args))))
+        (protocol
+         (lambda field-values
+           (scheme::make-record rtd (append field-values child-values)))))))
+
+;; The record-protocol returns the protocol of the constructor
+;; descriptor rcd. The default protocol with a parent type splits the
+;; constructor arguments between the parent and the record type.
+(define (scheme::record-protocol rcd)
+  (let ((protocol (scheme::rcd-protocol rcd))
+        (parent (scheme::rcd-parent rcd)))
+    (cond
+     (protocol protocol)
+     (parent
+      (let ((count (scheme::record-type-num-fields (scheme::rcd-rtd parent))))
+        (lambda (n)
+          (lambda args
+            (let loop ((parent-args '())
+                       (args args)
+                       (count count))
+              (if (zero? count)
+                  (apply (apply n (reverse parent-args)) args)
+                  (loop (cons (car args) parent-args) (cdr args)
+                        (- count 1))))))))
+     (else
+      (lambda (p) p)))))
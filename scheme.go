@@ -8,6 +8,7 @@ package scheme
 
 import (
 	"bytes"
+	"context"
 	"embed"
 	"fmt"
 	"io"
@@ -15,6 +16,9 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/markkurossi/scheme/types"
 )
@@ -24,7 +28,11 @@ import (
 //go:embed runtime/*.scm
 var runtime embed.FS
 
-// Scheme implements Scheme interpreter and virtual machine.
+// Scheme implements Scheme interpreter and virtual machine. Each
+// Scheme instance is a machine with its own registers and stack, and
+// it runs programs in its image. A machine must not be used from
+// multiple goroutines concurrently but the machines of an image can
+// run in parallel.
 type Scheme struct {
 	Params  Params
 	Stdout  *Port
@@ -32,16 +40,22 @@ type Scheme struct {
 	Parsing bool
 	verbose bool
 
-	hasRuntime bool
-
-	pragmaVerboseTypecheck bool
-
-	pc      int
-	sp      int
-	fp      int
-	stack   []Value
-	symbols map[string]*Identifier
-	frameFL *Frame
+	image *Image
+
+	pc       int
+	sp       int
+	fp       int
+	stack    []Value
+	frameFL  *Frame
+	winders  Value
+	handlers Value
+	ctx      context.Context
+	fuel     int64
+	running  bool
+	run      *vmRun
+	imported map[string]*Identifier
+
+	expansion *syntaxExpansion
 }
 
 // Params define the configuration parameters for Scheme.
@@ -58,22 +72,122 @@ type Params struct {
 
 	// Do not warn when redefining global symbols.
 	NoWarnDefine bool
+
+	// MaxStackDepth specifies the maximum size of the VM stack in
+	// values. The stack grows on demand up to this limit. If the
+	// value is 0, the DefaultMaxStackDepth is used.
+	MaxStackDepth int
+
+	// Fuel specifies the maximum number of VM instructions each
+	// Eval, EvalFile, and Apply call can execute. If the budget is
+	// exhausted, the call fails with ErrOutOfFuel. If the value is
+	// 0, the number of instructions is not limited.
+	Fuel int64
+
+	// CleanupFuel specifies the maximum number of VM instructions
+	// the dynamic-wind after thunks can execute when an evaluation
+	// is aborted because its context is done or its instruction
+	// budget is exhausted. If the value is 0, the DefaultCleanupFuel
+	// is used.
+	CleanupFuel int64
+
+	// CleanupTimeout specifies the maximum time the dynamic-wind
+	// after thunks can run when an evaluation is aborted. If the
+	// value is 0, the DefaultCleanupTimeout is used.
+	CleanupTimeout time.Duration
 }
 
+// Stack depth limits.
+const (
+	// DefaultMaxStackDepth is the default maximum VM stack depth.
+	DefaultMaxStackDepth = 1024 * 1024
+
+	// initialStackDepth is the initial VM stack depth.
+	initialStackDepth = 4096
+)
+
+// Cleanup limits.
+const (
+	// DefaultCleanupFuel is the default instruction budget of the
+	// after thunks of aborted evaluations.
+	DefaultCleanupFuel = 1000000
+
+	// DefaultCleanupTimeout is the default time limit of the after
+	// thunks of aborted evaluations.
+	DefaultCleanupTimeout = 100 * time.Millisecond
+)
+
 // New creates a new Scheme interpreter.
 func New() (*Scheme, error) {
 	return NewWithParams(Params{})
 }
 
-// NewWithParams creates a new Scheme interpreter with the parameters.
+// NewWithParams creates a new Scheme interpreter with the
+// parameters. The interpreter is a machine of a new image.
 func NewWithParams(params Params) (*Scheme, error) {
-	scm := &Scheme{
-		Params:  params,
-		Stdout:  NewPort(os.Stdout),
-		Stderr:  NewPort(os.Stderr),
-		stack:   make([]Value, 4096), // XXX initial stack depth
-		symbols: make(map[string]*Identifier),
+	img, err := NewImage(params)
+	if err != nil {
+		return nil, err
 	}
+	return img.NewMachine(), nil
+}
+
+// Image holds the state that is shared between Scheme machines: the
+// symbol table with the global bindings, and the runtime. The image
+// is safe for concurrent use so its machines can run programs in
+// parallel goroutines.
+type Image struct {
+	params     Params
+	hasRuntime bool
+
+	// m protects the symbol table.
+	m       sync.RWMutex
+	symbols map[string]*Identifier
+
+	// compile serializes parsing and compilation which access the
+	// global types of the symbols and the macros.
+	compile machineLock
+	macros  map[string]*Macro
+
+	// initLibraries serializes the library initialization which
+	// accesses the library registry of the runtime.
+	initLibraries machineLock
+
+	// libraries holds the compiled libraries by their names. The
+	// libraries are accessed with the compile lock held.
+	libraries map[string]*Library
+
+	// records holds the nongenerative record types by their UIDs.
+	recordsM sync.Mutex
+	records  map[string]*RecordType
+
+	// marks counts the macro expansion marks. The marks are also
+	// allocated at runtime by generate-temporaries.
+	marks atomic.Int64
+
+	pragmaVerboseTypecheck bool
+}
+
+// NewImage creates a new image with the parameters. The image is
+// initialized with the builtin functions and the Scheme runtime.
+func NewImage(params Params) (*Image, error) {
+	if params.MaxStackDepth <= 0 {
+		params.MaxStackDepth = DefaultMaxStackDepth
+	}
+	if params.CleanupFuel <= 0 {
+		params.CleanupFuel = DefaultCleanupFuel
+	}
+	if params.CleanupTimeout <= 0 {
+		params.CleanupTimeout = DefaultCleanupTimeout
+	}
+	img := &Image{
+		params:    params,
+		symbols:   make(map[string]*Identifier),
+		macros:    make(map[string]*Macro),
+		libraries: make(map[string]*Library),
+		records:   make(map[string]*RecordType),
+	}
+	scm := img.NewMachine()
 
 	scm.DefineBuiltins(booleanBuiltins)
 	scm.DefineBuiltins(characterBuiltins)
@@ -85,6 +199,9 @@ func NewWithParams(params Params) (*Scheme, error) {
 	scm.DefineBuiltins(symbolBuiltins)
 	scm.DefineBuiltins(vectorBuiltins)
 	scm.DefineBuiltins(loadBuiltins)
+	scm.DefineBuiltins(continuationBuiltins)
+	scm.DefineBuiltins(conditionBuiltins)
+	scm.DefineBuiltins(valuesBuiltins)
 	scm.DefineBuiltins(vmBuiltins)
 
 	scm.DefineBuiltins(rnrsUnicodeBuiltins)
@@ -94,15 +211,124 @@ func NewWithParams(params Params) (*Scheme, error) {
 	scm.DefineBuiltins(rnrsMutablePairsBuiltins)
 	scm.DefineBuiltins(rnrsMutableStringsBuiltins)
 	scm.DefineBuiltins(rnrsProgramsBuiltins)
-
-	if !scm.Params.NoRuntime {
+	scm.DefineBuiltins(rnrsConditionsBuiltins)
+	scm.DefineBuiltins(rnrsRecordsSyntacticBuiltins)
+	scm.DefineBuiltins(rnrsRecordsProceduralBuiltins)
+	scm.DefineBuiltins(rnrsRecordsInspectionBuiltins)
+	scm.DefineBuiltins(rnrsSortingBuiltins)
+	scm.DefineBuiltins(rnrsSyntaxCaseBuiltins)
+
+	scm.defineCallCC()
+	scm.defineCallWithValues()
+	scm.defineConditionTypes()
+
+	if !params.NoRuntime {
 		err := scm.loadRuntime("runtime")
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	return scm, nil
+	return img, nil
+}
+
+// machineLock implements a lock that is re-entrant for the machine
+// holding it.
+type machineLock struct {
+	m     sync.Mutex
+	owner atomic.Pointer[Scheme]
+	depth int
+}
+
+// lock locks the lock for the machine scm.
+func (l *machineLock) lock(scm *Scheme) {
+	if l.owner.Load() == scm {
+		l.depth++
+		return
+	}
+	l.m.Lock()
+	l.owner.Store(scm)
+	l.depth = 1
+}
+
+// unlock releases the lock.
+func (l *machineLock) unlock() {
+	l.depth--
+	if l.depth == 0 {
+		l.owner.Store(nil)
+		l.m.Unlock()
+	}
+}
+
+// lockCompile locks the image for parsing and compilation. The lock
+// is re-entrant for the machine holding it so macro transformers and
+// library imports can compile code while their caller is compiling.
+func (img *Image) lockCompile(scm *Scheme) {
+	img.compile.lock(scm)
+}
+
+// unlockCompile releases the compilation lock.
+func (img *Image) unlockCompile() {
+	img.compile.unlock()
+}
+
+// newMark allocates a new macro expansion mark.
+func (img *Image) newMark() int {
+	return int(img.marks.Add(1))
+}
+
+// NewMachine creates a new machine for running programs in the
+// image. The machine is initialized with the image parameters.
+func (img *Image) NewMachine() *Scheme {
+	depth := initialStackDepth
+	if depth > img.params.MaxStackDepth {
+		depth = img.params.MaxStackDepth
+	}
+	return &Scheme{
+		Params: img.params,
+		Stdout: NewPort(os.Stdout),
+		Stderr: NewPort(os.Stderr),
+		image:  img,
+		stack:  make([]Value, depth),
+		fuel:   -1,
+	}
+}
+
+// Intern interns the name and returns the interned symbol.
+func (img *Image) Intern(name string) *Identifier {
+	img.m.RLock()
+	id, ok := img.symbols[name]
+	img.m.RUnlock()
+	if ok {
+		return id
+	}
+
+	img.m.Lock()
+	defer img.m.Unlock()
+
+	id, ok = img.symbols[name]
+	if !ok {
+		id = &Identifier{
+			Name:       name,
+			GlobalType: types.Unspecified,
+		}
+		img.symbols[name] = id
+	}
+	return id
+}
+
+// lookup returns the interned symbol of the name.
+func (img *Image) lookup(name string) (*Identifier, bool) {
+	img.m.RLock()
+	defer img.m.RUnlock()
+
+	id, ok := img.symbols[name]
+	return id, ok
+}
+
+// Image returns the image of the machine.
+func (scm *Scheme) Image() *Image {
+	return scm.image
 }
 
 func (scm *Scheme) verbosef(format string, a ...interface{}) {
@@ -133,7 +359,7 @@ func (scm *Scheme) loadRuntime(dir string) error {
 			return err
 		}
 	}
-	scm.hasRuntime = true
+	scm.image.hasRuntime = true
 
 	return nil
 }
@@ -153,6 +379,9 @@ func (scm *Scheme) DefineBuiltin(builtin Builtin) {
 		panic(fmt.Sprintf("builtin %v: no return type defined", builtin.Name))
 	}
 
+	scm.image.lockCompile(scm)
+	defer scm.image.unlockCompile()
+
 	var minArgs, maxArgs int
 	var usage []*TypedName
 	var rest bool
@@ -194,38 +423,54 @@ func (scm *Scheme) DefineBuiltin(builtin Builtin) {
 	}
 	sym := scm.Intern(builtin.Name)
 	sym.GlobalType = lambda.Type()
-	sym.Global = lambda
-	sym.Flags |= FlagDefined
-	sym.Flags |= builtin.Flags
+	sym.GlobalType.Parametrizer = builtin.Parametrizer
+	sym.bind(lambda, builtin.Flags)
 
 	for _, alias := range builtin.Aliases {
 		as := scm.Intern(alias)
 		as.GlobalType = sym.GlobalType
-		as.Global = &Lambda{
+		as.bind(&Lambda{
 			Impl: &LambdaImpl{
 				Name:   alias,
 				Args:   args,
 				Return: builtin.Return,
 				Native: builtin.Native,
 			},
-		}
-		as.Flags |= FlagDefined
+		}, 0)
 	}
 }
 
 // EvalFile evaluates the scheme file.
 func (scm *Scheme) EvalFile(file string) (Value, error) {
+	return scm.EvalFileContext(context.Background(), file)
+}
+
+// EvalFileContext evaluates the scheme file. The evaluation is
+// aborted if the context is cancelled or its deadline expires.
+func (scm *Scheme) EvalFileContext(ctx context.Context, file string) (
+	Value, error) {
+
 	in, err := os.Open(file)
 	if err != nil {
 		return nil, err
 	}
 	defer in.Close()
-	return scm.Eval(file, in)
+	return scm.EvalContext(ctx, file, in)
 }
 
 // Eval evaluates the scheme source.
 func (scm *Scheme) Eval(source string, in io.Reader) (Value, error) {
-	if scm.hasRuntime {
+	return scm.EvalContext(context.Background(), source, in)
+}
+
+// EvalContext evaluates the scheme source. The evaluation is aborted
+// if the context is cancelled or its deadline expires.
+func (scm *Scheme) EvalContext(ctx context.Context, source string,
+	in io.Reader) (Value, error) {
+
+	defer scm.restoreLimits(scm.setLimits(ctx))
+
+	if scm.image.hasRuntime {
 		return scm.evalRuntime(source, in)
 	}
 	return scm.eval(source, in)
@@ -238,7 +483,9 @@ func (scm *Scheme) evalRuntime(source string, in io.Reader) (Value, error) {
 	}
 	sym := scm.Intern("scheme::init-library")
 
-	return scm.Apply(sym.Global, []Value{library})
+	init := sym.Global()
+
+	return scm.apply(init, []Value{library})
 }
 
 func (scm *Scheme) eval(source string, in io.Reader) (Value, error) {
@@ -260,27 +507,29 @@ func (scm *Scheme) eval(source string, in io.Reader) (Value, error) {
 		return nil, err
 	}
 
-	return scm.Apply(init, nil)
+	return scm.apply(init, nil)
 }
 
 // Global returns the global value of the symbol.
 func (scm *Scheme) Global(name string) (Value, error) {
-	id, ok := scm.symbols[name]
-	if !ok || id.Flags&FlagDefined == 0 {
+	id, ok := scm.image.lookup(name)
+	if !ok {
+		return nil, fmt.Errorf("undefined symbol '%s'", name)
+	}
+	value, flags := id.global()
+	if flags&FlagDefined == 0 {
 		return nil, fmt.Errorf("undefined symbol '%s'", name)
 	}
-	return id.Global, nil
+	return value, nil
 }
 
 // SetGlobal sets the value of the global symbol. The function returns
 // an error if the symbols was defined to be a FlagFinal. The symbol
 // will became defined if it was undefined before the call.
 func (scm *Scheme) SetGlobal(name string, value Value) error {
-	id := scm.Intern(name)
-	if id.Flags&FlagConst != 0 {
+	_, ok := scm.Intern(name).Define(value, 0)
+	if !ok {
 		return fmt.Errorf("can't reset final symbol '%s'", name)
 	}
-	id.Flags |= FlagDefined
-	id.Global = value
 	return nil
 }
@@ -58,23 +58,28 @@ func (p *SexprParser) Next() (Value, error) {
 	}
 	switch t.Type {
 	case '\'':
-		v, err := p.Next()
-		if err != nil {
-			if errors.Is(err, io.EOF) {
-				return nil, p.lexer.errf("unexpected EOF")
-			}
-			return nil, err
-		}
+		return p.abbreviation(t, KwQuote)
 
-		var next Value
-		locator, ok := v.(Locator)
-		if ok {
-			next = NewLocationPair(locator.From(), locator.To(), v, nil)
-		} else {
-			next = NewPair(v, nil)
-		}
+	case '`':
+		return p.abbreviation(t, KwQuasiquote)
+
+	case ',':
+		return p.abbreviation(t, KwUnquote)
+
+	case TCommaAt:
+		return p.abbreviation(t, KwUnquoteSplicing)
 
-		return NewLocationPair(t.From, t.To, KwQuote, next), nil
+	case THashQuote:
+		return p.abbreviation(t, KwSyntax)
+
+	case THashBackquote:
+		return p.abbreviation(t, KwQuasisyntax)
+
+	case THashComma:
+		return p.abbreviation(t, KwUnsyntax)
+
+	case THashCommaAt:
+		return p.abbreviation(t, KwUnsyntaxSplicing)
 
 	case '(':
 		var list, cursor Pair
@@ -221,3 +226,25 @@ func (p *SexprParser) Next() (Value, error) {
 		return nil, t.Errorf("unexpected token: %v", t)
 	}
 }
+
+// abbreviation parses the datum following the abbreviation token t
+// and returns the datum as the list (keyword datum).
+func (p *SexprParser) abbreviation(t *Token, keyword Keyword) (Value, error) {
+	v, err := p.Next()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, p.lexer.errf("unexpected EOF")
+		}
+		return nil, err
+	}
+
+	var next Value
+	locator, ok := v.(Locator)
+	if ok {
+		next = NewLocationPair(locator.From(), locator.To(), v, nil)
+	} else {
+		next = NewPair(v, nil)
+	}
+
+	return NewLocationPair(t.From, t.To, keyword, next), nil
+}
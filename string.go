@@ -165,17 +165,7 @@ var stringBuiltins = []Builtin{
 		Args:   []string{"string", "k"},
 		Return: types.Character,
 		Native: func(scm *Scheme, args []Value) (Value, error) {
-			str, ok := args[0].(String)
-			if !ok {
-				return nil, fmt.Errorf("invalid string: %v", args[0])
-			}
-			chars := []rune(string(str))
-
-			k, err := Int64(args[1])
-			if err != nil || k < 0 || k >= int64(len(chars)) {
-				return nil, fmt.Errorf("invalid index: %v", args[1])
-			}
-			return Character(chars[k]), nil
+			return stringRef(args[0], args[1])
 		},
 	},
 	{
@@ -336,3 +326,22 @@ var stringBuiltins = []Builtin{
 		},
 	},
 }
+
+// stringRef returns the character k of the string s. The characters
+// are counted without converting the string into runes.
+func stringRef(s, k Value) (Value, error) {
+	str, ok := s.(String)
+	if !ok {
+		return nil, fmt.Errorf("invalid string: %v", s)
+	}
+	idx, err := Int64(k)
+	if err == nil && idx >= 0 {
+		for _, r := range string(str) {
+			if idx == 0 {
+				return Character(r), nil
+			}
+			idx--
+		}
+	}
+	return nil, fmt.Errorf("invalid index: %v", k)
+}
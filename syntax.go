@@ -0,0 +1,908 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package scheme
+
+import (
+	"fmt"
+
+	"github.com/markkurossi/scheme/types"
+)
+
+// maxExpansionDepth limits the nesting of macro expansions.
+const maxExpansionDepth = 10000
+
+// Macro implements macro transformers. The syntax-rules macros hold
+// their rules and the procedural macros their transformer procedure.
+// The frames hold the environment where the macro was defined; they
+// are nil for top-level macros.
+type Macro struct {
+	Name        string
+	Ellipsis    string
+	Literals    map[string]bool
+	Rules       []SyntaxRule
+	Transformer Value
+	frames      []*EnvFrame
+	library     *Library
+}
+
+// SyntaxRule defines a syntax-rules pattern and its template.
+type SyntaxRule struct {
+	Pattern  Value
+	Template Value
+}
+
+// syntaxAlias defines the origin of an identifier that the macro
+// expansion mark introduced. If the expansion does not bind the
+// alias, it refers to the binding of the original identifier in the
+// macro definition environment. The library is the library of the
+// macro definition and it resolves the alias's global references.
+type syntaxAlias struct {
+	orig    *Identifier
+	frames  []*EnvFrame
+	mark    int
+	library *Library
+}
+
+// syntaxExpansion holds the state of a macro expansion. The env is
+// the environment and the form the macro use, and the mark
+// identifies the identifiers that the expansion introduces.
+type syntaxExpansion struct {
+	env   *Env
+	form  Pair
+	macro *Macro
+	mark  int
+}
+
+// syntaxBinding holds the form that a pattern variable matched. The
+// variables of ellipsis patterns hold a binding for each repetition.
+type syntaxBinding struct {
+	value    Value
+	ellipsis bool
+	items    []*syntaxBinding
+}
+
+// Scheme returns the value as a Scheme string.
+func (b *syntaxBinding) Scheme() string {
+	return b.String()
+}
+
+// Eq tests if the argument value is eq? to this value.
+func (b *syntaxBinding) Eq(o Value) bool {
+	ob, ok := o.(*syntaxBinding)
+	return ok && b == ob
+}
+
+// Equal tests if the argument value is equal to this value.
+func (b *syntaxBinding) Equal(o Value) bool {
+	return b.Eq(o)
+}
+
+// Type implements Value.Type.
+func (b *syntaxBinding) Type() *types.Type {
+	return types.Any
+}
+
+func (b *syntaxBinding) String() string {
+	return "#<pattern-variable>"
+}
+
+// baseName returns the name of the identifier without its macro
+// expansion aliases.
+func baseName(id *Identifier) string {
+	for id.alias != nil {
+		id = id.alias.orig
+	}
+	return id.Name
+}
+
+// unaliasIdentifier returns the original identifier of the alias
+// identifier id. Non-alias identifiers are returned as-is.
+func unaliasIdentifier(id *Identifier) *Identifier {
+	if id.alias == nil {
+		return id
+	}
+	return &Identifier{
+		Name:  baseName(id),
+		Point: id.Point,
+	}
+}
+
+// unalias replaces the alias identifiers of the value with their
+// original identifiers. The function returns the value as-is if it
+// does not contain aliases.
+func unalias(value Value) (Value, bool) {
+	return mapSyntax(value, func(v Value) (Value, bool) {
+		id, ok := v.(*Identifier)
+		if !ok || id.alias == nil {
+			return v, false
+		}
+		return unaliasIdentifier(id), true
+	})
+}
+
+// mapSyntax maps the non-list values of the value with the function
+// f. The lists and vectors are copied only if f changes their items.
+func mapSyntax(value Value, f func(v Value) (Value, bool)) (Value, bool) {
+	switch v := value.(type) {
+	case Pair:
+		car, carChanged := mapSyntax(v.Car(), f)
+		cdr, cdrChanged := mapSyntax(v.Cdr(), f)
+		if !carChanged && !cdrChanged {
+			return v, false
+		}
+		return NewLocationPair(v.From(), v.To(), car, cdr), true
+
+	case Vector:
+		var result Vector
+		for idx, item := range v {
+			u, changed := mapSyntax(item, f)
+			if changed && result == nil {
+				result = make(Vector, len(v))
+				copy(result, v)
+			}
+			if result != nil {
+				result[idx] = u
+			}
+		}
+		if result == nil {
+			return v, false
+		}
+		return result, true
+
+	default:
+		return f(value)
+	}
+}
+
+// lookupBinding finds the binding of the identifier from the
+// environment frames. If the identifier is not bound, lookupBinding
+// returns nil and the name of the global symbol that the identifier
+// refers to.
+func lookupBinding(frames []*EnvFrame, id *Identifier) (*EnvBinding, string) {
+	for {
+		for i := len(frames) - 1; i >= 0; i-- {
+			b, ok := frames[i].Bindings[id.Name]
+			if ok && !b.Disabled {
+				return b, id.Name
+			}
+		}
+		if id.alias == nil {
+			return nil, id.Name
+		}
+		frames = id.alias.frames
+		id = id.alias.orig
+	}
+}
+
+// lookupMacro finds the macro that the identifier names. The function
+// returns nil if the identifier is not a macro keyword.
+func (p *Parser) lookupMacro(env *Env, id *Identifier) *Macro {
+	frames := env.Frames
+	for {
+		for i := len(frames) - 1; i >= 0; i-- {
+			b, ok := frames[i].Bindings[id.Name]
+			if ok && !b.Disabled {
+				return nil
+			}
+			m, ok := frames[i].Macros[id.Name]
+			if ok {
+				return m
+			}
+		}
+		if id.alias == nil {
+			return p.scm.image.macros[id.Name]
+		}
+		frames = id.alias.frames
+		id = id.alias.orig
+	}
+}
+
+// newMark allocates a new expansion mark.
+func (p *Parser) newMark() int {
+	return p.scm.image.newMark()
+}
+
+// temporary creates a fresh identifier that does not conflict with
+// any other identifier.
+func (p *Parser) temporary(loc Locator, name string) *Identifier {
+	return &Identifier{
+		Name:  fmt.Sprintf("%s %d", name, p.newMark()),
+		Point: loc.From(),
+	}
+}
+
+// globalIdentifier creates an identifier that refers to the global
+// symbol name even if the name is bound in the current environment.
+func (p *Parser) globalIdentifier(loc Locator, name string) *Identifier {
+	orig := &Identifier{
+		Name:  name,
+		Point: loc.From(),
+	}
+	mark := p.newMark()
+	return &Identifier{
+		Name:  fmt.Sprintf("%s %d", name, mark),
+		Point: loc.From(),
+		alias: &syntaxAlias{
+			orig: orig,
+			mark: mark,
+		},
+	}
+}
+
+func (p *Parser) parseDefineSyntax(env *Env, list []Pair) (AST, error) {
+	// (define-syntax keyword transformer)
+	if len(list) != 3 {
+		return nil, list[0].Errorf("define-syntax: syntax error")
+	}
+	name, ok := isIdentifier(list[1].Car())
+	if !ok {
+		return nil, list[1].Errorf("define-syntax: invalid keyword: %v",
+			list[1].Car())
+	}
+	if len(env.Frames) <= 1 {
+		// Top-level macro.
+		m, err := p.parseTransformer(list[2], nil, baseName(name))
+		if err != nil {
+			return nil, err
+		}
+		p.scm.image.macros[m.Name] = m
+
+		// Exported macros are bound also with their external names.
+		if p.library != nil {
+			export, ok := p.library.exported[name.Name]
+			if ok {
+				export.id = name
+				for _, external := range export.names {
+					p.scm.image.macros[external] = m
+				}
+			}
+		}
+	} else {
+		frame := env.Frames[len(env.Frames)-1]
+		frames := make([]*EnvFrame, len(env.Frames))
+		copy(frames, env.Frames)
+
+		m, err := p.parseTransformer(list[2], frames, name.Name)
+		if err != nil {
+			return nil, err
+		}
+		if frame.Macros == nil {
+			frame.Macros = make(map[string]*Macro)
+		}
+		frame.Macros[name.Name] = m
+	}
+
+	return &ASTSequence{
+		From: list[0],
+	}, nil
+}
+
+func (p *Parser) parseLetSyntax(kind Keyword, env *Env, list []Pair,
+	tail bool) (AST, error) {
+
+	// (let-syntax ((keyword transformer)...) body...)
+	// (letrec-syntax ((keyword transformer)...) body...)
+	if len(list) < 2 {
+		return nil, list[0].Errorf("%s: missing bindings", kind)
+	}
+	bindings, ok := ListPairs(list[1].Car())
+	if !ok {
+		return nil, list[1].Errorf("%s: invalid bindings: %v",
+			kind, list[1].Car())
+	}
+
+	// The macros of let-syntax are defined in the enclosing
+	// environment and the macros of letrec-syntax in the environment
+	// that contains the macros themselves.
+	frames := make([]*EnvFrame, len(env.Frames))
+	copy(frames, env.Frames)
+
+	letEnv := env.Copy()
+	frame := letEnv.PushFrame(TypeMacro, FULet, 0)
+	frame.Macros = make(map[string]*Macro)
+
+	if kind == KwLetrecSyntax {
+		frames = append(frames, frame)
+	}
+
+	for _, binding := range bindings {
+		def, ok := ListPairs(binding.Car())
+		if !ok || len(def) != 2 {
+			return nil, binding.Errorf("%s: invalid binding: %v",
+				kind, binding.Car())
+		}
+		name, ok := isIdentifier(def[0].Car())
+		if !ok {
+			return nil, def[0].Errorf("%s: invalid keyword: %v",
+				kind, def[0].Car())
+		}
+		m, err := p.parseTransformer(def[1], frames, name.Name)
+		if err != nil {
+			return nil, err
+		}
+		frame.Macros[name.Name] = m
+	}
+
+	seq := &ASTSequence{
+		From: list[0],
+	}
+	for i := 2; i < len(list); i++ {
+		ast, err := p.parseValue(letEnv, list[i], list[i].Car(),
+			tail && i+1 >= len(list))
+		if err != nil {
+			return nil, err
+		}
+		seq.Add(ast)
+	}
+	return seq, nil
+}
+
+// parseTransformer parses the transformer spec of a macro
+// definition. The syntax-rules specs define syntax-rules macros and
+// all other specs are evaluated into transformer procedures.
+func (p *Parser) parseTransformer(spec Pair, frames []*EnvFrame,
+	name string) (*Macro, error) {
+
+	pair, ok := spec.Car().(Pair)
+	if ok && isKeyword(pair.Car(), KwSyntaxRules) {
+		return p.parseSyntaxRules(spec, frames, name)
+	}
+	transformer, err := p.evalTransformer(spec, spec.Car())
+	if err != nil {
+		return nil, err
+	}
+	return &Macro{
+		Name:        name,
+		Ellipsis:    "...",
+		Transformer: transformer,
+		frames:      frames,
+		library:     p.library,
+	}, nil
+}
+
+// parseSyntaxRules parses the syntax-rules transformer spec.
+func (p *Parser) parseSyntaxRules(spec Pair, frames []*EnvFrame,
+	name string) (*Macro, error) {
+
+	// (syntax-rules (literal...) (pattern template)...)
+	// (syntax-rules ellipsis (literal...) (pattern template)...)
+	list, ok := ListPairs(spec.Car())
+	if !ok || len(list) < 2 || !isKeyword(list[0].Car(), KwSyntaxRules) {
+		return nil, spec.Errorf("%s: expected syntax-rules: %v",
+			name, spec.Car())
+	}
+	m := &Macro{
+		Name:     name,
+		Ellipsis: "...",
+		frames:   frames,
+		library:  p.library,
+	}
+	idx := 1
+	id, ok := isIdentifier(list[idx].Car())
+	if ok {
+		m.Ellipsis = id.Name
+		idx++
+		if idx >= len(list) {
+			return nil, spec.Errorf("%s: missing literals", name)
+		}
+	}
+	literals, err := parseLiterals(list[idx], name)
+	if err != nil {
+		return nil, err
+	}
+	m.Literals = literals
+
+	for _, rule := range list[idx+1:] {
+		r, ok := ListPairs(rule.Car())
+		if !ok || len(r) != 2 {
+			return nil, rule.Errorf("%s: invalid syntax rule: %v",
+				name, rule.Car())
+		}
+		_, ok = r[0].Car().(Pair)
+		if !ok {
+			return nil, r[0].Errorf("%s: invalid pattern: %v",
+				name, r[0].Car())
+		}
+		err := m.checkPattern(r[0], r[0].Car())
+		if err != nil {
+			return nil, err
+		}
+		m.Rules = append(m.Rules, SyntaxRule{
+			Pattern:  r[0].Car(),
+			Template: r[1].Car(),
+		})
+	}
+	return m, nil
+}
+
+// parseLiterals parses the literals list of syntax-rules and
+// syntax-case.
+func parseLiterals(pair Pair, name string) (map[string]bool, error) {
+	literals, ok := ListPairs(pair.Car())
+	if !ok {
+		return nil, pair.Errorf("%s: invalid literals: %v", name, pair.Car())
+	}
+	result := make(map[string]bool)
+	for _, literal := range literals {
+		switch lit := literal.Car().(type) {
+		case *Identifier:
+			result[lit.Name] = true
+		case Keyword:
+			// Keywords match only themselves.
+		default:
+			return nil, literal.Errorf("%s: invalid literal: %v",
+				name, literal.Car())
+		}
+	}
+	return result, nil
+}
+
+// checkPattern verifies that the pattern has at most one ellipsis
+// at each list level and that the ellipsis follows a subpattern.
+func (m *Macro) checkPattern(loc Locator, pattern Value) error {
+	var items []Value
+	switch pat := pattern.(type) {
+	case Pair:
+		var tail Value
+		items, _, tail = syntaxItems(pat)
+		err := m.checkPattern(loc, tail)
+		if err != nil {
+			return err
+		}
+	case Vector:
+		items = pat
+	default:
+		return nil
+	}
+	var ellipsis bool
+	for idx, item := range items {
+		if m.isEllipsis(item) {
+			if idx == 0 || ellipsis {
+				return loc.Errorf("%s: misplaced ellipsis in pattern: %v",
+					m.Name, pattern)
+			}
+			ellipsis = true
+			continue
+		}
+		err := m.checkPattern(loc, item)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Macro) isEllipsis(value Value) bool {
+	id, ok := value.(*Identifier)
+	if !ok || m.Literals[id.Name] {
+		return false
+	}
+	return id.Name == m.Ellipsis || baseName(id) == m.Ellipsis
+}
+
+func isUnderscore(id *Identifier) bool {
+	return baseName(id) == "_"
+}
+
+// patternVars returns the pattern variables of the pattern.
+func (m *Macro) patternVars(pattern Value, vars []*Identifier) []*Identifier {
+	switch pat := pattern.(type) {
+	case *Identifier:
+		if m.Literals[pat.Name] || m.isEllipsis(pat) || isUnderscore(pat) {
+			return vars
+		}
+		return append(vars, pat)
+
+	case Pair:
+		vars = m.patternVars(pat.Car(), vars)
+		return m.patternVars(pat.Cdr(), vars)
+
+	case Vector:
+		for _, item := range pat {
+			vars = m.patternVars(item, vars)
+		}
+		return vars
+
+	default:
+		return vars
+	}
+}
+
+// syntaxItems returns the items of the list value, the pairs holding
+// the items, and the tail of the list.
+func syntaxItems(value Value) ([]Value, []Pair, Value) {
+	var items []Value
+	var pairs []Pair
+	for {
+		value = syntaxDatum(value)
+		pair, ok := value.(Pair)
+		if !ok {
+			return items, pairs, value
+		}
+		items = append(items, pair.Car())
+		pairs = append(pairs, pair)
+		value = pair.Cdr()
+	}
+}
+
+// parseMacro expands the macro use form and parses the expansion.
+func (p *Parser) parseMacro(env *Env, m *Macro, form Pair,
+	tail bool) (AST, error) {
+
+	if p.expansions >= maxExpansionDepth {
+		return nil, form.Errorf("%s: macro expansion too deep", m.Name)
+	}
+	p.expansions++
+	defer func() {
+		p.expansions--
+	}()
+
+	expanded, loc, err := p.expandMacro(env, m, form)
+	if err != nil {
+		return nil, err
+	}
+	return p.parseValue(env, loc, expanded, tail)
+}
+
+// expandMacro expands the macro use form. The function returns the
+// expansion and its locator.
+func (p *Parser) expandMacro(env *Env, m *Macro, form Pair) (
+	Value, Locator, error) {
+
+	x := &syntaxExpansion{
+		env:   env,
+		form:  form,
+		macro: m,
+		mark:  p.newMark(),
+	}
+	var expanded Value
+	var err error
+	if m.Transformer != nil {
+		expanded, err = x.transform(p.scm, form)
+	} else {
+		expanded, err = x.expand(form)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var loc Locator = form
+	pair, ok := expanded.(Pair)
+	if ok {
+		loc = pair
+	}
+	return expanded, loc, nil
+}
+
+// expand expands the macro use form with the first matching syntax
+// rule.
+func (x *syntaxExpansion) expand(form Pair) (Value, error) {
+	for _, rule := range x.macro.Rules {
+		pattern := rule.Pattern.(Pair)
+		b := make(map[string]*syntaxBinding)
+
+		// The keyword position of the pattern is ignored.
+		if !x.match(x.macro, pattern.Cdr(), form.Cdr(), b) {
+			continue
+		}
+		return x.expandTemplate(form, rule.Template, b, false)
+	}
+	return nil, form.Errorf("%s: invalid syntax: %v", x.macro.Name, form)
+}
+
+// match matches the form against the pattern of the macro m and
+// stores the pattern variable bindings into b.
+func (x *syntaxExpansion) match(m *Macro, pattern, form Value,
+	b map[string]*syntaxBinding) bool {
+
+	switch pat := pattern.(type) {
+	case *Identifier:
+		if m.Literals[pat.Name] {
+			id, ok := syntaxDatum(form).(*Identifier)
+			if !ok {
+				return false
+			}
+			return x.freeIdentifierEqual(id, m.frames, pat)
+		}
+		if isUnderscore(pat) {
+			return true
+		}
+		b[pat.Name] = &syntaxBinding{
+			value: form,
+		}
+		return true
+
+	case Pair:
+		items, pairs, tail := syntaxItems(form)
+		pats, _, ptail := syntaxItems(pat)
+		return x.matchItems(m, pats, ptail, items,
+			func(idx int) Value {
+				if idx < len(pairs) {
+					return pairs[idx]
+				}
+				return tail
+			}, tail, b)
+
+	case Vector:
+		v, ok := syntaxDatum(form).(Vector)
+		if !ok {
+			return false
+		}
+		return x.matchItems(m, pat, nil, v, nil, nil, b)
+
+	default:
+		return Equal(pattern, syntaxDatum(form))
+	}
+}
+
+// matchItems matches the list or vector items against the pattern
+// items pats and the pattern tail ptail. The rest function returns
+// the form list starting from the argument item index.
+func (x *syntaxExpansion) matchItems(m *Macro, pats []Value, ptail Value,
+	items []Value, rest func(idx int) Value, tail Value,
+	b map[string]*syntaxBinding) bool {
+
+	ellipsis := -1
+	for idx, pat := range pats {
+		if m.isEllipsis(pat) {
+			ellipsis = idx - 1
+			break
+		}
+	}
+	if ellipsis < 0 {
+		if len(items) < len(pats) {
+			return false
+		}
+		for idx, pat := range pats {
+			if !x.match(m, pat, items[idx], b) {
+				return false
+			}
+		}
+		if ptail == nil {
+			return len(items) == len(pats) && tail == nil
+		}
+		return x.match(m, ptail, rest(len(pats)), b)
+	}
+
+	before := pats[:ellipsis]
+	repeat := pats[ellipsis]
+	after := pats[ellipsis+2:]
+
+	count := len(items) - len(before) - len(after)
+	if count < 0 {
+		return false
+	}
+	if ptail == nil && tail != nil {
+		return false
+	}
+	for idx, pat := range before {
+		if !x.match(m, pat, items[idx], b) {
+			return false
+		}
+	}
+
+	vars := m.patternVars(repeat, nil)
+	seqs := make(map[string][]*syntaxBinding)
+	for i := 0; i < count; i++ {
+		sub := make(map[string]*syntaxBinding)
+		if !x.match(m, repeat, items[len(before)+i], sub) {
+			return false
+		}
+		for _, v := range vars {
+			seqs[v.Name] = append(seqs[v.Name], sub[v.Name])
+		}
+	}
+	for _, v := range vars {
+		b[v.Name] = &syntaxBinding{
+			ellipsis: true,
+			items:    seqs[v.Name],
+		}
+	}
+
+	for idx, pat := range after {
+		if !x.match(m, pat, items[len(before)+count+idx], b) {
+			return false
+		}
+	}
+	if ptail != nil {
+		return x.match(m, ptail, tail, b)
+	}
+	return true
+}
+
+// freeIdentifierEqual tests if the identifier id of the macro use
+// refers to the same binding as the identifier lit that is defined in
+// the environment frames.
+func (x *syntaxExpansion) freeIdentifierEqual(id *Identifier,
+	frames []*EnvFrame, lit *Identifier) bool {
+
+	var envFrames []*EnvFrame
+	if x.env != nil {
+		envFrames = x.env.Frames
+	}
+	b1, n1 := lookupBinding(envFrames, id)
+	b2, n2 := lookupBinding(frames, lit)
+	if b1 != nil || b2 != nil {
+		return b1 == b2
+	}
+	return n1 == n2
+}
+
+// expandTemplate instantiates the template with the pattern variable
+// bindings b. The identifiers that the template introduces are
+// renamed to aliases. The constructed list pairs get their location
+// from the macro use form loc.
+func (x *syntaxExpansion) expandTemplate(loc Locator, template Value,
+	b map[string]*syntaxBinding, escaped bool) (Value, error) {
+
+	switch t := template.(type) {
+	case *Identifier:
+		sb, ok := b[t.Name]
+		if ok {
+			if sb.ellipsis {
+				return nil, loc.Errorf("%s: missing ellipsis after %s",
+					x.macro.Name, t.Name)
+			}
+			return sb.value, nil
+		}
+		return x.rename(t), nil
+
+	case Pair:
+		items, _, tail := syntaxItems(t)
+		if !escaped && len(items) == 2 && tail == nil &&
+			x.macro.isEllipsis(items[0]) {
+			// (... template) escapes the ellipses of the template.
+			return x.expandTemplate(loc, items[1], b, true)
+		}
+		result, err := x.expandItems(loc, items, b, escaped)
+		if err != nil {
+			return nil, err
+		}
+		var rest Value
+		if tail != nil {
+			rest, err = x.expandTemplate(loc, tail, b, escaped)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return newListTail(loc, rest, result...), nil
+
+	case Vector:
+		result, err := x.expandItems(loc, t, b, escaped)
+		if err != nil {
+			return nil, err
+		}
+		return Vector(result), nil
+
+	default:
+		return template, nil
+	}
+}
+
+func (x *syntaxExpansion) expandItems(loc Locator, items []Value,
+	b map[string]*syntaxBinding, escaped bool) ([]Value, error) {
+
+	var result []Value
+	for i := 0; i < len(items); i++ {
+		var depth int
+		for !escaped && i+1+depth < len(items) &&
+			x.macro.isEllipsis(items[i+1+depth]) {
+			depth++
+		}
+		if depth == 0 {
+			v, err := x.expandTemplate(loc, items[i], b, escaped)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, v)
+			continue
+		}
+		values, err := x.expandEllipsis(loc, items[i], b, depth)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, values...)
+		i += depth
+	}
+	return result, nil
+}
+
+// expandEllipsis expands the template that is followed by depth
+// ellipses.
+func (x *syntaxExpansion) expandEllipsis(loc Locator, template Value,
+	b map[string]*syntaxBinding, depth int) ([]Value, error) {
+
+	var vars []string
+	count := -1
+	for _, name := range templateVars(template, b, nil) {
+		sb := b[name]
+		if !sb.ellipsis {
+			continue
+		}
+		if count < 0 {
+			count = len(sb.items)
+		} else if count != len(sb.items) {
+			return nil, loc.Errorf("%s: ellipsis length mismatch: %v",
+				x.macro.Name, template)
+		}
+		vars = append(vars, name)
+	}
+	if len(vars) == 0 {
+		return nil, loc.Errorf("%s: no pattern variables before ellipsis: %v",
+			x.macro.Name, template)
+	}
+
+	var result []Value
+	for i := 0; i < count; i++ {
+		sub := make(map[string]*syntaxBinding)
+		for k, v := range b {
+			sub[k] = v
+		}
+		for _, name := range vars {
+			sub[name] = b[name].items[i]
+		}
+		if depth > 1 {
+			values, err := x.expandEllipsis(loc, template, sub, depth-1)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, values...)
+		} else {
+			v, err := x.expandTemplate(loc, template, sub, false)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, v)
+		}
+	}
+	return result, nil
+}
+
+// templateVars returns the pattern variables that the template uses.
+func templateVars(template Value, b map[string]*syntaxBinding,
+	vars []string) []string {
+
+	switch t := template.(type) {
+	case *Identifier:
+		_, ok := b[t.Name]
+		if ok {
+			return append(vars, t.Name)
+		}
+		return vars
+
+	case Pair:
+		vars = templateVars(t.Car(), b, vars)
+		return templateVars(t.Cdr(), b, vars)
+
+	case Vector:
+		for _, item := range t {
+			vars = templateVars(item, b, vars)
+		}
+		return vars
+
+	default:
+		return vars
+	}
+}
+
+// rename returns the alias that the expansion introduces for the
+// template identifier id. The identifiers are not renamed outside
+// macro expansions.
+func (x *syntaxExpansion) rename(id *Identifier) *Identifier {
+	if x.mark == 0 {
+		return id
+	}
+	return &Identifier{
+		Name:  fmt.Sprintf("%s %d", id.Name, x.mark),
+		Point: id.Point,
+		alias: &syntaxAlias{
+			orig:    id,
+			frames:  x.macro.frames,
+			mark:    x.mark,
+			library: x.macro.library,
+		},
+	}
+}
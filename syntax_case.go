@@ -0,0 +1,714 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+// The (rnrs syntax-case (6)) library.
+//
+
+package scheme
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/markkurossi/scheme/types"
+)
+
+// Syntax implements syntax objects. A syntax object wraps a datum
+// with its source location. The lexical context of the datum's
+// identifiers is held in their macro expansion aliases.
+type Syntax struct {
+	Datum Value
+	From  Point
+	To    Point
+}
+
+// NewSyntax creates a syntax object for the datum. If the datum is a
+// syntax object, it is returned as-is.
+func NewSyntax(datum Value) *Syntax {
+	switch d := datum.(type) {
+	case *Syntax:
+		return d
+
+	case *Identifier:
+		return &Syntax{
+			Datum: d,
+			From:  d.Point,
+			To:    d.Point,
+		}
+
+	case Pair:
+		return &Syntax{
+			Datum: d,
+			From:  d.From(),
+			To:    d.To(),
+		}
+
+	default:
+		return &Syntax{
+			Datum: d,
+		}
+	}
+}
+
+// Scheme returns the value as a Scheme string.
+func (s *Syntax) Scheme() string {
+	return s.String()
+}
+
+// Eq tests if the argument value is eq? to this value.
+func (s *Syntax) Eq(o Value) bool {
+	os, ok := o.(*Syntax)
+	return ok && s == os
+}
+
+// Equal tests if the argument value is equal to this value.
+func (s *Syntax) Equal(o Value) bool {
+	return s.Eq(o)
+}
+
+// Type implements Value.Type.
+func (s *Syntax) Type() *types.Type {
+	return types.Any
+}
+
+func (s *Syntax) String() string {
+	return fmt.Sprintf("#<syntax %s>", ToScheme(syntaxToDatum(s)))
+}
+
+// syntaxDatum returns the datum of the syntax object. Other values
+// are returned as-is.
+func syntaxDatum(v Value) Value {
+	for {
+		s, ok := v.(*Syntax)
+		if !ok {
+			return v
+		}
+		v = s.Datum
+	}
+}
+
+// stripSyntax removes the syntax object wrappers from the value.
+func stripSyntax(value Value) (Value, bool) {
+	return mapSyntax(value, func(v Value) (Value, bool) {
+		s, ok := v.(*Syntax)
+		if !ok {
+			return v, false
+		}
+		datum, _ := stripSyntax(s.Datum)
+		return datum, true
+	})
+}
+
+// wrapSyntax wraps the identifiers of the value into syntax
+// objects. The lists and vectors of the value are kept as-is so that
+// they can be processed with the list and vector functions.
+func wrapSyntax(value Value) Value {
+	value, _ = mapSyntax(value, func(v Value) (Value, bool) {
+		id, ok := v.(*Identifier)
+		if !ok {
+			return v, false
+		}
+		return NewSyntax(id), true
+	})
+	return value
+}
+
+// syntaxToDatum strips the syntax object wrappers and the lexical
+// context from the value.
+func syntaxToDatum(value Value) Value {
+	value, _ = stripSyntax(value)
+	value, _ = unalias(value)
+	return value
+}
+
+// withContext creates an identifier with the name and the lexical
+// context of the identifier tid.
+func withContext(tid *Identifier, name string) *Identifier {
+	if tid.alias == nil {
+		return &Identifier{
+			Name:  name,
+			Point: tid.Point,
+		}
+	}
+	orig := withContext(tid.alias.orig, name)
+	return &Identifier{
+		Name:  fmt.Sprintf("%s %d", orig.Name, tid.alias.mark),
+		Point: tid.Point,
+		alias: &syntaxAlias{
+			orig:    orig,
+			frames:  tid.alias.frames,
+			mark:    tid.alias.mark,
+			library: tid.alias.library,
+		},
+	}
+}
+
+// transform expands the macro use form by calling the macro's
+// transformer procedure.
+func (x *syntaxExpansion) transform(scm *Scheme, form Pair) (Value, error) {
+	saved := scm.expansion
+	scm.expansion = x
+	defer func() {
+		scm.expansion = saved
+	}()
+
+	v, err := scm.apply(x.macro.Transformer, []Value{NewSyntax(form)})
+	if err != nil {
+		// Syntax violations are reported at the macro use.
+		var cond *Condition
+		if errors.As(err, &cond) {
+			_, ok := cond.Find(condSyntax)
+			if ok {
+				return nil, form.Errorf("%v", cond)
+			}
+		}
+		return nil, form.Errorf("%s: %v", x.macro.Name, err)
+	}
+	v, _ = stripSyntax(v)
+	return v, nil
+}
+
+// syntaxExpansion returns the macro expansion that the machine is
+// running. Outside macro expansions, the function returns an
+// expansion that does not rename identifiers.
+func (scm *Scheme) syntaxExpansion() *syntaxExpansion {
+	if scm.expansion != nil {
+		return scm.expansion
+	}
+	return &syntaxExpansion{
+		macro: &Macro{
+			Name:     "syntax",
+			Ellipsis: "...",
+		},
+	}
+}
+
+// evalTransformer evaluates the transformer expression of a
+// procedural macro. The expression is evaluated in the top-level
+// environment.
+func (p *Parser) evalTransformer(loc Locator, expr Value) (Value, error) {
+	parser := NewParser(p.scm)
+	parser.source = p.source
+	parser.assigned = make(map[string]bool)
+
+	lib := &Library{
+		scm:       p.scm,
+		Source:    p.source,
+		Name:      NewPair(&Identifier{Name: "main"}, nil),
+		Body:      &ASTSequence{},
+		ExportAll: true,
+		exported:  make(map[string]*export),
+		parser:    parser,
+		forms: []libraryForm{
+			{
+				from:  loc,
+				value: expr,
+			},
+		},
+	}
+	init, err := lib.Compile()
+	if err != nil {
+		return nil, err
+	}
+	v, err := p.scm.apply(init, nil)
+	if err != nil {
+		return nil, err
+	}
+	_, ok := v.(*Lambda)
+	if !ok {
+		return nil, loc.Errorf("invalid transformer: %v", ToScheme(v))
+	}
+	return v, nil
+}
+
+func (p *Parser) parseSyntaxCase(env *Env, list []Pair,
+	tail bool) (AST, error) {
+
+	// (syntax-case expr (literal...) clause...)
+	if len(list) < 3 {
+		return nil, list[0].Errorf("syntax-case: syntax error")
+	}
+	literals, err := parseLiterals(list[2], "syntax-case")
+	if err != nil {
+		return nil, err
+	}
+	m := &Macro{
+		Name:     "syntax-case",
+		Ellipsis: "...",
+		Literals: literals,
+	}
+
+	// The syntax-case is compiled into a sequence of pattern matches:
+	//
+	//   (let ((tmp expr))
+	//     (let ((match (scheme::syntax-match tmp pattern literals)))
+	//       (if (if match (scheme::apply (lambda (var...) fender) match)
+	//               #f)
+	//           (scheme::apply (lambda (var...) output) match)
+	//           ...next clause...)))
+	loc := list[0]
+	tmp := p.temporary(loc, "syntax-case")
+	literalList := NewSyntax(list[2].Car())
+
+	var rest Value = newList(loc,
+		p.globalIdentifier(loc, "syntax-violation"),
+		Boolean(false),
+		String("invalid syntax"),
+		tmp)
+
+	for i := len(list) - 1; i >= 3; i-- {
+		clause, ok := ListPairs(list[i].Car())
+		if !ok || len(clause) < 2 || len(clause) > 3 {
+			return nil, list[i].Errorf("syntax-case: invalid clause: %v",
+				list[i].Car())
+		}
+		pattern := clause[0].Car()
+		err := m.checkPattern(clause[0], pattern)
+		if err != nil {
+			return nil, err
+		}
+		var formals []Value
+		seen := newSeen()
+		for _, v := range m.patternVars(pattern, nil) {
+			err := seen.add(v.Name)
+			if err != nil {
+				return nil, clause[0].Errorf("syntax-case: %v", err)
+			}
+			formals = append(formals, v)
+		}
+		loc := list[i]
+		match := p.temporary(loc, "match")
+		call := func(expr Value) Value {
+			return newList(loc, KwSchemeApply,
+				newList(loc, KwLambda, newList(loc, formals...), expr),
+				match)
+		}
+		var test Value = match
+		if len(clause) == 3 {
+			test = newList(loc, KwIf, match, call(clause[1].Car()),
+				Boolean(false))
+		}
+		rest = newList(loc, KwLet,
+			newList(loc,
+				newList(loc, match,
+					newList(loc,
+						&Identifier{
+							Name:  "scheme::syntax-match",
+							Point: loc.From(),
+						},
+						tmp, NewSyntax(pattern), literalList))),
+			newList(loc, KwIf, test, call(clause[len(clause)-1].Car()),
+				rest))
+	}
+
+	expr := newList(loc, KwLet, newList(loc, newList(loc, tmp, list[1].Car())),
+		rest)
+
+	return p.parseValue(env, loc, expr, tail)
+}
+
+func (p *Parser) parseSyntax(env *Env, list []Pair,
+	tail bool) (AST, error) {
+
+	// (syntax template)
+	if len(list) != 2 {
+		return nil, list[0].Errorf("syntax: syntax error")
+	}
+	template := list[1].Car()
+
+	// The template's local variables are passed to the
+	// scheme::syntax function which substitutes the pattern
+	// variables with their values:
+	//
+	//   (scheme::syntax template (var...) var...)
+	var vars []Value
+	seen := make(map[string]bool)
+	mapSyntax(template, func(v Value) (Value, bool) {
+		id, ok := v.(*Identifier)
+		if ok && !seen[id.Name] {
+			b, _ := lookupBinding(env.Frames, id)
+			if b != nil {
+				seen[id.Name] = true
+				vars = append(vars, id)
+			}
+		}
+		return v, false
+	})
+
+	loc := list[0]
+	call := []Value{
+		&Identifier{
+			Name:  "scheme::syntax",
+			Point: loc.From(),
+		},
+		NewSyntax(template),
+		NewSyntax(newList(loc, vars...)),
+	}
+	call = append(call, vars...)
+
+	return p.parseValue(env, loc, newList(loc, call...), tail)
+}
+
+func (p *Parser) parseQuasisyntax(env *Env, list []Pair,
+	tail bool) (AST, error) {
+
+	// (quasisyntax template)
+	if len(list) != 2 {
+		return nil, list[0].Errorf("quasisyntax: syntax error")
+	}
+	loc := list[0]
+
+	// The unsyntax and unsyntax-splicing expressions are bound to
+	// pattern variables with with-syntax:
+	//
+	//   (with-syntax ((tmp expr) ((tmp2 ...) expr2)...)
+	//     (syntax template))
+	var bindings []Value
+	template, err := p.quasisyntax(loc, list[1].Car(), 0, &bindings)
+	if err != nil {
+		return nil, err
+	}
+	expr := newList(loc, KwSyntax, template)
+	if len(bindings) > 0 {
+		expr = newList(loc, KwWithSyntax, newList(loc, bindings...), expr)
+	}
+	return p.parseValue(env, loc, expr, tail)
+}
+
+// quasisyntax replaces the unsyntax and unsyntax-splicing expressions
+// of the template with pattern variables and adds the variable
+// bindings to bindings.
+func (p *Parser) quasisyntax(loc Locator, template Value, depth int,
+	bindings *[]Value) (Value, error) {
+
+	switch t := template.(type) {
+	case Pair:
+		items, pairs, tail := syntaxItems(t)
+		if len(items) == 2 && tail == nil {
+			switch items[0] {
+			case KwUnsyntax:
+				if depth == 0 {
+					tmp := p.temporary(pairs[1], "unsyntax")
+					*bindings = append(*bindings,
+						newList(pairs[1], tmp, items[1]))
+					return tmp, nil
+				}
+				depth--
+			case KwQuasisyntax:
+				depth++
+			}
+		}
+		result, err := p.quasisyntaxItems(loc, items, pairs, depth, bindings)
+		if err != nil {
+			return nil, err
+		}
+		if tail != nil {
+			tail, err = p.quasisyntax(loc, tail, depth, bindings)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return newListTail(t, tail, result...), nil
+
+	case Vector:
+		result, err := p.quasisyntaxItems(loc, t, nil, depth, bindings)
+		if err != nil {
+			return nil, err
+		}
+		return Vector(result), nil
+
+	default:
+		return template, nil
+	}
+}
+
+func (p *Parser) quasisyntaxItems(loc Locator, items []Value, pairs []Pair,
+	depth int, bindings *[]Value) ([]Value, error) {
+
+	var result []Value
+	for idx, item := range items {
+		if depth == 0 {
+			pair, ok := item.(Pair)
+			if ok && isKeyword(pair.Car(), KwUnsyntaxSplicing) {
+				exprs, ok := ListValues(pair.Cdr())
+				if !ok {
+					return nil, pair.Errorf("invalid unsyntax-splicing: %v",
+						pair)
+				}
+				for _, expr := range exprs {
+					tmp := p.temporary(pair, "unsyntax")
+					*bindings = append(*bindings,
+						newList(pair, newList(pair, tmp, &Identifier{
+							Name:  "...",
+							Point: pair.From(),
+						}), expr))
+					result = append(result, tmp, &Identifier{
+						Name:  "...",
+						Point: pair.From(),
+					})
+				}
+				continue
+			}
+		}
+		var l Locator = loc
+		if pairs != nil {
+			l = pairs[idx]
+		}
+		v, err := p.quasisyntax(l, item, depth, bindings)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, v)
+	}
+	return result, nil
+}
+
+func (p *Parser) parseWithSyntax(env *Env, list []Pair,
+	tail bool) (AST, error) {
+
+	// (with-syntax ((pattern expr)...) body...)
+	if len(list) < 3 {
+		return nil, list[0].Errorf("with-syntax: missing bindings or body")
+	}
+	bindings, ok := ListPairs(list[1].Car())
+	if !ok {
+		return nil, list[1].Errorf("with-syntax: invalid bindings: %v",
+			list[1].Car())
+	}
+	loc := list[0]
+
+	// The with-syntax is compiled into a syntax-case:
+	//
+	//   (syntax-case (list expr...) ()
+	//     ((pattern...) (let () body...)))
+	patterns := []Value{}
+	exprs := []Value{p.globalIdentifier(loc, "list")}
+	for _, binding := range bindings {
+		def, ok := ListValues(binding.Car())
+		if !ok || len(def) != 2 {
+			return nil, binding.Errorf("with-syntax: invalid binding: %v",
+				binding.Car())
+		}
+		patterns = append(patterns, def[0])
+		exprs = append(exprs, def[1])
+	}
+	body := []Value{KwLet, nil}
+	for _, b := range list[2:] {
+		body = append(body, b.Car())
+	}
+
+	expr := newList(loc, KwSyntaxCase, newList(loc, exprs...), nil,
+		newList(loc, newList(loc, patterns...), newList(loc, body...)))
+
+	return p.parseValue(env, loc, expr, tail)
+}
+
+var rnrsSyntaxCaseBuiltins = []Builtin{
+	{
+		Name:   "scheme::syntax-match",
+		Args:   []string{"form<any>", "pattern<any>", "literals<any>"},
+		Return: types.Any,
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			literals := make(map[string]bool)
+			items, _, _ := syntaxItems(args[2])
+			for _, item := range items {
+				id, ok := item.(*Identifier)
+				if ok {
+					literals[id.Name] = true
+				}
+			}
+			m := &Macro{
+				Name:     "syntax-case",
+				Ellipsis: "...",
+				Literals: literals,
+			}
+			pattern := syntaxDatum(args[1])
+			b := make(map[string]*syntaxBinding)
+			if !scm.syntaxExpansion().match(m, pattern, args[0], b) {
+				return Boolean(false), nil
+			}
+			vars := m.patternVars(pattern, nil)
+			var result Value
+			for i := len(vars) - 1; i >= 0; i-- {
+				result = NewPair(b[vars[i].Name], result)
+			}
+			return result, nil
+		},
+	},
+	{
+		Name:   "scheme::syntax",
+		Args:   []string{"template<any>", "vars<any>", "obj..."},
+		Return: types.Any,
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			template, ok := args[0].(*Syntax)
+			if !ok {
+				return nil, fmt.Errorf("invalid template: %v", args[0])
+			}
+			b := make(map[string]*syntaxBinding)
+			vars, _, _ := syntaxItems(args[1])
+			for idx, v := range vars {
+				id, ok := v.(*Identifier)
+				if !ok || idx+2 >= len(args) {
+					return nil, fmt.Errorf("invalid variable: %v", v)
+				}
+				binding, ok := args[idx+2].(*syntaxBinding)
+				if ok {
+					b[id.Name] = binding
+				}
+			}
+			x := scm.syntaxExpansion()
+			var loc Locator = template.From
+			if x.form != nil {
+				loc = x.form
+			}
+			v, err := x.expandTemplate(loc, template.Datum, b, false)
+			if err != nil {
+				return nil, err
+			}
+			return wrapSyntax(v), nil
+		},
+	},
+	{
+		Name:   "identifier?",
+		Args:   []string{"obj"},
+		Return: types.Boolean,
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			s, ok := args[0].(*Syntax)
+			if !ok {
+				return Boolean(false), nil
+			}
+			_, ok = syntaxDatum(s).(*Identifier)
+			return Boolean(ok), nil
+		},
+	},
+	{
+		Name:   "bound-identifier=?",
+		Args:   []string{"id1<any>", "id2<any>"},
+		Return: types.Boolean,
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			id1, id2, err := identifierArgs(args)
+			if err != nil {
+				return nil, err
+			}
+			return Boolean(id1.Name == id2.Name), nil
+		},
+	},
+	{
+		Name:   "free-identifier=?",
+		Args:   []string{"id1<any>", "id2<any>"},
+		Return: types.Boolean,
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			id1, id2, err := identifierArgs(args)
+			if err != nil {
+				return nil, err
+			}
+			x := scm.syntaxExpansion()
+			var frames []*EnvFrame
+			if x.env != nil {
+				frames = x.env.Frames
+			}
+			return Boolean(x.freeIdentifierEqual(id1, frames, id2)), nil
+		},
+	},
+	{
+		Name:   "syntax->datum",
+		Args:   []string{"obj"},
+		Return: types.Any,
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			return syntaxToDatum(args[0]), nil
+		},
+	},
+	{
+		Name:   "datum->syntax",
+		Args:   []string{"template-id<any>", "datum<any>"},
+		Return: types.Any,
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			tid, ok := syntaxDatum(args[0]).(*Identifier)
+			if !ok {
+				return nil, fmt.Errorf("invalid template identifier: %v",
+					ToScheme(args[0]))
+			}
+			datum, _ := mapSyntax(syntaxToDatum(args[1]),
+				func(v Value) (Value, bool) {
+					id, ok := v.(*Identifier)
+					if !ok {
+						return v, false
+					}
+					return withContext(tid, id.Name), true
+				})
+			return wrapSyntax(datum), nil
+		},
+	},
+	{
+		Name:   "generate-temporaries",
+		Args:   []string{"obj"},
+		Return: types.Any,
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			items, _, tail := syntaxItems(args[0])
+			if tail != nil {
+				return nil, fmt.Errorf("invalid list: %v", ToScheme(args[0]))
+			}
+			var result Value
+			for range items {
+				result = NewPair(NewSyntax(&Identifier{
+					Name: fmt.Sprintf("temp %d", scm.image.newMark()),
+				}), result)
+			}
+			return result, nil
+		},
+	},
+	{
+		Name: "syntax-violation",
+		Args: []string{
+			"who", "message<string>", "form<any>", "[subform<any>]",
+		},
+		Return: types.Any,
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			message, ok := args[1].(String)
+			if !ok {
+				return nil, fmt.Errorf("invalid message: %v", args[1])
+			}
+			form := syntaxToDatum(args[2])
+			var subform Value = Boolean(false)
+			if len(args) > 3 {
+				subform = syntaxToDatum(args[3])
+			}
+			who := args[0]
+			if who == Boolean(false) {
+				pair, ok := form.(Pair)
+				if ok {
+					id, ok := pair.Car().(*Identifier)
+					if ok {
+						who = id
+					}
+				}
+			}
+			conditions := []*Condition{condSyntax.New(form, subform)}
+			if who != Boolean(false) {
+				conditions = append(conditions, condWho.New(who))
+			}
+			conditions = append(conditions, condMessage.New(message))
+
+			return nil, NewCondition(conditions...)
+		},
+	},
+}
+
+// identifierArgs returns the identifier arguments of the identifier
+// comparison functions.
+func identifierArgs(args []Value) (*Identifier, *Identifier, error) {
+	var ids [2]*Identifier
+	for i := 0; i < 2; i++ {
+		s, ok := args[i].(*Syntax)
+		if ok {
+			ids[i], ok = syntaxDatum(s).(*Identifier)
+		}
+		if !ok {
+			return nil, nil, fmt.Errorf("invalid identifier: %v",
+				ToScheme(args[i]))
+		}
+	}
+	return ids[0], ids[1], nil
+}
@@ -0,0 +1,67 @@
+;;;
+;;; Copyright (c) 2024 Markku Rossi
+;;;
+;;; All rights reserved.
+;;;
+;;; Tests for the library form.
+;;;
+
+(library (main)
+  (export)
+  (import (rnrs base)
+          (prefix (go format) go:)
+          (rename (only (go lang (>= 1)) len) (len go-len))
+          (except (test library ((>= 1) (or 2 (>= 2)))) lf-double)
+          (for (prefix (library (test library (1))) tl:) run expand))
+
+  (runner 'sub-section "7.1. Library form")
+
+  (runner 'test "import sets"
+          (lambda () (equal? (go:format "%v-%v" 1 2) "1-2"))
+          (lambda () (eq? (go-len "abc") 3))
+          (lambda () (eq? (tl:lf-twice 2) 4))
+          (lambda () (eq? (lf-twice 3) 6))
+          (lambda ()
+            (guard (e ((undefined-violation? e) #t))
+              (lf-double 1)
+              #f))
+          (lambda ()
+            (guard (e ((undefined-violation? e) #t))
+              (len "abc")
+              #f))
+          (lambda ()
+            (guard (e ((undefined-violation? e) #t))
+              (format "%v" 1)
+              #f))
+          )
+
+  (runner 'test "export rename"
+          (lambda () (equal? (lf-external 1) '(internal 1)))
+          (lambda () (eq? (tl:lf-double 5) 10))
+          (lambda () (equal? (tl:lf-external 2) '(internal 2)))
+          )
+
+  (define (lf-helper x) (list 'main x))
+
+  (runner 'test "private definitions"
+          (lambda () (equal? (lf-helper 1) '(main 1)))
+          (lambda () (eq? (lf-helper-value) 2))
+          (lambda () (eq? (lf-quadruple 3) 12))
+          (lambda ()
+            (guard (e ((undefined-violation? e) #t))
+              (lf-internal 1)
+              #f))
+          )
+
+  (runner 'test "version references"
+          (lambda () (scheme::version-match? '() '(1 2)))
+          (lambda () (scheme::version-match? '(1) '(1 2)))
+          (lambda () (not (scheme::version-match? '(1 2 3) '(1 2))))
+          (lambda () (scheme::version-match? '((>= 1) (<= 2)) '(1 2)))
+          (lambda () (scheme::version-match? '(and (1) ((>= 0) 2)) '(1 2)))
+          (lambda () (scheme::version-match? '(or (2) (1)) '(1 2)))
+          (lambda () (scheme::version-match? '(not (2)) '(1 2)))
+          (lambda () (scheme::version-match? '((not 2)) '(1 2)))
+          (lambda () (not (scheme::version-match? '((or 2 3)) '(1 2))))
+          )
+  )
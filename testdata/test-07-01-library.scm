@@ -0,0 +1,25 @@
+;;;
+;;; Copyright (c) 2024 Markku Rossi
+;;;
+;;; All rights reserved.
+;;;
+;;; Test library for the library form tests.
+;;;
+
+(library (test library (1 2))
+  (export lf-twice lf-quadruple lf-helper-value
+          (rename (lf-internal lf-external)
+                  (lf-twice lf-double)))
+  (import (rnrs base))
+
+  (define (lf-internal x) (list 'internal x))
+
+  (define (lf-twice x) (lf-helper x))
+
+  (define-syntax lf-quadruple
+    (syntax-rules ()
+      ((_ x) (lf-helper (lf-helper x)))))
+
+  (define (lf-helper-value) (lf-helper 1))
+
+  (define (lf-helper x) (* x 2)))
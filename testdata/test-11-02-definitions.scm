@@ -0,0 +1,19 @@
+;;;
+;;; Copyright (c) 2024 Markku Rossi
+;;;
+;;; All rights reserved.
+;;;
+
+(runner 'sub-section "11.2. Definitions")
+
+(define-values (dv-a dv-b) (values 1 2))
+(define-values (dv-c . dv-rest) (values 3 4 5))
+(define-values dv-all (values 6 7))
+(define-values (dv-single) 8)
+
+(runner 'test "define-values"
+        (lambda () (equal? (list dv-a dv-b) '(1 2)))
+        (lambda () (equal? (list dv-c dv-rest) '(3 (4 5))))
+        (lambda () (equal? dv-all '(6 7)))
+        (lambda () (eq? dv-single 8))
+        )
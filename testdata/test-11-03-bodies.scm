@@ -0,0 +1,93 @@
+;;;
+;;; Copyright (c) 2024 Markku Rossi
+;;;
+;;; All rights reserved.
+;;;
+
+(runner 'sub-section "11.3. Bodies")
+
+(define body-x 'global)
+
+(define-syntax body-define-double
+  (syntax-rules ()
+    ((_ name value) (define name (* 2 value)))))
+
+(runner 'test "internal definitions"
+        (lambda ()
+          (eq? (let ()
+                 (define x 1)
+                 (define y (+ x 1))
+                 (* x y))
+               2))
+        (lambda ()
+          ((lambda ()
+             (define (even? n) (if (zero? n) #t (odd? (- n 1))))
+             (define (odd? n) (if (zero? n) #f (even? (- n 1))))
+             (even? 88))))
+        (lambda ()
+          (equal? (let* ((a 1))
+                    (define b (+ a 1))
+                    (define (f c) (list a b c))
+                    (f 3))
+                  '(1 2 3)))
+        (lambda ()
+          (eq? (letrec ((f (lambda () 42)))
+                 (define (g) (f))
+                 (g))
+               42))
+        (lambda ()
+          (let ((body-x 1))
+            (define body-x 2)
+            (eq? body-x 2)))
+        (lambda ()
+          ((lambda (n)
+             (define body-x (* n 2))
+             (eq? body-x 6))
+           3))
+        (lambda () (eq? body-x 'global))
+        (lambda ()
+          (define counter 0)
+          (define (inc!) (set! counter (+ counter 1)) counter)
+          (inc!)
+          (inc!)
+          (eq? counter 2))
+        (lambda ()
+          (define (make-adder n)
+            (define (add x) (+ x n))
+            add)
+          (eq? ((make-adder 2) 3) 5))
+        )
+
+(runner 'test "internal definition forms"
+        (lambda ()
+          (define-values (q r) (values 7 2))
+          (define-values (first . others) (values 1 2 3))
+          (define-values all (values 4 5))
+          (equal? (list q r first others all) '(7 2 1 (2 3) (4 5))))
+        (lambda ()
+          (define-record-type body-point (fields x (mutable y)))
+          (define p (make-body-point 1 2))
+          (body-point-y-set! p 3)
+          (and (body-point? p)
+               (equal? (list (body-point-x p) (body-point-y p)) '(1 3))))
+        (lambda ()
+          (begin
+            (define a 1)
+            (begin (define b 2)))
+          (eq? (+ a b) 3))
+        (lambda ()
+          (body-define-double d 21)
+          (eq? d 42))
+        (lambda ()
+          (define-syntax twice
+            (syntax-rules ()
+              ((_ e) (begin e e))))
+          (define n 0)
+          (twice (set! n (+ n 1)))
+          (eq? n 2))
+        (lambda ()
+          (equal? (letrec* ((a 1)
+                            (b (+ a 1)))
+                    (list a b))
+                  '(1 2)))
+        )
@@ -147,6 +147,32 @@
                           (even? 88))
                         #t))
         )
+(runner 'test "let-values"
+        (lambda () (equal? (let-values (((a b) (values 1 2))
+                                        ((c) (values 3)))
+                             (list a b c))
+                           '(1 2 3)))
+        (lambda () (equal? (let ((a 'a) (b 'b) (x 'x) (y 'y))
+                             (let-values (((a b) (values x y))
+                                          ((x y) (values a b)))
+                               (list a b x y)))
+                           '(x y a b)))
+        (lambda () (equal? (let-values (((a . rest) (values 1 2 3))
+                                        (all (values 4 5))
+                                        (() (values)))
+                             (list a rest all))
+                           '(1 (2 3) (4 5))))
+        (lambda () (eq? (let-values (((a b) (values 1 2)))
+                          ((lambda () (+ a b))))
+                        3))
+        )
+(runner 'test "let*-values"
+        (lambda () (equal? (let ((a 'a) (b 'b) (x 'x) (y 'y))
+                             (let*-values (((a b) (values x y))
+                                           ((x y) (values a b)))
+                               (list a b x y)))
+                           '(x y x y)))
+        )
 
 ;; 11.4.7. Sequencing
 
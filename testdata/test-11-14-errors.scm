@@ -0,0 +1,43 @@
+;;;
+;;; Copyright (c) 2024 Markku Rossi
+;;;
+;;; All rights reserved.
+;;;
+
+(runner 'sub-section "11.14. Errors and violations")
+
+(runner 'test "error"
+        (lambda () (guard (e ((error? e) #t))
+                     (error 'test "failure")
+                     #f))
+        (lambda () (eq? (guard (e (#t (condition-who e)))
+                          (error 'test "failure"))
+                        'test))
+        (lambda () (equal? (guard (e (#t (condition-message e)))
+                             (error 'test "failure"))
+                           "failure"))
+        (lambda () (equal? (guard (e (#t (condition-irritants e)))
+                             (error 'test "failure" 1 'two "three"))
+                           '(1 two "three")))
+        (lambda () (null? (guard (e (#t (condition-irritants e)))
+                            (error 'test "failure"))))
+        (lambda () (not (guard (e (#t (who-condition? e)))
+                          (error #f "failure"))))
+        (lambda () (not (guard (e (#t (violation? e)))
+                          (error 'test "failure"))))
+        )
+
+(runner 'test "assertion-violation"
+        (lambda () (guard (e ((assertion-violation? e) #t))
+                     (assertion-violation 'test "failure")
+                     #f))
+        (lambda () (guard (e (#t (and (violation? e)
+                                      (serious-condition? e)
+                                      (not (error? e)))))
+                     (assertion-violation 'test "failure")))
+        (lambda () (equal? (guard (e (#t (list (condition-who e)
+                                               (condition-message e)
+                                               (condition-irritants e))))
+                             (assertion-violation 'vector-ref "bad index" 5))
+                           '(vector-ref "bad index" (5))))
+        )
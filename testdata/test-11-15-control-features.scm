@@ -15,3 +15,215 @@
                           ((compose sqrt *) 12 75))
                         30))
         )
+
+(runner 'test "values"
+        (lambda () (eq? (values 1) 1))
+        (lambda () (equal? (call-with-values (lambda () (values 1 2)) list)
+                           '(1 2)))
+        (lambda () (null? (call-with-values values list)))
+        (lambda () (equal? (call-with-values
+                               (lambda () (values 1 2 3 4 5))
+                             list)
+                           '(1 2 3 4 5)))
+        )
+
+(runner 'test "self tail-call"
+        (lambda () (letrec ((loop (lambda (n acc)
+                                    (if (zero? n)
+                                        acc
+                                        (loop (- n 1) (+ acc 1))))))
+                     (eq? (loop 100000 0) 100000)))
+        (lambda () (letrec ((loop (lambda (n)
+                                    (let ((m (- n 1)))
+                                      (if (< m 0)
+                                          'done
+                                          (loop m))))))
+                     (eq? (loop 100000) 'done)))
+        (lambda () (letrec ((swap (lambda (a b n)
+                                    (if (zero? n)
+                                        (list a b)
+                                        (swap b a (- n 1))))))
+                     (equal? (swap 1 2 3) '(2 1))))
+        (lambda () (letrec ((loop (lambda (n)
+                                    (if (zero? n)
+                                        'original
+                                        (loop (- n 1))))))
+                     (let ((saved loop))
+                       (set! loop (lambda (n) 'assigned))
+                       (eq? (saved 5) 'assigned))))
+        )
+
+(runner 'test "call-with-values"
+        (lambda () (eq? (call-with-values (lambda () (values 4 5))
+                          (lambda (a b) b))
+                        5))
+        (lambda () (eq? (call-with-values * -) -1))
+        (lambda () (eq? (call-with-values (lambda () 5)
+                          (lambda (x) (* x x)))
+                        25))
+        (lambda () (equal? (call-with-values
+                               (lambda () (call/cc (lambda (k) (k 1 2))))
+                             list)
+                           '(1 2)))
+        (lambda () (equal? (call-with-values
+                               (lambda ()
+                                 (dynamic-wind
+                                     (lambda () #f)
+                                     (lambda () (values 1 2))
+                                     (lambda () #f)))
+                             cons)
+                           '(1 . 2)))
+        )
+
+(runner 'test "call-with-current-continuation"
+        (lambda () (eq? (call-with-current-continuation
+                         (lambda (k) (+ 2 5)))
+                        7))
+        (lambda () (eq? (call-with-current-continuation
+                         (lambda (k) (+ 2 5 (k 3))))
+                        3))
+        (lambda () (eq? (+ 1 (call/cc (lambda (k) (+ 2 (k 3))))) 4))
+        (lambda () (procedure? (call/cc (lambda (k) k))))
+        (lambda () (eq? (call/cc procedure?) #t))
+        (lambda () (procedure? (call/cc call/cc)))
+        )
+
+(runner 'test "call/cc escape"
+        (lambda () (eq? (call/cc
+                         (lambda (return)
+                           (for-each (lambda (x)
+                                       (if (< x 0)
+                                           (return x)))
+                                     '(54 0 37 -3 245 19))
+                           #t))
+                        -3))
+        (lambda () (eq? (letrec ((list-length
+                                  (lambda (obj)
+                                    (call/cc
+                                     (lambda (return)
+                                       (letrec ((r
+                                                 (lambda (obj)
+                                                   (cond
+                                                    ((null? obj) 0)
+                                                    ((pair? obj)
+                                                     (+ (r (cdr obj)) 1))
+                                                    (else (return #f))))))
+                                         (r obj)))))))
+                          (list-length '(1 2 3 4)))
+                        4))
+        (lambda () (eq? (letrec ((list-length
+                                  (lambda (obj)
+                                    (call/cc
+                                     (lambda (return)
+                                       (letrec ((r
+                                                 (lambda (obj)
+                                                   (cond
+                                                    ((null? obj) 0)
+                                                    ((pair? obj)
+                                                     (+ (r (cdr obj)) 1))
+                                                    (else (return #f))))))
+                                         (r obj)))))))
+                          (list-length '(a b . c)))
+                        #f))
+        )
+
+(runner 'test "call/cc re-entry"
+        (lambda ()
+          (let ((k #f)
+                (count 0))
+            (let ((v (call/cc (lambda (c) (set! k c) 0))))
+              (set! count (+ count 1))
+              (if (< v 3)
+                  (k (+ v 1))
+                  (and (eq? v 3) (eq? count 4))))))
+        (lambda ()
+          (let ((k #f)
+                (result '()))
+            (set! result (cons (+ 100 (call/cc (lambda (c) (set! k c) 1)))
+                               result))
+            (if (< (length result) 3)
+                (k (+ (length result) 1))
+                (equal? result '(103 102 101)))))
+        (lambda ()
+          ;; Generator producing list elements one at a time.
+          (letrec ((make-generator
+                    (lambda (lst)
+                      (let ((return #f)
+                            (resume #f))
+                        (lambda ()
+                          (call/cc
+                           (lambda (r)
+                             (set! return r)
+                             (if resume
+                                 (resume #f)
+                                 (begin
+                                   (for-each (lambda (x)
+                                               (call/cc
+                                                (lambda (c)
+                                                  (set! resume c)
+                                                  (return x))))
+                                             lst)
+                                   (return 'done))))))))))
+            (let ((gen (make-generator '(a b c))))
+              (let* ((a (gen))
+                     (b (gen))
+                     (c (gen))
+                     (d (gen)))
+                (equal? (list a b c d) '(a b c done))))))
+        )
+
+(runner 'test "dynamic-wind"
+        (lambda () (eq? (dynamic-wind (lambda () #f)
+                                      (lambda () 42)
+                                      (lambda () #f))
+                        42))
+        (lambda ()
+          (let ((path '()))
+            (dynamic-wind (lambda () (set! path (cons 'before path)))
+                          (lambda () (set! path (cons 'during path)))
+                          (lambda () (set! path (cons 'after path))))
+            (equal? (reverse path) '(before during after))))
+        (lambda ()
+          ;; Escape from the extent.
+          (let ((path '()))
+            (call/cc
+             (lambda (k)
+               (dynamic-wind (lambda () (set! path (cons 'before path)))
+                             (lambda () (k 'escape) (set! path '()))
+                             (lambda () (set! path (cons 'after path))))))
+            (equal? (reverse path) '(before after))))
+        (lambda ()
+          ;; Re-enter the extent.
+          (let ((path '())
+                (c #f))
+            (let ((add (lambda (s)
+                         (set! path (cons s path)))))
+              (dynamic-wind
+               (lambda () (add 'connect))
+               (lambda ()
+                 (add (call/cc
+                       (lambda (c0)
+                         (set! c c0)
+                         'talk1))))
+               (lambda () (add 'disconnect)))
+              (if (< (length path) 4)
+                  (c 'talk2)
+                  (equal? (reverse path)
+                          '(connect talk1 disconnect
+                                    connect talk2 disconnect))))))
+        (lambda ()
+          ;; Nested extents.
+          (let ((path '()))
+            (call/cc
+             (lambda (k)
+               (dynamic-wind
+                (lambda () (set! path (cons 'outer-in path)))
+                (lambda ()
+                  (dynamic-wind
+                   (lambda () (set! path (cons 'inner-in path)))
+                   (lambda () (k #t))
+                   (lambda () (set! path (cons 'inner-out path)))))
+                (lambda () (set! path (cons 'outer-out path))))))
+            (equal? (reverse path)
+                    '(outer-in inner-in inner-out outer-out))))
+        )
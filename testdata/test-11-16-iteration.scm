@@ -0,0 +1,49 @@
+;;;
+;;; Copyright (c) 2024 Markku Rossi
+;;;
+;;; All rights reserved.
+;;;
+
+(runner 'sub-section "11.16. Iteration")
+
+(runner 'test "named let"
+        (lambda () (equal? (let loop ((numbers '(3 -2 1 6 -5))
+                                      (nonneg '())
+                                      (neg '()))
+                             (cond ((null? numbers) (list nonneg neg))
+                                   ((>= (car numbers) 0)
+                                    (loop (cdr numbers)
+                                          (cons (car numbers) nonneg)
+                                          neg))
+                                   ((< (car numbers) 0)
+                                    (loop (cdr numbers)
+                                          nonneg
+                                          (cons (car numbers) neg)))))
+                           '((6 1 3) (-5 -2))))
+        (lambda () (eq? (let loop () 42) 42))
+        (lambda () (eq? (let loop ((i 0))
+                          (if (< i 100000)
+                              (loop (+ i 1))
+                              i))
+                        100000))
+        (lambda () (equal? (let loop ((l '(1 2 3)))
+                             (if (null? l)
+                                 '()
+                                 (cons (* 2 (car l)) (loop (cdr l)))))
+                           '(2 4 6)))
+        (lambda () (equal? (let ((n 3))
+                             (let loop ((i 0) (acc '()))
+                               (if (= i n)
+                                   acc
+                                   (loop (+ i 1) (cons i acc)))))
+                           '(2 1 0)))
+        (lambda () (equal? (let loop ((i 0) (fs '()))
+                             (if (= i 3)
+                                 (map (lambda (f) (f)) fs)
+                                 (loop (+ i 1) (cons (lambda () i) fs))))
+                           '(2 1 0)))
+        (lambda () (eq? (let ((loop 1))
+                          (let loop ((i loop))
+                            i))
+                        1))
+        )
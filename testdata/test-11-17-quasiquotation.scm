@@ -0,0 +1,56 @@
+;;;
+;;; Copyright (c) 2024 Markku Rossi
+;;;
+;;; All rights reserved.
+;;;
+
+(runner 'sub-section "11.17. Quasiquotation")
+
+(runner 'test "quasiquote"
+        (lambda () (equal? `(list ,(+ 1 2) 4) '(list 3 4)))
+        (lambda () (equal? (let ((name 'a)) `(list ,name ',name))
+                           '(list a (quote a))))
+        (lambda () (equal? `(a ,(+ 1 2) ,@(map - '(-4 -5 -6)) b)
+                           '(a 3 4 5 6 b)))
+        (lambda () (equal? `((foo ,(- 10 3)) ,@(cdr '(c)) . ,(car '(cons)))
+                           '((foo 7) . cons)))
+        (lambda () (equal? `#(10 5 ,(- 4) ,@(map - '(16 9)) 8)
+                           '#(10 5 -4 -16 -9 8)))
+        (lambda () (equal? (let ((name 'foo))
+                             `((unquote name name name)))
+                           '(foo foo foo)))
+        (lambda () (equal? (let ((name '(foo)))
+                             `((unquote-splicing name name name)))
+                           '(foo foo foo)))
+        (lambda () (equal? `(1 . ,(+ 1 1)) '(1 . 2)))
+        (lambda () (equal? `,(+ 2 3) 5))
+        (lambda () (equal? `(a b #(c)) '(a b #(c))))
+        (lambda () (equal? `(,@'() . x) 'x))
+        )
+
+(runner 'test "nested quasiquote"
+        (lambda () (equal? `(a `(b ,(c) ,',(+ 1 2)))
+                           '(a `(b ,(c) ,'3))))
+        (lambda () (equal? `(a `(b ,(a1 ,(+ 1 3) d) e) f)
+                           '(a `(b ,(a1 4 d) e) f)))
+        (lambda () (equal? (let ((name1 'x)
+                                 (name2 'y))
+                             `(a `(b ,,name1 ,',name2 d) e))
+                           '(a `(b ,x ,'y d) e)))
+        (lambda () (equal? (let ((l '(1 2)))
+                             `(a `(b ,(c ,@l))))
+                           '(a `(b ,(c 1 2)))))
+        )
+
+(runner 'test "quasiquote constants"
+        (lambda ()
+          (let ((f (lambda (x) `(const (a b) ,x))))
+            (eq? (cadr (f 1)) (cadr (f 2)))))
+        (lambda ()
+          (let ((l '(2 3)))
+            (eq? (cdr `(1 ,@l)) l)))
+        (lambda ()
+          (let ((cons list)
+                (x 1))
+            (equal? `(,x . ,x) '(1 . 1))))
+        )
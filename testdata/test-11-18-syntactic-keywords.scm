@@ -0,0 +1,59 @@
+;;;
+;;; Copyright (c) 2024 Markku Rossi
+;;;
+;;; All rights reserved.
+;;;
+
+(runner 'sub-section "11.18. Binding constructs for syntactic keywords")
+
+(runner 'test "let-syntax"
+        (lambda () (eq? (let-syntax ((double (syntax-rules ()
+                                               ((_ e) (* e 2)))))
+                          (double 21))
+                        42))
+        (lambda () (equal? (let ((x 'outer))
+                             (let-syntax ((m (syntax-rules () ((_) x))))
+                               (let ((x 'inner))
+                                 (m))))
+                           'outer))
+        (lambda () (equal? (let ((x 'outer))
+                             (let-syntax ((m (syntax-rules () ((_) x))))
+                               (let ((x 'inner))
+                                 (map (lambda (y) (list y (m)))
+                                      (list x)))))
+                           '((inner outer))))
+        (lambda () (eq? (let ((count 0))
+                          (let-syntax ((inc! (syntax-rules ()
+                                               ((_) (set! count
+                                                          (+ count 1))))))
+                            (inc!)
+                            (inc!))
+                          count)
+                        2))
+        )
+
+(runner 'test "letrec-syntax"
+        (lambda () (eq? (letrec-syntax
+                            ((my-or (syntax-rules ()
+                                      ((_) #f)
+                                      ((_ e) e)
+                                      ((_ e1 e2 ...)
+                                       (let ((temp e1))
+                                         (if temp
+                                             temp
+                                             (my-or e2 ...)))))))
+                          (let ((x #f)
+                                (y 7)
+                                (temp 8))
+                            (my-or x
+                                   (let ((temp 1)) #f)
+                                   y)))
+                        7))
+        (lambda () (eq? (letrec-syntax
+                            ((ev? (syntax-rules ()
+                                    ((_ n) (if (= n 0) #t (od? (- n 1))))))
+                             (od? (syntax-rules ()
+                                    ((_ n) (if (= n 0) #f #t)))))
+                          (ev? 2))
+                        #t))
+        )
@@ -0,0 +1,102 @@
+;;;
+;;; Copyright (c) 2024 Markku Rossi
+;;;
+;;; All rights reserved.
+;;;
+
+(runner 'sub-section "11.19. Macro transformers")
+
+(define-syntax mt-swap!
+  (syntax-rules ()
+    ((_ a b)
+     (let ((tmp a))
+       (set! a b)
+       (set! b tmp)))))
+
+(define-syntax mt-or
+  (syntax-rules ()
+    ((_) #f)
+    ((_ e) e)
+    ((_ e r ...) (let ((t e)) (if t t (mt-or r ...))))))
+
+(define-syntax mt-cond
+  (syntax-rules (else)
+    ((_ (else e ...)) (begin e ...))
+    ((_ (c e ...) clause ...) (if c (begin e ...) (mt-cond clause ...)))))
+
+(define-syntax mt-when
+  (syntax-rules (then)
+    ((_ c then e ...) (if c (begin e ...) #f))))
+
+(define-syntax mt-list
+  (syntax-rules ()
+    ((_ a) (list a))))
+
+(define-syntax mt-flatten
+  (syntax-rules ()
+    ((_ (a b ...) ...) '((a ...) (b ... ...)))))
+
+(define-syntax mt-vector
+  (syntax-rules ()
+    ((_ #(a ...)) (list a ...))))
+
+(define-syntax mt-rest
+  (syntax-rules ()
+    ((_ a . b) '(a . b))))
+
+(define-syntax mt-tail
+  (syntax-rules ()
+    ((_ a ... z) '(z a ...))))
+
+(define-syntax mt-custom
+  (syntax-rules ::: ()
+    ((_ a :::) (list a :::))))
+
+(define-syntax mt-define-begin
+  (syntax-rules ()
+    ((_ name)
+     (define-syntax name
+       (syntax-rules ()
+         ((name expr (... ...))
+          (begin expr (... ...))))))))
+
+(mt-define-begin mt-sequence)
+
+(define mt-x 1)
+(define mt-y 2)
+(mt-swap! mt-x mt-y)
+
+(runner 'test "define-syntax"
+        (lambda () (equal? (list mt-x mt-y) '(2 1)))
+        (lambda () (eq? (mt-sequence 1 2 3) 3))
+        (lambda () (let ((f (lambda ()
+                              (define-syntax twice
+                                (syntax-rules ()
+                                  ((_ e) (begin e e))))
+                              (let ((c 0))
+                                (twice (set! c (+ c 1)))
+                                c))))
+                     (eq? (f) 2)))
+        )
+
+(runner 'test "syntax-rules"
+        (lambda () (let ((tmp 5)
+                         (other 6))
+                     (mt-swap! tmp other)
+                     (equal? (list tmp other) '(6 5))))
+        (lambda () (eq? (mt-or) #f))
+        (lambda () (let ((t 5))
+                     (eq? (mt-or #f t) 5)))
+        (lambda () (eq? (mt-cond (#f 1) ((= 1 2) 2) (else 3)) 3))
+        (lambda () (eq? (mt-when #t then 1 2) 2))
+        (lambda () (equal? (let ((list vector))
+                             (mt-list 1))
+                           '(1)))
+        (lambda () (equal? (mt-flatten (1 2 3) (4 5 6))
+                           '((1 4) (2 3 5 6))))
+        (lambda () (equal? (mt-vector #(1 2 3)) '(1 2 3)))
+        (lambda () (equal? (mt-rest 1 2 3) '(1 2 3)))
+        (lambda () (equal? (mt-rest x) '(x)))
+        (lambda () (equal? (mt-tail 1 2 3) '(3 1 2)))
+        (lambda () (equal? (mt-custom 1 2 3) '(1 2 3)))
+        )
@@ -32,4 +32,30 @@
           (lambda () (equal? (vector-sort < '#(3)) '#(3)))
           (lambda () (equal? (vector-sort < '#(1 2 3 5)) '#(1 2 3 5)))
           )
+  (runner 'test "vector-sort!"
+          (lambda () (let ((v (vector 3 5 2 1)))
+                       (vector-sort! < v)
+                       (equal? v '#(1 2 3 5))))
+          (lambda () (let ((v (vector)))
+                       (vector-sort! < v)
+                       (equal? v '#())))
+
+          ;; Test that sorting is stable.
+          (lambda () (let ((v (vector '(3 . 1) '(2 . 1) '(3 . 2) '(2 . 2))))
+                       (vector-sort! (lambda (a b) (< (car a) (car b))) v)
+                       (equal? v '#((2 . 1) (2 . 2) (3 . 1) (3 . 2)))))
+
+          ;; Escape from the predicate.
+          (lambda () (eq? (call/cc
+                           (lambda (k)
+                             (vector-sort! (lambda (a b) (k 'escape))
+                                           (vector 2 1))))
+                          'escape))
+
+          ;; Errors in the predicate.
+          (lambda () (eq? (guard (e ((error? e) 'error))
+                            (vector-sort! (lambda (a b) (error 'pred "fail"))
+                                          (vector 2 1)))
+                          'error))
+          )
   )
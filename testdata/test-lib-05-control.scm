@@ -0,0 +1,77 @@
+;;;
+;;; Copyright (c) 2024 Markku Rossi
+;;;
+;;; All rights reserved.
+;;;
+;;; Tests for the r6rs control library.
+;;;
+
+(library (main)
+  (export)
+  (import (rnrs control))
+
+  (runner 'sub-section "5. Control structures")
+
+  (runner 'test "do"
+          (lambda () (equal? (do ((vec (make-vector 5))
+                                  (i 0 (+ i 1)))
+                                 ((= i 5) vec)
+                               (vector-set! vec i i))
+                             '#(0 1 2 3 4)))
+          (lambda () (eq? (let ((x '(1 3 5 7 9)))
+                            (do ((x x (cdr x))
+                                 (sum 0 (+ sum (car x))))
+                                ((null? x) sum)))
+                          25))
+          (lambda () (equal? (let ((result '()))
+                               (do ((i 0 (+ i 1)))
+                                   ((= i 3))
+                                 (set! result (cons i result)))
+                               result)
+                             '(2 1 0)))
+          (lambda () (eq? (do ((i 0 (+ i 1))
+                               (j 10))
+                              ((= i 5) (set! j (+ j i)) j))
+                          15))
+          )
+
+  (define plus
+    (case-lambda
+      (() 0)
+      ((x) x)
+      ((x y) (+ x y))
+      ((x y z) (+ (+ x y) z))
+      (args (apply + args))))
+
+  (define cl-kind
+    (case-lambda
+      ((x) (list 'one x))
+      ((x y) (list 'two x y))
+      ((x . r) (list 'many x r))))
+
+  (define (make-cell value)
+    (case-lambda
+      (() value)
+      ((v) (set! value v) value)))
+
+  (runner 'test "case-lambda"
+          (lambda () (eq? (plus) 0))
+          (lambda () (eq? (plus 1) 1))
+          (lambda () (eq? (plus 1 2) 3))
+          (lambda () (eq? (plus 1 2 3) 6))
+          (lambda () (eq? (plus 1 2 3 4) 10))
+          (lambda () (equal? (cl-kind 1) '(one 1)))
+          (lambda () (equal? (cl-kind 1 2) '(two 1 2)))
+          (lambda () (equal? (cl-kind 1 2 3) '(many 1 (2 3))))
+          (lambda () (equal? (apply cl-kind '(1 2)) '(two 1 2)))
+          (lambda () (equal? (map (case-lambda ((x) (* x x))) '(1 2 3))
+                             '(1 4 9)))
+          (lambda ()
+            (let ((cell (make-cell 1)))
+              (equal? (list (cell) (cell 2) (cell)) '(1 2 2))))
+          (lambda ()
+            (guard (e (#t #t))
+              ((case-lambda ((x) x) ((x y z) x)) 1 2)
+              #f))
+          )
+  )
@@ -0,0 +1,303 @@
+;;;
+;;; Copyright (c) 2024 Markku Rossi
+;;;
+;;; All rights reserved.
+;;;
+;;; Tests for the r6rs records libraries.
+;;;
+
+(library (main)
+  (export)
+  (import (rnrs records syntactic)
+          (rnrs records procedural)
+          (rnrs records inspection))
+
+  (runner 'sub-section "6. Records")
+
+  (define-record-type (point make-point point?)
+    (fields (immutable x point-x)
+            (mutable y point-y set-point-y!))
+    (nongenerative point-4893d957-e00b-11d9-817f-00111175eb9e))
+
+  (define-record-type (cpoint make-cpoint cpoint?)
+    (parent point)
+    (protocol
+     (lambda (n)
+       (lambda (x y c)
+         ((n x y) (color->rgb c)))))
+    (fields
+     (mutable rgb cpoint-rgb cpoint-rgb-set!)))
+
+  (define (color->rgb c)
+    (cons 'rgb c))
+
+  (define p1 (make-point 1 2))
+  (define p2 (make-cpoint 3 4 'red))
+
+  (runner 'test "define-record-type"
+          (lambda () (point? p1))
+          (lambda () (point? p2))
+          (lambda () (not (point? (vector))))
+          (lambda () (not (point? (cons 'a 'b))))
+          (lambda () (not (cpoint? p1)))
+          (lambda () (cpoint? p2))
+          (lambda () (eq? (point-x p1) 1))
+          (lambda () (eq? (point-y p1) 2))
+          (lambda () (eq? (point-x p2) 3))
+          (lambda () (eq? (point-y p2) 4))
+          (lambda () (equal? (cpoint-rgb p2) '(rgb . red)))
+          (lambda ()
+            (set-point-y! p1 17)
+            (eq? (point-y p1) 17))
+          (lambda () (eq? (record-type-descriptor point) point))
+          (lambda () (not (equal? (make-point 1 2) (make-point 1 2))))
+          )
+
+  (define-record-type node
+    (fields value (mutable next)))
+
+  (define-record-type point3
+    (parent point)
+    (fields z))
+
+  (runner 'test "default names"
+          (lambda ()
+            (let ((n (make-node 1 #f)))
+              (node-next-set! n (make-node 2 #f))
+              (equal? (list (node? n) (node-value n)
+                            (node-value (node-next n)))
+                      '(#t 1 2))))
+          (lambda ()
+            (let ((p (make-point3 1 2 3)))
+              (equal? (list (point? p) (point3? p)
+                            (point-x p) (point-y p) (point3-z p))
+                      '(#t #t 1 2 3))))
+          )
+
+  (define-record-type (ex1 make-ex1 ex1?)
+    (protocol (lambda (p) (lambda a (p a))))
+    (fields (immutable f ex1-f)))
+
+  (define-record-type (ex2 make-ex2 ex2?)
+    (protocol
+     (lambda (p) (lambda (a . b) (p a b))))
+    (fields (immutable a ex2-a)
+            (immutable b ex2-b)))
+
+  (define *ex3-instance* #f)
+
+  (define-record-type ex3
+    (parent cpoint)
+    (protocol
+     (lambda (n)
+       (lambda (x y t)
+         (let ((r ((n x y 'red) t)))
+           (set! *ex3-instance* r)
+           r))))
+    (fields
+     (mutable thickness))
+    (sealed #t) (opaque #t))
+
+  (define ex3-i1 (make-ex3 1 2 17))
+
+  (runner 'test "protocols"
+          (lambda () (equal? (ex1-f (make-ex1 1 2 3)) '(1 2 3)))
+          (lambda () (eq? (ex2-a (make-ex2 1 2 3)) 1))
+          (lambda () (equal? (ex2-b (make-ex2 1 2 3)) '(2 3)))
+          (lambda () (ex3? ex3-i1))
+          (lambda () (point? ex3-i1))
+          (lambda () (equal? (cpoint-rgb ex3-i1) '(rgb . red)))
+          (lambda () (eq? (ex3-thickness ex3-i1) 17))
+          (lambda ()
+            (ex3-thickness-set! ex3-i1 18)
+            (eq? (ex3-thickness ex3-i1) 18))
+          (lambda () (eq? *ex3-instance* ex3-i1))
+          )
+
+  (runner 'test "record errors"
+          (lambda ()
+            (guard (e (#t #t))
+              (point-x (car (list (vector 1 2))))
+              #f))
+          (lambda ()
+            (guard (e (#t #t))
+              (make-point 1)
+              #f))
+          )
+
+  (define :ppoint
+    (make-record-type-descriptor
+     'ppoint #f
+     #f #f #f
+     '#((mutable x) (mutable y))))
+
+  (define :ppoint-cd
+    (make-record-constructor-descriptor :ppoint #f #f))
+
+  (define make-ppoint (record-constructor :ppoint-cd))
+
+  (define ppoint? (record-predicate :ppoint))
+  (define ppoint-x (record-accessor :ppoint 0))
+  (define ppoint-y (record-accessor :ppoint 1))
+  (define ppoint-x-set! (record-mutator :ppoint 0))
+  (define ppoint-y-set! (record-mutator :ppoint 1))
+
+  (define pp1 (make-ppoint 1 2))
+
+  (define :ppoint2
+    (make-record-type-descriptor
+     'ppoint2 :ppoint
+     #f #f #f '#((mutable x) (mutable y))))
+
+  (define make-ppoint2
+    (record-constructor
+     (make-record-constructor-descriptor :ppoint2
+                                         #f #f)))
+  (define ppoint2? (record-predicate :ppoint2))
+  (define ppoint2-xx (record-accessor :ppoint2 0))
+  (define ppoint2-yy (record-accessor :ppoint2 1))
+
+  (define pp2 (make-ppoint2 1 2 3 4))
+
+  (define (absolute x)
+    (if (< x 0) (- 0 x) x))
+
+  (define :ppoint-cd/abs
+    (make-record-constructor-descriptor
+     :ppoint #f
+     (lambda (new)
+       (lambda (x y)
+         (new (absolute x) (absolute y))))))
+
+  (define make-ppoint/abs
+    (record-constructor :ppoint-cd/abs))
+
+  (define :pcpoint
+    (make-record-type-descriptor
+     'pcpoint :ppoint
+     #f #f #f
+     '#((mutable rgb))))
+
+  (define make-pcpoint
+    (record-constructor
+     (make-record-constructor-descriptor
+      :pcpoint :ppoint-cd
+      (lambda (p)
+        (lambda (x y c)
+          ((p x y) (color->rgb c)))))))
+
+  (define make-pcpoint/abs
+    (record-constructor
+     (make-record-constructor-descriptor
+      :pcpoint :ppoint-cd/abs
+      (lambda (p)
+        (lambda (x y c)
+          ((p x y) (color->rgb c)))))))
+
+  (define pcpoint-rgb
+    (record-accessor :pcpoint 0))
+
+  (runner 'test "procedural layer"
+          (lambda () (record-type-descriptor? :ppoint))
+          (lambda () (not (record-type-descriptor? :ppoint-cd)))
+          (lambda () (ppoint? pp1))
+          (lambda () (eq? (ppoint-x pp1) 1))
+          (lambda () (eq? (ppoint-y pp1) 2))
+          (lambda ()
+            (ppoint-x-set! pp1 5)
+            (eq? (ppoint-x pp1) 5))
+          (lambda () (ppoint? pp2))
+          (lambda () (ppoint2? pp2))
+          (lambda () (not (ppoint2? pp1)))
+          (lambda () (equal? (list (ppoint-x pp2) (ppoint-y pp2)
+                                   (ppoint2-xx pp2) (ppoint2-yy pp2))
+                             '(1 2 3 4)))
+          (lambda () (eq? (ppoint-x (make-ppoint/abs -1 -2)) 1))
+          (lambda () (eq? (ppoint-y (make-ppoint/abs -1 -2)) 2))
+          (lambda () (equal? (pcpoint-rgb (make-pcpoint -1 -3 'red))
+                             '(rgb . red)))
+          (lambda () (eq? (ppoint-x (make-pcpoint -1 -3 'red)) -1))
+          (lambda () (eq? (ppoint-x (make-pcpoint/abs -1 -3 'red)) 1))
+          (lambda ()
+            (guard (e (#t #t))
+              (record-mutator (make-record-type-descriptor
+                               'imm #f #f #f #f '#((immutable x)))
+                              0)
+              #f))
+          (lambda ()
+            (guard (e (#t #t))
+              (make-record-type-descriptor 'child ex3 #f #f #f '#())
+              #f))
+          )
+
+  (define :uid-point
+    (make-record-type-descriptor
+     'uid-point #f 'uid-point-1 #f #f '#((immutable x))))
+
+  (runner 'test "nongenerative"
+          (lambda ()
+            (eq? :uid-point
+                 (make-record-type-descriptor
+                  'uid-point #f 'uid-point-1 #f #f '#((immutable x)))))
+          (lambda ()
+            (guard (e (#t #t))
+              (make-record-type-descriptor
+               'uid-point #f 'uid-point-1 #f #f '#((mutable x)))
+              #f))
+          (lambda () (eq? (record-type-uid :uid-point) 'uid-point-1))
+          (lambda () (not (record-type-generative? :uid-point)))
+          (lambda () (record-type-generative? :ppoint))
+          (lambda () (not (record-type-generative? point)))
+          )
+
+  (runner 'test "inspection"
+          (lambda () (record? pp1))
+          (lambda () (record? p2))
+          (lambda () (not (record? ex3-i1)))
+          (lambda () (not (record? (vector 1 2))))
+          (lambda () (eq? (record-rtd pp1) :ppoint))
+          (lambda () (eq? (record-rtd p2) cpoint))
+          (lambda ()
+            (guard (e (#t #t))
+              (record-rtd ex3-i1)
+              #f))
+          (lambda () (eq? (record-type-name :ppoint2) 'ppoint2))
+          (lambda () (eq? (record-type-name cpoint) 'cpoint))
+          (lambda () (eq? (record-type-parent :ppoint2) :ppoint))
+          (lambda () (eq? (record-type-parent cpoint) point))
+          (lambda () (not (record-type-parent :ppoint)))
+          (lambda () (not (record-type-uid :ppoint)))
+          (lambda () (record-type-sealed? ex3))
+          (lambda () (not (record-type-sealed? point)))
+          (lambda () (record-type-opaque? ex3))
+          (lambda () (not (record-type-opaque? point)))
+          (lambda () (equal? (record-type-field-names point) '#(x y)))
+          (lambda () (equal? (record-type-field-names cpoint) '#(rgb)))
+          (lambda () (not (record-field-mutable? point 0)))
+          (lambda () (record-field-mutable? point 1))
+          )
+
+  (define (record->list record)
+    (let loop ((rtd (record-rtd record))
+               (result '()))
+      (if (not rtd)
+          result
+          (let ((names (record-type-field-names rtd)))
+            (let fields ((k (- (vector-length names) 1))
+                         (result result))
+              (if (< k 0)
+                  (loop (record-type-parent rtd) result)
+                  (fields (- k 1)
+                          (cons (cons (vector-ref names k)
+                                      ((record-accessor rtd k) record))
+                                result))))))))
+
+  (runner 'test "record walking"
+          (lambda ()
+            (equal? (record->list (make-cpoint 1 2 'blue))
+                    '((x . 1) (y . 2) (rgb rgb . blue))))
+          (lambda ()
+            (equal? (record->list (make-ppoint2 1 2 3 4))
+                    '((x . 1) (y . 2) (x . 3) (y . 4))))
+          )
+  )
@@ -0,0 +1,246 @@
+;;;
+;;; Copyright (c) 2024 Markku Rossi
+;;;
+;;; All rights reserved.
+;;;
+;;; Tests for the r6rs exceptions and conditions libraries.
+;;;
+
+(library (main)
+  (export)
+  (import (rnrs exceptions)
+          (rnrs conditions))
+
+  (runner 'sub-section "7.1. Exceptions")
+
+  (runner 'test "with-exception-handler"
+          (lambda () (eq? (with-exception-handler
+                           (lambda (e) 0)
+                           (lambda () (+ 1 2)))
+                          3))
+          (lambda () (eq? (with-exception-handler
+                           (lambda (e) 42)
+                           (lambda ()
+                             (+ (raise-continuable 'oops) 23)))
+                          65))
+          (lambda () (eq? (call/cc
+                           (lambda (k)
+                             (with-exception-handler
+                              (lambda (e) (k e))
+                              (lambda () (raise 'escape)))))
+                          'escape))
+          (lambda () (equal? (with-exception-handler
+                              (lambda (e) (list 'outer e))
+                              (lambda ()
+                                (with-exception-handler
+                                 (lambda (e) (raise-continuable (list 'inner e)))
+                                 (lambda () (raise-continuable 'x)))))
+                             '(outer (inner x))))
+          )
+
+  (runner 'test "raise"
+          (lambda () (eq? (guard (e (#t e)) (raise 'boom)) 'boom))
+          (lambda () (eq? (guard (e ((string? e) 'original)
+                                    (else 'secondary))
+                            (with-exception-handler
+                             (lambda (e) 'returned)
+                             (lambda () (raise "non-continuable"))))
+                          'secondary))
+          )
+
+  (runner 'test "guard"
+          (lambda () (eq? (guard (e ((symbol? e) 'sym)
+                                    ((string? e) 'str))
+                            (raise "error"))
+                          'str))
+          (lambda () (eq? (guard (e (#f 'never)
+                                    (else 'else))
+                            (raise 1))
+                          'else))
+          (lambda () (eq? (guard (e (#t 'caught)) (+ 1 2)) 3))
+          (lambda () (equal? (call-with-values
+                                 (lambda () (guard (e (#t #f)) (values 1 2)))
+                               list)
+                             '(1 2)))
+          (lambda () (eq? (guard (e ((and (pair? e) e) => car))
+                            (raise (list 'first 'second)))
+                          'first))
+          (lambda () (eq? (guard (e ((string? e) 'outer))
+                            (guard (e ((number? e) 'inner))
+                              (raise "string")))
+                          'outer))
+          (lambda () (eq? (with-exception-handler
+                           (lambda (e) 10)
+                           (lambda ()
+                             (guard (e ((number? e) 'num))
+                               (+ 1 (raise-continuable 'reraised)))))
+                          11))
+          (lambda () (equal? (let ((x 5))
+                               (guard (e (#t (list x e)))
+                                 (raise (* x 2))))
+                             '(5 10)))
+          (lambda ()
+            (let ((path '()))
+              (guard (e (#t (set! path (cons 'handler path))))
+                (dynamic-wind
+                    (lambda () (set! path (cons 'before path)))
+                    (lambda () (raise 'exit))
+                    (lambda () (set! path (cons 'after path)))))
+              (equal? (reverse path) '(before after handler))))
+          )
+
+  (runner 'test "native errors"
+          (lambda () (guard (e (#t #t))
+                       (vector-ref (vector 1 2) 5)
+                       #f))
+          (lambda () (guard (e (#t #t))
+                       (error 'test "failure")
+                       #f))
+          (lambda () (guard (e (#t #t))
+                       (string-ref "abc" 10)
+                       #f))
+          (lambda () (eq? (guard (e (#t 'outer))
+                            (guard (e ((string? e) 'inner))
+                              (vector-ref (vector 1 2) 5)))
+                          'outer))
+          )
+
+  (runner 'sub-section "7.2. Conditions")
+
+  (define-condition-type &test &error
+    make-test-condition test-condition?
+    (code test-condition-code)
+    (detail test-condition-detail))
+
+  (define-condition-type &sub-test &test
+    make-sub-test-condition sub-test-condition?
+    (extra sub-test-condition-extra))
+
+  (runner 'test "condition"
+          (lambda () (condition? (make-error)))
+          (lambda () (not (condition? 'error)))
+          (lambda () (let ((c (condition (make-error)
+                                         (make-message-condition "msg"))))
+                       (and (condition? c)
+                            (error? c)
+                            (message-condition? c)
+                            (not (who-condition? c))
+                            (equal? (condition-message c) "msg"))))
+          (lambda () (equal? (length (simple-conditions
+                                      (condition (make-error)
+                                                 (make-who-condition 'me)
+                                                 (make-irritants-condition
+                                                  '(1 2)))))
+                             3))
+          (lambda () (let ((c (make-warning)))
+                       (eq? (car (simple-conditions c)) c)))
+          (lambda () (null? (simple-conditions (condition))))
+          (lambda () (equal? (length (simple-conditions
+                                      (condition (condition (make-error)
+                                                            (make-warning))
+                                                 (make-violation))))
+                             3))
+          )
+
+  (runner 'test "condition-predicate"
+          (lambda () ((condition-predicate &error) (make-error)))
+          (lambda () ((condition-predicate &serious) (make-error)))
+          (lambda () (not ((condition-predicate &error) (make-violation))))
+          (lambda () (not ((condition-predicate &error) 42)))
+          )
+
+  (runner 'test "condition-accessor"
+          (lambda () (equal? ((condition-accessor &message condition-message)
+                              (condition (make-error)
+                                         (make-message-condition "msg")))
+                             "msg"))
+          (lambda () (eq? ((condition-accessor &who
+                                               (lambda (c) 'accessed))
+                           (make-who-condition 'me))
+                          'accessed))
+          )
+
+  (runner 'test "define-condition-type"
+          (lambda () (let ((c (make-test-condition 42 "detail")))
+                       (and (test-condition? c)
+                            (error? c)
+                            (serious-condition? c)
+                            (not (violation? c))
+                            (eq? (test-condition-code c) 42)
+                            (equal? (test-condition-detail c) "detail"))))
+          (lambda () (let ((c (make-sub-test-condition 1 2 3)))
+                       (and (sub-test-condition? c)
+                            (test-condition? c)
+                            (eq? (test-condition-code c) 1)
+                            (eq? (test-condition-detail c) 2)
+                            (eq? (sub-test-condition-extra c) 3))))
+          (lambda () (not (sub-test-condition?
+                           (make-test-condition 1 2))))
+          (lambda () (eq? (test-condition-code
+                           (condition (make-who-condition 'me)
+                                      (make-test-condition 7 8)))
+                          7))
+          (lambda () (eq? (guard (e ((test-condition? e)
+                                     (test-condition-code e)))
+                            (raise (make-test-condition 500 "failed")))
+                          500))
+          )
+
+  (runner 'test "standard condition types"
+          (lambda () (let ((c (make-assertion-violation)))
+                       (and (assertion-violation? c)
+                            (violation? c)
+                            (serious-condition? c))))
+          (lambda () (non-continuable-violation?
+                      (make-non-continuable-violation)))
+          (lambda () (implementation-restriction-violation?
+                      (make-implementation-restriction-violation)))
+          (lambda () (lexical-violation? (make-lexical-violation)))
+          (lambda () (let ((c (make-syntax-violation '(a b) 'b)))
+                       (and (syntax-violation? c)
+                            (equal? (syntax-violation-form c) '(a b))
+                            (eq? (syntax-violation-subform c) 'b))))
+          (lambda () (undefined-violation? (make-undefined-violation)))
+          (lambda () (eq? (condition-who (make-who-condition 'me)) 'me))
+          (lambda () (equal? (condition-irritants
+                              (make-irritants-condition '(1 2)))
+                             '(1 2)))
+          (lambda () (guard (e ((undefined-violation? e) #t))
+                       (scheme::undefined-variable)
+                       #f))
+          (lambda () (guard (e ((non-continuable-violation? e) #t))
+                       (with-exception-handler
+                        (lambda (e) 'returned)
+                        (lambda () (raise 'oops)))
+                       #f))
+          )
+
+  (runner 'test "i/o condition types"
+          (lambda () (let ((c (make-i/o-error)))
+                       (and (i/o-error? c) (error? c))))
+          (lambda () (i/o-read-error? (make-i/o-read-error)))
+          (lambda () (i/o-write-error? (make-i/o-write-error)))
+          (lambda () (eq? (i/o-error-position
+                           (make-i/o-invalid-position-error 10))
+                          10))
+          (lambda () (let ((c (make-i/o-file-does-not-exist-error "file")))
+                       (and (i/o-file-does-not-exist-error? c)
+                            (i/o-filename-error? c)
+                            (i/o-error? c)
+                            (not (i/o-file-protection-error? c))
+                            (equal? (i/o-error-filename c) "file"))))
+          (lambda () (let ((c (make-i/o-file-is-read-only-error "file")))
+                       (and (i/o-file-is-read-only-error? c)
+                            (i/o-file-protection-error? c))))
+          (lambda () (i/o-file-already-exists-error?
+                      (make-i/o-file-already-exists-error "file")))
+          (lambda () (eq? (i/o-error-port (make-i/o-port-error 'port))
+                          'port))
+          (lambda () (i/o-decoding-error? (make-i/o-decoding-error 'port)))
+          (lambda () (let ((c (make-i/o-encoding-error 'port #\a)))
+                       (and (i/o-encoding-error? c)
+                            (i/o-port-error? c)
+                            (eq? (i/o-error-port c) 'port)
+                            (eq? (i/o-encoding-error-char c) #\a))))
+          )
+  )
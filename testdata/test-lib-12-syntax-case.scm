@@ -0,0 +1,168 @@
+;;;
+;;; Copyright (c) 2024 Markku Rossi
+;;;
+;;; All rights reserved.
+;;;
+;;; Tests for the r6rs syntax-case library.
+;;;
+
+(library (main)
+  (export)
+  (import (rnrs syntax-case)
+          (rnrs exceptions)
+          (rnrs conditions))
+
+  (runner 'sub-section "12. syntax-case")
+
+  (define-syntax sc-swap!
+    (lambda (x)
+      (syntax-case x ()
+        ((_ a b)
+         (syntax
+          (let ((tmp a))
+            (set! a b)
+            (set! b tmp)))))))
+
+  (define-syntax sc-or
+    (lambda (x)
+      (syntax-case x ()
+        ((_) #'#f)
+        ((_ e) #'e)
+        ((_ e r ...) #'(let ((t e)) (if t t (sc-or r ...)))))))
+
+  (define-syntax sc-kind
+    (lambda (x)
+      (syntax-case x ()
+        ((_ e) (identifier? #'e) #''identifier)
+        ((_ (e ...)) #''list)
+        ((_ e) #''other))))
+
+  (define-syntax sc-count
+    (lambda (x)
+      (syntax-case x ()
+        ((_ e ...) #`(quote (#,(length #'(e ...)) e ...))))))
+
+  (define-syntax sc-splice
+    (lambda (x)
+      (syntax-case x ()
+        ((_ (a ...) (b ...)) #`(list #,@#'(b ...) #,@#'(a ...))))))
+
+  (define-syntax sc-let2
+    (lambda (x)
+      (syntax-case x ()
+        ((_ (a b) e1 e2 body)
+         (with-syntax ((x1 #'a)
+                       (x2 #'b))
+           #'(let ((x1 e1) (x2 e2)) body))))))
+
+  (define-syntax sc-with-it
+    (lambda (x)
+      (syntax-case x ()
+        ((k e body ...)
+         (with-syntax ((it (datum->syntax #'k 'it)))
+           #'(let ((it e)) body ...))))))
+
+  (define-syntax sc-datum
+    (lambda (x)
+      (syntax-case x ()
+        ((_ e) #`(quote #,(syntax->datum #'e))))))
+
+  (define-syntax sc-bound
+    (lambda (x)
+      (syntax-case x ()
+        ((_ a b) (if (bound-identifier=? #'a #'b) #'#t #'#f)))))
+
+  (define-syntax sc-free
+    (lambda (x)
+      (syntax-case x ()
+        ((_ a) (if (free-identifier=? #'a #'car) #'#t #'#f)))))
+
+  (define-syntax sc-temps
+    (lambda (x)
+      (syntax-case x ()
+        ((_ e ...)
+         (with-syntax (((t ...) (generate-temporaries #'(e ...))))
+           #'(let ((t e) ...) (list t ...)))))))
+
+  (define-syntax sc-literal
+    (lambda (x)
+      (syntax-case x (then)
+        ((_ c then e) #'(if c e #f))
+        ((_ c e) #''no-then))))
+
+  (define-syntax sc-positive
+    (lambda (x)
+      (syntax-case x ()
+        ((_ n) (let ((v (syntax->datum #'n)))
+                 (if (and (number? v) (> v 0))
+                     #'n
+                     (syntax-violation 'sc-positive "not positive" x #'n)))))))
+
+  (runner 'test "syntax-case"
+          (lambda ()
+            (let ((a 1)
+                  (b 2))
+              (sc-swap! a b)
+              (equal? (list a b) '(2 1))))
+          (lambda ()
+            (let ((tmp 1)
+                  (other 2))
+              (sc-swap! tmp other)
+              (equal? (list tmp other) '(2 1))))
+          (lambda () (eq? (sc-or) #f))
+          (lambda () (eq? (sc-or #f 2) 2))
+          (lambda () (let ((t 5)) (eq? (sc-or #f t) 5)))
+          (lambda () (eq? (sc-kind foo) 'identifier))
+          (lambda () (eq? (sc-kind (1 2)) 'list))
+          (lambda () (eq? (sc-kind 42) 'other))
+          (lambda () (eq? (sc-literal #t then 1) 1))
+          (lambda () (eq? (sc-literal #t 1) 'no-then))
+          (lambda () (eq? (sc-positive 3) 3))
+          )
+
+  (runner 'test "quasisyntax"
+          (lambda () (equal? (sc-count a b c) '(3 a b c)))
+          (lambda () (equal? (sc-count) '(0)))
+          (lambda () (equal? (sc-splice (1 2) (3 4)) '(3 4 1 2)))
+          )
+
+  (runner 'test "with-syntax"
+          (lambda () (equal? (sc-let2 (x y) 1 2 (list x y)) '(1 2)))
+          (lambda () (equal? (sc-temps 1 2 3) '(1 2 3)))
+          )
+
+  (runner 'test "datum->syntax"
+          (lambda () (eq? (sc-with-it 41 (+ it 1)) 42))
+          (lambda () (equal? (sc-datum (a #(b) . c)) '(a #(b) . c)))
+          (lambda () (equal? (syntax->datum #'(a b)) '(a b)))
+          (lambda () (identifier? (datum->syntax #'x 'y)))
+          (lambda () (not (identifier? 'x)))
+          )
+
+  (runner 'test "identifier comparison"
+          (lambda () (sc-bound x x))
+          (lambda () (not (sc-bound x y)))
+          (lambda () (sc-free car))
+          (lambda () (not (sc-free cdr)))
+          (lambda () (not (let ((car 1)) (sc-free car))))
+          (lambda () (bound-identifier=? #'x #'x))
+          (lambda () (not (bound-identifier=? #'x #'y)))
+          (lambda ()
+            (let ((temps (generate-temporaries '(a b))))
+              (not (bound-identifier=? (car temps) (cadr temps)))))
+          )
+
+  (runner 'test "syntax-violation"
+          (lambda ()
+            (guard (e ((syntax-violation? e)
+                       (equal? (list (condition-who e)
+                                     (condition-message e)
+                                     (syntax-violation-form e)
+                                     (syntax-violation-subform e))
+                               '(test "invalid form" (f 1) 1))))
+              (syntax-violation 'test "invalid form" #'(f 1) #'1)))
+          (lambda ()
+            (guard (e ((syntax-violation? e) (condition-who e)))
+              (syntax-violation #f "invalid form" '(f 1))))
+          )
+  )
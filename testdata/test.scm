@@ -74,8 +74,10 @@
 (runner 'section "11. Base library")
 
 ;; XXX 11.1. Base types
-;; XXX 11.2. Definitions
-;; XXX 11.3. Bodies
+
+(load "test-11-02-definitions.scm")
+
+(load "test-11-03-bodies.scm")
 
 (load "test-11-04-expressions.scm")
 (load "test-11-05-equivalence.scm")
@@ -87,15 +89,14 @@
 (load "test-11-11-characters.scm")
 (load "test-11-12-strings.scm")
 (load "test-11-13-vectors.scm")
-
-;; XXX 11.14. Errors and violations
-
+(load "test-11-14-errors.scm")
 (load "test-11-15-control-features.scm")
 
-;; XXX 11.16. Iteration
-;; XXX 11.17. Quasiquotation
-;; XXX 11.18. Binding constructs for syntactic key-words
-;; XXX 11.19. Macro transformers
+(load "test-11-16-iteration.scm")
+(load "test-11-17-quasiquotation.scm")
+
+(load "test-11-18-syntactic-keywords.scm")
+(load "test-11-19-macro-transformers.scm")
 
 (runner 'section "1. Standard libraries")
 
@@ -103,9 +104,18 @@
 (load "test-lib-02-bytevectors.scm")
 (load "test-lib-03-list-utilities.scm")
 (load "test-lib-04-sorting.scm")
+(load "test-lib-05-control.scm")
+(load "test-lib-06-records.scm")
+(load "test-lib-07-exceptions.scm")
+(load "test-lib-12-syntax-case.scm")
 
 (load "test-go-lang.scm")
 (load "test-go-format.scm")
 
+(runner 'section "Libraries")
+
+(load "test-07-01-library.scm")
+(load "test-07-01-library-form.scm")
+
 (runner 'stats)
 (runner 'status)
@@ -1,5 +1,5 @@
 //
-// Copyright (c) 2022-2023 Markku Rossi
+// Copyright (c) 2022-2024 Markku Rossi
 //
 // All rights reserved.
 //
@@ -96,6 +96,84 @@ var typecheckTests = []struct {
          (f (lambda (a) (+ a 1))))
   (display (b 1))
   (newline))
+`,
+	},
+	{
+		name: "let-values value count",
+		data: `
+(let-values (((a b) (values 1 2 3)))
+  (+ a b))
+`,
+	},
+	{
+		name: "let-values binding type",
+		data: `
+(let-values (((a b) (values "a" 2)))
+  (string-length b))
+`,
+	},
+	{
+		name: "define-values value count",
+		data: `
+(define-values (a b) 1)
+`,
+	},
+	{
+		name: "record accessor argument type",
+		data: `
+(define-record-type point (fields x y))
+(point-x '(1 2))
+`,
+	},
+	{
+		name: "record accessor record type",
+		data: `
+(define-record-type point (fields x y))
+(define-record-type size (fields width height))
+(define s (make-size 1 2))
+(define (width)
+  (point-x s))
+`,
+	},
+	{
+		name: "record mutator parent type",
+		data: `
+(define-record-type point (fields (mutable x) y))
+(define-record-type cpoint (parent point) (fields (mutable color)))
+(cpoint-color-set! (make-point 1 2) 'red)
+`,
+	},
+	{
+		name: "internal definition after expression",
+		data: `
+(define (foo)
+  (display "foo")
+  (define a 1)
+  a)
+`,
+	},
+	{
+		name: "internal definitions without expressions",
+		data: `
+(define (foo)
+  (define a 1))
+`,
+	},
+	{
+		name: "internal definition redefinition",
+		data: `
+(let ()
+  (define a 1)
+  (define a 2)
+  a)
+`,
+	},
+	{
+		name: "internal definition argument count",
+		data: `
+(define (foo)
+  (define (bar a) (+ a 1))
+  (bar 1 2))
 `,
 	},
 }
@@ -35,6 +35,9 @@ const (
 	EnumLambda
 	EnumPair
 	EnumVector
+	EnumValues
+	EnumRecord
+	EnumRecordType
 )
 
 var enumNames = map[Enum]string{
@@ -55,6 +58,9 @@ var enumNames = map[Enum]string{
 	EnumLambda:         "lambda",
 	EnumPair:           "pair",
 	EnumVector:         "vector",
+	EnumValues:         "values",
+	EnumRecord:         "record",
+	EnumRecordType:     "rtd",
 }
 
 func (e Enum) String() string {
@@ -72,7 +78,8 @@ func (e Enum) Super() Enum {
 		return EnumUnspecified
 
 	case EnumAny, EnumNil, EnumBoolean, EnumString, EnumCharacter, EnumSymbol,
-		EnumBytevector, EnumNumber, EnumPort, EnumLambda, EnumPair, EnumVector:
+		EnumBytevector, EnumNumber, EnumPort, EnumLambda, EnumPair, EnumVector,
+		EnumValues, EnumRecord, EnumRecordType:
 		return EnumAny
 
 	case EnumExactInteger, EnumExactFloat:
@@ -210,6 +217,17 @@ func Parse(arg string) (*Type, string, error) {
 			Enum: EnumPort,
 			Kind: kind,
 		}, name, nil
+	} else if strings.HasPrefix(typeName, "record") {
+		return &Type{
+			Enum: EnumRecord,
+			Kind: kind,
+		}, name, nil
+	} else if strings.HasPrefix(typeName, "rtd") {
+		return &Type{
+			Enum:   EnumRecordType,
+			Kind:   kind,
+			Record: Record,
+		}, name, nil
 	} else if strings.HasPrefix(typeName, "string") ||
 		strings.HasPrefix(typeName, "message") {
 		return &Type{
@@ -254,9 +272,34 @@ type Type struct {
 	Car          *Type
 	Cdr          *Type
 	Element      *Type
+	Clauses      []*Type
+	Name         string
+	Parent       *Type
+	Record       *Type
 	Parametrizer Parametrizer
 }
 
+// NewRecord creates a new record type with the name and parent
+// type. Each record type is distinct from all other record types,
+// including the types created with the same name. The record type
+// is a subtype of its parent type.
+func NewRecord(name string, parent *Type) *Type {
+	return &Type{
+		Enum:   EnumRecord,
+		Name:   name,
+		Parent: parent,
+	}
+}
+
+// NewRecordType creates a record-type descriptor type for the record
+// type.
+func NewRecordType(record *Type) *Type {
+	return &Type{
+		Enum:   EnumRecordType,
+		Record: record,
+	}
+}
+
 // Parametrizer implements type parametrization.
 type Parametrizer interface {
 	Parametrize(ctx Ctx, params []*Type) *Type
@@ -270,6 +313,16 @@ func (t *Type) String() string {
 
 	switch t.Enum {
 	case EnumLambda:
+		if len(t.Clauses) > 0 {
+			result = ""
+			for idx, clause := range t.Clauses {
+				if idx > 0 {
+					result += "|"
+				}
+				result += clause.String()
+			}
+			break
+		}
 		result += "("
 		for idx, arg := range t.Args {
 			if idx > 0 {
@@ -289,6 +342,26 @@ func (t *Type) String() string {
 	case EnumVector:
 		result = result + "(" + t.Element.String() + ")"
 
+	case EnumValues:
+		result += "("
+		for idx, arg := range t.Args {
+			if idx > 0 {
+				result += ","
+			}
+			result += arg.String()
+		}
+		result += ")"
+
+	case EnumRecord:
+		if len(t.Name) > 0 {
+			result = result + "(" + t.Name + ")"
+		}
+
+	case EnumRecordType:
+		if len(t.Record.Name) > 0 {
+			result = result + "(" + t.Record.Name + ")"
+		}
+
 	default:
 	}
 
@@ -351,6 +424,13 @@ var (
 		Car:  Any,
 		Cdr:  Any,
 	}
+	Record = &Type{
+		Enum: EnumRecord,
+	}
+	RecordType = &Type{
+		Enum:   EnumRecordType,
+		Record: Record,
+	}
 )
 
 // IsA tests if type is the same as the argument type.
@@ -360,6 +440,14 @@ func (t *Type) IsA(o *Type) bool {
 	}
 	switch t.Enum {
 	case EnumLambda:
+		if len(t.Clauses) != len(o.Clauses) {
+			return false
+		}
+		for idx, clause := range t.Clauses {
+			if !clause.IsA(o.Clauses[idx]) {
+				return false
+			}
+		}
 		if len(t.Args) != len(o.Args) {
 			return false
 		}
@@ -384,11 +472,34 @@ func (t *Type) IsA(o *Type) bool {
 	case EnumVector:
 		return t.Element.IsA(o.Element)
 
+	case EnumValues:
+		if len(t.Args) != len(o.Args) {
+			return false
+		}
+		for idx, arg := range t.Args {
+			if !arg.IsA(o.Args[idx]) {
+				return false
+			}
+		}
+		return true
+
+	case EnumRecord:
+		return t == o || (t.generic() && o.generic())
+
+	case EnumRecordType:
+		return t.Record.IsA(o.Record)
+
 	default:
 		return true
 	}
 }
 
+// generic tests if the record type is the generic record type which
+// is the supertype of all record types.
+func (t *Type) generic() bool {
+	return len(t.Name) == 0 && t.Parent == nil
+}
+
 // IsKindOf tests if type is kind of the argument type.
 func (t *Type) IsKindOf(o *Type) bool {
 	if t.Enum == EnumUnspecified || o.Enum == EnumUnspecified {
@@ -415,6 +526,26 @@ func (t *Type) IsKindOf(o *Type) bool {
 
 	switch t.Enum {
 	case EnumLambda:
+		if len(o.Clauses) > 0 {
+			if len(t.Clauses) != len(o.Clauses) {
+				return false
+			}
+			for idx, clause := range t.Clauses {
+				if !clause.IsKindOf(o.Clauses[idx]) {
+					return false
+				}
+			}
+			return true
+		}
+		if len(t.Clauses) > 0 {
+			// Case-lambda is kind of the lambda types of its clauses.
+			for _, clause := range t.Clauses {
+				if clause.IsKindOf(o) {
+					return true
+				}
+			}
+			return false
+		}
 		if len(t.Args) != len(o.Args) {
 			return false
 		}
@@ -439,17 +570,67 @@ func (t *Type) IsKindOf(o *Type) bool {
 	case EnumVector:
 		return t.Element.IsKindOf(o.Element)
 
+	case EnumValues:
+		if len(t.Args) != len(o.Args) {
+			return false
+		}
+		for idx, arg := range t.Args {
+			if !arg.IsKindOf(o.Args[idx]) {
+				return false
+			}
+		}
+		return true
+
+	case EnumRecord:
+		if o.generic() {
+			return true
+		}
+		for r := t; r != nil; r = r.Parent {
+			if r == o {
+				return true
+			}
+		}
+		return false
+
+	case EnumRecordType:
+		return t.Record.IsKindOf(o.Record)
+
 	default:
 		return true
 	}
 }
 
+// Clause returns the type of the case-lambda clause that accepts
+// numArgs arguments. For other lambda types the function returns the
+// type itself. The function returns nil if no clause accepts numArgs
+// arguments.
+func (t *Type) Clause(numArgs int) *Type {
+	if len(t.Clauses) == 0 {
+		return t
+	}
+	for _, clause := range t.Clauses {
+		if numArgs >= clause.MinArgs() && numArgs <= clause.MaxArgs() {
+			return clause
+		}
+	}
+	return nil
+}
+
 // MinArgs returns the minimum number for arguments for a lambda
 // type. For all other types the function returns 0.
 func (t *Type) MinArgs() int {
 	if t.Enum != EnumLambda {
 		return 0
 	}
+	if len(t.Clauses) > 0 {
+		count := math.MaxInt
+		for _, clause := range t.Clauses {
+			if n := clause.MinArgs(); n < count {
+				count = n
+			}
+		}
+		return count
+	}
 	var count int
 	for _, arg := range t.Args {
 		if arg.Kind == Fixed {
@@ -465,6 +646,15 @@ func (t *Type) MaxArgs() int {
 	if t.Enum != EnumLambda {
 		return 0
 	}
+	if len(t.Clauses) > 0 {
+		var count int
+		for _, clause := range t.Clauses {
+			if n := clause.MaxArgs(); n > count {
+				count = n
+			}
+		}
+		return count
+	}
 	if t.Rest != nil {
 		return math.MaxInt
 	}
@@ -1,5 +1,5 @@
 //
-// Copyright (c) 2023 Markku Rossi
+// Copyright (c) 2023-2024 Markku Rossi
 //
 // All rights reserved.
 //
@@ -7,13 +7,15 @@
 package types
 
 import (
+	"math"
 	"testing"
 )
 
 func TestSuper(t *testing.T) {
 	for _, e := range []Enum{
 		EnumAny, EnumBoolean, EnumString, EnumCharacter, EnumSymbol, EnumVector,
-		EnumBytevector, EnumNumber, EnumPort, EnumLambda, EnumPair} {
+		EnumBytevector, EnumNumber, EnumPort, EnumLambda, EnumPair,
+		EnumRecord, EnumRecordType} {
 		if e.Super() != EnumAny {
 			t.Errorf("%v.Super() != %v", e, EnumAny)
 		}
@@ -39,6 +41,7 @@ func TestEnumUnify(t *testing.T) {
 	directs := []Enum{
 		EnumAny, EnumBoolean, EnumString, EnumCharacter, EnumSymbol,
 		EnumBytevector, EnumNumber, EnumPort, EnumLambda, EnumPair, EnumVector,
+		EnumRecord, EnumRecordType,
 	}
 	for _, a := range directs {
 		for _, b := range directs {
@@ -202,3 +205,98 @@ func TestIsKindOf(t *testing.T) {
 		t.Errorf("!%v.IsKindOf(%v)", vector, vector1)
 	}
 }
+
+func TestClauses(t *testing.T) {
+	one := &Type{
+		Enum:   EnumLambda,
+		Args:   []*Type{ExactInteger},
+		Return: ExactInteger,
+	}
+	rest := &Type{
+		Enum:   EnumLambda,
+		Args:   []*Type{ExactInteger, ExactInteger},
+		Rest:   Any,
+		Return: ExactInteger,
+	}
+	lambda := &Type{
+		Enum:    EnumLambda,
+		Clauses: []*Type{one, rest},
+		Return:  ExactInteger,
+	}
+	if lambda.MinArgs() != 1 {
+		t.Errorf("%v.MinArgs() = %v, expected 1", lambda, lambda.MinArgs())
+	}
+	if lambda.MaxArgs() != math.MaxInt {
+		t.Errorf("%v.MaxArgs() = %v, expected %v",
+			lambda, lambda.MaxArgs(), math.MaxInt)
+	}
+	if lambda.Clause(0) != nil {
+		t.Errorf("%v.Clause(0) != nil", lambda)
+	}
+	if lambda.Clause(1) != one {
+		t.Errorf("%v.Clause(1) != %v", lambda, one)
+	}
+	if lambda.Clause(3) != rest {
+		t.Errorf("%v.Clause(3) != %v", lambda, rest)
+	}
+	if !lambda.IsA(lambda) {
+		t.Errorf("!%v.IsA(%v)", lambda, lambda)
+	}
+	if !lambda.IsKindOf(one) {
+		t.Errorf("!%v.IsKindOf(%v)", lambda, one)
+	}
+	if one.IsKindOf(lambda) {
+		t.Errorf("%v.IsKindOf(%v)", one, lambda)
+	}
+	expected := "lambda(#eint)#eint|lambda(#eint,#eint . any)#eint"
+	if lambda.String() != expected {
+		t.Errorf("String() = %v, expected %v", lambda.String(), expected)
+	}
+}
+
+func TestRecord(t *testing.T) {
+	point := NewRecord("point", nil)
+	cpoint := NewRecord("cpoint", point)
+	ppoint := NewRecord("ppoint", point)
+	size := NewRecord("size", nil)
+
+	for _, r := range []*Type{point, cpoint, ppoint, size} {
+		if !r.IsA(r) {
+			t.Errorf("!%v.IsA(%v)", r, r)
+		}
+		if !r.IsKindOf(Record) {
+			t.Errorf("!%v.IsKindOf(%v)", r, Record)
+		}
+		if Record.IsKindOf(r) {
+			t.Errorf("%v.IsKindOf(%v)", Record, r)
+		}
+	}
+	if point.IsA(NewRecord("point", nil)) {
+		t.Errorf("%v.IsA(%v)", point, point)
+	}
+	if !cpoint.IsKindOf(point) {
+		t.Errorf("!%v.IsKindOf(%v)", cpoint, point)
+	}
+	if point.IsKindOf(cpoint) {
+		t.Errorf("%v.IsKindOf(%v)", point, cpoint)
+	}
+	if size.IsKindOf(point) {
+		t.Errorf("%v.IsKindOf(%v)", size, point)
+	}
+	if !NewRecordType(cpoint).IsKindOf(NewRecordType(point)) {
+		t.Errorf("!rtd(%v).IsKindOf(rtd(%v))", cpoint, point)
+	}
+	if NewRecordType(point).IsKindOf(point) {
+		t.Errorf("rtd(%v).IsKindOf(%v)", point, point)
+	}
+
+	if u := Unify(cpoint, ppoint); u != point {
+		t.Errorf("Unify(%v, %v) = %v, expected %v", cpoint, ppoint, u, point)
+	}
+	if u := Unify(cpoint, size); !u.IsA(Record) {
+		t.Errorf("Unify(%v, %v) = %v, expected %v", cpoint, size, u, Record)
+	}
+	if cpoint.String() != "record(cpoint)" {
+		t.Errorf("String() = %v, expected record(cpoint)", cpoint)
+	}
+}
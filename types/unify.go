@@ -1,5 +1,5 @@
 //
-// Copyright (c) 2023 Markku Rossi
+// Copyright (c) 2023-2024 Markku Rossi
 //
 // All rights reserved.
 //
@@ -37,6 +37,18 @@ func Unify(a *Type, b *Type) *Type {
 		}
 
 	case EnumLambda:
+		if len(a.Clauses) > 0 || len(b.Clauses) > 0 {
+			if len(a.Clauses) != len(b.Clauses) {
+				return Any
+			}
+			t := &Type{
+				Enum: e,
+			}
+			for idx, clause := range a.Clauses {
+				t.Clauses = append(t.Clauses, Unify(clause, b.Clauses[idx]))
+			}
+			return t
+		}
 		if len(a.Args) != len(b.Args) ||
 			(a.Rest == nil && b.Rest != nil) ||
 			(a.Rest != nil && b.Rest == nil) {
@@ -65,6 +77,29 @@ func Unify(a *Type, b *Type) *Type {
 			Element: Unify(a.Element, b.Element),
 		}
 
+	case EnumValues:
+		if len(a.Args) != len(b.Args) {
+			return Any
+		}
+		t := &Type{
+			Enum: e,
+		}
+		for idx, arg := range a.Args {
+			t.Args = append(t.Args, Unify(arg, b.Args[idx]))
+		}
+		return t
+
+	case EnumRecord:
+		for r := a.Parent; r != nil; r = r.Parent {
+			if b.IsKindOf(r) {
+				return r
+			}
+		}
+		return Record
+
+	case EnumRecordType:
+		return NewRecordType(Unify(a.Record, b.Record))
+
 	default:
 		panic(fmt.Sprintf("unknown Enum: %d", e))
 	}
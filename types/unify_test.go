@@ -84,6 +84,39 @@ func TestUnify(t *testing.T) {
 				Element: Number,
 			},
 		},
+		{
+			a: &Type{
+				Enum: EnumValues,
+				Args: []*Type{ExactInteger, String},
+			},
+			b: &Type{
+				Enum: EnumValues,
+				Args: []*Type{InexactFloat, String},
+			},
+			u: &Type{
+				Enum: EnumValues,
+				Args: []*Type{Number, String},
+			},
+		},
+		{
+			a: &Type{
+				Enum: EnumValues,
+				Args: []*Type{Number, String},
+			},
+			b: &Type{
+				Enum: EnumValues,
+				Args: []*Type{Number},
+			},
+			u: Any,
+		},
+		{
+			a: &Type{
+				Enum: EnumValues,
+				Args: []*Type{Number, String},
+			},
+			b: Number,
+			u: Any,
+		},
 	}
 	for idx, test := range tests {
 		u := Unify(test.a, test.b)
@@ -9,18 +9,23 @@ package scheme
 import (
 	"fmt"
 	"strings"
+	"sync/atomic"
 
 	"github.com/markkurossi/scheme/types"
 )
 
 var (
 	_ Value = &BigInt{}
+	_ Value = &Box{}
 	_ Value = &Bytevector{}
+	_ Value = &Condition{}
+	_ Value = &Continuation{}
 	_ Value = &Frame{}
 	_ Value = &Identifier{}
 	_ Value = &Lambda{}
 	_ Value = &PlainPair{}
 	_ Value = &Port{}
+	_ Value = Values{}
 	_ Value = &Vector{}
 	_ Value = Boolean(true)
 	_ Value = Character('@')
@@ -74,13 +79,107 @@ func (f Flags) String() string {
 	return strings.TrimSpace(result)
 }
 
-// Identifier implements identifier values.
+// Identifier implements identifier values. The interned identifiers
+// hold the global bindings of the symbols. The global bindings are
+// shared between the machines of an image so they are accessed
+// atomically with the Global, Flags, Define, and Set methods. The
+// identifiers that macro expansions introduce have an alias to their
+// original identifier.
 type Identifier struct {
 	Name       string
 	Point      Point
 	GlobalType *types.Type
-	Global     Value
-	Flags      Flags
+	binding    atomic.Pointer[globalBinding]
+	alias      *syntaxAlias
+}
+
+// globalBinding holds the global value and flags of an identifier.
+// The bindings are immutable once published: a Value is a two-word
+// interface which can't be stored atomically in place so the
+// modifications publish a new binding.
+type globalBinding struct {
+	value Value
+	flags Flags
+}
+
+// Global returns the global value of the identifier.
+func (v *Identifier) Global() Value {
+	value, _ := v.global()
+	return value
+}
+
+// Flags returns the flags of the identifier's global binding.
+func (v *Identifier) Flags() Flags {
+	_, flags := v.global()
+	return flags
+}
+
+// global returns the global value and flags of the identifier from
+// the same binding.
+func (v *Identifier) global() (Value, Flags) {
+	b := v.binding.Load()
+	if b == nil {
+		return nil, 0
+	}
+	return b.value, b.flags
+}
+
+// Define defines the global value of the identifier and adds the
+// flags to the identifier's flags. The function returns the flags
+// that the identifier had before the definition and false if the
+// identifier was a constant and it could not be redefined.
+func (v *Identifier) Define(value Value, flags Flags) (Flags, bool) {
+	b := &globalBinding{
+		value: value,
+	}
+	for {
+		old := v.binding.Load()
+		var oldFlags Flags
+		if old != nil {
+			oldFlags = old.flags
+		}
+		if oldFlags&FlagConst != 0 {
+			return oldFlags, false
+		}
+		b.flags = oldFlags | flags | FlagDefined
+		if v.binding.CompareAndSwap(old, b) {
+			return oldFlags, true
+		}
+	}
+}
+
+// Set sets the global value of a defined identifier. The function
+// returns the identifier's flags and false if the identifier was
+// undefined or a constant.
+func (v *Identifier) Set(value Value) (Flags, bool) {
+	var b *globalBinding
+	for {
+		old := v.binding.Load()
+		if old == nil {
+			return 0, false
+		}
+		if old.flags&FlagConst != 0 || old.flags&FlagDefined == 0 {
+			return old.flags, false
+		}
+		if b == nil {
+			b = &globalBinding{
+				value: value,
+			}
+		}
+		b.flags = old.flags
+		if v.binding.CompareAndSwap(old, b) {
+			return old.flags, true
+		}
+	}
+}
+
+// bind binds the global value and flags of the identifier
+// unconditionally. It is used when defining the builtin functions.
+func (v *Identifier) bind(value Value, flags Flags) {
+	v.binding.Store(&globalBinding{
+		value: value,
+		flags: flags | FlagDefined,
+	})
 }
 
 // Scheme returns the value as a Scheme string.
@@ -0,0 +1,265 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package scheme
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/markkurossi/scheme/types"
+)
+
+// Values implements multiple return values. A single value is always
+// returned as itself so Values holds zero or two or more values.
+type Values []Value
+
+// Scheme returns the value as a Scheme string.
+func (v Values) Scheme() string {
+	return v.String()
+}
+
+// Eq tests if the argument value is eq? to this value.
+func (v Values) Eq(o Value) bool {
+	return v.Equal(o)
+}
+
+// Equal tests if the argument value is equal to this value.
+func (v Values) Equal(o Value) bool {
+	ov, ok := o.(Values)
+	if !ok || len(v) != len(ov) {
+		return false
+	}
+	for idx, value := range v {
+		if !Equal(value, ov[idx]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Type implements the Value.Type().
+func (v Values) Type() *types.Type {
+	t := &types.Type{
+		Enum: types.EnumValues,
+	}
+	for _, value := range v {
+		if value == nil {
+			t.Args = append(t.Args, types.Nil)
+		} else {
+			t.Args = append(t.Args, value.Type())
+		}
+	}
+	return t
+}
+
+func (v Values) String() string {
+	var str strings.Builder
+	for idx, value := range v {
+		if idx > 0 {
+			str.WriteRune(' ')
+		}
+		str.WriteString(ToScheme(value))
+	}
+	return str.String()
+}
+
+// callWithValuesCode implements the call-with-values procedure. The
+// code calls the producer and pushes its return values as the
+// arguments of the consumer frame. The consumer is tail-called with
+// the values.
+//
+//	fp+0: call-with-values frame
+//	fp+1: producer
+//	fp+2: consumer
+//	fp+3: consumer frame
+//	fp+4: producer frame, values
+var callWithValuesCode = mustEncode(Instrs{
+	{
+		Op: OpLocal,
+		I:  1,
+	},
+	{
+		Op: OpPushF,
+	},
+	{
+		Op: OpLocal,
+		I:  0,
+	},
+	{
+		Op: OpPushF,
+	},
+	{
+		Op: OpConst,
+		V:  Int(0),
+	},
+	{
+		Op: OpCall,
+	},
+	{
+		Op: OpPushV,
+	},
+	{
+		Op: OpCall,
+		I:  1,
+	},
+	{
+		Op: OpReturn,
+	},
+})
+
+// defineCallWithValues defines the call-with-values procedure.
+func (scm *Scheme) defineCallWithValues() {
+	args := Args{
+		Fixed: []*TypedName{
+			{
+				Name: "producer",
+				Type: types.Any,
+			},
+			{
+				Name: "consumer",
+				Type: types.Any,
+			},
+		},
+	}
+	args.Init()
+
+	lambda := &Lambda{
+		Impl: &LambdaImpl{
+			Name:     "call-with-values",
+			Args:     args,
+			Return:   types.Unspecified,
+			Code:     callWithValuesCode,
+			MaxStack: 2,
+		},
+	}
+	sym := scm.Intern(lambda.Impl.Name)
+	sym.GlobalType = lambda.Type()
+	sym.GlobalType.Parametrizer = callWithValuesParametrizer{}
+	sym.bind(lambda, FlagConst)
+}
+
+// valuesParametrizer resolves the type of the values procedure call.
+type valuesParametrizer struct{}
+
+// Parametrize implements types.Parametrizer.
+func (p valuesParametrizer) Parametrize(ctx types.Ctx,
+	params []*types.Type) *types.Type {
+
+	if len(params) == 1 {
+		return params[0]
+	}
+	return &types.Type{
+		Enum: types.EnumValues,
+		Args: params,
+	}
+}
+
+// callWithValuesParametrizer resolves the type of the
+// call-with-values procedure call from the types of the producer's
+// return values and the consumer.
+type callWithValuesParametrizer struct{}
+
+// Parametrize implements types.Parametrizer.
+func (p callWithValuesParametrizer) Parametrize(ctx types.Ctx,
+	params []*types.Type) *types.Type {
+
+	if len(params) != 2 || params[1].Enum != types.EnumLambda {
+		return types.Unspecified
+	}
+	producer := params[0]
+	consumer := params[1]
+
+	if consumer.Parametrizer == nil || producer.Enum != types.EnumLambda {
+		return consumer.Return
+	}
+	vt := producer.Return
+	if producer.Parametrizer != nil {
+		vt = producer.Parametrizer.Parametrize(ctx, nil)
+	}
+	switch vt.Enum {
+	case types.EnumUnspecified, types.EnumAny:
+		return consumer.Return
+
+	case types.EnumValues:
+		return consumer.Parametrizer.Parametrize(ctx, vt.Args)
+
+	default:
+		return consumer.Parametrizer.Parametrize(ctx, []*types.Type{vt})
+	}
+}
+
+// valuesTypes returns the types of the values of type t when they are
+// bound to the formals. The function returns an error if the number
+// of values does not match the formals.
+func valuesTypes(t *types.Type, formals Args) ([]*types.Type, error) {
+	var vt []*types.Type
+
+	switch t.Enum {
+	case types.EnumUnspecified, types.EnumAny:
+		for range formals.Fixed {
+			vt = append(vt, types.Unspecified)
+		}
+		if formals.Rest != nil {
+			vt = append(vt, &types.Type{
+				Enum: types.EnumPair,
+				Car:  types.Unspecified,
+				Cdr:  types.Any,
+			})
+		}
+		return vt, nil
+
+	case types.EnumValues:
+		vt = t.Args
+
+	default:
+		vt = []*types.Type{t}
+	}
+
+	if len(vt) < len(formals.Fixed) ||
+		(formals.Rest == nil && len(vt) > len(formals.Fixed)) {
+		return nil, fmt.Errorf("expected %v values, got %v",
+			len(formals.Fixed), len(vt))
+	}
+	result := vt[:len(formals.Fixed):len(formals.Fixed)]
+	if formals.Rest != nil {
+		rest := vt[len(formals.Fixed):]
+		if len(rest) == 0 {
+			result = append(result, types.Nil)
+		} else {
+			var car *types.Type
+			for _, t := range rest {
+				car = types.Unify(car, t)
+			}
+			result = append(result, &types.Type{
+				Enum: types.EnumPair,
+				Car:  car,
+				Cdr:  types.Any,
+			})
+		}
+	}
+	return result, nil
+}
+
+var valuesBuiltins = []Builtin{
+	{
+		Name:         "values",
+		Args:         []string{"obj..."},
+		Return:       types.Unspecified,
+		Parametrizer: valuesParametrizer{},
+		Flags:        FlagConst,
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			if len(args) == 1 {
+				return args[0], nil
+			}
+			// The arguments are in the VM stack so they must be
+			// copied.
+			values := make(Values, len(args))
+			copy(values, args)
+			return values, nil
+		},
+	},
+}
@@ -142,19 +142,7 @@ var vectorBuiltins = []Builtin{
 		Args:   []string{"vector", "k"},
 		Return: types.Any,
 		Native: func(scm *Scheme, args []Value) (Value, error) {
-			vector, ok := args[0].(Vector)
-			if !ok {
-				return nil, fmt.Errorf("invalid vector: %v", args[0])
-			}
-			k, err := Int64(args[1])
-			if err != nil {
-				return nil, fmt.Errorf("invalid index: %v", args[1])
-			}
-			if k < 0 || k >= int64(len(vector)) {
-				return nil, fmt.Errorf("index %v out of range for vector %v",
-					k, args[0])
-			}
-			return vector[k], nil
+			return vectorRef(args[0], args[1])
 		},
 	},
 	{
@@ -240,3 +228,19 @@ var vectorBuiltins = []Builtin{
 		},
 	},
 }
+
+// vectorRef returns the element k of the vector v.
+func vectorRef(v, k Value) (Value, error) {
+	vector, ok := v.(Vector)
+	if !ok {
+		return nil, fmt.Errorf("invalid vector: %v", v)
+	}
+	idx, err := Int64(k)
+	if err != nil {
+		return nil, fmt.Errorf("invalid index: %v", k)
+	}
+	if idx < 0 || idx >= int64(len(vector)) {
+		return nil, fmt.Errorf("index %v out of range for vector %v", idx, v)
+	}
+	return vector[idx], nil
+}
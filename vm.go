@@ -7,6 +7,7 @@
 package scheme
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"math/big"
@@ -25,18 +26,23 @@ const (
 	OpLambda
 	OpLabel
 	OpLocal
+	OpLocalBox
 	OpEnv
+	OpEnvBox
 	OpGlobal
 	OpLocalSet
+	OpLocalBoxSet
 	OpEnvSet
+	OpPatch
 	OpGlobalSet
+	OpBox
 	OpPushF
 	OpPushS
-	OpPushE
 	OpPopS
-	OpPopE
 	OpPushA
+	OpPushV
 	OpCall
+	OpCallConst
 	OpIf
 	OpIfNot
 	OpJmp
@@ -44,73 +50,126 @@ const (
 	OpPairp
 	OpCons
 	OpCar
+	OpCarPair
 	OpCdr
+	OpCdrPair
 	OpNullp
 	OpZerop
 	OpNot
 	OpAdd
 	OpAddI64
+	OpAddF64
 	OpAddConst
 	OpSub
 	OpSubI64
+	OpSubF64
 	OpSubConst
 	OpMul
+	OpMulI64
+	OpMulF64
 	OpMulConst
 	OpDiv
+	OpDivF64
 	OpEq
+	OpEqI64
+	OpEqF64
 	OpLt
+	OpLtI64
+	OpLtF64
 	OpGt
+	OpGtI64
+	OpGtF64
 	OpLe
+	OpLeI64
+	OpLeF64
 	OpGe
+	OpGeI64
+	OpGeF64
+	OpVectorRef
+	OpStringRef
 	OpCastNumber
 	OpCastSymbol
+	OpContinuation
+	OpResume
+	OpValues
+	OpValueRef
+	OpValueRest
 )
 
 var operands = map[Operand]string{
-	OpConst:      "const",
-	OpDefine:     "define",
-	OpLambda:     "lambda",
-	OpLabel:      "label",
-	OpLocal:      "local",
-	OpEnv:        "env",
-	OpGlobal:     "global",
-	OpLocalSet:   "local!",
-	OpEnvSet:     "env!",
-	OpGlobalSet:  "global!",
-	OpPushF:      "pushf",
-	OpPushS:      "pushs",
-	OpPushE:      "pushe",
-	OpPopS:       "pops",
-	OpPopE:       "pope",
-	OpPushA:      "pusha",
-	OpCall:       "call",
-	OpIf:         "if",
-	OpIfNot:      "ifnot",
-	OpJmp:        "jmp",
-	OpReturn:     "return",
-	OpPairp:      "pair?",
-	OpCons:       "cons",
-	OpCar:        "car",
-	OpCdr:        "cdr",
-	OpNullp:      "null?",
-	OpZerop:      "zero?",
-	OpNot:        "not",
-	OpAdd:        "+",
-	OpAddI64:     "+<int64>",
-	OpAddConst:   "+const",
-	OpSub:        "-",
-	OpSubI64:     "-<int64>",
-	OpSubConst:   "-const",
-	OpMul:        "*",
-	OpMulConst:   "*const",
-	OpDiv:        "/",
-	OpEq:         "=",
-	OpLt:         "<",
-	OpGt:         ">",
-	OpLe:         "<=",
-	OpGe:         ">=",
-	OpCastNumber: "number!",
-	OpCastSymbol: "symbol!",
+	OpConst:        "const",
+	OpDefine:       "define",
+	OpLambda:       "lambda",
+	OpLabel:        "label",
+	OpLocal:        "local",
+	OpLocalBox:     "local-box",
+	OpEnv:          "env",
+	OpEnvBox:       "env-box",
+	OpGlobal:       "global",
+	OpLocalSet:     "local!",
+	OpLocalBoxSet:  "local-box!",
+	OpEnvSet:       "env!",
+	OpPatch:        "patch",
+	OpGlobalSet:    "global!",
+	OpBox:          "box",
+	OpPushF:        "pushf",
+	OpPushS:        "pushs",
+	OpPopS:         "pops",
+	OpPushA:        "pusha",
+	OpPushV:        "pushv",
+	OpCall:         "call",
+	OpCallConst:    "callc",
+	OpIf:           "if",
+	OpIfNot:        "ifnot",
+	OpJmp:          "jmp",
+	OpReturn:       "return",
+	OpPairp:        "pair?",
+	OpCons:         "cons",
+	OpCar:          "car",
+	OpCarPair:      "car<pair>",
+	OpCdr:          "cdr",
+	OpCdrPair:      "cdr<pair>",
+	OpNullp:        "null?",
+	OpZerop:        "zero?",
+	OpNot:          "not",
+	OpAdd:          "+",
+	OpAddI64:       "+<int64>",
+	OpAddF64:       "+<float64>",
+	OpAddConst:     "+const",
+	OpSub:          "-",
+	OpSubI64:       "-<int64>",
+	OpSubF64:       "-<float64>",
+	OpSubConst:     "-const",
+	OpMul:          "*",
+	OpMulI64:       "*<int64>",
+	OpMulF64:       "*<float64>",
+	OpMulConst:     "*const",
+	OpDiv:          "/",
+	OpDivF64:       "/<float64>",
+	OpEq:           "=",
+	OpEqI64:        "=<int64>",
+	OpEqF64:        "=<float64>",
+	OpLt:           "<",
+	OpLtI64:        "<<int64>",
+	OpLtF64:        "<<float64>",
+	OpGt:           ">",
+	OpGtI64:        "><int64>",
+	OpGtF64:        "><float64>",
+	OpLe:           "<=",
+	OpLeI64:        "<=<int64>",
+	OpLeF64:        "<=<float64>",
+	OpGe:           ">=",
+	OpGeI64:        ">=<int64>",
+	OpGeF64:        ">=<float64>",
+	OpVectorRef:    "vector-ref",
+	OpStringRef:    "string-ref",
+	OpCastNumber:   "number!",
+	OpCastSymbol:   "symbol!",
+	OpContinuation: "continuation",
+	OpResume:       "resume",
+	OpValues:       "values",
+	OpValueRef:     "value-ref",
+	OpValueRest:    "value-rest",
 }
 
 func (op Operand) String() string {
@@ -147,17 +206,25 @@ func (i Instr) String() string {
 	case OpPushF:
 		return fmt.Sprintf("\t%s\t%v", i.Op, i.I != 0)
 
-	case OpPushS, OpPushE:
+	case OpPushS:
 		return fmt.Sprintf("\t%s\t%v", i.Op, i.I)
 
 	case OpLambda:
-		return fmt.Sprintf("\t%s\tl%v:%v", i.Op, i.I, i.J)
+		if i.V != nil {
+			return fmt.Sprintf("\t%s\t%s", i.Op, i.V.Scheme())
+		}
+		return fmt.Sprintf("\t%s\t%v", i.Op, i.I)
 
-	case OpLocal, OpLocalSet, OpAddConst, OpSubConst, OpMulConst:
+	case OpLocal, OpLocalBox, OpEnv, OpEnvBox, OpLocalSet, OpLocalBoxSet,
+		OpEnvSet, OpBox, OpAddConst, OpSubConst, OpMulConst,
+		OpValueRef, OpValueRest:
 		return fmt.Sprintf("\t%s\t%v", i.Op, i.I)
 
-	case OpEnv, OpEnvSet:
-		return fmt.Sprintf("\t%s\t%v.%v", i.Op, i.I, i.J)
+	case OpValues:
+		return fmt.Sprintf("\t%s\t%v\t%v", i.Op, i.I, i.J != 0)
+
+	case OpPatch:
+		return fmt.Sprintf("\t%s\t%v\t%v", i.Op, i.I, i.J)
 
 	case OpGlobal, OpGlobalSet, OpDefine:
 		str := fmt.Sprintf("\t%s\t%v", i.Op, i.Sym)
@@ -179,16 +246,298 @@ func (i Instr) String() string {
 		}
 		return fmt.Sprintf("\t%s%s", i.Op, suffix)
 
+	case OpCallConst:
+		var suffix string
+		if i.I != 0 {
+			suffix += "t"
+		}
+		return fmt.Sprintf("\t%s%s\t%v", i.Op, suffix, i.J)
+
 	default:
 		return fmt.Sprintf("\t%s", i.Op.String())
 	}
 }
 
-// Apply applies lambda for arguments. This function implements the
+// ErrOutOfFuel is returned when the evaluation exceeds its
+// instruction budget, specified by Params.Fuel.
+var ErrOutOfFuel = errors.New("out of fuel")
+
+// fuelInterval defines how many instructions the VM executes between
+// checking its context and instruction budget.
+const fuelInterval = 1024
+
+// Apply applies lambda for arguments. If the application fails, the
+// after thunks of the dynamic-wind extents, entered during the
+// application, are run and the exception handlers are restored before
+// the error is returned. The after thunks are run also when the
+// application is aborted by its context or instruction budget.
+//
+// Native functions can call Apply to call back into Scheme. The
+// nested call is executed on top of the current stack and it returns
+// to the native function when the lambda returns. If the lambda
+// resumes a continuation captured outside the nested call, Apply
+// returns an error which the native function must return to the
+// virtual machine so that the execution continues from the
+// continuation.
+func (scm *Scheme) Apply(lambda Value, args []Value) (Value, error) {
+	return scm.ApplyContext(context.Background(), lambda, args)
+}
+
+// ApplyContext applies lambda for arguments like Apply. The
+// application is aborted if the context is cancelled or its deadline
+// expires.
+func (scm *Scheme) ApplyContext(ctx context.Context, lambda Value,
+	args []Value) (Value, error) {
+
+	defer scm.restoreLimits(scm.setLimits(ctx))
+
+	return scm.apply(lambda, args)
+}
+
+// savedLimits holds the limits that setLimits replaced.
+type savedLimits struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// setLimits sets the context and instruction budget for an Eval or
+// Apply call. The function returns the previous limits for
+// restoreLimits. Nested calls share the instruction budget of the
+// outermost call, and they are aborted also when the context of the
+// outer call is done.
+func (scm *Scheme) setLimits(ctx context.Context) savedLimits {
+	saved := savedLimits{
+		ctx: scm.ctx,
+	}
+	if saved.ctx == nil {
+		scm.fuel = scm.Params.Fuel
+		if scm.fuel <= 0 {
+			scm.fuel = -1
+		}
+	} else if ctx.Done() == nil {
+		ctx = saved.ctx
+	} else if ctx != saved.ctx {
+		ctx, saved.cancel = nestContext(saved.ctx, ctx)
+	}
+	scm.ctx = ctx
+	return saved
+}
+
+// restoreLimits restores the limits that setLimits replaced.
+func (scm *Scheme) restoreLimits(saved savedLimits) {
+	if saved.cancel != nil {
+		saved.cancel()
+	}
+	scm.ctx = saved.ctx
+	if saved.ctx == nil {
+		scm.fuel = -1
+	}
+}
+
+// nestedContext implements the context of a nested call. The context
+// is done when either the outer or the inner context is done, and
+// its error is the outer context's error if the outer context is
+// done.
+type nestedContext struct {
+	context.Context
+	outer context.Context
+}
+
+func (ctx *nestedContext) Err() error {
+	err := ctx.outer.Err()
+	if err != nil {
+		return err
+	}
+	return ctx.Context.Err()
+}
+
+// nestContext creates the context of a nested call with the inner
+// context inner. The returned function releases the context.
+func nestContext(outer, inner context.Context) (
+	context.Context, context.CancelFunc) {
+
+	if outer.Done() == nil {
+		return inner, nil
+	}
+	ctx, cancel := context.WithCancel(inner)
+	go func() {
+		select {
+		case <-outer.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return &nestedContext{
+		Context: ctx,
+		outer:   outer,
+	}, cancel
+}
+
+// limitError wraps the context and fuel errors. The limit errors
+// abort the execution and they can't be handled by the exception
+// handlers.
+type limitError struct {
+	err error
+}
+
+func (e *limitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *limitError) Unwrap() error {
+	return e.err
+}
+
+// reserveFuel reserves instructions from the instruction budget. The
+// function returns the number of instructions the VM can execute
+// before calling it again.
+func (scm *Scheme) reserveFuel() (int, error) {
+	if scm.ctx != nil {
+		select {
+		case <-scm.ctx.Done():
+			return 0, &limitError{
+				err: scm.ctx.Err(),
+			}
+		default:
+		}
+	}
+	if scm.fuel < 0 {
+		return fuelInterval, nil
+	}
+	if scm.fuel == 0 {
+		return 0, &limitError{
+			err: ErrOutOfFuel,
+		}
+	}
+	n := scm.fuel
+	if n > fuelInterval {
+		n = fuelInterval
+	}
+	scm.fuel -= n
+	return int(n), nil
+}
+
+// returnFuel returns unused reserved instructions to the instruction
+// budget.
+func (scm *Scheme) returnFuel(n int) {
+	if scm.fuel >= 0 {
+		scm.fuel += int64(n)
+	}
+}
+
+func (scm *Scheme) apply(lambda Value, args []Value) (Value, error) {
+	winders := scm.winders
+	handlers := scm.handlers
+
+	v, err := scm.execute(lambda, args)
+	if err != nil {
+		var esc *escape
+		if errors.As(err, &esc) {
+			// The continuation has already rewound the extents.
+			return nil, err
+		}
+		var limit *limitError
+		if errors.As(err, &limit) {
+			// The limits are exceeded but the after thunks must
+			// still run, under the cleanup limits.
+			defer scm.cleanupLimits()()
+		}
+		uerr := scm.unwind(winders)
+		scm.handlers = handlers
+		if uerr != nil {
+			err = fmt.Errorf("%w; dynamic-wind after: %v", err, uerr)
+		}
+		if scm.running {
+			err = &nestedError{
+				err: err,
+			}
+		}
+	}
+	return v, err
+}
+
+// nestedError wraps the errors of the nested executions. The nested
+// execution has already located the error so the native function's
+// caller returns it unchanged.
+type nestedError struct {
+	err error
+}
+
+func (e *nestedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *nestedError) Unwrap() error {
+	return e.err
+}
+
+// cleanupLimits replaces the context and instruction budget limits
+// with the cleanup limits while the after thunks of the dynamic-wind
+// extents are run after the limits were exceeded. The thunks get the
+// Params.CleanupFuel instruction budget and the
+// Params.CleanupTimeout deadline so they can't escape the limits of
+// the aborted evaluation. The function returns a function that
+// restores the limits.
+func (scm *Scheme) cleanupLimits() func() {
+	ctx := scm.ctx
+	fuel := scm.fuel
+
+	cleanup, cancel := context.WithTimeout(context.Background(),
+		scm.Params.CleanupTimeout)
+	scm.ctx = cleanup
+	scm.fuel = scm.Params.CleanupFuel
+	return func() {
+		cancel()
+		scm.ctx = ctx
+		scm.fuel = fuel
+	}
+}
+
+// vmRun identifies a nested virtual machine execution, started by a
+// native function calling Apply.
+type vmRun struct {
+	parent *vmRun
+}
+
+// active tests if the nested execution run is active in the current
+// execution. The outermost execution, identified by nil, is always
+// active.
+func (scm *Scheme) active(run *vmRun) bool {
+	if run == nil {
+		return true
+	}
+	for r := scm.run; r != nil; r = r.parent {
+		if r == run {
+			return true
+		}
+	}
+	return false
+}
+
+// escape unwinds nested executions when a continuation, captured in
+// an outer execution, is resumed.
+type escape struct {
+	cont  *Continuation
+	value Value
+}
+
+func (e *escape) Error() string {
+	return "continuation escapes from nested call"
+}
+
+// entryCode calls the lambda from the toplevel frame that execute
+// pushes with the lambda's arguments.
+var entryCode = mustEncode(Instrs{
+	{
+		Op: OpCall,
+	},
+})
+
+// execute applies lambda for arguments. This function implements the
 // virtual machine program execution.
 //
 // The virtual machine is a stack machine with the following registers:
-//   - env - the current environment
+//   - env - the current lambda whose captures the code accesses
 //   - fp - the current stack frame
 //   - pc - program counter
 //   - accu - holds the value of the latest operation
@@ -205,71 +554,102 @@ func (i Instr) String() string {
 //	fp ---> Next fp ---+
 //	                   |
 //	                   v
-func (scm *Scheme) Apply(lambda Value, args []Value) (Value, error) {
-	var argsList, tail Pair
+func (scm *Scheme) execute(lambda Value, args []Value) (Value, error) {
+	fn, ok := lambda.(*Lambda)
+	if !ok {
+		return nil, fmt.Errorf("invalid function: %v", lambda)
+	}
 
-	for _, arg := range args {
-		item := NewPair(arg, nil)
+	fuel, err := scm.reserveFuel()
+	if err != nil {
+		return nil, err
+	}
 
-		if argsList == nil {
-			argsList = item
-		} else {
-			tail.SetCdr(item)
+	if scm.running {
+		// Nested call from a native function. The call is executed
+		// on top of the current stack and the registers are
+		// restored when it returns.
+		err = scm.growStack(1+len(args), scm.Params.MaxStackDepth)
+		if err != nil {
+			return nil, err
+		}
+		pc, fp, sp := scm.pc, scm.fp, scm.sp
+		scm.run = &vmRun{
+			parent: scm.run,
+		}
+		defer func() {
+			scm.pc, scm.fp, scm.sp = pc, fp, sp
+			scm.run = scm.run.parent
+		}()
+		scm.pc = 0
+	} else {
+		scm.running = true
+		defer func() {
+			scm.running = false
+		}()
+		scm.pc = 0
+		scm.fp = 0
+		scm.sp = 0
+		scm.limitStack()
+		err = scm.growStack(1+len(args), scm.Params.MaxStackDepth)
+		if err != nil {
+			return nil, err
 		}
-		tail = item
 	}
 
-	var err error
-	var env *VMEnvFrame
-	var accu Value = lambda
+	// Push the toplevel frame and the arguments for the entry code.
+	frame := scm.newFrame()
+	frame.Index = len(scm.stack)
+	frame.Next = scm.fp
+	frame.Toplevel = true
+	frame.Lambda = fn
 
-	code := []*Instr{
-		{
-			Op: OpPushF,
-			I:  1,
-		},
-		{
-			Op: OpConst,
-			V:  argsList,
-		},
-		{
-			Op: OpPushA,
-		},
-		{
-			Op: OpCall,
-		},
-	}
-	scm.pc = 0
-	scm.fp = 0
-	scm.sp = 0
+	scm.stack[scm.sp] = frame
+	scm.sp++
+	copy(scm.stack[scm.sp:], args)
+	scm.sp += len(args)
+
+	var env *Lambda
+	var accu Value = Int(len(args))
+
+	code := entryCode
 
 	for {
-		instr := code[scm.pc]
+		if fuel <= 0 {
+			fuel, err = scm.reserveFuel()
+			if err != nil {
+				return nil, scm.Breakf("%w", err)
+			}
+		}
+		fuel--
+
+		instr := code.Words[scm.pc]
 		scm.pc++
 
-		switch instr.Op {
+		switch instr.Op() {
 		case OpConst:
-			accu = instr.V
+			accu = code.Consts[instr.I()]
 
 		case OpDefine:
-			if instr.Sym.Flags&FlagConst != 0 {
-				return nil, scm.Breakf("redefining final symbol '%s'",
-					instr.Sym.Name)
+			sym := code.Syms[instr.J()]
+			flags, ok := sym.Define(accu, Flags(instr.I()))
+			if !ok {
+				err = fmt.Errorf("redefining final symbol '%s'", sym.Name)
+				break
 			}
-			if instr.Sym.Flags&FlagDefined != 0 && !scm.Params.NoWarnDefine {
-				scm.VMWarningf("redefining symbol '%s'", instr.Sym.Name)
+			if flags&FlagDefined != 0 && !scm.Params.NoWarnDefine {
+				scm.VMWarningf("redefining symbol '%s'", sym.Name)
 			}
-			instr.Sym.Global = accu
-			instr.Sym.Flags |= FlagDefined
-			instr.Sym.Flags |= Flags(instr.I)
 
 		case OpLambda:
-			tmpl, ok := instr.V.(*LambdaImpl)
+			v := code.Consts[instr.I()]
+			tmpl, ok := v.(*LambdaImpl)
 			if !ok {
-				return nil, scm.Breakf("lambda: invalid argument: %v", instr.V)
+				err = fmt.Errorf("lambda: invalid argument: %v", v)
+				break
 			}
 			accu = &Lambda{
-				Capture: env,
+				Capture: scm.capture(tmpl, env),
 				Impl:    tmpl,
 			}
 
@@ -278,98 +658,89 @@ func (scm *Scheme) Apply(lambda Value, args []Value) (Value, error) {
 		case OpLocal:
 			// fmt.Printf("*** local: %v.%v\n", scm.fp+1+instr.I, instr.J)
 			// scm.printStack()
-			accu = scm.stack[scm.fp+1+instr.I]
+			accu = scm.stack[scm.fp+1+instr.I()]
+
+		case OpLocalBox:
+			accu = scm.stack[scm.fp+1+instr.I()].(*Box).Value
 
 		case OpEnv:
-			var e *VMEnvFrame
-			for e = env; e != nil; e = e.Next {
-				if e.Index == instr.I {
-					accu = e.Values[instr.J]
-					break
-				}
-			}
-			if e == nil {
-				return nil, scm.Breakf("invalid env frame %v", instr.I)
-			}
+			accu = env.Capture[instr.I()]
+
+		case OpEnvBox:
+			accu = env.Capture[instr.I()].(*Box).Value
 
 		case OpGlobal:
-			if instr.Sym.Flags&FlagDefined == 0 {
-				return nil, scm.Breakf("undefined symbol '%s' ", instr.Sym.Name)
+			sym := code.Syms[instr.J()]
+			var flags Flags
+			accu, flags = sym.global()
+			if flags&FlagDefined == 0 {
+				err = undefinedCondition(sym)
+				break
 			}
-			accu = instr.Sym.Global
 
 		case OpLocalSet:
-			scm.stack[scm.fp+1+instr.I] = accu
+			scm.stack[scm.fp+1+instr.I()] = accu
+
+		case OpLocalBoxSet:
+			scm.stack[scm.fp+1+instr.I()].(*Box).Value = accu
 
 		case OpEnvSet:
-			var e *VMEnvFrame
-			for e = env; e != nil; e = e.Next {
-				if e.Index == instr.I {
-					e.Values[instr.J] = accu
-					break
-				}
-			}
-			if e == nil {
-				return nil, scm.Breakf("invalid env frame %v", instr.I)
-			}
+			env.Capture[instr.I()].(*Box).Value = accu
+
+		case OpPatch:
+			scm.patch(instr.I(), instr.I()+instr.J())
 
 		case OpGlobalSet:
-			if instr.Sym.Flags&FlagConst != 0 {
-				return nil, scm.Breakf("setting final symbol '%s'",
-					instr.Sym.Name)
+			sym := code.Syms[instr.J()]
+			flags, ok := sym.Set(accu)
+			if ok {
+				break
+			}
+			if flags&FlagConst != 0 {
+				err = fmt.Errorf("setting final symbol '%s'", sym.Name)
+			} else {
+				err = undefinedCondition(sym)
 			}
-			if instr.Sym.Flags&FlagDefined == 0 {
-				return nil, scm.Breakf("undefined symbol '%s'", instr.Sym.Name)
+
+		case OpBox:
+			scm.stack[scm.fp+1+instr.I()] = &Box{
+				Value: scm.stack[scm.fp+1+instr.I()],
 			}
-			instr.Sym.Global = accu
 
 		case OpPushF:
 			// i.I != 0 for toplevel frames.
 			lambda, ok := accu.(*Lambda)
 			if !ok {
-				return nil, scm.Breakf("invalid function: %v", accu)
-			}
-
-			var frame *Frame
-			if scm.frameFL != nil {
-				frame = scm.frameFL
-				scm.frameFL = frame.flNext
-			} else {
-				frame = new(Frame)
+				err = fmt.Errorf("invalid function: %v", accu)
+				break
 			}
 
+			frame := scm.newFrame()
 			frame.Index = len(scm.stack)
 			frame.Next = scm.fp
-			frame.Toplevel = instr.I != 0
+			frame.Toplevel = instr.I() != 0
 			frame.Lambda = lambda
 
 			scm.stack[scm.sp] = frame
 			scm.sp++
 
 		case OpPushS:
-			for i := 0; i < instr.I; i++ {
+			for i := 0; i < instr.I(); i++ {
 				scm.stack[scm.sp] = nil
 				scm.sp++
 			}
 
-		case OpPushE:
-			var index int
-			if env != nil {
-				index = env.Index + 1
-			}
-			env = &VMEnvFrame{
-				Next:   env,
-				Index:  index,
-				Values: make([]Value, instr.I),
-			}
-
 		case OpPopS:
-			scm.sp -= instr.I
-
-		case OpPopE:
-			env = env.Next
+			scm.sp -= instr.I()
 
 		case OpPushA:
+			length, ok := ListLength(accu)
+			if ok && scm.sp+length > len(scm.stack) {
+				err = scm.growStack(length, scm.Params.MaxStackDepth)
+				if err != nil {
+					break
+				}
+			}
 			var count int
 			err = Map(func(idx int, v Value) error {
 				scm.stack[scm.sp] = v
@@ -378,44 +749,123 @@ func (scm *Scheme) Apply(lambda Value, args []Value) (Value, error) {
 				return nil
 			}, accu)
 			if err != nil {
-				return nil, scm.Breakf("pusha: invalid arguments: %v", err)
+				err = fmt.Errorf("pusha: invalid arguments: %v", err)
+				break
 			}
 			accu = Int(count)
 
-		case OpCall:
-			vi, ok := accu.(Int)
-			if !ok {
-				return nil, scm.Breakf("%s: invalid #args: %v", instr.Op, accu)
+		case OpPushV:
+			if values, ok := accu.(Values); ok {
+				if scm.sp+len(values) > len(scm.stack) {
+					err = scm.growStack(len(values),
+						scm.Params.MaxStackDepth)
+					if err != nil {
+						break
+					}
+				}
+				copy(scm.stack[scm.sp:], values)
+				scm.sp += len(values)
+				accu = Int(len(values))
+			} else {
+				scm.stack[scm.sp] = accu
+				scm.sp++
+				accu = Int(1)
+			}
+
+		case OpCall, OpCallConst:
+			var numArgs int
+			if instr.Op() == OpCallConst {
+				numArgs = instr.J()
+			} else {
+				vi, ok := accu.(Int)
+				if !ok {
+					err = fmt.Errorf("%s: invalid #args: %v", instr.Op(), accu)
+					break
+				}
+				numArgs = int(vi)
 			}
-			numArgs := int(vi)
 			args := scm.stack[scm.sp-numArgs : scm.sp]
 
 			callFrame, ok := scm.stack[scm.sp-numArgs-1].(*Frame)
 			if !ok || callFrame.Lambda == nil {
-				return nil, scm.Breakf("%s: invalid function: %v",
-					instr.Op, scm.stack[scm.sp-numArgs-1])
+				err = fmt.Errorf("%s: invalid function: %v",
+					instr.Op(), scm.stack[scm.sp-numArgs-1])
+				break
 			}
 			lambda := callFrame.Lambda
 
+			if len(lambda.Impl.Clauses) > 0 {
+				clause := lambda.Impl.Clause(numArgs)
+				if clause == nil {
+					err = fmt.Errorf("no clause for %v arguments", numArgs)
+					break
+				}
+				lambda = &Lambda{
+					Capture: lambda.Capture,
+					Impl:    clause,
+				}
+				callFrame.Lambda = lambda
+			}
+
 			if numArgs < lambda.Impl.Args.Min {
-				return nil, scm.Breakf("too few arguments: got %v, need %v",
+				err = fmt.Errorf("too few arguments: got %v, need %v",
 					numArgs, lambda.Impl.Args.Min)
+				break
 			}
 			if numArgs > lambda.Impl.Args.Max {
-				return nil, scm.Breakf("too many arguments: got %v, max %v",
+				err = fmt.Errorf("too many arguments: got %v, max %v",
 					numArgs, lambda.Impl.Args.Max)
+				break
+			}
+
+			if lambda.Impl.Native == nil &&
+				scm.sp+lambda.Impl.MaxStack > len(scm.stack) {
+				err = scm.growStack(lambda.Impl.MaxStack,
+					scm.Params.MaxStackDepth)
+				if err != nil {
+					break
+				}
+				args = scm.stack[scm.sp-numArgs : scm.sp]
 			}
 
 			// Set fp for the call.
 			scm.fp = scm.sp - numArgs - 1
 
 			if lambda.Impl.Native != nil {
+				// Save pc for the stack traces of nested calls.
+				callFrame.PC = scm.pc
+
 				accu, err = callFrame.Lambda.Impl.Native(scm, args)
 				if err != nil {
-					if len(lambda.Impl.Name) != 0 {
-						return nil, scm.Breakf("%s: %v", lambda.Impl.Name, err)
+					var esc *escape
+					if errors.As(err, &esc) {
+						if esc.cont.run != scm.run {
+							return nil, esc
+						}
+						var toplevel bool
+						accu = esc.value
+						code, env, toplevel, err = scm.resume(esc.cont)
+						if err != nil {
+							break
+						}
+						if toplevel {
+							scm.returnFuel(fuel)
+							return accu, nil
+						}
+						continue
+					}
+					var nested *nestedError
+					if errors.As(err, &nested) {
+						return nil, scm.breakError(nested.err)
+					}
+					var limit *limitError
+					if errors.As(err, &limit) {
+						return nil, scm.Breakf("%w", limit)
+					}
+					err = scm.errorCondition(lambda.Impl.Name, err)
+					if scm.handlers == nil {
+						break
 					}
-					return nil, scm.Breakf("%v", err)
 				}
 				scm.sp = scm.fp
 				scm.fp = callFrame.Next
@@ -423,6 +873,15 @@ func (scm *Scheme) Apply(lambda Value, args []Value) (Value, error) {
 				callFrame.flNext = scm.frameFL
 				scm.frameFL = callFrame
 
+				if err != nil {
+					// Raise the error from the caller's frame.
+					break
+				}
+				if callFrame.Toplevel {
+					// Apply called a native function.
+					scm.returnFuel(fuel)
+					return accu, nil
+				}
 				continue
 			}
 
@@ -440,33 +899,18 @@ func (scm *Scheme) Apply(lambda Value, args []Value) (Value, error) {
 				}
 				scm.stack[scm.sp] = rest
 				scm.sp++
-				numArgs = lambda.Impl.Args.Min + 1
-				args = scm.stack[scm.sp-numArgs : scm.sp]
 			}
 
-			env = lambda.Capture
+			env = lambda
 
-			if lambda.Impl.Captures {
-				var index int
-				if env != nil {
-					index = env.Index + 1
-				}
-				env = &VMEnvFrame{
-					Next:   env,
-					Index:  index,
-					Values: make([]Value, len(args)),
-				}
-				copy(env.Values, args)
-				scm.sp -= len(args)
-			}
-
-			if instr.I != 0 {
+			if instr.I() != 0 {
 				// Tail-call.
 				next := callFrame.Next
 				nextFrame, ok := scm.stack[next].(*Frame)
 				if !ok {
-					return nil, scm.Breakf("invalid next frame: %v",
+					err = fmt.Errorf("invalid next frame: %v",
 						scm.stack[callFrame.Next])
+					break
 				}
 				nextFrame.Lambda = callFrame.Lambda
 
@@ -478,39 +922,36 @@ func (scm *Scheme) Apply(lambda Value, args []Value) (Value, error) {
 				scm.sp = next + 1 + count
 				scm.fp = next
 			}
-			if scm.sp+lambda.Impl.MaxStack > len(scm.stack) {
-				return nil, scm.Breakf("out of stack: need %d, got %d",
-					lambda.Impl.MaxStack, len(scm.stack)-scm.sp)
-			}
-
 			// Jump to lambda code.
 			code = lambda.Impl.Code
 			scm.pc = 0
 
 		case OpIf:
 			if IsTrue(accu) {
-				scm.pc += instr.I
+				scm.pc += instr.I()
 			}
 
 		case OpIfNot:
 			if !IsTrue(accu) {
-				scm.pc += instr.I
+				scm.pc += instr.I()
 			}
 
 		case OpJmp:
-			scm.pc += instr.I
+			scm.pc += instr.I()
 
 		case OpReturn:
 			frame, ok := scm.stack[scm.fp].(*Frame)
 			if !ok {
-				return nil, scm.Breakf("%s: invalid function: %v",
-					instr.Op, scm.stack[scm.fp])
+				err = fmt.Errorf("%s: invalid function: %v",
+					instr.Op(), scm.stack[scm.fp])
+				break
 			}
 			scm.pc = frame.PC
 			code = frame.Code
 			env = frame.Env
 
 			if scm.popFrame() {
+				scm.returnFuel(fuel)
 				return accu, nil
 			}
 
@@ -524,14 +965,44 @@ func (scm *Scheme) Apply(lambda Value, args []Value) (Value, error) {
 		case OpCar:
 			pair, ok := accu.(Pair)
 			if !ok {
-				return nil, scm.Breakf("%s: not a pair: %v", instr.Op, accu)
+				err = scm.errorCondition(OpCar.String(),
+					fmt.Errorf("not a pair: %v", accu))
+				break
+			}
+			accu = pair.Car()
+
+		case OpCarPair:
+			if pair, ok := accu.(*PlainPair); ok {
+				accu = pair.car
+				break
+			}
+			pair, ok := accu.(Pair)
+			if !ok {
+				err = scm.errorCondition(OpCar.String(),
+					fmt.Errorf("not a pair: %v", accu))
+				break
 			}
 			accu = pair.Car()
 
 		case OpCdr:
 			pair, ok := accu.(Pair)
 			if !ok {
-				return nil, scm.Breakf("%s: not a pair: %v", instr.Op, accu)
+				err = scm.errorCondition(OpCdr.String(),
+					fmt.Errorf("not a pair: %v", accu))
+				break
+			}
+			accu = pair.Cdr()
+
+		case OpCdrPair:
+			if pair, ok := accu.(*PlainPair); ok {
+				accu = pair.cdr
+				break
+			}
+			pair, ok := accu.(Pair)
+			if !ok {
+				err = scm.errorCondition(OpCdr.String(),
+					fmt.Errorf("not a pair: %v", accu))
+				break
 			}
 			accu = pair.Cdr()
 
@@ -541,7 +1012,8 @@ func (scm *Scheme) Apply(lambda Value, args []Value) (Value, error) {
 		case OpZerop:
 			accu, err = zero(accu)
 			if err != nil {
-				return nil, scm.Breakf("%s: %v", instr.Op, err.Error())
+				err = fmt.Errorf("%s: %v", instr.Op(), err.Error())
+				break
 			}
 
 		case OpNot:
@@ -550,152 +1022,586 @@ func (scm *Scheme) Apply(lambda Value, args []Value) (Value, error) {
 		case OpAdd:
 			accu, err = numAdd(scm.stack[scm.sp-2], scm.stack[scm.sp-1])
 			if err != nil {
-				return nil, scm.Breakf("%s: %v", instr.Op, err.Error())
+				err = fmt.Errorf("%s: %v", instr.Op(), err.Error())
+				break
 			}
 
 		case OpAddI64:
-			accu = scm.stack[scm.sp-2].(Int) + scm.stack[scm.sp-1].(Int)
+			v1, ok1 := scm.stack[scm.sp-2].(Int)
+			v2, ok2 := scm.stack[scm.sp-1].(Int)
+			if ok1 && ok2 {
+				accu = v1 + v2
+				break
+			}
+			accu, err = numBinary(instr.Op(), scm.stack[scm.sp-2],
+				scm.stack[scm.sp-1])
+
+		case OpAddF64:
+			v1, ok1 := scm.stack[scm.sp-2].(Float)
+			v2, ok2 := scm.stack[scm.sp-1].(Float)
+			if ok1 && ok2 {
+				accu = v1 + v2
+				break
+			}
+			accu, err = numBinary(instr.Op(), scm.stack[scm.sp-2],
+				scm.stack[scm.sp-1])
 
 		case OpAddConst:
 			switch av := accu.(type) {
 			case Int:
-				accu = av + Int(instr.I)
+				accu = av + Int(instr.I())
 
 			case Float:
-				accu = av + Float(instr.I)
+				accu = av + Float(instr.I())
 
 			case *BigInt:
 				accu = &BigInt{
-					I: new(big.Int).Add(av.I, big.NewInt(int64(instr.I))),
+					I: new(big.Int).Add(av.I, big.NewInt(int64(instr.I()))),
 				}
 
 			case *BigFloat:
 				accu = &BigFloat{
-					F: new(big.Float).Add(av.F, big.NewFloat(float64(instr.I))),
+					F: new(big.Float).Add(av.F,
+						big.NewFloat(float64(instr.I()))),
 				}
 
 			default:
-				return nil, scm.Breakf("%s: invalid number %v", instr.Op, accu)
+				err = fmt.Errorf("%s: invalid number %v", instr.Op(), accu)
+				break
 			}
 
 		case OpSub:
 			accu, err = numSub(scm.stack[scm.sp-2], scm.stack[scm.sp-1])
 			if err != nil {
-				return nil, scm.Breakf("%s: %v", instr.Op, err.Error())
+				err = fmt.Errorf("%s: %v", instr.Op(), err.Error())
+				break
 			}
 
 		case OpSubI64:
-			accu = scm.stack[scm.sp-2].(Int) - scm.stack[scm.sp-1].(Int)
+			v1, ok1 := scm.stack[scm.sp-2].(Int)
+			v2, ok2 := scm.stack[scm.sp-1].(Int)
+			if ok1 && ok2 {
+				accu = v1 - v2
+				break
+			}
+			accu, err = numBinary(instr.Op(), scm.stack[scm.sp-2],
+				scm.stack[scm.sp-1])
+
+		case OpSubF64:
+			v1, ok1 := scm.stack[scm.sp-2].(Float)
+			v2, ok2 := scm.stack[scm.sp-1].(Float)
+			if ok1 && ok2 {
+				accu = v1 - v2
+				break
+			}
+			accu, err = numBinary(instr.Op(), scm.stack[scm.sp-2],
+				scm.stack[scm.sp-1])
 
 		case OpSubConst:
 			switch av := accu.(type) {
 			case Int:
-				accu = av - Int(instr.I)
+				accu = av - Int(instr.I())
 
 			case Float:
-				accu = av - Float(instr.I)
+				accu = av - Float(instr.I())
 
 			case *BigInt:
 				accu = &BigInt{
-					I: new(big.Int).Sub(av.I, big.NewInt(int64(instr.I))),
+					I: new(big.Int).Sub(av.I, big.NewInt(int64(instr.I()))),
 				}
 
 			case *BigFloat:
 				accu = &BigFloat{
-					F: new(big.Float).Sub(av.F, big.NewFloat(float64(instr.I))),
+					F: new(big.Float).Sub(av.F,
+						big.NewFloat(float64(instr.I()))),
 				}
 
 			default:
-				return nil, scm.Breakf("%s: invalid number %v", instr.Op, accu)
+				err = fmt.Errorf("%s: invalid number %v", instr.Op(), accu)
+				break
 			}
 
 		case OpMul:
 			accu, err = numMul(scm.stack[scm.sp-2], scm.stack[scm.sp-1])
 			if err != nil {
-				return nil, scm.Breakf("%s: %v", instr.Op, err.Error())
+				err = fmt.Errorf("%s: %v", instr.Op(), err.Error())
+				break
+			}
+
+		case OpMulI64:
+			v1, ok1 := scm.stack[scm.sp-2].(Int)
+			v2, ok2 := scm.stack[scm.sp-1].(Int)
+			if ok1 && ok2 {
+				accu = v1 * v2
+				break
+			}
+			accu, err = numBinary(instr.Op(), scm.stack[scm.sp-2],
+				scm.stack[scm.sp-1])
+
+		case OpMulF64:
+			v1, ok1 := scm.stack[scm.sp-2].(Float)
+			v2, ok2 := scm.stack[scm.sp-1].(Float)
+			if ok1 && ok2 {
+				accu = v1 * v2
+				break
 			}
+			accu, err = numBinary(instr.Op(), scm.stack[scm.sp-2],
+				scm.stack[scm.sp-1])
 
 		case OpMulConst:
 			switch av := accu.(type) {
 			case Int:
-				accu = av * Int(instr.I)
+				accu = av * Int(instr.I())
 
 			case Float:
-				accu = av * Float(instr.I)
+				accu = av * Float(instr.I())
 
 			case *BigInt:
 				accu = &BigInt{
-					I: new(big.Int).Mul(av.I, big.NewInt(int64(instr.I))),
+					I: new(big.Int).Mul(av.I, big.NewInt(int64(instr.I()))),
 				}
 
 			case *BigFloat:
 				accu = &BigFloat{
-					F: new(big.Float).Mul(av.F, big.NewFloat(float64(instr.I))),
+					F: new(big.Float).Mul(av.F,
+						big.NewFloat(float64(instr.I()))),
 				}
 
 			default:
-				return nil, scm.Breakf("%s: invalid number %v", instr.Op, accu)
+				err = fmt.Errorf("%s: invalid number %v", instr.Op(), accu)
+				break
 			}
 
 		case OpDiv:
 			accu, err = numDiv(scm.stack[scm.sp-2], scm.stack[scm.sp-1])
 			if err != nil {
-				return nil, scm.Breakf("%s: %v", instr.Op, err.Error())
+				err = fmt.Errorf("%s: %v", instr.Op(), err.Error())
+				break
 			}
 
+		case OpDivF64:
+			v1, ok1 := scm.stack[scm.sp-2].(Float)
+			v2, ok2 := scm.stack[scm.sp-1].(Float)
+			if ok1 && ok2 {
+				accu = v1 / v2
+				break
+			}
+			accu, err = numBinary(instr.Op(), scm.stack[scm.sp-2],
+				scm.stack[scm.sp-1])
+
 		case OpEq:
 			accu, err = numEq(scm.stack[scm.sp-2], scm.stack[scm.sp-1])
 			if err != nil {
-				return nil, scm.Breakf("%s: %v", instr.Op, err.Error())
+				err = fmt.Errorf("%s: %v", instr.Op(), err.Error())
+				break
+			}
+
+		case OpEqI64:
+			v1, ok1 := scm.stack[scm.sp-2].(Int)
+			v2, ok2 := scm.stack[scm.sp-1].(Int)
+			if ok1 && ok2 {
+				accu = Boolean(v1 == v2)
+				break
+			}
+			accu, err = numBinary(instr.Op(), scm.stack[scm.sp-2],
+				scm.stack[scm.sp-1])
+
+		case OpEqF64:
+			v1, ok1 := scm.stack[scm.sp-2].(Float)
+			v2, ok2 := scm.stack[scm.sp-1].(Float)
+			if ok1 && ok2 {
+				accu = Boolean(v1 == v2)
+				break
 			}
+			accu, err = numBinary(instr.Op(), scm.stack[scm.sp-2],
+				scm.stack[scm.sp-1])
 
 		case OpLt:
 			accu, err = numLt(scm.stack[scm.sp-2], scm.stack[scm.sp-1])
 			if err != nil {
-				return nil, scm.Breakf("%s: %v", instr.Op, err.Error())
+				err = fmt.Errorf("%s: %v", instr.Op(), err.Error())
+				break
 			}
 
+		case OpLtI64:
+			v1, ok1 := scm.stack[scm.sp-2].(Int)
+			v2, ok2 := scm.stack[scm.sp-1].(Int)
+			if ok1 && ok2 {
+				accu = Boolean(v1 < v2)
+				break
+			}
+			accu, err = numBinary(instr.Op(), scm.stack[scm.sp-2],
+				scm.stack[scm.sp-1])
+
+		case OpLtF64:
+			v1, ok1 := scm.stack[scm.sp-2].(Float)
+			v2, ok2 := scm.stack[scm.sp-1].(Float)
+			if ok1 && ok2 {
+				accu = Boolean(v1 < v2)
+				break
+			}
+			accu, err = numBinary(instr.Op(), scm.stack[scm.sp-2],
+				scm.stack[scm.sp-1])
+
 		case OpGt:
 			accu, err = numGt(scm.stack[scm.sp-2], scm.stack[scm.sp-1])
 			if err != nil {
-				return nil, scm.Breakf("%s: %v", instr.Op, err.Error())
+				err = fmt.Errorf("%s: %v", instr.Op(), err.Error())
+				break
+			}
+
+		case OpGtI64:
+			v1, ok1 := scm.stack[scm.sp-2].(Int)
+			v2, ok2 := scm.stack[scm.sp-1].(Int)
+			if ok1 && ok2 {
+				accu = Boolean(v1 > v2)
+				break
+			}
+			accu, err = numBinary(instr.Op(), scm.stack[scm.sp-2],
+				scm.stack[scm.sp-1])
+
+		case OpGtF64:
+			v1, ok1 := scm.stack[scm.sp-2].(Float)
+			v2, ok2 := scm.stack[scm.sp-1].(Float)
+			if ok1 && ok2 {
+				accu = Boolean(v1 > v2)
+				break
 			}
+			accu, err = numBinary(instr.Op(), scm.stack[scm.sp-2],
+				scm.stack[scm.sp-1])
 
 		case OpLe:
 			accu, err = numGt(scm.stack[scm.sp-2], scm.stack[scm.sp-1])
 			if err != nil {
-				return nil, scm.Breakf("%s: %v", instr.Op, err.Error())
+				err = fmt.Errorf("%s: %v", instr.Op(), err.Error())
+				break
 			}
 			accu = Boolean(!IsTrue(accu))
 
+		case OpLeI64:
+			v1, ok1 := scm.stack[scm.sp-2].(Int)
+			v2, ok2 := scm.stack[scm.sp-1].(Int)
+			if ok1 && ok2 {
+				accu = Boolean(v1 <= v2)
+				break
+			}
+			accu, err = numBinary(instr.Op(), scm.stack[scm.sp-2],
+				scm.stack[scm.sp-1])
+
+		case OpLeF64:
+			v1, ok1 := scm.stack[scm.sp-2].(Float)
+			v2, ok2 := scm.stack[scm.sp-1].(Float)
+			if ok1 && ok2 {
+				// Compare like the generic operand, also for NaNs.
+				accu = Boolean(!(v1 > v2))
+				break
+			}
+			accu, err = numBinary(instr.Op(), scm.stack[scm.sp-2],
+				scm.stack[scm.sp-1])
+
 		case OpGe:
 			accu, err = numLt(scm.stack[scm.sp-2], scm.stack[scm.sp-1])
 			if err != nil {
-				return nil, scm.Breakf("%s: %v", instr.Op, err.Error())
+				err = fmt.Errorf("%s: %v", instr.Op(), err.Error())
+				break
 			}
 			accu = Boolean(!IsTrue(accu))
 
+		case OpGeI64:
+			v1, ok1 := scm.stack[scm.sp-2].(Int)
+			v2, ok2 := scm.stack[scm.sp-1].(Int)
+			if ok1 && ok2 {
+				accu = Boolean(v1 >= v2)
+				break
+			}
+			accu, err = numBinary(instr.Op(), scm.stack[scm.sp-2],
+				scm.stack[scm.sp-1])
+
+		case OpGeF64:
+			v1, ok1 := scm.stack[scm.sp-2].(Float)
+			v2, ok2 := scm.stack[scm.sp-1].(Float)
+			if ok1 && ok2 {
+				// Compare like the generic operand, also for NaNs.
+				accu = Boolean(!(v1 < v2))
+				break
+			}
+			accu, err = numBinary(instr.Op(), scm.stack[scm.sp-2],
+				scm.stack[scm.sp-1])
+
+		case OpVectorRef:
+			vector, ok := scm.stack[scm.sp-2].(Vector)
+			k, kok := scm.stack[scm.sp-1].(Int)
+			if ok && kok && k >= 0 && k < Int(len(vector)) {
+				accu = vector[k]
+				break
+			}
+			accu, err = vectorRef(scm.stack[scm.sp-2], scm.stack[scm.sp-1])
+			if err != nil {
+				err = scm.errorCondition(instr.Op().String(), err)
+			}
+
+		case OpStringRef:
+			accu, err = stringRef(scm.stack[scm.sp-2], scm.stack[scm.sp-1])
+			if err != nil {
+				err = scm.errorCondition(instr.Op().String(), err)
+			}
+
 		case OpCastNumber:
 			if accu == nil || !accu.Type().IsKindOf(types.Number) {
-				return nil, scm.Breakf("%s: cannot cast %v", instr.Op,
+				err = fmt.Errorf("%s: cannot cast %v", instr.Op(),
 					ToScheme(accu))
+				break
 			}
 
 		case OpCastSymbol:
 			if accu == nil || !accu.Type().IsA(types.Symbol) {
-				return nil, scm.Breakf("%s: cannot cast %v", instr.Op,
+				err = fmt.Errorf("%s: cannot cast %v", instr.Op(),
 					ToScheme(accu))
+				break
 			}
 
+		case OpContinuation:
+			accu = scm.captureContinuation()
+
+		case OpResume:
+			values, ok := ListValues(accu)
+			if !ok {
+				err = fmt.Errorf("%s: invalid values: %v",
+					instr.Op(), ToScheme(accu))
+				break
+			}
+			if len(values) == 1 {
+				accu = values[0]
+			} else {
+				accu = Values(values)
+			}
+
+			v := code.Consts[instr.I()]
+			cont, ok := v.(*Continuation)
+			if !ok {
+				err = fmt.Errorf("%s: invalid continuation: %v",
+					instr.Op(), v)
+				break
+			}
+			if cont.run != scm.run {
+				if !scm.active(cont.run) {
+					err = fmt.Errorf("%s: continuation of returned call",
+						instr.Op())
+					break
+				}
+				// Unwind to the execution of the continuation.
+				return nil, &escape{
+					cont:  cont,
+					value: accu,
+				}
+			}
+			var toplevel bool
+			code, env, toplevel, err = scm.resume(cont)
+			if err != nil {
+				break
+			}
+			if toplevel {
+				scm.returnFuel(fuel)
+				return accu, nil
+			}
+
+		case OpValues:
+			count := 1
+			if values, ok := accu.(Values); ok {
+				count = len(values)
+			}
+			if count < instr.I() || (instr.J() == 0 && count > instr.I()) {
+				err = fmt.Errorf("expected %v values, got %v",
+					instr.I(), count)
+				break
+			}
+
+		case OpValueRef:
+			if values, ok := accu.(Values); ok {
+				accu = values[instr.I()]
+			}
+
+		case OpValueRest:
+			values, ok := accu.(Values)
+			if !ok {
+				values = Values{accu}
+			}
+			var list Pair
+			for i := len(values) - 1; i >= instr.I(); i-- {
+				list = NewPair(values[i], list)
+			}
+			accu = list
+
 		default:
-			return nil, scm.Breakf("%s: not implemented", instr.Op)
+			err = fmt.Errorf("%s: not implemented", instr.Op())
+			break
+		}
+		if err != nil {
+			if scm.handlers == nil {
+				return nil, scm.Breakf("%w", err)
+			}
+			code, env, err = scm.raiseError(err, code, env)
+			if err != nil {
+				return nil, scm.Breakf("%w", err)
+			}
+		}
+	}
+}
+
+// capture creates the captures of the lambda tmpl from the captures
+// of the current lambda env and the current stack frame.
+func (scm *Scheme) capture(tmpl *LambdaImpl, env *Lambda) []Value {
+	if len(tmpl.Captures) == 0 {
+		return nil
+	}
+	capture := make([]Value, len(tmpl.Captures))
+	for idx, c := range tmpl.Captures {
+		if c.Env {
+			capture[idx] = env.Capture[c.Index]
+		} else {
+			capture[idx] = scm.stack[scm.fp+1+c.Index]
 		}
 	}
+	return capture
+}
+
+// patch sets the values of the letrec bindings in the stack slots
+// from start to end into the captures of the letrec's lambdas. The
+// lambdas are created before the bindings are set so their captures
+// of the bindings are set after all bindings are set.
+func (scm *Scheme) patch(start, end int) {
+	for i := start; i < end; i++ {
+		lambda, ok := scm.stack[scm.fp+1+i].(*Lambda)
+		if !ok {
+			continue
+		}
+		for idx, c := range lambda.Impl.Captures {
+			if !c.Env && c.Index >= start && c.Index < end {
+				lambda.Capture[idx] = scm.stack[scm.fp+1+c.Index]
+			}
+		}
+	}
+}
+
+// resume reinstates the continuation's stack and returns from the
+// continuation's frame. The function returns the code and lambda of
+// the frame's caller, and a boolean value indicating if the frame was
+// a toplevel frame.
+func (scm *Scheme) resume(cont *Continuation) (*Code, *Lambda, bool,
+	error) {
+
+	scm.restoreContinuation(cont)
+
+	frame, ok := scm.stack[scm.fp].(*Frame)
+	if !ok {
+		return nil, nil, false, fmt.Errorf("%s: invalid function: %v",
+			OpResume, scm.stack[scm.fp])
+	}
+	scm.pc = frame.PC
+
+	return frame.Code, frame.Env, scm.popFrame(), nil
+}
+
+// raiseError raises the error err as a condition. The raise procedure
+// is called as if the failing instruction had called it so the
+// continuation of the raise is the instruction following the failing
+// instruction. The function returns the code and lambda of the raise
+// procedure.
+func (scm *Scheme) raiseError(err error, code *Code, env *Lambda) (
+	*Code, *Lambda, error) {
+
+	raise := scm.Intern("raise").Global()
+	lambda, ok := raise.(*Lambda)
+	if !ok || lambda.Impl.Native != nil || lambda.Impl.Args.Min != 1 ||
+		lambda.Impl.Args.Max != 1 {
+		return nil, nil, err
+	}
+	if scm.sp+2+lambda.Impl.MaxStack > len(scm.stack) {
+		// The stack can grow over its maximum depth so that stack
+		// overflows can be raised.
+		if scm.growStack(2+lambda.Impl.MaxStack,
+			scm.Params.MaxStackDepth+stackReserve) != nil {
+			return nil, nil, err
+		}
+	}
+
+	frame := scm.newFrame()
+	frame.Index = len(scm.stack)
+	frame.Next = scm.fp
+	frame.Toplevel = false
+	frame.Lambda = lambda
+	frame.PC = scm.pc
+	frame.Code = code
+	frame.Env = env
+
+	scm.stack[scm.sp] = frame
+	scm.fp = scm.sp
+	scm.sp++
+
+	cond := scm.errorCondition("", err)
+	scm.stack[scm.sp] = cond
+	scm.sp++
+
+	scm.pc = 0
+
+	return lambda.Impl.Code, lambda, nil
+}
+
+// stackReserve defines how much the stack can grow over its maximum
+// depth when raising errors. This allows the exception handlers to
+// handle stack overflows.
+const stackReserve = 4096
+
+// growStack grows the stack so that it has room for need values
+// above the stack pointer. The stack size is doubled until it is big
+// enough or it reaches the limit. The function returns a stack
+// overflow condition if the stack can't grow enough.
+func (scm *Scheme) growStack(need, limit int) error {
+	size := scm.sp + need
+	if size <= len(scm.stack) {
+		return nil
+	}
+	if size > limit {
+		return stackOverflowCondition(scm.Params.MaxStackDepth)
+	}
+	newSize := len(scm.stack) * 2
+	if newSize == 0 {
+		newSize = 1
+	}
+	for newSize < size {
+		newSize *= 2
+	}
+	if newSize > limit {
+		newSize = limit
+	}
+	if newSize <= cap(scm.stack) {
+		scm.stack = scm.stack[:newSize]
+		return nil
+	}
+	stack := make([]Value, newSize)
+	copy(stack, scm.stack[:scm.sp])
+	scm.stack = stack
+
+	return nil
+}
+
+// limitStack limits the stack to its maximum depth after the stack
+// has grown over it for raising errors. The function is called when
+// the execution continues from a stack below the maximum depth.
+func (scm *Scheme) limitStack() {
+	if len(scm.stack) > scm.Params.MaxStackDepth &&
+		scm.sp <= scm.Params.MaxStackDepth {
+		scm.stack = scm.stack[:scm.Params.MaxStackDepth]
+	}
 }
 
 // Breakf breaks the program execution with the error.
 func (scm *Scheme) Breakf(format string, a ...interface{}) error {
-	err := scm.VMErrorf(format, a...)
+	return scm.breakError(scm.VMErrorf(format, a...))
+}
+
+// breakError breaks the program execution with the located error.
+func (scm *Scheme) breakError(err error) error {
 	msg := err.Error()
 
 	var compilerError bool
@@ -705,14 +1611,18 @@ func (scm *Scheme) Breakf(format string, a ...interface{}) error {
 		msg = msg[idx+2:]
 		compilerError = true
 	}
-	if !scm.Params.Quiet && !compilerError {
+	// The nested calls return their errors to the native functions.
+	if !scm.Params.Quiet && !compilerError && scm.run == nil {
 		fmt.Printf("%s\n", msg)
 		scm.PrintStack()
 	}
 
 	scm.popToplevel()
 
-	return errors.New(msg)
+	if compilerError {
+		return errors.New(msg)
+	}
+	return err
 }
 
 // Location returns the source file location of the current VM
@@ -754,17 +1664,18 @@ func (scm *Scheme) VMWarningf(format string, a ...interface{}) {
 	}
 }
 
-// VMErrorf creates a virtual machine error.
+// VMErrorf creates a virtual machine error. The error wraps the
+// errors of the %w verbs.
 func (scm *Scheme) VMErrorf(format string, a ...interface{}) error {
-	msg := fmt.Sprintf(format, a...)
+	err := fmt.Errorf(format, a...)
 
-	source, line, err := scm.Location()
-	if err != nil || line == 0 || len(source) == 0 {
-		return errors.New(msg)
+	source, line, lerr := scm.Location()
+	if lerr != nil || line == 0 || len(source) == 0 {
+		return err
 	} else if line == 0 {
-		return fmt.Errorf("%s: %s", source, msg)
+		return fmt.Errorf("%s: %w", source, err)
 	}
-	return fmt.Errorf("%s:%v: %s", source, line, msg)
+	return fmt.Errorf("%s:%v: %w", source, line, err)
 }
 
 func (scm *Scheme) popToplevel() {
@@ -792,29 +1703,59 @@ func (scm *Scheme) PrintStack() {
 	fp := scm.fp
 	pc := scm.pc
 
+	// Consecutive identical frames are printed only once since
+	// recursive functions can create very deep stacks.
+	var last string
+	var repeat int
+
+	flush := func() {
+		if repeat > 0 {
+			fmt.Printf("  \u251c\u2574... %d more\n", repeat)
+			repeat = 0
+		}
+	}
+
+	printFrame := func(toplevel bool, signature, source string,
+		line int) {
+
+		var str strings.Builder
+		if toplevel {
+			str.WriteString("\u2514\u2574")
+		} else {
+			str.WriteString("\u251c\u2574")
+		}
+		str.WriteString(signature)
+		str.WriteString(" at ")
+		if line > 0 {
+			str.WriteString(fmt.Sprintf("%s:%d", source, line))
+		}
+		if str.String() == last {
+			repeat++
+		} else {
+			flush()
+			last = str.String()
+			fmt.Printf("  %s\n", last)
+		}
+	}
+
 	for fp < len(scm.stack) {
 		frame, ok := scm.stack[fp].(*Frame)
 		if !ok {
 			panic("corrupted stack")
 		}
 
-		fmt.Print("  ")
-		if frame.Toplevel {
-			fmt.Print("\u2514\u2574")
-		} else {
-			fmt.Print("\u251c\u2574")
+		// The inlined procedure calls are printed as frames of their
+		// own.
+		source, line := frame.MapPC(pc)
+		for inl := frame.Inlined(pc); inl != nil; inl = inl.Outer {
+			printFrame(false, inl.Signature, source, line)
+			line = inl.Line
 		}
+		signature := "???"
 		if frame.Lambda != nil {
-			fmt.Printf("%v", frame.Lambda.Impl.Signature(false))
-		} else {
-			fmt.Printf("???")
+			signature = frame.Lambda.Impl.Signature(false)
 		}
-		fmt.Printf(" at ")
-		source, line := frame.MapPC(pc)
-		if line > 0 {
-			fmt.Printf("%s:%d", source, line)
-		}
-		fmt.Println()
+		printFrame(frame.Toplevel, signature, source, line)
 
 		if frame.Next == fp {
 			break
@@ -822,6 +1763,7 @@ func (scm *Scheme) PrintStack() {
 		fp = frame.Next
 		pc = frame.PC
 	}
+	flush()
 }
 
 // StackFrame provides information about the virtual machine stack
@@ -845,6 +1787,15 @@ func (scm *Scheme) StackTrace() []StackFrame {
 		}
 
 		source, line := frame.MapPC(pc)
+		for inl := frame.Inlined(pc); inl != nil; inl = inl.Outer {
+			if line > 0 {
+				result = append(result, StackFrame{
+					Source: source,
+					Line:   line,
+				})
+			}
+			line = inl.Line
+		}
 		if line > 0 {
 			result = append(result, StackFrame{
 				Source: source,
@@ -861,17 +1812,19 @@ func (scm *Scheme) StackTrace() []StackFrame {
 	return result
 }
 
-// Intern interns the name and returns the interned symbol.
+// Intern interns the name in the machine's image and returns the
+// interned symbol.
 func (scm *Scheme) Intern(name string) *Identifier {
-	id, ok := scm.symbols[name]
-	if !ok {
-		id = &Identifier{
-			Name:       name,
-			GlobalType: types.Unspecified,
-		}
-		scm.symbols[name] = id
+	return scm.image.Intern(name)
+}
+
+func (scm *Scheme) newFrame() *Frame {
+	frame := scm.frameFL
+	if frame != nil {
+		scm.frameFL = frame.flNext
+		return frame
 	}
-	return id
+	return new(Frame)
 }
 
 func (scm *Scheme) popFrame() bool {
@@ -886,6 +1839,41 @@ func (scm *Scheme) popFrame() bool {
 	return frame.Toplevel
 }
 
+// Box implements a location for the captured variables whose values
+// can change after they are captured. The lambdas capturing the
+// variable share the box with the scope of the variable.
+type Box struct {
+	Value Value
+}
+
+// Scheme returns the value as a Scheme string.
+func (b *Box) Scheme() string {
+	return b.String()
+}
+
+// Eq tests if the argument value is eq? to this value.
+func (b *Box) Eq(o Value) bool {
+	return b == o
+}
+
+// Equal tests if the argument value is equal to this value.
+func (b *Box) Equal(o Value) bool {
+	ov, ok := o.(*Box)
+	if !ok {
+		return false
+	}
+	return Equal(b.Value, ov.Value)
+}
+
+// Type implements Value.Type.
+func (b *Box) Type() *types.Type {
+	return types.Unspecified
+}
+
+func (b *Box) String() string {
+	return fmt.Sprintf("box: %v", b.Value)
+}
+
 // Frame implements a SCM call stack frame.
 type Frame struct {
 	Index    int
@@ -894,8 +1882,8 @@ type Frame struct {
 
 	Lambda *Lambda
 	PC     int
-	Code   Code
-	Env    *VMEnvFrame
+	Code   *Code
+	Env    *Lambda
 	flNext *Frame
 }
 
@@ -912,6 +1900,15 @@ func (f *Frame) MapPC(pc int) (source string, line int) {
 	return
 }
 
+// Inlined returns the inlined procedure call that the frame executes
+// at the program counter value.
+func (f *Frame) Inlined(pc int) *PCInline {
+	if f.Lambda != nil {
+		return f.Lambda.Impl.PCMap.Inlined(pc)
+	}
+	return nil
+}
+
 // Eq tests if the argument value is eq? to this value.
 func (f *Frame) Eq(o Value) bool {
 	return f == o
@@ -935,13 +1932,6 @@ func (f *Frame) Type() *types.Type {
 	return types.Unspecified
 }
 
-// VMEnvFrame implement a virtual machine environment frame.
-type VMEnvFrame struct {
-	Next   *VMEnvFrame
-	Index  int
-	Values []Value
-}
-
 func (f *Frame) String() string {
 	var toplevel = "#f"
 	if f.Toplevel {
@@ -990,11 +1980,7 @@ var vmBuiltins = []Builtin{
 		Args:   []string{"who", "message", "irritant..."},
 		Return: types.Any,
 		Native: func(scm *Scheme, args []Value) (Value, error) {
-			message, ok := args[1].(String)
-			if !ok {
-				return nil, fmt.Errorf("invalid message: %v", args[1])
-			}
-			return nil, fmt.Errorf("%v: %v", args[0], message)
+			return nil, newErrorCondition(condError, args)
 		},
 	},
 	{
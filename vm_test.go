@@ -1,5 +1,5 @@
 //
-// Copyright (c) 2022-2023 Markku Rossi
+// Copyright (c) 2022-2024 Markku Rossi
 //
 // All rights reserved.
 //
@@ -7,9 +7,16 @@
 package scheme
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/markkurossi/scheme/types"
 )
 
 var vmTests = []struct {
@@ -187,3 +194,1814 @@ func TestVM(t *testing.T) {
 		}
 	}
 }
+
+func TestDynamicWindError(t *testing.T) {
+	scm, err := New()
+	if err != nil {
+		t.Fatalf("failed to create virtual machine: %v", err)
+	}
+	scm.Params.Quiet = true
+
+	_, err = scm.Eval("test", strings.NewReader(`
+(define path '())
+(dynamic-wind
+  (lambda () (set! path (cons 'before path)))
+  (lambda () (error 'test "failure"))
+  (lambda () (set! path (cons 'after path))))
+`))
+	if err == nil {
+		t.Fatalf("error not detected")
+	}
+	v, err := scm.Global("path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := NewPair(&Identifier{Name: "after"},
+		NewPair(&Identifier{Name: "before"}, nil))
+	if !Equal(v, expected) {
+		t.Errorf("unexpected path: got %v, expected %v", v, expected)
+	}
+	if scm.winders != nil {
+		t.Errorf("winders not unwound: %v", scm.winders)
+	}
+
+	// The errors of the after thunks are returned.
+	_, err = scm.Eval("test", strings.NewReader(`
+(dynamic-wind
+  (lambda () #f)
+  (lambda () (error 'test "failure"))
+  (lambda () (error 'cleanup "after failure")))
+`))
+	if err == nil || !strings.Contains(err.Error(), "after failure") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if scm.winders != nil {
+		t.Errorf("winders not unwound: %v", scm.winders)
+	}
+}
+
+func TestExceptions(t *testing.T) {
+	scm, err := New()
+	if err != nil {
+		t.Fatalf("failed to create virtual machine: %v", err)
+	}
+	scm.Params.Quiet = true
+
+	// Native errors are raised as conditions.
+	v, err := scm.Eval("test", strings.NewReader(`
+(guard (e (#t e))
+  (vector-ref (vector 1 2) 2))
+`))
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	cond, ok := v.(*Condition)
+	if !ok {
+		t.Fatalf("expected condition, got %v", v)
+	}
+	if _, ok := cond.Find(condError); !ok {
+		t.Errorf("condition %v is not an error", cond)
+	}
+	expected := "vector-ref: index 2 out of range for vector #(1 2)"
+	if cond.Error() != expected {
+		t.Errorf("unexpected condition: got '%v', expected '%v'",
+			cond.Error(), expected)
+	}
+
+	// Uncaught errors are reported like before.
+	_, err = scm.Eval("test", strings.NewReader(`
+(vector-ref (vector 1 2) 2)
+`))
+	if err == nil {
+		t.Fatalf("error not detected")
+	}
+	if !strings.HasSuffix(err.Error(), expected) {
+		t.Errorf("unexpected error: got '%v', expected '%v'", err, expected)
+	}
+
+	// Handler returning from a non-continuable exception.
+	_, err = scm.Eval("test", strings.NewReader(`
+(with-exception-handler
+  (lambda (e) 42)
+  (lambda () (raise 'boom)))
+`))
+	if err == nil {
+		t.Fatalf("error not detected")
+	}
+	if scm.handlers != nil {
+		t.Errorf("handlers not restored: %v", scm.handlers)
+	}
+}
+
+func TestConditions(t *testing.T) {
+	scm, err := New()
+	if err != nil {
+		t.Fatalf("failed to create virtual machine: %v", err)
+	}
+	scm.Params.Quiet = true
+
+	// The error irritants are kept in the condition.
+	v, err := scm.Eval("test", strings.NewReader(`
+(guard (e (#t e))
+  (error 'test "failure" 42 "str"))
+`))
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	cond, ok := v.(*Condition)
+	if !ok {
+		t.Fatalf("expected condition, got %v", v)
+	}
+	irritants, ok := cond.Field(condIrritants, "irritants")
+	if !ok {
+		t.Fatalf("condition %v has no irritants", cond)
+	}
+	expected := NewPair(Int(42), NewPair(String("str"), nil))
+	if !Equal(irritants, expected) {
+		t.Errorf("unexpected irritants: got %v, expected %v",
+			irritants, expected)
+	}
+	msg := `test: failure 42 "str"`
+	if cond.Error() != msg {
+		t.Errorf("unexpected condition: got '%v', expected '%v'",
+			cond.Error(), msg)
+	}
+
+	// Field indices include the parent type fields.
+	v, err = scm.Eval("test", strings.NewReader(`
+(define-condition-type &base &error make-base base? (a base-a))
+(define-condition-type &derived &base make-derived derived? (b derived-b))
+(make-derived 1 2)
+`))
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	cond, ok = v.(*Condition)
+	if !ok {
+		t.Fatalf("expected condition, got %v", v)
+	}
+	if len(cond.Fields) != 2 {
+		t.Fatalf("unexpected fields: %v", cond.Fields)
+	}
+	if _, ok := cond.Find(condError); !ok {
+		t.Errorf("condition %v is not an error", cond)
+	}
+	idx, ok := cond.Kind.FieldIndex("b")
+	if !ok || idx != 1 {
+		t.Errorf("unexpected field index: got %v, expected 1", idx)
+	}
+}
+
+func TestRecords(t *testing.T) {
+	scm, err := New()
+	if err != nil {
+		t.Fatalf("failed to create virtual machine: %v", err)
+	}
+	v, err := scm.Eval("test", strings.NewReader(`
+(define-record-type point (fields x (mutable y)))
+(define-record-type cpoint (parent point) (fields color))
+(make-cpoint 1 2 'red)
+`))
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	r, ok := v.(*Record)
+	if !ok {
+		t.Fatalf("expected record, got %v", v)
+	}
+	if r.Kind.Name != "cpoint" || r.Kind.Parent.Name != "point" {
+		t.Errorf("unexpected record type: %v", r.Kind)
+	}
+
+	// The records can be walked with their field definitions.
+	fields := r.Kind.AllFields()
+	expected := []RecordField{
+		{Name: "x"},
+		{Name: "y", Mutable: true},
+		{Name: "color"},
+	}
+	if len(fields) != len(expected) || len(r.Fields) != len(expected) {
+		t.Fatalf("unexpected fields: %v", fields)
+	}
+	for idx, field := range fields {
+		if field != expected[idx] {
+			t.Errorf("field %v: got %v, expected %v", idx, field,
+				expected[idx])
+		}
+	}
+	for name, value := range map[string]Value{
+		"x":     Int(1),
+		"y":     Int(2),
+		"color": scm.Intern("red"),
+	} {
+		v, ok := r.Field(name)
+		if !ok || !Equal(v, value) {
+			t.Errorf("field %v: got %v, expected %v", name, v, value)
+		}
+	}
+	if _, ok := r.Field("z"); ok {
+		t.Errorf("unexpected field z")
+	}
+
+	// The accessor errors name the accessor once.
+	_, err = scm.Eval("test", strings.NewReader(`
+(define-record-type circle (fields r))
+(define (get-x v) (point-x v))
+(get-x (if (eq? 1 1) (make-circle 1) 2))
+`))
+	msg := "test:3: point-x: not a point record: #<record circle>"
+	if err == nil || !strings.HasPrefix(err.Error(), msg) {
+		t.Errorf("unexpected error: got %v, expected %v", err, msg)
+	}
+}
+
+func TestImports(t *testing.T) {
+	tests := []struct {
+		data string
+		v    Value
+		err  string
+	}{
+		{
+			data: `(import (rename (go lang ((>= 1) (>= 19))) (len size)))
+(size "abc")`,
+			v: Int(3),
+		},
+		{
+			data: `(import (go lang (2)))
+(len "abc")`,
+			err: "library version mismatch",
+		},
+		{
+			data: `(import (go lang (foo)))`,
+			err:  "invalid version reference: (foo)",
+		},
+		{
+			data: `(import (only (go lang) size))`,
+			err:  "size not exported by (go lang)",
+		},
+		{
+			data: `(import (prefix (go lang)))`,
+			err:  "invalid import set",
+		},
+		{
+			data: `(import (rename (go lang) (len format)) (go format))
+(format "abc")`,
+			err: "format imported from (go lang) and (go format)",
+		},
+		{
+			data: `(import (go lang))
+(set! len (lambda (obj) 0))`,
+			err: "set!: can't assign imported variable 'len'",
+		},
+	}
+	for idx, test := range tests {
+		scm, err := New()
+		if err != nil {
+			t.Fatalf("failed to create virtual machine: %v", err)
+		}
+		scm.Params.Quiet = true
+
+		v, err := scm.Eval(fmt.Sprintf("test-%d", idx),
+			strings.NewReader(test.data))
+		if len(test.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("test-%d: expected error '%v', got %v",
+					idx, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("test-%d: Eval failed: %v", idx, err)
+		}
+		if !Equal(v, test.v) {
+			t.Errorf("test-%d: got %v, expected %v", idx, v, test.v)
+		}
+	}
+}
+
+func TestTopLevelImports(t *testing.T) {
+	scm, err := NewWithParams(Params{
+		Quiet: true,
+	})
+	if err != nil {
+		t.Fatalf("failed to create virtual machine: %v", err)
+	}
+	tests := []struct {
+		data string
+		v    Value
+	}{
+		{
+			data: `(import (rename (go lang) (len format)))`,
+		},
+		{
+			data: `(format "abc")`,
+			v:    Int(3),
+		},
+		{
+			data: `(import (go format))`,
+		},
+		{
+			data: `(format "%v" 42)`,
+			v:    String("42"),
+		},
+	}
+	for idx, test := range tests {
+		v, err := scm.Eval(fmt.Sprintf("test-%d", idx),
+			strings.NewReader(test.data))
+		if err != nil {
+			t.Fatalf("test-%d: Eval failed: %v", idx, err)
+		}
+		if test.v != nil && !Equal(v, test.v) {
+			t.Errorf("test-%d: got %v, expected %v", idx, v, test.v)
+		}
+	}
+
+	// The imports are visible only in the importing machine.
+	_, err = scm.image.NewMachine().Eval("test", strings.NewReader(
+		`(format "%v" 42)`))
+	if err == nil || !strings.Contains(err.Error(), "undefined symbol") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestImportError(t *testing.T) {
+	scm, err := NewWithParams(Params{
+		Quiet: true,
+	})
+	if err != nil {
+		t.Fatalf("failed to create virtual machine: %v", err)
+	}
+	dir := t.TempDir()
+	err = os.MkdirAll(filepath.Join(dir, "test"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "test", "broken.scm"), []byte(`
+(library (test broken)
+  (export broken)
+  (import (rnrs base))
+  (define broken (car '())))
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = scm.Eval("test", strings.NewReader(
+		fmt.Sprintf(`(set! load-path (cons %q load-path))`, dir)))
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+
+	// The failed imports return errors.
+	for _, expected := range []string{
+		"car: not a pair",
+		"library initialization failed",
+	} {
+		_, err = scm.Eval("test", strings.NewReader(`
+(import (test broken))
+'imported
+`))
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("unexpected error: got %v, expected %v", err, expected)
+		}
+	}
+}
+
+func TestSelfTailCall(t *testing.T) {
+	scm, err := New()
+	if err != nil {
+		t.Fatalf("failed to create virtual machine: %v", err)
+	}
+	v, err := scm.Eval("test", strings.NewReader(`
+(define-constant (count n acc)
+  (if (zero? n)
+      acc
+      (let ((m (- n 1)))
+        (count m (+ acc 1)))))
+(count 100000 0)
+`))
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	if !Equal(v, Int(100000)) {
+		t.Errorf("unexpected result: got %v, expected 100000", v)
+	}
+	v, err = scm.Global("count")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lambda, ok := v.(*Lambda)
+	if !ok {
+		t.Fatalf("expected lambda, got %v", v)
+	}
+	var jumps int
+	for _, instr := range lambda.Impl.Code.Decode() {
+		switch instr.Op {
+		case OpCall, OpCallConst:
+			t.Errorf("self tail-call not compiled into jump: %v", instr)
+		case OpJmp:
+			jumps++
+		}
+	}
+	if jumps == 0 {
+		t.Errorf("no jumps in lambda code")
+	}
+
+	// Later evaluations can assign the global procedures so their
+	// self tail-calls call the current value of the global.
+	_, err = scm.Eval("test", strings.NewReader(`
+(define (f n) (if (= n 0) 'old (f (- n 1))))
+(define g f)
+`))
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	v, err = scm.Eval("test", strings.NewReader(`
+(set! f (lambda (n) 'new))
+(g 3)
+`))
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	if !Equal(v, &Identifier{Name: "new"}) {
+		t.Errorf("unexpected result: got %v, expected new", v)
+	}
+}
+
+func TestLoops(t *testing.T) {
+	scm, err := New()
+	if err != nil {
+		t.Fatalf("failed to create virtual machine: %v", err)
+	}
+	v, err := scm.Eval("test", strings.NewReader(`
+(define (count-let n)
+  (let loop ((i 0) (acc 0))
+    (if (= i n)
+        acc
+        (loop (+ i 1) (+ acc 1)))))
+(define (count-do n)
+  (do ((i 0 (+ i 1))
+       (acc 0 (+ acc 1)))
+      ((= i n) acc)))
+(+ (count-let 100000) (count-do 100000))
+`))
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	if !Equal(v, Int(200000)) {
+		t.Errorf("unexpected result: got %v, expected 200000", v)
+	}
+
+	// The loops are compiled into jumps inside the loop lambda.
+	for _, name := range []string{"count-let", "count-do"} {
+		v, err = scm.Global(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lambda, ok := v.(*Lambda)
+		if !ok {
+			t.Fatalf("expected lambda, got %v", v)
+		}
+		var loop *LambdaImpl
+		for _, instr := range lambda.Impl.Code.Decode() {
+			if instr.Op == OpLambda {
+				loop, _ = instr.V.(*LambdaImpl)
+			}
+		}
+		if loop == nil {
+			t.Fatalf("%s: loop lambda not found", name)
+		}
+		var jumps int
+		for _, instr := range loop.Code.Decode() {
+			switch instr.Op {
+			case OpCall, OpCallConst:
+				t.Errorf("%s: loop not compiled into jump: %v", name, instr)
+			case OpJmp:
+				jumps++
+			}
+		}
+		if jumps == 0 {
+			t.Errorf("%s: no jumps in loop code", name)
+		}
+	}
+}
+
+func TestConstantFolding(t *testing.T) {
+	scm, err := NewWithParams(Params{
+		Quiet: true,
+	})
+	if err != nil {
+		t.Fatalf("failed to create virtual machine: %v", err)
+	}
+	v, err := scm.Eval("test", strings.NewReader(`
+(define-constant width 80)
+(define-constant debug #f)
+(define (columns)
+  (let ((margin 2))
+    (if debug
+        (display "debug")
+        (cond
+         ((< width 40) 'narrow)
+         ((> (* width 2) (+ margin 100)) (- width (* margin 2)))
+         (else 'wide)))))
+(columns)
+`))
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	if !Equal(v, Int(76)) {
+		t.Errorf("unexpected result: got %v, expected 76", v)
+	}
+	v, err = scm.Global("columns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lambda, ok := v.(*Lambda)
+	if !ok {
+		t.Fatalf("expected lambda, got %v", v)
+	}
+	for _, instr := range lambda.Impl.Code.Decode() {
+		switch instr.Op {
+		case OpIf, OpIfNot, OpGlobal, OpAdd, OpSub, OpMul, OpLt, OpGt:
+			t.Errorf("constant expression not folded: %v", instr)
+		}
+	}
+
+	// Runtime errors are not folded.
+	v, err = scm.Eval("test", strings.NewReader(`
+(define (div) (/ 1 0))
+div
+`))
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	lambda, ok = v.(*Lambda)
+	if !ok {
+		t.Fatalf("expected lambda, got %v", v)
+	}
+	var div bool
+	for _, instr := range lambda.Impl.Code.Decode() {
+		if instr.Op == OpDiv {
+			div = true
+		}
+	}
+	if !div {
+		t.Errorf("division by zero folded")
+	}
+
+	// The constants are not propagated to the preceding references.
+	v, err = scm.Eval("test", strings.NewReader(`
+(define (early) limit)
+(define-constant limit 10)
+early
+`))
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	lambda, ok = v.(*Lambda)
+	if !ok {
+		t.Fatalf("expected lambda, got %v", v)
+	}
+	var global bool
+	for _, instr := range lambda.Impl.Code.Decode() {
+		if instr.Op == OpGlobal {
+			global = true
+		}
+	}
+	if !global {
+		t.Errorf("constant propagated to a preceding reference")
+	}
+	_, err = scm.Eval("test", strings.NewReader(`
+(define before depth)
+(define-constant depth 10)
+`))
+	if err == nil || !strings.Contains(err.Error(), "undefined symbol 'depth'") {
+		t.Errorf("reference before definition did not fail: %v", err)
+	}
+}
+
+func TestInlineProcedures(t *testing.T) {
+	scm, err := New()
+	if err != nil {
+		t.Fatalf("failed to create virtual machine: %v", err)
+	}
+	v, err := scm.Eval("test", strings.NewReader(`
+(define-constant (point-x p) (car p))
+(define-constant (square x) (* x x))
+(define-constant (sum-squares a b) (+ (square a) (square b)))
+(define-constant (add1 n) (+ n 1))
+(define (fact n) (if (zero? n) 1 (* n (fact (- n 1)))))
+(define (counter) 0)
+(set! counter (lambda () 1))
+(define (foo p)
+  (sum-squares (point-x p) (add1 2)))
+(define (bar)
+  (define (twice y) (* 2 y))
+  (+ (+ (twice (twice 5)) (counter)) (fact 3)))
+(list (foo '(3 4)) (bar) (square 4))
+`))
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	expected := NewPair(Int(18), NewPair(Int(27), NewPair(Int(16), nil)))
+	if !Equal(v, expected) {
+		t.Errorf("unexpected result: got %v, expected %v", v, expected)
+	}
+
+	calls := func(name string) map[string]bool {
+		v, err := scm.Global(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lambda, ok := v.(*Lambda)
+		if !ok {
+			t.Fatalf("expected lambda, got %v", v)
+		}
+		result := make(map[string]bool)
+		code := lambda.Impl.Code.Decode()
+		for idx, instr := range code {
+			if instr.Op == OpGlobal && idx+1 < len(code) &&
+				code[idx+1].Op == OpPushF {
+				result[instr.Sym.Name] = true
+			}
+		}
+		return result
+	}
+
+	if c := calls("foo"); len(c) != 0 {
+		t.Errorf("foo: procedures not inlined: %v", c)
+	}
+	c := calls("bar")
+	if !c["counter"] || !c["fact"] || len(c) != 2 {
+		t.Errorf("bar: unexpected calls: %v", c)
+	}
+	if c := calls("fact"); !c["fact"] {
+		t.Errorf("fact: recursive call inlined")
+	}
+
+	// The global procedures can be assigned by later evaluations so
+	// they are not inlined.
+	v, err = scm.Eval("test", strings.NewReader(`
+(define (sq x) (* x x))
+(define (use n) (sq n))
+(use 3)
+`))
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	if !Equal(v, Int(9)) {
+		t.Errorf("unexpected result: got %v, expected 9", v)
+	}
+	v, err = scm.Eval("test", strings.NewReader(`
+(set! sq (lambda (x) 1))
+(use 3)
+`))
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	if !Equal(v, Int(1)) {
+		t.Errorf("unexpected result: got %v, expected 1", v)
+	}
+
+	// The procedures of libraries are inlined.
+	_, err = scm.Eval("test", strings.NewReader(`
+(library (test inline)
+  (export scaled)
+  (import (rnrs base))
+  (define (twice x) (* 2 x))
+  (define (scaled x) (twice x)))
+`))
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	_, err = scm.Eval("test", strings.NewReader(`
+(import (test inline))
+(define imported-scaled scaled)
+`))
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	if c := calls("imported-scaled"); len(c) != 0 {
+		t.Errorf("scaled: procedures not inlined: %v", c)
+	}
+
+	// The errors of the inlined procedures name the procedures and
+	// the stack traces show the inlined calls.
+	scm.DefineBuiltin(Builtin{
+		Name:   "test-trace",
+		Return: types.Any,
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			var lines []Value
+			for _, frame := range scm.StackTrace() {
+				lines = append(lines, Int(frame.Line))
+			}
+			return newList(Point{}, lines...), nil
+		},
+	})
+	v, err = scm.Eval("test", strings.NewReader(`
+(define-constant (traced x)
+  (cons x (test-trace)))
+(define (trace-caller n)
+  (traced n))
+(list (guard (e (#t (condition-who e)))
+        (point-x 5))
+      (cdr (trace-caller 1)))
+`))
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	if c := calls("trace-caller"); c["traced"] {
+		t.Errorf("trace-caller: procedure not inlined")
+	}
+	expected = NewPair(&Identifier{Name: "car"},
+		NewPair(newList(Point{}, Int(3), Int(5), Int(8)), nil))
+	if !Equal(v, expected) {
+		t.Errorf("unexpected result: got %v, expected %v", v, expected)
+	}
+}
+
+func TestClosures(t *testing.T) {
+	scm, err := New()
+	if err != nil {
+		t.Fatalf("failed to create virtual machine: %v", err)
+	}
+	v, err := scm.Eval("test", strings.NewReader(`
+(define (make-counter)
+  (let ((count 0))
+    (lambda ()
+      (set! count (+ count 1))
+      count)))
+(define (make-cell value)
+  (cons (lambda () value)
+        (lambda (v) (set! value v))))
+(define (parity n)
+  (letrec ((even? (lambda (n) (if (zero? n) #t (odd? (- n 1)))))
+           (odd? (lambda (n) (if (zero? n) #f (even? (- n 1))))))
+    (even? n)))
+(define (thunks n)
+  (let loop ((i 0) (result '()))
+    (if (< i n)
+        (loop (+ i 1) (cons (lambda () i) result))
+        (map (lambda (f) (f)) result))))
+(define (adder a b c)
+  (lambda (x)
+    (lambda () (+ x b))))
+(define (count-to n)
+  (let ((empty '()))
+    (let loop ((i 0) (sum 0))
+      (if (< i n)
+          (loop (+ i 1) (+ sum 1))
+          sum))))
+(define c1 (make-counter))
+(define c2 (make-counter))
+(c1)
+(c1)
+(c2)
+(define cell (make-cell 1))
+((cdr cell) 42)
+(list (c1) (c2) ((car cell)) (parity 10) (thunks 3) (((adder 1 2 3) 4))
+      (count-to 5))
+`))
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	expected := NewPair(Int(3),
+		NewPair(Int(2),
+			NewPair(Int(42),
+				NewPair(Boolean(true),
+					NewPair(
+						NewPair(Int(2), NewPair(Int(1), NewPair(Int(0), nil))),
+						NewPair(Int(6), NewPair(Int(5), nil)))))))
+	if !Equal(v, expected) {
+		t.Errorf("unexpected result: got %v, expected %v", v, expected)
+	}
+
+	// The closures capture only the free variables they reference.
+	v, err = scm.Eval("test", strings.NewReader(`(adder 1 2 3)`))
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	lambda, ok := v.(*Lambda)
+	if !ok {
+		t.Fatalf("expected lambda, got %v", v)
+	}
+	if len(lambda.Capture) != 1 || !Equal(lambda.Capture[0], Int(2)) {
+		t.Errorf("unexpected captures: %v", lambda.Capture)
+	}
+
+	// The letrec bindings of lambdas and constants are not boxed.
+	// The bindings with other inits are boxed.
+	v, err = scm.Eval("test", strings.NewReader(`
+(define (walk n)
+  (define (ping n) (if (zero? n) 'ping (pong (- n 1))))
+  (define (pong n) (if (zero? n) 'pong (ping (- n 1))))
+  (define (start) (ping n))
+  (start))
+(define (late)
+  (letrec* ((get (lambda () value))
+            (value (* 6 (length '(1 2 3 4 5 6 7)))))
+    (get)))
+(define (collect)
+  (letrec ((items '())
+           (limit 3)
+           (add (lambda (x) (set! items (cons x items))))
+           (fill (lambda (n) (if (< n limit) (begin (add n) (fill (+ n 1)))))))
+    (fill 0)
+    items))
+(list (walk 5) (walk 6) (late) (collect))
+`))
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	expected = NewPair(&Identifier{Name: "pong"},
+		NewPair(&Identifier{Name: "ping"},
+			NewPair(Int(42),
+				NewPair(NewPair(Int(2), NewPair(Int(1), NewPair(Int(0), nil))),
+					nil))))
+	if !Equal(v, expected) {
+		t.Errorf("unexpected result: got %v, expected %v", v, expected)
+	}
+	boxes := func(name string) int {
+		v, err := scm.Global(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lambda, ok := v.(*Lambda)
+		if !ok {
+			t.Fatalf("expected lambda, got %v", v)
+		}
+		var count int
+		for _, instr := range lambda.Impl.Code.Decode() {
+			if instr.Op == OpBox {
+				count++
+			}
+		}
+		return count
+	}
+	if n := boxes("walk"); n != 0 {
+		t.Errorf("walk: letrec lambdas boxed: %v", n)
+	}
+	if n := boxes("late"); n != 1 {
+		t.Errorf("late: unexpected boxes: %v", n)
+	}
+	if n := boxes("collect"); n != 1 {
+		t.Errorf("collect: unexpected boxes: %v", n)
+	}
+}
+
+func TestCaseLambda(t *testing.T) {
+	scm, err := NewWithParams(Params{
+		Quiet: true,
+	})
+	if err != nil {
+		t.Fatalf("failed to create virtual machine: %v", err)
+	}
+	for idx, data := range []string{
+		`((case-lambda))`,
+		`(define (f) (case-lambda))`,
+	} {
+		_, err = scm.Eval(fmt.Sprintf("test-%d", idx),
+			strings.NewReader(data))
+		if err == nil || !strings.Contains(err.Error(),
+			"case-lambda: no clauses") {
+			t.Errorf("test-%d: unexpected error: %v", idx, err)
+		}
+	}
+}
+
+func TestBytecode(t *testing.T) {
+	scm, err := New()
+	if err != nil {
+		t.Fatalf("failed to create virtual machine: %v", err)
+	}
+	v, err := scm.Eval("test", strings.NewReader(`
+(define (sum-list lst)
+  (let loop ((lst lst) (sum 0))
+    (if (null? lst)
+        sum
+        (loop (cdr lst) (+ sum (car lst))))))
+(define (greet name)
+  (string-append "hello, " name "! " "hello, " name))
+(list (sum-list '(1 2 3 4)) (greet "world"))
+`))
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	expected := NewPair(Int(10),
+		NewPair(String("hello, world! hello, world"), nil))
+	if !Equal(v, expected) {
+		t.Errorf("unexpected result: got %v, expected %v", v, expected)
+	}
+
+	v, err = scm.Global("greet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lambda, ok := v.(*Lambda)
+	if !ok {
+		t.Fatalf("expected lambda, got %v", v)
+	}
+	code := lambda.Impl.Code
+
+	// The constants and symbols are stored once in the pools.
+	seen := make(map[Value]bool)
+	for _, c := range code.Consts {
+		if seen[c] {
+			t.Errorf("duplicate constant: %v", c)
+		}
+		seen[c] = true
+	}
+	if len(code.Syms) != 1 || code.Syms[0].Name != "string-append" {
+		t.Errorf("unexpected symbols: %v", code.Syms)
+	}
+
+	// The labels are removed and the argument counts are encoded into
+	// the calls.
+	var calls int
+	for _, instr := range code.Decode() {
+		switch instr.Op {
+		case OpLabel, OpCall:
+			t.Errorf("unexpected instruction: %v", instr)
+		case OpCallConst:
+			if instr.J != 5 {
+				t.Errorf("unexpected argument count: %v", instr)
+			}
+			calls++
+		}
+	}
+	if calls != 1 {
+		t.Errorf("unexpected number of calls: %v", calls)
+	}
+
+	// Constant operands outside the immediate range are pooled.
+	v, err = scm.Eval("test", strings.NewReader(`
+(define (wide x)
+  (list (+ x 3000000000) (- x 3000000000) (* x -3000000000)))
+(wide 1)
+`))
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	expected = NewPair(Int(3000000001),
+		NewPair(Int(-2999999999), NewPair(Int(-3000000000), nil)))
+	if !Equal(v, expected) {
+		t.Errorf("unexpected result: got %v, expected %v", v, expected)
+	}
+}
+
+func TestSpecializedOps(t *testing.T) {
+	scm, err := New()
+	if err != nil {
+		t.Fatalf("failed to create virtual machine: %v", err)
+	}
+	v, err := scm.Eval("test", strings.NewReader(`
+(define vec (make-vector 3 7))
+(define (ops a b x y s)
+  (list (+ a b) (* a b) (< a b) (>= a b)
+        (+ x y) (/ x y) (<= x y)
+        (vector-ref vec a) (string-ref s b)
+        (number! (+ a b))))
+(define (assigned)
+  (let ((x 1))
+    (set! x 2.5)
+    (list (< x 3) (+ x 1))))
+(list (ops 1 2 1.5 0.5 "abc") (assigned))
+`))
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	expected := NewPair(
+		NewPair(Int(3),
+			NewPair(Int(2),
+				NewPair(Boolean(true),
+					NewPair(Boolean(false),
+						NewPair(Float(2),
+							NewPair(Float(3),
+								NewPair(Boolean(false),
+									NewPair(Int(7),
+										NewPair(Character('c'),
+											NewPair(Int(3), nil)))))))))),
+		NewPair(NewPair(Boolean(true), NewPair(Float(3.5), nil)), nil))
+	if !Equal(v, expected) {
+		t.Errorf("unexpected result: got %v, expected %v", v, expected)
+	}
+
+	v, err = scm.Global("ops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lambda, ok := v.(*Lambda)
+	if !ok {
+		t.Fatalf("expected lambda, got %v", v)
+	}
+	ops := make(map[Operand]bool)
+	for _, instr := range lambda.Impl.Code.Decode() {
+		ops[instr.Op] = true
+	}
+	for _, op := range []Operand{OpAddI64, OpMulI64, OpLtI64, OpGeI64,
+		OpAddF64, OpDivF64, OpLeF64, OpVectorRef, OpStringRef} {
+		if !ops[op] {
+			t.Errorf("instruction %v not emitted", op)
+		}
+	}
+	if ops[OpCastNumber] {
+		t.Errorf("redundant cast not eliminated")
+	}
+
+	// The specialized instructions fail like the procedures.
+	_, err = scm.Eval("test", strings.NewReader(`(ops 5 1 1.0 2.0 "abc")`))
+	if err == nil || !strings.Contains(err.Error(),
+		"index 5 out of range for vector") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestMacros(t *testing.T) {
+	scm, err := NewWithParams(Params{
+		Quiet: true,
+	})
+	if err != nil {
+		t.Fatalf("failed to create virtual machine: %v", err)
+	}
+
+	// Quoted template identifiers are symbols.
+	v, err := scm.Eval("test", strings.NewReader(`
+(define-syntax quoted
+  (syntax-rules ()
+    ((_) '(tmp #(tmp)))))
+(quoted)
+`))
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	tmp := &Identifier{Name: "tmp"}
+	expected := NewPair(tmp, NewPair(Vector{tmp}, nil))
+	if !Equal(v, expected) {
+		t.Errorf("unexpected result: got %v, expected %v", v, expected)
+	}
+
+	// Errors in expansions point to the macro use.
+	_, err = scm.Eval("test", strings.NewReader(`
+(define-syntax first
+  (syntax-rules ()
+    ((_ e) (car e))))
+(first
+  1)
+`))
+	if err == nil {
+		t.Fatalf("invalid argument not detected")
+	}
+	if !strings.HasPrefix(err.Error(), "test:5:") {
+		t.Errorf("unexpected error location: %v", err)
+	}
+
+	// Unmatched uses.
+	_, err = scm.Eval("test", strings.NewReader(`
+(first 1 2)
+`))
+	if err == nil || !strings.Contains(err.Error(), "invalid syntax") {
+		t.Errorf("unmatched macro use not detected: %v", err)
+	}
+
+	// Infinite expansions.
+	_, err = scm.Eval("test", strings.NewReader(`
+(define-syntax forever
+  (syntax-rules ()
+    ((_ e) (forever (e)))))
+(forever 1)
+`))
+	if err == nil || !strings.Contains(err.Error(), "too deep") {
+		t.Errorf("infinite expansion not detected: %v", err)
+	}
+}
+
+func TestSyntaxCaseLibrary(t *testing.T) {
+	scm, err := NewWithParams(Params{
+		Quiet: true,
+	})
+	if err != nil {
+		t.Fatalf("failed to create virtual machine: %v", err)
+	}
+	dir := t.TempDir()
+	err = os.MkdirAll(filepath.Join(dir, "test"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "test", "macros.scm"), []byte(`
+(library (test macros)
+  (export scale check)
+  (import (rnrs base) (rnrs syntax-case))
+  (define (factor) 10)
+  (define-syntax scale
+    (lambda (x)
+      (syntax-case x ()
+        ((_ e) #'(* (factor) e)))))
+  (define-syntax check
+    (lambda (x)
+      (syntax-case x ()
+        ((_ e) (identifier? #'e) #'e)
+        ((_ e) (syntax-violation #f "not an identifier" x #'e))))))
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = scm.Eval("test", strings.NewReader(
+		fmt.Sprintf(`(set! load-path (cons %q load-path))`, dir)))
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+
+	// Exported macros refer to the library bindings.
+	v, err := scm.Eval("test", strings.NewReader(`
+(import (test macros))
+(define (f factor) (scale factor))
+(f 4)
+`))
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	if !Equal(v, Int(40)) {
+		t.Errorf("unexpected result: got %v, expected 40", v)
+	}
+
+	// Syntax violations point to the macro use.
+	_, err = scm.Eval("test", strings.NewReader(`
+(import (test macros))
+(check
+  1)
+`))
+	if err == nil {
+		t.Fatalf("syntax violation not detected")
+	}
+	if !strings.HasPrefix(err.Error(), "test:3:") ||
+		!strings.Contains(err.Error(), "check: not an identifier") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestLibraryPrivate(t *testing.T) {
+	scm, err := NewWithParams(Params{
+		Quiet: true,
+	})
+	if err != nil {
+		t.Fatalf("failed to create virtual machine: %v", err)
+	}
+	dir := t.TempDir()
+	err = os.MkdirAll(filepath.Join(dir, "test"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b"} {
+		err = os.WriteFile(filepath.Join(dir, "test", name+".scm"),
+			[]byte(fmt.Sprintf(`
+(library (test %[1]s)
+  (export %[1]s-value)
+  (import (rnrs base))
+  (define (%[1]s-value) (helper))
+  (define (helper) '%[1]s))
+`, name)), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = scm.Eval("test", strings.NewReader(
+		fmt.Sprintf(`(set! load-path (cons %q load-path))`, dir)))
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+
+	// Both libraries have their own helper.
+	v, err := scm.Eval("test", strings.NewReader(`
+(import (test a) (test b))
+(list (a-value) (b-value))
+`))
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	expected := NewPair(&Identifier{Name: "a"},
+		NewPair(&Identifier{Name: "b"}, nil))
+	if !Equal(v, expected) {
+		t.Errorf("unexpected result: got %v, expected %v", v, expected)
+	}
+
+	// The private definitions are not imported.
+	_, err = scm.Global("helper")
+	if err == nil {
+		t.Errorf("private definition imported")
+	}
+
+	// The libraries can export the same names.
+	for _, name := range []string{"c", "d"} {
+		err = os.WriteFile(filepath.Join(dir, "test", name+".scm"),
+			[]byte(fmt.Sprintf(`
+(library (test %[1]s)
+  (export pub)
+  (import (rnrs base))
+  (define (pub) '%[1]s))
+`, name)), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	v, err = scm.Eval("test", strings.NewReader(`
+(import (prefix (test c) c:) (prefix (test d) d:))
+(list (c:pub) (d:pub))
+`))
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	expected = NewPair(&Identifier{Name: "c"},
+		NewPair(&Identifier{Name: "d"}, nil))
+	if !Equal(v, expected) {
+		t.Errorf("unexpected result: got %v, expected %v", v, expected)
+	}
+
+	// The exports are visible only in the programs that import them.
+	v, err = scm.Eval("test", strings.NewReader(`
+(guard (e ((undefined-violation? e) 'undefined))
+  (pub))
+`))
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	if !Equal(v, &Identifier{Name: "undefined"}) {
+		t.Errorf("exported definition visible without import: %v", v)
+	}
+	_, err = scm.Global("pub")
+	if err == nil {
+		t.Errorf("exported definition interned")
+	}
+
+	// Private definitions can't redefine inlined procedures.
+	_, err = scm.Eval("test", strings.NewReader(`
+(library (test car)
+  (export first)
+  (import (rnrs base))
+  (define (first x) (car x))
+  (define (car x) x))
+`))
+	if err == nil || !strings.Contains(err.Error(), "redefining symbol 'car'") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestStack(t *testing.T) {
+	scm, err := NewWithParams(Params{
+		Quiet:         true,
+		MaxStackDepth: 64 * 1024,
+	})
+	if err != nil {
+		t.Fatalf("failed to create virtual machine: %v", err)
+	}
+
+	// The stack grows over its initial depth.
+	v, err := scm.Eval("test", strings.NewReader(`
+(define (depth n)
+  (if (zero? n)
+      0
+      (+ 1 (depth (- n 1)))))
+(depth 10000)
+`))
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	if !Equal(v, Int(10000)) {
+		t.Errorf("unexpected result: got %v, expected 10000", v)
+	}
+
+	// Stack overflows can be caught.
+	for i := 0; i < 2; i++ {
+		v, err = scm.Eval("test", strings.NewReader(`
+(guard (e ((implementation-restriction-violation? e) 'overflow))
+  (depth 1000000))
+`))
+		if err != nil {
+			t.Fatalf("Eval failed: %v", err)
+		}
+		if !Equal(v, &Identifier{Name: "overflow"}) {
+			t.Errorf("unexpected result: got %v, expected overflow", v)
+		}
+	}
+
+	// Uncaught stack overflow.
+	_, err = scm.Eval("test", strings.NewReader(`
+(depth 1000000)
+`))
+	if err == nil {
+		t.Fatalf("stack overflow not detected")
+	}
+	if !strings.Contains(err.Error(), "stack overflow") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if len(scm.stack) > scm.Params.MaxStackDepth+stackReserve {
+		t.Errorf("stack grew over its limit: %v", len(scm.stack))
+	}
+}
+
+func TestContext(t *testing.T) {
+	scm, err := NewWithParams(Params{
+		Quiet: true,
+	})
+	if err != nil {
+		t.Fatalf("failed to create virtual machine: %v", err)
+	}
+	_, err = scm.Eval("test", strings.NewReader(`
+(define (loop n) (loop (+ n 1)))
+`))
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	loop := `
+(guard (e (#t 'caught))
+  (loop 0))
+`
+
+	// Cancel.
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	_, err = scm.EvalContext(ctx, "test", strings.NewReader(loop))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("unexpected error: got %v, expected %v",
+			err, context.Canceled)
+	}
+
+	// Deadline.
+	ctx, cancel = context.WithTimeout(context.Background(),
+		10*time.Millisecond)
+	defer cancel()
+	_, err = scm.EvalContext(ctx, "test", strings.NewReader(loop))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("unexpected error: got %v, expected %v",
+			err, context.DeadlineExceeded)
+	}
+
+	// The machine is usable after the abort.
+	v, err := scm.Eval("test", strings.NewReader(`(+ 1 2)`))
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	if !Equal(v, Int(3)) {
+		t.Errorf("unexpected result: got %v, expected 3", v)
+	}
+
+	// Cancelled Apply.
+	v, err = scm.Global("loop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = scm.ApplyContext(ctx, v, []Value{Int(0)})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("unexpected error: got %v, expected %v",
+			err, context.Canceled)
+	}
+
+	// The after thunks are run when the deadline expires.
+	_, err = scm.Eval("test", strings.NewReader(`
+(define unwound 0)
+(define (wound-loop n)
+  (dynamic-wind
+    (lambda () #f)
+    (lambda () (loop n))
+    (lambda () (set! unwound (+ unwound 1)))))
+`))
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	v, err = scm.Global("wound-loop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(),
+		50*time.Millisecond)
+	defer cancel()
+	_, err = scm.ApplyContext(ctx, v, []Value{Int(0)})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("unexpected error: got %v, expected %v",
+			err, context.DeadlineExceeded)
+	}
+	v, err = scm.Global("unwound")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !Equal(v, Int(1)) {
+		t.Errorf("after thunk not run: unwound=%v", v)
+	}
+
+	// The non-terminating after thunks are aborted by the cleanup
+	// limits.
+	spin := `
+(define (spin) (spin))
+(dynamic-wind (lambda () #f) (lambda () (spin)) (lambda () (spin)))
+`
+	start := time.Now()
+	ctx, cancel = context.WithTimeout(context.Background(),
+		50*time.Millisecond)
+	defer cancel()
+	_, err = scm.EvalContext(ctx, "test", strings.NewReader(spin))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("unexpected error: got %v, expected %v",
+			err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("after thunk escaped the limits: ran %v", d)
+	}
+
+	// The nested calls of native functions are aborted by the
+	// context of the outer call.
+	sort := `
+(import (rnrs sorting))
+(vector-sort! (lambda (a b) (spin)) (vector 3 2 1))
+`
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	_, err = scm.EvalContext(ctx, "test", strings.NewReader(sort))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("unexpected error: got %v, expected %v",
+			err, context.Canceled)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(),
+		50*time.Millisecond)
+	defer cancel()
+	_, err = scm.EvalContext(ctx, "test", strings.NewReader(sort))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("unexpected error: got %v, expected %v",
+			err, context.DeadlineExceeded)
+	}
+}
+
+func TestFuel(t *testing.T) {
+	scm, err := NewWithParams(Params{
+		Quiet: true,
+		Fuel:  100000,
+	})
+	if err != nil {
+		t.Fatalf("failed to create virtual machine: %v", err)
+	}
+
+	_, err = scm.Eval("test", strings.NewReader(`
+(define (count n) (if (zero? n) 'done (count (- n 1))))
+`))
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+
+	// The runtime is loaded without the budget and each call has its
+	// own budget.
+	for i := 0; i < 2; i++ {
+		v, err := scm.Eval("test", strings.NewReader(`(count 1000)`))
+		if err != nil {
+			t.Fatalf("Eval failed: %v", err)
+		}
+		if !Equal(v, &Identifier{Name: "done"}) {
+			t.Errorf("unexpected result: got %v, expected done", v)
+		}
+	}
+
+	_, err = scm.Eval("test", strings.NewReader(`
+(guard (e (#t 'caught))
+  (count 1000000))
+`))
+	if !errors.Is(err, ErrOutOfFuel) {
+		t.Errorf("unexpected error: got %v, expected %v", err, ErrOutOfFuel)
+	}
+
+	v, err := scm.Global("count")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = scm.Apply(v, []Value{Int(1000000)})
+	if !errors.Is(err, ErrOutOfFuel) {
+		t.Errorf("unexpected error: got %v, expected %v", err, ErrOutOfFuel)
+	}
+	v, err = scm.Apply(v, []Value{Int(10)})
+	if err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	if !Equal(v, &Identifier{Name: "done"}) {
+		t.Errorf("unexpected result: got %v, expected done", v)
+	}
+
+	// The after thunks are run when the budget is exhausted.
+	_, err = scm.Eval("test", strings.NewReader(`
+(define unwound 0)
+(dynamic-wind
+  (lambda () #f)
+  (lambda () (count 1000000))
+  (lambda () (set! unwound (+ unwound 1))))
+`))
+	if !errors.Is(err, ErrOutOfFuel) {
+		t.Errorf("unexpected error: got %v, expected %v", err, ErrOutOfFuel)
+	}
+	v, err = scm.Global("unwound")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !Equal(v, Int(1)) {
+		t.Errorf("after thunk not run: unwound=%v", v)
+	}
+
+	// The after thunks run with the cleanup budget.
+	_, err = scm.Eval("test", strings.NewReader(`
+(dynamic-wind
+  (lambda () #f)
+  (lambda () (count 1000000))
+  (lambda () (count 1000000000)))
+`))
+	if !errors.Is(err, ErrOutOfFuel) {
+		t.Errorf("unexpected error: got %v, expected %v", err, ErrOutOfFuel)
+	}
+}
+
+func TestNestedApply(t *testing.T) {
+	scm, err := NewWithParams(Params{
+		Quiet: true,
+		Fuel:  1000000,
+	})
+	if err != nil {
+		t.Fatalf("failed to create virtual machine: %v", err)
+	}
+	scm.DefineBuiltin(Builtin{
+		Name:   "test-call",
+		Args:   []string{"proc<any>", "obj..."},
+		Return: types.Any,
+		Native: func(scm *Scheme, args []Value) (Value, error) {
+			return scm.Apply(args[0], args[1:])
+		},
+	})
+
+	tests := []struct {
+		i string
+		v Value
+	}{
+		{
+			i: `(test-call + 1 2)`,
+			v: Int(3),
+		},
+		{
+			i: `(+ 1 (test-call (lambda (x)
+               (+ x (test-call (lambda () 40))))
+             1))`,
+			v: Int(42),
+		},
+		{
+			i: `(guard (e ((error? e) (condition-message e)))
+  (test-call (lambda () (error 'test "failure"))))`,
+			v: String("failure"),
+		},
+		{
+			i: `(call/cc (lambda (k) (test-call (lambda () (k 'escape) 1))))`,
+			v: &Identifier{Name: "escape"},
+		},
+		{
+			i: `(guard (e (#t 'caught))
+  (test-call (lambda () (raise 'boom))))`,
+			v: &Identifier{Name: "caught"},
+		},
+	}
+	for idx, test := range tests {
+		v, err := scm.Eval(fmt.Sprintf("test-%d", idx),
+			strings.NewReader(test.i))
+		if err != nil {
+			t.Fatalf("Test %d: Eval failed: %v", idx, err)
+		}
+		if !Equal(v, test.v) {
+			t.Errorf("Test %d: got %v, expected %v", idx, v, test.v)
+		}
+		if scm.running || scm.run != nil {
+			t.Errorf("Test %d: execution not finished", idx)
+		}
+	}
+
+	// Continuations of returned nested calls can't be resumed.
+	_, err = scm.Eval("test", strings.NewReader(`
+(define k (lambda (x) x))
+(test-call (lambda () (call/cc (lambda (c) (set! k c) 1))))
+(k 2)
+`))
+	if err == nil || !strings.Contains(err.Error(), "returned call") {
+		t.Errorf("resuming returned call not detected: %v", err)
+	}
+
+	// The invalid resume is detected before the dynamic-wind extents
+	// and the handlers are rewound.
+	v, err := scm.Eval("test", strings.NewReader(`
+(define path '())
+(test-call
+ (lambda ()
+   (dynamic-wind
+     (lambda () (set! path (cons 'before path)))
+     (lambda ()
+       (with-exception-handler
+        (lambda (e) 'inner)
+        (lambda () (call/cc (lambda (c) (set! k c) 1)))))
+     (lambda () (set! path (cons 'after path))))))
+(set! path '())
+(guard (e ((error? e) (list (condition-message e) path)))
+  (k 2))
+`))
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	result := NewPair(String("continuation of returned call"),
+		NewPair(nil, nil))
+	if !Equal(v, result) {
+		t.Errorf("unexpected result: got %v, expected %v", v, result)
+	}
+
+	// Limit errors can't be handled in nested calls.
+	_, err = scm.Eval("test", strings.NewReader(`
+(define (loop) (loop))
+(guard (e (#t 'caught))
+  (test-call loop))
+`))
+	if !errors.Is(err, ErrOutOfFuel) {
+		t.Errorf("unexpected error: got %v, expected %v", err, ErrOutOfFuel)
+	}
+
+	// The errors of the nested calls are returned unchanged.
+	_, err = scm.Eval("test", strings.NewReader(`
+(import (only (rnrs sorting) vector-sort!))
+(define (fail a b)
+  (not (car a)))
+(vector-sort! fail (vector 2 1))
+`))
+	expected := "test:4: car: not a pair: 1"
+	if err == nil || err.Error() != expected {
+		t.Errorf("unexpected error: got %v, expected %v", err, expected)
+	}
+}
+
+func TestApplyAllocs(t *testing.T) {
+	scm, err := New()
+	if err != nil {
+		t.Fatalf("failed to create virtual machine: %v", err)
+	}
+	v, err := scm.Eval("test", strings.NewReader(`(lambda (a b) (+ a b))`))
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	args := []Value{Int(1), Int(2)}
+
+	// The entry code is shared by all applications.
+	allocs := testing.AllocsPerRun(100, func() {
+		_, err = scm.Apply(v, args)
+	})
+	if err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	if allocs != 0 {
+		t.Errorf("Apply allocates: %v", allocs)
+	}
+}
+
+func TestMachines(t *testing.T) {
+	img, err := NewImage(Params{
+		Quiet: true,
+	})
+	if err != nil {
+		t.Fatalf("failed to create image: %v", err)
+	}
+	_, err = img.NewMachine().Eval("test", strings.NewReader(`
+(define (fib n)
+  (if (< n 2)
+      n
+      (+ (fib (- n 1)) (fib (- n 2)))))
+(define counter 0)
+`))
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+
+	const count = 8
+	errs := make(chan error, count)
+
+	for i := 0; i < count; i++ {
+		go func(i int) {
+			scm := img.NewMachine()
+			stdout := &strings.Builder{}
+			scm.Stdout = NewPort(stdout)
+
+			v, err := scm.Eval("test", strings.NewReader(fmt.Sprintf(`
+(set! counter (+ counter 1))
+(display %d)
+(fib 20)
+`, i)))
+			if err != nil {
+				errs <- err
+				return
+			}
+			if !Equal(v, Int(6765)) {
+				errs <- fmt.Errorf("machine %d: got %v, expected 6765", i, v)
+				return
+			}
+			if stdout.String() != fmt.Sprintf("%d", i) {
+				errs <- fmt.Errorf("machine %d: unexpected output: %v",
+					i, stdout.String())
+				return
+			}
+			fib, err := scm.Global("fib")
+			if err != nil {
+				errs <- err
+				return
+			}
+			v, err = scm.Apply(fib, []Value{Int(10)})
+			if err != nil {
+				errs <- err
+				return
+			}
+			if !Equal(v, Int(55)) {
+				errs <- fmt.Errorf("machine %d: got %v, expected 55", i, v)
+				return
+			}
+			errs <- nil
+		}(i)
+	}
+	for i := 0; i < count; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+
+	// The machines import libraries concurrently.
+	const importers = 16
+	for i := 0; i < importers; i++ {
+		go func(i int) {
+			scm := img.NewMachine()
+			stdout := &strings.Builder{}
+			scm.Stdout = NewPort(stdout)
+
+			_, err := scm.Eval("test", strings.NewReader(fmt.Sprintf(`
+(import (go format) (rnrs sorting) (rnrs unicode))
+(display (format "%%v-%%v" %d (list-sort < '(2 1))))
+`, i)))
+			if err != nil {
+				errs <- err
+				return
+			}
+			expected := fmt.Sprintf("%d-(1 2)", i)
+			if stdout.String() != expected {
+				errs <- fmt.Errorf("machine %d: got %q, expected %q",
+					i, stdout.String(), expected)
+				return
+			}
+			errs <- nil
+		}(i)
+	}
+	for i := 0; i < importers; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestIdentifierGlobal(t *testing.T) {
+	scm, err := NewWithParams(Params{
+		Quiet: true,
+	})
+	if err != nil {
+		t.Fatalf("failed to create virtual machine: %v", err)
+	}
+	_, err = scm.Eval("test", strings.NewReader(`
+(define counter 0)
+(define-constant limit 10)
+(set! counter (+ counter 1))
+`))
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+
+	counter := scm.Intern("counter")
+	if !Equal(counter.Global(), Int(1)) {
+		t.Errorf("counter: got %v, expected 1", counter.Global())
+	}
+	if counter.Flags()&FlagDefined == 0 || counter.Flags()&FlagConst != 0 {
+		t.Errorf("counter: unexpected flags %v", counter.Flags())
+	}
+	if _, ok := counter.Set(Int(2)); !ok {
+		t.Errorf("counter: Set failed")
+	}
+	if !Equal(counter.Global(), Int(2)) {
+		t.Errorf("counter: got %v, expected 2", counter.Global())
+	}
+
+	limit := scm.Intern("limit")
+	if limit.Flags()&FlagConst == 0 {
+		t.Errorf("limit: unexpected flags %v", limit.Flags())
+	}
+	if _, ok := limit.Set(Int(20)); ok {
+		t.Errorf("limit: Set succeeded for a constant")
+	}
+	if !Equal(limit.Global(), Int(10)) {
+		t.Errorf("limit: got %v, expected 10", limit.Global())
+	}
+	if scm.Intern("undefined-global").Global() != nil {
+		t.Errorf("undefined-global: unexpected value")
+	}
+}